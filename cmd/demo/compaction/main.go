@@ -20,7 +20,7 @@ func main() {
 
 	// Open DB
 	fmt.Println("1. Opening DB...")
-	db, err := lsm.Open(lsm.Options{DataDir: tmpDir})
+	db, err := lsm.Open(lsm.Options{DataDir: tmpDir, MaxValueSize: 8 << 10})
 	if err != nil {
 		log.Fatalf("Failed to open DB: %v", err)
 	}
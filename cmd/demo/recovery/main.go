@@ -19,7 +19,7 @@ func main() {
 
 	// Step 1: Open DB and write data
 	fmt.Println("1. Opening DB and writing data...")
-	db1, err := lsm.Open(lsm.Options{DataDir: dataDir})
+	db1, err := lsm.Open(lsm.Options{DataDir: dataDir, MaxValueSize: 8 << 10})
 	if err != nil {
 		log.Fatalf("Failed to open DB: %v", err)
 	}
@@ -56,14 +56,14 @@ func main() {
 		}
 	}
 
-	fmt.Println("\n3. Closing DB...")
-	if err := db1.Close(); err != nil {
+	fmt.Println("\n3. Flushing and closing DB...")
+	if err := db1.CloseAndFlush(); err != nil {
 		log.Fatalf("Failed to close DB: %v", err)
 	}
 
 	// Step 2: Reopen DB and verify recovery
 	fmt.Println("\n4. Reopening DB (testing recovery)...")
-	db2, err := lsm.Open(lsm.Options{DataDir: dataDir})
+	db2, err := lsm.Open(lsm.Options{DataDir: dataDir, MaxValueSize: 8 << 10})
 	if err != nil {
 		log.Fatalf("Failed to reopen DB: %v", err)
 	}
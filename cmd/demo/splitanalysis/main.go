@@ -19,7 +19,7 @@ func main() {
 	fmt.Printf("Max SSTable file size: %d MB\n\n", sstable.MaxSSTableFileSize()/(1<<20))
 
 	// Open DB
-	db, err := lsm.Open(lsm.Options{DataDir: tmpDir})
+	db, err := lsm.Open(lsm.Options{DataDir: tmpDir, MaxValueSize: 8 << 10})
 	if err != nil {
 		log.Fatalf("Failed to open DB: %v", err)
 	}
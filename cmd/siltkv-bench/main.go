@@ -0,0 +1,174 @@
+// Command siltkv-bench replays a workload trace, recorded from a running DB
+// with DB.StartTrace, against the DB in a data directory, to reproduce a
+// production access pattern on a test build and compare latencies.
+//
+// Operations are issued at the times they were recorded, divided by
+// -speed, so that concurrent ones overlap as they did; -speed 0 issues them
+// as fast as -workers goroutines allow. Keys are derived from the hashes in
+// the trace, so operations on one key still hit one key. A scan reads up to
+// -scan records, and a range deletion covers only its start key.
+//
+// Usage:
+//
+//	siltkv-bench -dir path [-speed 1] [-workers 64] [-scan 100] trace
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/lsm"
+)
+
+func main() {
+	dir := flag.String("dir", "", "data directory of the DB to replay against (created if missing)")
+	speed := flag.Float64("speed", 1, "replay speed relative to the recording; 0 replays as fast as possible")
+	workers := flag.Int("workers", 64, "operations in flight at once")
+	scan := flag.Int("scan", 100, "records read by each replayed scan")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: siltkv-bench -dir path [-speed 1] [-workers 64] [-scan 100] trace\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *dir == "" || *speed < 0 || *workers < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), *dir, replayOptions{speed: *speed, workers: *workers, scan: *scan}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type replayOptions struct {
+	speed   float64
+	workers int
+	scan    int
+}
+
+// opStats collects the latencies of one kind of operation.
+type opStats struct {
+	recorded time.Duration   // total in the trace
+	replayed []time.Duration // each in the replay
+	errors   int
+}
+
+func run(tracePath, dir string, opts replayOptions) error {
+	f, err := os.Open(tracePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr, err := lsm.NewTraceReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", tracePath, err)
+	}
+	db, err := lsm.Open(lsm.Options{DataDir: dir})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var mu sync.Mutex
+	stats := map[lsm.TraceOp]*opStats{}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.workers)
+	start := time.Now()
+	for {
+		rec, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", tracePath, err)
+		}
+		if opts.speed > 0 {
+			at := time.Duration(float64(rec.Time) / opts.speed)
+			time.Sleep(time.Until(start.Add(at)))
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			began := time.Now()
+			err := replay(db, rec, opts.scan)
+			took := time.Since(began)
+
+			mu.Lock()
+			defer mu.Unlock()
+			s := stats[rec.Op]
+			if s == nil {
+				s = &opStats{}
+				stats[rec.Op] = s
+			}
+			s.recorded += rec.Latency
+			s.replayed = append(s.replayed, took)
+			if err != nil {
+				s.errors++
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := 0
+	fmt.Printf("%-12s %8s %8s %12s %12s %12s\n", "op", "count", "errors", "recorded", "replayed", "replay p99")
+	for op := lsm.TraceOpGet; op <= lsm.TraceOpScan; op++ {
+		s := stats[op]
+		if s == nil {
+			continue
+		}
+		n := len(s.replayed)
+		total += n
+		var sum time.Duration
+		for _, d := range s.replayed {
+			sum += d
+		}
+		slices.Sort(s.replayed)
+		p99 := s.replayed[min(n-1, n*99/100)]
+		fmt.Printf("%-12s %8d %8d %12s %12s %12s\n", op, n, s.errors,
+			s.recorded/time.Duration(n), sum/time.Duration(n), p99)
+	}
+	fmt.Printf("replayed %d operations in %s (%.0f ops/s)\n", total, elapsed.Round(time.Millisecond),
+		float64(total)/elapsed.Seconds())
+	return nil
+}
+
+// replay runs the operation of rec against db.
+func replay(db *lsm.DB, rec lsm.TraceRecord, scan int) error {
+	key := rec.Key()
+	switch rec.Op {
+	case lsm.TraceOpGet:
+		_, _, err := db.Get(key)
+		return err
+	case lsm.TraceOpPut:
+		value := make([]byte, rec.ValueSize)
+		for i := range value {
+			value[i] = byte('a' + i%26)
+		}
+		return db.Put(key, value)
+	case lsm.TraceOpDelete:
+		return db.Delete(key)
+	case lsm.TraceOpDeleteRange:
+		return db.DeleteRange(key, append(key, 0))
+	case lsm.TraceOpScan:
+		it, err := db.NewIterator(lsm.IterOptions{LowerBound: key})
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		n := 0
+		for err = it.SeekToFirst(); err == nil && it.Valid() && n < scan; err = it.Next() {
+			n++
+		}
+		return err
+	}
+	return errors.New("unknown operation")
+}
@@ -0,0 +1,150 @@
+// Command sstdump prints the metadata of SSTable files: format, key bounds,
+// record counts, range tombstones and table properties. Compaction outputs
+// carry properties naming the files and levels they were produced from,
+// which helps to trace where a bad value came from.
+//
+// Keys and values are printed as quoted Go strings, or with -encoding as
+// hex or base64, which suits binary keys; -start and -end, in the same
+// encoding, limit the records printed to a key range.
+//
+// Usage:
+//
+//	sstdump [-records] [-encoding text|hex|base64] [-start key] [-end key] file.sst...
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/return2faye/SiltKV/internal/dumpenc"
+	"github.com/return2faye/SiltKV/internal/sstable"
+)
+
+func main() {
+	records := flag.Bool("records", false, "also print every record")
+	enc := dumpenc.Text
+	flag.Var(&enc, "encoding", "how keys and values are printed and -start and -end are given: text, hex or base64")
+	startArg := flag.String("start", "", "print records from this key on")
+	endArg := flag.String("end", "", "print records up to, but not including, this key")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: sstdump [-records] [-encoding text|hex|base64] [-start key] [-end key] file.sst...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var opts dumpOptions
+	opts.records, opts.enc = *records, enc
+	var err error
+	if *startArg != "" {
+		if opts.start, err = enc.Parse(*startArg); err != nil {
+			log.Fatalf("-start: %v", err)
+		}
+	}
+	if *endArg != "" {
+		if opts.end, err = enc.Parse(*endArg); err != nil {
+			log.Fatalf("-end: %v", err)
+		}
+	}
+
+	failed := false
+	for i, path := range flag.Args() {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := dump(os.Stdout, path, opts); err != nil {
+			log.Printf("%s: %v", path, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// dumpOptions are the command-line options that shape a dump.
+type dumpOptions struct {
+	records    bool
+	enc        dumpenc.Encoding
+	start, end []byte // bounds of the records printed; nil leaves a side open
+}
+
+func dump(w io.Writer, path string, opts dumpOptions) error {
+	enc := opts.enc
+	r, err := sstable.NewReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	footer := r.Footer()
+	fmt.Fprintf(w, "file:       %s\n", path)
+	fmt.Fprintf(w, "format:     V%d\n", footer.Version)
+	fmt.Fprintf(w, "size:       %d bytes (index %d bytes)\n", r.Size(), footer.BlockIndexSize)
+
+	smallest, largest, err := r.Bounds()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "smallest:   %s\n", enc.Format(smallest))
+	fmt.Fprintf(w, "largest:    %s\n", enc.Format(largest))
+
+	n, err := r.CountRange(nil, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "records:    %d\n", n)
+
+	rts := r.RangeTombstones()
+	fmt.Fprintf(w, "range dels: %d\n", len(rts))
+	for _, rt := range rts {
+		fmt.Fprintf(w, "  [%s, %s)\n", enc.Format(rt.Start), enc.Format(rt.End))
+	}
+
+	props, err := r.Properties()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "properties: %d\n", len(names))
+	for _, name := range names {
+		value := props[name]
+		if enc != dumpenc.Text && (name == sstable.PropSmallestKey || name == sstable.PropLargestKey) {
+			value = enc.Format([]byte(value))
+		}
+		fmt.Fprintf(w, "  %s = %s\n", name, value)
+	}
+
+	if !opts.records {
+		return nil
+	}
+	fmt.Fprintln(w, "entries:")
+	it := r.NewIterator()
+	if opts.start != nil {
+		err = it.Seek(opts.start)
+	} else {
+		err = it.SeekToFirst()
+	}
+	for ; err == nil && it.Valid(); err = it.Next() {
+		if opts.end != nil && bytes.Compare(it.Key(), opts.end) >= 0 {
+			break
+		}
+		if it.Value() == nil {
+			fmt.Fprintf(w, "  %s DELETED\n", enc.Format(it.Key()))
+		} else {
+			fmt.Fprintf(w, "  %s = %s\n", enc.Format(it.Key()), enc.Format(it.Value()))
+		}
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/return2faye/SiltKV/internal/dumpenc"
+	"github.com/return2faye/SiltKV/internal/sstable"
+)
+
+func TestDumpEncodings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.sst")
+	w, err := sstable.NewWriter(path)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for _, kv := range [][2]string{{"a\x00", "v\xff"}, {"b", "w"}} {
+		if _, err := w.Write([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatalf("Write %q: %v", kv[0], err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	tests := []struct {
+		enc   dumpenc.Encoding
+		lines []string
+	}{
+		{dumpenc.Text, []string{`smallest:   "a\x00"`, `  "a\x00" = "v\xff"`, `  "b" = "w"`}},
+		{dumpenc.Hex, []string{"smallest:   6100", "  6100 = 76ff", "  62 = 77"}},
+		{dumpenc.Base64, []string{"smallest:   YQA=", "  YQA= = dv8=", "  Yg== = dw=="}},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := dump(&out, path, dumpOptions{records: true, enc: tt.enc}); err != nil {
+			t.Fatalf("%s: dump: %v", tt.enc, err)
+		}
+		for _, line := range tt.lines {
+			if !strings.Contains(out.String(), line+"\n") {
+				t.Errorf("%s: output lacks %q:\n%s", tt.enc, line, out.String())
+			}
+		}
+	}
+
+	// -start is given in the chosen encoding and skips the records before it.
+	start, err := dumpenc.Hex.Parse("62")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := dump(&out, path, dumpOptions{records: true, enc: dumpenc.Hex, start: start}); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if strings.Contains(out.String(), "  6100 = ") || !strings.Contains(out.String(), "  62 = 77\n") {
+		t.Errorf("dump from 62 printed the wrong records:\n%s", out.String())
+	}
+}
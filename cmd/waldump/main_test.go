@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/return2faye/SiltKV/internal/dumpenc"
+	"github.com/return2faye/SiltKV/internal/wal"
+)
+
+func TestDumpEncodings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.wal")
+	w, err := wal.NewWalWriter(path)
+	if err != nil {
+		t.Fatalf("NewWalWriter: %v", err)
+	}
+	if err := w.Write([]byte("a\x00"), []byte("v\xff")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Write([]byte("b"), nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	tests := []struct {
+		enc   dumpenc.Encoding
+		lines []string
+	}{
+		{dumpenc.Text, []string{` "a\x00" = "v\xff"`, ` "b" DELETED`}},
+		{dumpenc.Hex, []string{" 6100 = 76ff", " 62 DELETED"}},
+		{dumpenc.Base64, []string{" YQA= = dv8=", " Yg== DELETED"}},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := dump(&out, path, true, tt.enc); err != nil {
+			t.Fatalf("%s: dump: %v", tt.enc, err)
+		}
+		for _, line := range tt.lines {
+			if !strings.Contains(out.String(), line+"\n") {
+				t.Errorf("%s: output lacks %q:\n%s", tt.enc, line, out.String())
+			}
+		}
+		if !strings.Contains(out.String(), "records:    2 intact, 0 damaged\n") {
+			t.Errorf("%s: wrong record count:\n%s", tt.enc, out.String())
+		}
+	}
+}
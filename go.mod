@@ -1,3 +1,5 @@
 module github.com/return2faye/SiltKV
 
 go 1.25.5
+
+require github.com/klauspost/compress v1.18.0
@@ -0,0 +1,43 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeTicker(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	c := NewFake(start)
+	tk := c.NewTicker(time.Second)
+	defer tk.Stop()
+
+	c.Advance(500 * time.Millisecond)
+	select {
+	case <-tk.C():
+		t.Fatal("Ticker fired before its interval elapsed")
+	default:
+	}
+
+	c.Advance(500 * time.Millisecond)
+	select {
+	case got := <-tk.C():
+		if want := start.Add(time.Second); !got.Equal(want) {
+			t.Errorf("Tick at %v, want %v", got, want)
+		}
+	default:
+		t.Fatal("Ticker did not fire after its interval")
+	}
+
+	// A big jump delivers one tick, like time.Ticker with a slow reader.
+	c.Advance(10 * time.Second)
+	<-tk.C()
+	select {
+	case <-tk.C():
+		t.Error("Expected missed ticks to be dropped")
+	default:
+	}
+
+	if got, want := c.Now(), start.Add(11*time.Second); !got.Equal(want) {
+		t.Errorf("Now = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+// Package dumpenc is how the dump tools print keys and values and read
+// keys given on the command line: as quoted Go strings, or as hex or
+// base64, which suits binary keys.
+package dumpenc
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// Encoding is how keys and values are printed and given on the command
+// line. It implements flag.Value.
+type Encoding string
+
+const (
+	Text   Encoding = "text" // printed as quoted Go strings, given as is
+	Hex    Encoding = "hex"
+	Base64 Encoding = "base64" // standard, padded
+)
+
+func (e *Encoding) String() string { return string(*e) }
+
+func (e *Encoding) Set(s string) error {
+	switch v := Encoding(s); v {
+	case Text, Hex, Base64:
+		*e = v
+		return nil
+	}
+	return fmt.Errorf("unknown encoding %q", s)
+}
+
+// Format returns b as printed in encoding e.
+func (e Encoding) Format(b []byte) string {
+	switch e {
+	case Hex:
+		return hex.EncodeToString(b)
+	case Base64:
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return strconv.Quote(string(b))
+}
+
+// Parse decodes a command-line argument given in encoding e.
+func (e Encoding) Parse(s string) ([]byte, error) {
+	switch e {
+	case Hex:
+		return hex.DecodeString(s)
+	case Base64:
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return []byte(s), nil
+}
@@ -0,0 +1,56 @@
+package dumpenc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFormatParse(t *testing.T) {
+	key := []byte("k\x00\xff\"")
+	tests := []struct {
+		enc    Encoding
+		format string
+		parse  string
+	}{
+		{Text, `"k\x00\xff\""`, "k\x00\xff\""},
+		{Hex, "6b00ff22", "6b00ff22"},
+		{Base64, "awD/Ig==", "awD/Ig=="},
+	}
+	for _, tt := range tests {
+		if got := tt.enc.Format(key); got != tt.format {
+			t.Errorf("%s: Format = %s, want %s", tt.enc, got, tt.format)
+		}
+		got, err := tt.enc.Parse(tt.parse)
+		if err != nil {
+			t.Fatalf("%s: Parse: %v", tt.enc, err)
+		}
+		if !bytes.Equal(got, key) {
+			t.Errorf("%s: Parse = %q, want %q", tt.enc, got, key)
+		}
+	}
+
+	if _, err := Hex.Parse("zz"); err == nil {
+		t.Error("Hex.Parse accepted a non-hex argument")
+	}
+	if _, err := Base64.Parse("a"); err == nil {
+		t.Error("Base64.Parse accepted a non-base64 argument")
+	}
+}
+
+func TestSet(t *testing.T) {
+	e := Text
+	for _, s := range []string{"hex", "base64", "text"} {
+		if err := e.Set(s); err != nil {
+			t.Fatalf("Set(%q): %v", s, err)
+		}
+		if e.String() != s {
+			t.Errorf("Set(%q) left %q", s, e.String())
+		}
+	}
+	if err := e.Set("raw"); err == nil {
+		t.Error("Set accepted an unknown encoding")
+	}
+	if e != Text {
+		t.Errorf("failed Set changed the encoding to %q", e)
+	}
+}
@@ -0,0 +1,220 @@
+package lsm
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/memtable"
+	"github.com/return2faye/SiltKV/internal/wal"
+)
+
+var (
+	// ErrArchiveGap is returned by ReplayTo when the archive lacks records
+	// between the DB it rolls forward and the target, such as the WALs
+	// flushed before archiving was turned on.
+	ErrArchiveGap = errors.New("lsm: WAL archive is missing records")
+	// ErrArchiveValueLog is returned by Open when Options.WALArchiveDir is
+	// set for a DB with a value log: archived records would point into
+	// blob files that value log collection deletes.
+	ErrArchiveValueLog = errors.New("lsm: WAL archive cannot be used with a value log")
+)
+
+// archiveWALName names an archived WAL by the first and last sequence
+// numbers it holds, zero-padded so that names sort in log order.
+func archiveWALName(first, last uint64) string {
+	return fmt.Sprintf("%020d-%020d.wal", first, last)
+}
+
+// parseArchiveWALName is the inverse of archiveWALName.
+func parseArchiveWALName(name string) (first, last uint64, ok bool) {
+	a, b, found := strings.Cut(strings.TrimSuffix(name, ".wal"), "-")
+	if !found || !strings.HasSuffix(name, ".wal") {
+		return 0, 0, false
+	}
+	first, err1 := strconv.ParseUint(a, 10, 64)
+	last, err2 := strconv.ParseUint(b, 10, 64)
+	return first, last, err1 == nil && err2 == nil && first <= last
+}
+
+// archiveWAL puts the flushed WAL at path, whose newest record has
+// sequence number last, into the archive: hard-linked if the archive is on
+// the same filesystem, copied otherwise. The caller deletes path after.
+// A WAL already archived by an earlier attempt is left as it is.
+func (db *DB) archiveWAL(path string, last uint64) error {
+	if last == 0 {
+		// No records, or only ones from before sequence numbers
+		return nil
+	}
+	first := uint64(0)
+	if _, err := wal.ReplayFile(path, func(rec wal.Record) bool {
+		first = rec.Seq
+		return rec.Seq == 0
+	}); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(db.archiveDir, 0o755); err != nil {
+		return err
+	}
+	dst := filepath.Join(db.archiveDir, archiveWALName(first, last))
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	// Copy to a temporary name first, so that a crash cannot leave a
+	// partial WAL under an archive name.
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+	if err := linkOrCopyFile(path, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(db.archiveDir)
+}
+
+// archiveRetiredWAL puts the WAL at path, whose memtable is flushed, into
+// the archive if there is one, and reports whether the WAL may be deleted.
+// It runs while the memtable is still queued, so that a WALTail finds
+// every record in a live WAL or in the archive. A WAL that fails to
+// archive is kept and reported; the next Open archives it.
+func (db *DB) archiveRetiredWAL(path string, last uint64) bool {
+	if db.archiveDir == "" {
+		return true
+	}
+	if err := db.archiveWAL(path, last); err != nil {
+		db.reportBackgroundError(BackgroundOpArchive, path, err, false)
+		return false
+	}
+	return true
+}
+
+// archiveFlushedWAL archives the WAL of mt, which Open found flushed
+// already, as the flush that retired it may have crashed before it did.
+func (db *DB) archiveFlushedWAL(mt *memtable.Memtable) error {
+	if db.archiveDir == "" {
+		return nil
+	}
+	last, _ := mt.LastSequence()
+	return db.archiveWAL(mt.WalPath(), last)
+}
+
+// PointInTime is the target of ReplayTo: the newest record to restore, by
+// sequence number (see DB.LastSequence), by write time, or by both, in
+// which case the earlier of the two bounds the replay.
+type PointInTime struct {
+	Sequence uint64
+	Time     time.Time
+}
+
+// ReplayTo rolls the closed DB in dataDir forward to target by replaying
+// the WALs archived in archiveDir (see Options.WALArchiveDir), and returns
+// the sequence number of the last record it applied. dataDir is usually a
+// backup restored with Restore, taken while archiving was on; an empty or
+// missing dataDir is rebuilt from the archive alone, which then must go
+// back to the DB's first write. The records a DB still held in its
+// unflushed WALs are not in the archive.
+//
+// Records are replayed with their original sequence numbers, and batches
+// whole: a target inside a batch leaves the batch out. ReplayTo fails with
+// ErrArchiveGap if the archive does not continue where dataDir ends.
+func ReplayTo(dataDir, archiveDir string, target PointInTime) (last uint64, err error) {
+	rt := recoveryTarget{seq: target.Sequence, t: target.Time}
+	if !rt.isSet() {
+		return 0, fmt.Errorf("lsm: replay target not set: %w", os.ErrInvalid)
+	}
+	type archived struct {
+		path        string
+		first, last uint64
+	}
+	entries, err := os.ReadDir(archiveDir)
+	if err != nil {
+		return 0, err
+	}
+	var files []archived
+	for _, e := range entries {
+		if first, last, ok := parseArchiveWALName(e.Name()); ok {
+			files = append(files, archived{filepath.Join(archiveDir, e.Name()), first, last})
+		}
+	}
+	slices.SortFunc(files, func(a, b archived) int { return cmp.Compare(a.first, b.first) })
+
+	// The archive may hold keys and values up to what the WAL format takes.
+	db, err := Open(Options{DataDir: dataDir, MaxKeySize: wal.KeySizeLimit, MaxValueSize: wal.ValueSizeLimit, MaxBatchSize: wal.BatchSizeLimit})
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if db.vlog != nil {
+		return 0, ErrArchiveValueLog
+	}
+
+	last = db.LastSequence()
+	var batch []batchOp
+	var applyErr error
+	done := false
+	apply := func(rec wal.Record) bool {
+		switch {
+		case rec.Seq <= last:
+			// Already in dataDir
+			return true
+		case rec.Seq != last+1+uint64(len(batch)):
+			applyErr = fmt.Errorf("%w: sequence %d follows %d", ErrArchiveGap, rec.Seq, last)
+			return false
+		case len(batch) == 0 && rt.past(max(rec.Seq, rec.BatchEnd), rec.Time):
+			done = true
+			return false
+		}
+		// Keys and values only live until the callback returns, and a
+		// batch is applied once its last op is in.
+		value := cloneValue(rec.Value)
+		batch = append(batch, batchOp{key: slices.Clone(rec.Key), value: value, stored: value, rangeDelete: rec.RangeDelete})
+		if rec.BatchEnd != 0 && rec.Seq != rec.BatchEnd {
+			return true
+		}
+		// Every write takes the next number from the counter, so
+		// setting it first gives the ops their original numbers.
+		atomic.StoreUint64(&db.seq, last)
+		if applyErr = db.writeBatch(context.Background(), batch); applyErr != nil {
+			return false
+		}
+		batch, last = batch[:0], rec.Seq
+		return true
+	}
+	for _, f := range files {
+		if f.last <= last {
+			continue
+		}
+		if _, err := wal.ReplayFile(f.path, apply); err != nil {
+			return last, err
+		}
+		if applyErr != nil {
+			return last, applyErr
+		}
+		if done {
+			break
+		}
+	}
+	return last, db.Flush()
+}
+
+// cloneValue copies v, keeping nil (a tombstone) apart from empty.
+func cloneValue(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
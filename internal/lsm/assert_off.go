@@ -0,0 +1,6 @@
+//go:build !siltkv_assert
+
+package lsm
+
+// assertMisuse is false in normal builds; see assert_on.go.
+const assertMisuse = false
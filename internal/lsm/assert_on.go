@@ -0,0 +1,8 @@
+//go:build siltkv_assert
+
+package lsm
+
+// assertMisuse makes strict mode panic on API misuse instead of returning
+// an error, so that tests run with -tags siltkv_assert stop at the faulty
+// call.
+const assertMisuse = true
@@ -0,0 +1,175 @@
+package lsm
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/utils"
+)
+
+// AuditOp identifies the kind of mutation in an AuditEvent.
+type AuditOp string
+
+const (
+	AuditOpPut         AuditOp = "put"
+	AuditOpDelete      AuditOp = "delete"
+	AuditOpDeleteRange AuditOp = "delete_range"
+)
+
+// AuditEvent describes one successful mutation.
+type AuditEvent struct {
+	Op  AuditOp
+	Key []byte
+	// End is the exclusive upper bound of a DeleteRange; nil otherwise.
+	End []byte
+	// Size is the number of value bytes written (0 for deletes).
+	Size int
+	// Seq numbers mutations of this DB in the order they completed.
+	Seq uint64
+	// Principal is taken from the request context (see WithPrincipal).
+	Principal string
+	Time      time.Time
+}
+
+// AuditHook receives audit events in batches, in Seq order. It is called from
+// one goroutine at a time and must not retain the slice.
+type AuditHook func(events []AuditEvent)
+
+const (
+	defaultAuditBatchSize     = 128
+	defaultAuditFlushInterval = 100 * time.Millisecond
+)
+
+type principalKey struct{}
+
+// WithPrincipal returns a context whose mutations are audited as principal.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal set by WithPrincipal, if any.
+func PrincipalFromContext(ctx context.Context) string {
+	p, _ := ctx.Value(principalKey{}).(string)
+	return p
+}
+
+// auditor batches audit events for an AuditHook. A batch is delivered when
+// it is full, when the flush interval elapses, or on Close.
+//
+// Events are delivered on the writer's goroutine when a batch fills up, so a
+// slow hook slows down writes instead of dropping audit records.
+type auditor struct {
+	hook      AuditHook
+	batchSize int
+
+	mu      sync.Mutex // guards pending and closed
+	pending []AuditEvent
+	closed  bool
+	emitMu  sync.Mutex // serializes hook calls so batches arrive in order
+	seq     uint64     // atomic
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newAuditor returns nil when hook is nil; a nil auditor ignores all calls.
+func newAuditor(hook AuditHook, batchSize int, interval time.Duration) *auditor {
+	if hook == nil {
+		return nil
+	}
+	if batchSize <= 0 {
+		batchSize = defaultAuditBatchSize
+	}
+	if interval <= 0 {
+		interval = defaultAuditFlushInterval
+	}
+	a := &auditor{
+		hook:      hook,
+		batchSize: batchSize,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go a.run(interval)
+	return a
+}
+
+func (a *auditor) run(interval time.Duration) {
+	defer close(a.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			a.mu.Lock()
+			a.flushLocked()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// record queues one event. Key and end are copied.
+func (a *auditor) record(ctx context.Context, op AuditOp, key, end []byte, size int) {
+	if a == nil {
+		return
+	}
+	ev := AuditEvent{
+		Op:        op,
+		Key:       utils.CopyBytes(key),
+		End:       utils.CopyBytes(end),
+		Size:      size,
+		Principal: PrincipalFromContext(ctx),
+		Time:      time.Now(),
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	// Assigned under mu so that Seq order matches delivery order.
+	ev.Seq = atomic.AddUint64(&a.seq, 1)
+	a.pending = append(a.pending, ev)
+	if len(a.pending) < a.batchSize {
+		a.mu.Unlock()
+		return
+	}
+	a.flushLocked()
+}
+
+// flushLocked delivers pending events. It is called with a.mu held and
+// releases it; emitMu is taken first so a later batch cannot overtake.
+func (a *auditor) flushLocked() {
+	if len(a.pending) == 0 {
+		a.mu.Unlock()
+		return
+	}
+	batch := a.pending
+	a.pending = nil
+	a.emitMu.Lock()
+	a.mu.Unlock()
+	defer a.emitMu.Unlock()
+	a.hook(batch)
+}
+
+// close delivers the remaining events and stops the flush goroutine.
+func (a *auditor) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	a.mu.Unlock()
+
+	close(a.stop)
+	<-a.done
+
+	a.mu.Lock()
+	a.flushLocked()
+}
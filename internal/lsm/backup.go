@@ -0,0 +1,580 @@
+package lsm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/return2faye/SiltKV/internal/sstable"
+)
+
+var (
+	// ErrBackupDirNotEmpty is returned by Backup when destDir already has files.
+	ErrBackupDirNotEmpty = errors.New("lsm: backup directory is not empty")
+	// ErrBackupCorrupt is returned by Restore when a backup file is missing
+	// or does not match its recorded size and checksum.
+	ErrBackupCorrupt = errors.New("lsm: backup is corrupt")
+)
+
+// backupManifestName is the file in a backup directory that lists every
+// other file with its size and CRC32C. Restore checks it, and incremental
+// backups use it to find SSTables they can reuse.
+//
+// Format: one file per line, "relpath\tsize\tcrc32c".
+const backupManifestName = "BACKUP"
+
+// BackupOptions configures BackupWithOptions.
+type BackupOptions struct {
+	// Previous is the directory of an earlier backup of the same DB. SSTables
+	// it already holds are linked (or copied) from there instead of from the
+	// DB, so only SSTables written since then are read from the DB.
+	Previous string
+}
+
+// BackupStats describes what a backup wrote.
+type BackupStats struct {
+	Files       int   // files in the backup, including the manifests
+	Reused      int   // SSTables taken from the previous backup
+	BytesCopied int64 // bytes read from the DB and written to the backup
+}
+
+// Backup writes a consistent copy of the DB to destDir while it stays open
+// for reads and writes. The copy holds every write that completed before
+// Backup was called, and destDir can be opened directly with Open.
+//
+// SSTables are hard-linked when destDir is on the same filesystem and
+// copied otherwise. The manifest is written from the pinned SSTable set,
+// and the WALs of unflushed memtables are copied up to the last synced
+// record. Sealed blob files of the value log are linked like SSTables, and
+// the one taking appends copied like a WAL. destDir is created if needed
+// and must be empty.
+func (db *DB) Backup(destDir string) error {
+	_, err := db.BackupWithOptions(destDir, BackupOptions{})
+	return err
+}
+
+// BackupWithOptions is Backup with explicit options, such as an incremental
+// backup against a previous one.
+func (db *DB) BackupWithOptions(destDir string, opts BackupOptions) (stats BackupStats, err error) {
+	detail := "dir=" + destDir
+	if opts.Previous != "" {
+		detail += " previous=" + opts.Previous
+	}
+	defer db.journal(AdminOpBackup, detail, db.clock.Now(), &err)
+
+	var previous map[string]backupFile
+	if opts.Previous != "" {
+		files, err := loadBackupManifest(opts.Previous)
+		if err != nil {
+			return stats, fmt.Errorf("lsm: previous backup: %w", err)
+		}
+		previous = make(map[string]backupFile, len(files))
+		for _, f := range files {
+			previous[f.name] = f
+		}
+	}
+
+	if err := prepareBackupDir(destDir); err != nil {
+		return stats, err
+	}
+
+	snap, err := db.backupSnapshot()
+	if err != nil {
+		return stats, err
+	}
+	defer snap.release()
+
+	var files []backupFile
+	var entries []manifestEntry
+	for _, e := range snap.version.manifest() {
+		name, err := filepath.Rel(db.dataDir, e.path)
+		if err != nil {
+			return stats, err
+		}
+		dst := filepath.Join(destDir, name)
+
+		st, err := os.Stat(e.path)
+		if err != nil {
+			return stats, fmt.Errorf("lsm: backup %s: %w", e.path, err)
+		}
+		if prev, ok := previous[name]; ok && prev.size == st.Size() {
+			if err := linkOrCopyFile(filepath.Join(opts.Previous, name), dst); err != nil {
+				return stats, fmt.Errorf("lsm: backup %s: %w", name, err)
+			}
+			files = append(files, prev)
+			stats.Reused++
+		} else {
+			f, copied, err := backupSSTable(e.path, dst)
+			if err != nil {
+				return stats, fmt.Errorf("lsm: backup %s: %w", e.path, err)
+			}
+			f.name = name
+			files = append(files, f)
+			stats.BytesCopied += copied
+		}
+
+		e.path = dst
+		entries = append(entries, e)
+	}
+	if err := rewriteManifest(destDir, db.identity, entries); err != nil {
+		return stats, fmt.Errorf("lsm: backup manifest: %w", err)
+	}
+	mf, err := checksumFile(manifestPath(destDir))
+	if err != nil {
+		return stats, err
+	}
+	mf.name = manifestFileName
+	files = append(files, mf)
+
+	for _, w := range snap.wals {
+		// WALs go next to the SSTables, even from a WALDir.
+		name := filepath.Base(w.file.Name())
+		f, err := copyFile(w.file, filepath.Join(destDir, name), w.size)
+		if err != nil {
+			return stats, fmt.Errorf("lsm: backup %s: %w", w.file.Name(), err)
+		}
+		f.name = name
+		files = append(files, f)
+		stats.BytesCopied += f.size
+	}
+
+	if len(snap.blobs) > 0 {
+		if err := os.Mkdir(filepath.Join(destDir, valueLogDirName), 0o755); err != nil {
+			return stats, err
+		}
+	}
+	for _, b := range snap.blobs {
+		name, err := filepath.Rel(db.dataDir, b.path)
+		if err != nil {
+			return stats, err
+		}
+		dst := filepath.Join(destDir, name)
+		var f backupFile
+		var copied int64
+		if prev, ok := previous[name]; ok && b.sealed && prev.size == b.size {
+			err = linkOrCopyFile(filepath.Join(opts.Previous, name), dst)
+			f = prev
+			stats.Reused++
+		} else if b.sealed {
+			f, copied, err = backupSSTable(b.path, dst)
+		} else {
+			f, copied, err = backupBlobFile(b, dst)
+		}
+		if err != nil {
+			return stats, fmt.Errorf("lsm: backup %s: %w", b.path, err)
+		}
+		f.name = name
+		files = append(files, f)
+		stats.BytesCopied += copied
+	}
+
+	if err := writeBackupManifest(destDir, files); err != nil {
+		return stats, err
+	}
+	stats.Files = len(files) + 1
+	return stats, syncDir(destDir)
+}
+
+// Checkpoint creates an openable copy of the DB in dir, as of the moment it
+// is called, for seeding replicas or testing against real data. Unlike
+// Backup it writes no backup manifest and reads no SSTable contents:
+// SSTables are hard-linked (copied only across filesystems), so on one
+// filesystem a checkpoint costs little more than the unflushed WAL data.
+// dir is created if needed and must be empty.
+//
+// Because the SSTables share storage with the DB, a checkpoint is not
+// protection against disk failure; use Backup to another device for that.
+func (db *DB) Checkpoint(dir string) (err error) {
+	defer db.journal(AdminOpCheckpoint, "dir="+dir, db.clock.Now(), &err)
+	if err := prepareBackupDir(dir); err != nil {
+		return err
+	}
+
+	snap, err := db.backupSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.release()
+
+	var entries []manifestEntry
+	for _, e := range snap.version.manifest() {
+		name, err := filepath.Rel(db.dataDir, e.path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, name)
+		if err := linkOrCopyFile(e.path, dst); err != nil {
+			return fmt.Errorf("lsm: checkpoint %s: %w", e.path, err)
+		}
+		e.path = dst
+		entries = append(entries, e)
+	}
+	if err := rewriteManifest(dir, db.identity, entries); err != nil {
+		return fmt.Errorf("lsm: checkpoint manifest: %w", err)
+	}
+
+	for _, w := range snap.wals {
+		name := filepath.Base(w.file.Name())
+		if _, err := copyFile(w.file, filepath.Join(dir, name), w.size); err != nil {
+			return fmt.Errorf("lsm: checkpoint %s: %w", w.file.Name(), err)
+		}
+	}
+
+	if len(snap.blobs) > 0 {
+		if err := os.Mkdir(filepath.Join(dir, valueLogDirName), 0o755); err != nil {
+			return err
+		}
+	}
+	for _, b := range snap.blobs {
+		name, err := filepath.Rel(db.dataDir, b.path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, name)
+		if b.sealed {
+			err = linkOrCopyFile(b.path, dst)
+		} else {
+			_, _, err = backupBlobFile(b, dst)
+		}
+		if err != nil {
+			return fmt.Errorf("lsm: checkpoint %s: %w", b.path, err)
+		}
+	}
+	if len(snap.blobs) > 0 {
+		if err := syncDir(filepath.Join(dir, valueLogDirName)); err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+// backupSSTable links or copies the SSTable at src to dst and checksums it.
+// It returns the number of bytes copied, which is 0 for a hard link.
+func backupSSTable(src, dst string) (backupFile, int64, error) {
+	if err := os.Link(src, dst); err == nil {
+		f, err := checksumFile(dst)
+		return f, 0, err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return backupFile{}, 0, err
+	}
+	defer in.Close()
+	f, err := copyFile(in, dst, -1)
+	return f, f.size, err
+}
+
+// backupBlobFile copies the part of the blob file b still taking appends
+// that the backup covers to dst.
+func backupBlobFile(b blobFile, dst string) (backupFile, int64, error) {
+	in, err := os.Open(b.path)
+	if err != nil {
+		return backupFile{}, 0, err
+	}
+	defer in.Close()
+	f, err := copyFile(in, dst, b.size)
+	return f, f.size, err
+}
+
+// Restore validates the backup in backupDir against its backup manifest and
+// the SSTables' block checksums, then copies it into dataDir, which is
+// created if needed and must be empty. Nothing is written to dataDir if
+// validation fails.
+func Restore(backupDir, dataDir string) error {
+	files, err := loadBackupManifest(backupDir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		path := filepath.Join(backupDir, f.name)
+		got, err := checksumFile(path)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBackupCorrupt, err)
+		}
+		if got.size != f.size || got.crc != f.crc {
+			return fmt.Errorf("%w: %s does not match its recorded checksum", ErrBackupCorrupt, f.name)
+		}
+		if strings.HasSuffix(f.name, ".sst") {
+			if err := verifySSTable(path); err != nil {
+				return fmt.Errorf("%w: %v", ErrBackupCorrupt, err)
+			}
+		}
+	}
+
+	if err := prepareBackupDir(dataDir); err != nil {
+		return err
+	}
+	for _, f := range files {
+		src := filepath.Join(backupDir, f.name)
+		dst := filepath.Join(dataDir, f.name)
+		// Blob files live in the value log directory.
+		if dir := filepath.Dir(dst); dir != dataDir {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return err
+			}
+		}
+		if strings.HasSuffix(f.name, ".sst") {
+			// SSTables are never modified, so the restored DB may share them.
+			err = linkOrCopyFile(src, dst)
+		} else {
+			// WALs are appended to and the manifest is replaced: copy them.
+			var in *os.File
+			if in, err = os.Open(src); err == nil {
+				_, err = copyFile(in, dst, -1)
+				in.Close()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("lsm: restore %s: %w", f.name, err)
+		}
+	}
+	return syncDir(dataDir)
+}
+
+// verifySSTable checks every block checksum of the SSTable at path.
+func verifySSTable(path string) error {
+	r, err := sstable.NewReader(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	defer r.Close()
+	_, err = r.VerifyChecksumsInRange(nil, nil)
+	return err
+}
+
+// backupFile is one line of a backup manifest.
+type backupFile struct {
+	name string // relative to the backup directory
+	size int64
+	crc  uint32
+}
+
+var backupCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+func writeBackupManifest(dir string, files []backupFile) error {
+	var b strings.Builder
+	for _, f := range files {
+		fmt.Fprintf(&b, "%s\t%d\t%d\n", f.name, f.size, f.crc)
+	}
+	out, err := os.OpenFile(filepath.Join(dir, backupManifestName), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := out.WriteString(b.String()); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func loadBackupManifest(dir string) ([]backupFile, error) {
+	in, err := os.Open(filepath.Join(dir, backupManifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	var files []backupFile
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%w: malformed backup manifest line %q", ErrBackupCorrupt, line)
+		}
+		name := fields[0]
+		if filepath.IsAbs(name) || !filepath.IsLocal(name) {
+			return nil, fmt.Errorf("%w: path %q escapes the backup", ErrBackupCorrupt, name)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad size in %q", ErrBackupCorrupt, line)
+		}
+		crc, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad checksum in %q", ErrBackupCorrupt, line)
+		}
+		files = append(files, backupFile{name: name, size: size, crc: uint32(crc)})
+	}
+	return files, scanner.Err()
+}
+
+// checksumFile reads the file at path and returns its size and CRC32C.
+func checksumFile(path string) (backupFile, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return backupFile{}, err
+	}
+	defer in.Close()
+	h := crc32.New(backupCRCTable)
+	n, err := io.Copy(h, in)
+	if err != nil {
+		return backupFile{}, err
+	}
+	return backupFile{size: n, crc: h.Sum32()}, nil
+}
+
+// backupSnapshot pins what a backup must copy: the current SSTable set and
+// open handles on the WALs of the unflushed memtables. Holding the WALs open
+// keeps their contents readable even if a flush removes them meanwhile.
+type backupSnapshot struct {
+	version *version
+	wals    []backupWAL
+	blobs   []blobFile // the value log, if the DB has one
+	// hold keeps the WALs from being deleted, which not every platform
+	// allows for open files, and the SSTables the copy sees from being
+	// deleted once the version is released.
+	hold *FileDeletionHold
+}
+
+type backupWAL struct {
+	file *os.File
+	size int64 // bytes to copy
+}
+
+func (s *backupSnapshot) release() {
+	if s.version != nil {
+		s.version.unref()
+	}
+	for _, w := range s.wals {
+		w.file.Close()
+	}
+	s.hold.Release()
+}
+
+func (db *DB) backupSnapshot() (*backupSnapshot, error) {
+	// The write lock keeps the memtables and version in step: no rotation
+	// or flush can move data from one to the other while we look.
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	switch {
+	case db.closed || db.current == nil:
+		return nil, ErrClosed
+	case db.readOnly:
+		return nil, ErrReadOnly
+	}
+
+	snap := &backupSnapshot{version: db.current, hold: db.deleter.hold("backup")}
+	snap.version.ref()
+
+	addWAL := func(path string, size int64) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		snap.wals = append(snap.wals, backupWAL{file: f, size: size})
+		return nil
+	}
+
+	// Oldest first, matching the order Open replays WAL segments in. The
+	// immutable memtables are frozen, so their whole WALs are copied; the
+	// active one still takes writes, so only what is synced now.
+	for i := len(db.immutables) - 1; i >= 0; i-- {
+		if err := addWAL(db.immutables[i].WalPath(), -1); err != nil {
+			snap.release()
+			return nil, err
+		}
+	}
+	if db.active != nil {
+		size, err := db.active.SyncWAL()
+		if err == nil {
+			err = addWAL(db.active.WalPath(), size)
+		}
+		if err != nil {
+			snap.release()
+			return nil, err
+		}
+	}
+	// Syncing the WAL synced the value log, so what it holds now covers
+	// every record the copied WALs and SSTables point to.
+	if db.vlog != nil {
+		blobs, err := db.vlog.snapshot()
+		if err != nil {
+			snap.release()
+			return nil, err
+		}
+		snap.blobs = blobs
+	}
+	return snap, nil
+}
+
+// prepareBackupDir creates dir, or checks that an existing dir is empty.
+func prepareBackupDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("%w: %s", ErrBackupDirNotEmpty, dir)
+	}
+	return nil
+}
+
+// linkOrCopyFile hard-links src to dst, falling back to a copy (for example
+// across filesystems). SSTables are immutable, so sharing the inode is safe.
+func linkOrCopyFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = copyFile(f, dst, -1)
+	return err
+}
+
+// copyFile copies the first n bytes of src (all of it if n < 0), read from
+// its current offset, to a new file dst and syncs it. It returns the size
+// and CRC32C of what was copied; the name is left for the caller.
+func copyFile(src *os.File, dst string, n int64) (backupFile, error) {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return backupFile{}, err
+	}
+
+	var r io.Reader = src
+	if n >= 0 {
+		r = io.LimitReader(src, n)
+	}
+	h := crc32.New(backupCRCTable)
+	copied, err := io.Copy(io.MultiWriter(out, h), r)
+	if err != nil {
+		out.Close()
+		return backupFile{}, err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return backupFile{}, err
+	}
+	return backupFile{size: copied, crc: h.Sum32()}, out.Close()
+}
+
+// syncDir fsyncs a directory so the entries created in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,301 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/return2faye/SiltKV/internal/utils"
+	"github.com/return2faye/SiltKV/internal/wal"
+)
+
+// ErrBatchTooLarge is returned by DB.Write for a batch that would log more
+// than Options.MaxBatchSize bytes.
+var ErrBatchTooLarge = errors.New("lsm: write batch is too large")
+
+const (
+	// defaultMaxBatchSize is the default Options.MaxBatchSize.
+	defaultMaxBatchSize = 4 << 20
+	// batchOpOverhead is the most a WAL batch record adds to the key and
+	// value of a mutation: a tag byte and the varint lengths of both.
+	batchOpOverhead = 8
+)
+
+// WriteBatch collects mutations for DB.Write, which logs them atomically:
+// they go to the WAL as one batch record, so a recovery restores all of
+// them or none. The memtable takes them one at a time, so a concurrent
+// Get or iterator may see part of a batch that is still being applied.
+// The zero value is an empty batch. A WriteBatch is not safe for
+// concurrent use.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+// batchOp is one mutation of a WriteBatch.
+type batchOp struct {
+	key   []byte
+	value []byte // nil for a delete; the end key for a range delete
+
+	rangeDelete bool
+
+	// stored is value as the LSM holds it, set by DB.Write.
+	stored []byte
+}
+
+// Put adds a write of value to key. A nil value deletes key, as with
+// DB.Put. The batch keeps copies of key and value.
+func (b *WriteBatch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: utils.CopyBytes(key), value: utils.CopyBytes(value)})
+}
+
+// Delete adds a delete of key.
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: utils.CopyBytes(key)})
+}
+
+// DeleteRange adds a delete of every key in [start, end).
+func (b *WriteBatch) DeleteRange(start, end []byte) {
+	b.ops = append(b.ops, batchOp{key: utils.CopyBytes(start), value: utils.CopyBytes(end), rangeDelete: true})
+}
+
+// Len returns the number of mutations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch for reuse.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write applies the mutations of b in order, so a later mutation of a key
+// wins over an earlier one, and logs them so that a crash keeps all of
+// them or none. An empty batch is a no-op; one of more than
+// Options.MaxBatchSize bytes fails with ErrBatchTooLarge.
+func (db *DB) Write(b *WriteBatch) error {
+	return db.WriteContext(context.Background(), b)
+}
+
+// WriteContext is Write with a request context for auditing.
+func (db *DB) WriteContext(ctx context.Context, b *WriteBatch) error {
+	if b == nil {
+		return nil
+	}
+	ops := make([]batchOp, 0, len(b.ops))
+	size := 0
+	for _, op := range b.ops {
+		size += len(op.key) + len(op.value) + batchOpOverhead
+		if size > db.maxBatchSize {
+			return ErrBatchTooLarge
+		}
+		if !op.rangeDelete {
+			if err := checkUserKey(op.key); err != nil {
+				return err
+			}
+			ops = append(ops, op)
+			continue
+		}
+		switch cmp := bytes.Compare(op.key, op.value); {
+		case cmp > 0:
+			return ErrInvalidRange
+		case cmp == 0:
+			// Empty range
+			continue
+		}
+		ranges, err := userRanges(op.key, op.value)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, ranges...)
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	if t := db.trace(); t != nil {
+		start := db.clock.Now()
+		defer func() {
+			for _, op := range ops {
+				switch {
+				case op.rangeDelete:
+					t.record(TraceOpDeleteRange, op.key, 0, start)
+				case op.value == nil:
+					t.record(TraceOpDelete, op.key, 0, start)
+				default:
+					t.record(TraceOpPut, op.key, len(op.value), start)
+				}
+			}
+		}()
+	}
+	if err := db.writeErr(); err != nil {
+		return err
+	}
+
+	for i := range ops {
+		op := &ops[i]
+		if op.rangeDelete {
+			op.stored = op.value
+			continue
+		}
+		stored, err := db.codecs.encode(op.key, op.value)
+		if err != nil {
+			return err
+		}
+		op.stored = stored
+	}
+	if db.softDelete {
+		// As with Put, the keys' locks keep the values the deletes move
+		// to the trash from changing before the batch is written.
+		defer db.lockKeys(ops)()
+		var err error
+		if ops, err = db.trashBatch(ops); err != nil {
+			return err
+		}
+	}
+	return db.applyBatch(ctx, ops)
+}
+
+// applyBatch writes ops, whose stored forms are set, as one WAL batch
+// record together with the posting updates of the token index, if any.
+func (db *DB) applyBatch(ctx context.Context, ops []batchOp) error {
+	if db.tokenizer != nil {
+		db.indexMu.Lock()
+		defer db.indexMu.Unlock()
+		var err error
+		if ops, err = db.indexBatch(ops); err != nil {
+			return err
+		}
+	}
+	return db.writeBatch(ctx, ops)
+}
+
+// indexBatch returns ops with the posting updates of the token index
+// added, new postings before the op and stale ones after it, all in the
+// same atomic write. Must be called with indexMu held.
+func (db *DB) indexBatch(ops []batchOp) ([]batchOp, error) {
+	// latest is the value of each key as of the ops seen so far.
+	latest := make(map[string][]byte)
+	out := make([]batchOp, 0, len(ops))
+	for _, op := range ops {
+		if op.rangeDelete {
+			for k := range latest {
+				if k >= string(op.key) && k < string(op.value) {
+					latest[k] = nil
+				}
+			}
+			out = append(out, op)
+			continue
+		}
+		if isInternalKey(op.key) {
+			out = append(out, op)
+			continue
+		}
+		old, seen := latest[string(op.key)]
+		if !seen {
+			value, found, err := db.GetWithOptions(op.key, ReadOptions{})
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				old = value
+			}
+		}
+		oldTokens := db.tokens(op.key, old)
+		newTokens := db.tokens(op.key, op.value)
+		for t := range newTokens {
+			if _, ok := oldTokens[t]; !ok {
+				out = append(out, batchOp{key: postingKey(t, op.key), stored: postingValue})
+			}
+		}
+		out = append(out, op)
+		for t := range oldTokens {
+			if _, ok := newTokens[t]; !ok {
+				out = append(out, batchOp{key: postingKey(t, op.key)})
+			}
+		}
+		latest[string(op.key)] = op.value
+	}
+	return out, nil
+}
+
+// writeBatch writes ops, whose stored forms are set, to the active
+// memtable as one WAL batch record.
+func (db *DB) writeBatch(ctx context.Context, ops []batchOp) error {
+	if db.vlog != nil {
+		db.vlog.writeMu.RLock()
+		defer db.vlog.writeMu.RUnlock()
+	}
+	walOps := make([]wal.BatchOp, len(ops))
+	size := 0
+	for i, op := range ops {
+		rec := op.stored
+		if db.vlog != nil && !op.rangeDelete && !isInternalKey(op.key) {
+			var err error
+			if rec, err = db.vlog.record(op.key, op.stored); err != nil {
+				return err
+			}
+		}
+		if err := db.checkSize(op.key, rec, op.rangeDelete); err != nil {
+			return err
+		}
+		walOps[i] = wal.BatchOp{Key: op.key, Value: rec, RangeDelete: op.rangeDelete}
+		size += len(op.key) + len(rec)
+	}
+	if size+len(ops)*batchOpOverhead > wal.BatchSizeLimit {
+		// The postings of the token index can grow a batch past the
+		// most the WAL logs in one record.
+		return ErrBatchTooLarge
+	}
+
+	db.throttle.admit(size)
+	if err := db.makeRoomForWrite(); err != nil {
+		return err
+	}
+
+	db.mu.RLock()
+	mt := db.active
+	bgErr := db.bgErr
+	db.mu.RUnlock()
+
+	if mt == nil {
+		return ErrClosed
+	}
+	if bgErr != nil {
+		return bgErr
+	}
+
+	if db.rowCache != nil {
+		db.rowCache.lockAllWrites()
+		err := mt.WriteBatch(walOps)
+		if err == nil {
+			for _, op := range walOps {
+				if op.RangeDelete {
+					db.rowCache.deleteRange(op.Key, op.Value)
+				} else {
+					db.rowCache.put(op.Key, op.Value)
+				}
+			}
+		}
+		db.rowCache.unlockAllWrites()
+		if err != nil {
+			return err
+		}
+	} else if err := mt.WriteBatch(walOps); err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		switch {
+		case op.rangeDelete:
+			atomic.AddUint64(&db.io.userBytes, uint64(len(op.key)+len(op.value)))
+			db.audit.record(ctx, AuditOpDeleteRange, op.key, op.value, 0)
+		case op.stored == nil:
+			atomic.AddUint64(&db.io.userBytes, uint64(len(op.key)))
+			db.audit.record(ctx, AuditOpDelete, op.key, nil, 0)
+		default:
+			atomic.AddUint64(&db.io.userBytes, uint64(len(op.key)+len(op.value)))
+			db.audit.record(ctx, AuditOpPut, op.key, nil, len(op.value))
+		}
+	}
+	return db.rotateIfFull(mt)
+}
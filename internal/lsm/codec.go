@@ -0,0 +1,96 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrEmptyEncoding is returned by a Put whose value a ValueCodec encoded
+// to zero bytes.
+var ErrEmptyEncoding = errors.New("lsm: value codec returned an empty encoding")
+
+// ValueCodec transforms values between their user form and the form stored
+// in the WAL, memtables and SSTables, e.g. to compress, encrypt or tag them
+// with a schema version. Both methods get the key so a codec can bind the
+// stored bytes to it (as an encryption codec would with associated data).
+//
+// Stored values are never re-encoded: flushes and compactions copy them
+// as-is. A codec must therefore keep decoding everything it ever encoded,
+// and the same codecs must be registered every time the DB is opened.
+//
+// Encode must not return an empty result, not even for an empty value:
+// SSTables store empty values as tombstones, so the key would vanish at
+// the next flush. Put fails such an encoding with ErrEmptyEncoding.
+type ValueCodec interface {
+	Encode(key, value []byte) ([]byte, error)
+	Decode(key, stored []byte) ([]byte, error)
+}
+
+// PrefixCodec applies Codec to the values of keys starting with Prefix.
+type PrefixCodec struct {
+	Prefix []byte
+	Codec  ValueCodec
+}
+
+// codecSet picks the codec registered for the longest matching prefix.
+type codecSet []PrefixCodec
+
+func newCodecSet(codecs []PrefixCodec) (codecSet, error) {
+	set := make(codecSet, len(codecs))
+	copy(set, codecs)
+	sort.SliceStable(set, func(i, j int) bool {
+		return len(set[i].Prefix) > len(set[j].Prefix)
+	})
+	for i, c := range set {
+		if c.Codec == nil {
+			return nil, fmt.Errorf("lsm: nil codec for prefix %q", c.Prefix)
+		}
+		if i > 0 && bytes.Equal(c.Prefix, set[i-1].Prefix) {
+			return nil, fmt.Errorf("lsm: duplicate codec for prefix %q", c.Prefix)
+		}
+	}
+	return set, nil
+}
+
+func (s codecSet) lookup(key []byte) ValueCodec {
+	for _, c := range s {
+		if bytes.HasPrefix(key, c.Prefix) {
+			return c.Codec
+		}
+	}
+	return nil
+}
+
+// encode returns the stored form of value. Tombstones (nil) pass through.
+func (s codecSet) encode(key, value []byte) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	c := s.lookup(key)
+	if c == nil {
+		return value, nil
+	}
+	stored, err := c.Encode(key, value)
+	if err != nil {
+		return nil, fmt.Errorf("lsm: encode value of %q: %w", key, err)
+	}
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("lsm: encode value of %q: %w", key, ErrEmptyEncoding)
+	}
+	return stored, nil
+}
+
+// decode is the inverse of encode.
+func (s codecSet) decode(key, stored []byte) ([]byte, error) {
+	c := s.lookup(key)
+	if c == nil {
+		return stored, nil
+	}
+	value, err := c.Decode(key, stored)
+	if err != nil {
+		return nil, fmt.Errorf("lsm: decode value of %q: %w", key, err)
+	}
+	return value, nil
+}
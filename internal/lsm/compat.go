@@ -0,0 +1,123 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// EngineVersion is the version of the on-disk format this package writes.
+// It is recorded in the manifest together with the format features the
+// data directory uses, and is raised whenever a feature is added.
+const EngineVersion = 14
+
+// Format features a data directory can use. Each names something a binary
+// must understand to read the directory correctly.
+const (
+	FeatureSequenceNumbers = "seqnums"      // manifest lines carry WAL sequence numbers
+	FeatureLevels          = "levels"       // manifest lines carry the level of files below L0
+	FeatureTableV6         = "sstable-v6"   // SSTables may use table format V6 (properties)
+	FeatureManifestLog     = "manifest-log" // the manifest is a log of version edits
+	FeatureTableV7         = "sstable-v7"   // SSTables may use table format V7 (file checksum)
+	FeatureTableV8         = "sstable-v8"   // SSTables may use table format V8 (block compression)
+	FeatureTableV9         = "sstable-v9"   // SSTables may use table format V9 (prefix-compressed blocks)
+	FeatureTableV10        = "sstable-v10"  // SSTables may use table format V10 (double-hashing bloom filters)
+	FeatureTableV11        = "sstable-v11"  // SSTables may use table format V11 (partitioned bloom filters)
+	FeatureTableV12        = "sstable-v12"  // SSTables may use table format V12 (partitioned block index)
+	FeatureTableV13        = "sstable-v13"  // SSTables may use table format V13 (versioned footer)
+	FeatureIdentity        = "db-identity"  // the manifest snapshot records the DB's Identity
+	FeatureValueLog        = "value-log"    // values may be tagged and point into blob files under vlog/
+	FeatureWALBatch        = "wal-batch"    // WAL files may hold batch records of several ops
+	FeatureWALSyncMarker   = "wal-sync"     // WAL records start with a sync marker
+	FeatureWALCompression  = "wal-snappy"   // WAL files may hold Snappy-compressed chunks of records
+)
+
+// supportedFeatures are the features this binary can read.
+var supportedFeatures = []string{
+	FeatureSequenceNumbers, FeatureLevels, FeatureTableV6, FeatureManifestLog, FeatureTableV7, FeatureTableV8,
+	FeatureTableV9, FeatureTableV10, FeatureTableV11, FeatureTableV12,
+	FeatureTableV13, FeatureIdentity, FeatureValueLog, FeatureWALBatch,
+	FeatureWALSyncMarker, FeatureWALCompression,
+}
+
+// writtenFeatures are the features this binary records in the manifests it
+// writes: all the ones it may use.
+var writtenFeatures = supportedFeatures
+
+// ErrIncompatible is matched by errors.Is for an *IncompatibleError.
+var ErrIncompatible = errors.New("lsm: data directory is incompatible with this version")
+
+// IncompatibleError is returned by Open when the data directory was written
+// by a newer engine using format features this binary does not support.
+// Opening it anyway would misread its files.
+type IncompatibleError struct {
+	Engine   int      // EngineVersion that last wrote the manifest
+	Features []string // required features this binary lacks
+}
+
+func (e *IncompatibleError) Error() string {
+	return fmt.Sprintf("lsm: data directory written by engine version %d requires unsupported features: %s",
+		e.Engine, strings.Join(e.Features, ", "))
+}
+
+func (e *IncompatibleError) Is(target error) bool {
+	return target == ErrIncompatible
+}
+
+// manifestHeaderPrefix starts the first line of a text manifest that
+// records the engine version and features, e.g.
+//
+//	#siltkv	engine=1	features=seqnums,levels,sstable-v6
+//
+// No SSTable path starts with '#', and text manifests without the line are
+// read as using no optional features. The log format records them in its
+// first record instead.
+const manifestHeaderPrefix = "#siltkv"
+
+// checkManifestHeader parses the header line of a text manifest and checks
+// it with checkFeatures. Unknown fields are ignored, so newer engines can
+// add information that does not change the format.
+func checkManifestHeader(line string) error {
+	fields := strings.Split(line, "\t")
+	if fields[0] != manifestHeaderPrefix {
+		return fmt.Errorf("manifest: malformed header %q", line)
+	}
+	engine := 0
+	var features []string
+	for _, f := range fields[1:] {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "engine":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("manifest: bad engine version in %q", line)
+			}
+			engine = n
+		case "features":
+			for _, feat := range strings.Split(v, ",") {
+				if feat != "" {
+					features = append(features, feat)
+				}
+			}
+		}
+	}
+	return checkFeatures(engine, features)
+}
+
+// checkFeatures returns an *IncompatibleError if features, recorded in a
+// manifest by the given engine version, include any this binary does not
+// support.
+func checkFeatures(engine int, features []string) error {
+	var missing []string
+	for _, feat := range features {
+		if !slices.Contains(supportedFeatures, feat) {
+			missing = append(missing, feat)
+		}
+	}
+	if len(missing) > 0 {
+		return &IncompatibleError{Engine: engine, Features: missing}
+	}
+	return nil
+}
@@ -2,12 +2,25 @@ package lsm
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/return2faye/SiltKV/internal/clock"
 	"github.com/return2faye/SiltKV/internal/memtable"
+	"github.com/return2faye/SiltKV/internal/sstable"
 	"github.com/return2faye/SiltKV/internal/wal"
 )
 
@@ -123,8 +136,10 @@ func TestWALFileDeletionAfterFlush(t *testing.T) {
 		t.Fatalf("SSTable file was not created within timeout. Expected: %s", sstPath)
 	}
 
-	// Give a bit more time for WAL deletion to complete after SSTable is created
-	time.Sleep(500 * time.Millisecond)
+	// The SSTable shows up as soon as the flush starts writing it, which
+	// takes a while under the race detector; the WAL is deleted once the
+	// flush is done.
+	db.flushWg.Wait()
 
 	// Verify initial WAL file was deleted after flush
 	if _, err := os.Stat(initialWalPath); !os.IsNotExist(err) {
@@ -308,3 +323,4886 @@ func TestRecoveryWithMultipleWALFiles(t *testing.T) {
 		}
 	}
 }
+
+// pathEntries builds manifest entries without sequence information.
+func pathEntries(paths []string) []manifestEntry {
+	entries := make([]manifestEntry, len(paths))
+	for i, p := range paths {
+		entries[i] = manifestEntry{path: p}
+	}
+	return entries
+}
+
+// writeTestSSTable writes kvs (already sorted by key) to an SSTable at path.
+func writeTestSSTable(t *testing.T, path string, kvs [][2]string) {
+	t.Helper()
+	w, err := sstable.NewWriter(path)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for _, kv := range kvs {
+		if _, err := w.Write([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatalf("Failed to write %q: %v", kv[0], err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+}
+
+func TestCompactionSurvivesConcurrentFlush(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var files []*fileMeta
+	for i := 0; i < 6; i++ {
+		path := filepath.Join(tmpDir, fmt.Sprintf("f%d.sst", i))
+		writeTestSSTable(t, path, [][2]string{{fmt.Sprintf("k%d", i), "v"}})
+		r, err := sstable.NewReader(path)
+		if err != nil {
+			t.Fatalf("Failed to open reader: %v", err)
+		}
+		files = append(files, &fileMeta{id: uint64(i + 1), path: path, reader: r})
+	}
+
+	// Version at compaction start: f3 (newest) .. f0 (oldest).
+	base := newVersion([]*fileMeta{files[3], files[2], files[1], files[0]})
+	inputs := base.files[2:] // f1, f0
+
+	// A flush lands while the compaction is running.
+	flushed := base.withFlushed(files[4])
+	base.unref()
+
+	out := files[5]
+	nv, ok := flushed.withCompaction(inputs, []*fileMeta{out})
+	if !ok {
+		t.Fatal("compaction should not be invalidated by a newer flushed file")
+	}
+
+	var got []uint64
+	for _, f := range nv.files {
+		got = append(got, f.id)
+	}
+	want := []uint64{5, 4, 3, 6}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("files after compaction = %v, want %v", got, want)
+	}
+
+	// An input that is no longer live must still abort the install.
+	if _, ok := nv.withCompaction(inputs, nil); ok {
+		t.Fatal("compaction with missing inputs should be rejected")
+	}
+
+	nv.unref()
+	flushed.unref()
+}
+
+func TestCompactionReplacesOldestFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// Oldest first, as recorded in the manifest. Later files override earlier ones.
+	tables := [][][2]string{
+		{{"a", "1"}, {"b", "1"}, {"c", "1"}},
+		{{"b", "2"}},
+		{{"c", "3"}},
+		{{"d", "4"}},
+		{{"e", "5"}},
+	}
+	var paths []string
+	for i, kvs := range tables {
+		path := filepath.Join(tmpDir, fmt.Sprintf("t%d.sst", i))
+		writeTestSSTable(t, path, kvs)
+		paths = append(paths, path)
+	}
+	if err := rewriteManifest(tmpDir, Identity{}, pathEntries(paths)); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	db, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.compactWg.Add(1)
+	db.compactSSTables()
+	db.compactWg.Wait()
+
+	if m := db.CompactionMetrics(); m.Completed != 1 || m.Aborted != 0 || m.BytesWritten == 0 {
+		t.Errorf("unexpected compaction metrics: %+v", m)
+	}
+
+	v := db.currentVersion()
+	if len(v.files) != 2 {
+		t.Fatalf("expected 2 SSTables after compaction, got %d", len(v.files))
+	}
+	if v.files[0].path != paths[4] {
+		t.Errorf("newest file should be untouched, got %s", v.files[0].path)
+	}
+	v.unref()
+
+	for _, p := range paths[:4] {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("compacted input %s should have been removed", p)
+		}
+	}
+
+	// Manifest must list files oldest first so that a reopen keeps precedence.
+	manifestPaths, err := loadManifest(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to load manifest: %v", err)
+	}
+	if len(manifestPaths) != 2 || manifestPaths[1].path != paths[4] {
+		t.Fatalf("unexpected manifest after compaction: %v", manifestPaths)
+	}
+
+	want := map[string]string{"a": "1", "b": "2", "c": "3", "d": "4", "e": "5"}
+	for k, wv := range want {
+		got, found, err := db.Get([]byte(k))
+		if err != nil || !found || string(got) != wv {
+			t.Errorf("Get(%q) = %q, %v, %v; want %q", k, got, found, err, wv)
+		}
+	}
+}
+
+// checkLevels fails the test if a level below L0 holds unsorted or
+// overlapping files.
+func checkLevels(t *testing.T, v *version) {
+	t.Helper()
+	for level, files := range v.levels[1:] {
+		for i := 1; i < len(files); i++ {
+			if bytes.Compare(files[i-1].largest, files[i].smallest) > 0 {
+				t.Errorf("L%d: %s [%q, %q] overlaps %s [%q, %q]", level+1,
+					files[i-1].path, files[i-1].smallest, files[i-1].largest,
+					files[i].path, files[i].smallest, files[i].largest)
+			}
+		}
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	tmpDir := t.TempDir()
+	db, err := Open(Options{DataDir: tmpDir, L0CompactionTrigger: 2})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	// flush writes kvs (a nil value deletes) as one L0 file and waits for
+	// any compaction it triggers.
+	flush := func(kvs ...[2]string) {
+		t.Helper()
+		for _, kv := range kvs {
+			var val []byte
+			if kv[1] != "" {
+				val = []byte(kv[1])
+			}
+			if err := db.Put([]byte(kv[0]), val); err != nil {
+				t.Fatalf("Put(%q): %v", kv[0], err)
+			}
+		}
+		if err := db.rotateMemtable(); err != nil {
+			t.Fatalf("Rotate: %v", err)
+		}
+		db.flushWg.Wait()
+		db.compactWg.Wait()
+	}
+
+	// Two flushes reach the L0 trigger and are merged into L1.
+	flush([2]string{"a", "1"}, [2]string{"b", "1"}, [2]string{"c", "1"})
+	flush([2]string{"b", "2"})
+	v := db.currentVersion()
+	if len(v.levels[0]) != 0 || len(v.levels[1]) != 1 {
+		t.Fatalf("after L0 compaction: L0=%d L1=%d files", len(v.levels[0]), len(v.levels[1]))
+	}
+	// The output records which files it was merged from.
+	props, err := v.levels[1][0].reader.Properties()
+	if err != nil {
+		t.Fatalf("Properties: %v", err)
+	}
+	if inputs := strings.Fields(props[PropCompactionInputs]); len(inputs) != 2 || !strings.HasPrefix(inputs[0], "L0:active-") {
+		t.Errorf("compaction inputs = %q", props[PropCompactionInputs])
+	}
+	if props[PropCompactionOutputLevel] != "1" || props[PropCompactionTime] == "" {
+		t.Errorf("unexpected provenance: %v", props)
+	}
+	v.unref()
+
+	// Tiny level limits push the data all the way down to the last level.
+	db.levelBaseSize, db.levelMultiplier = 1, 1
+	db.compactWg.Add(1)
+	db.compactSSTables()
+	db.compactWg.Wait()
+	db.levelBaseSize, db.levelMultiplier = defaultLevelBaseSize, defaultLevelSizeMultiplier
+	v = db.currentVersion()
+	if n := len(v.levels[numLevels-1]); n != 1 || len(v.files) != 1 {
+		t.Fatalf("expected one file in the last level, got %d of %d", n, len(v.files))
+	}
+	v.unref()
+
+	// With older data below, L0 -> L1 must keep the tombstones that still
+	// shadow it, and only those: the last level holds just [a, c].
+	for _, r := range [][2]string{{"c", "d"}, {"y", "z"}} {
+		if err := db.DeleteRange([]byte(r[0]), []byte(r[1])); err != nil {
+			t.Fatalf("DeleteRange: %v", err)
+		}
+	}
+	flush([2]string{"a", ""}, [2]string{"x", "9"})
+	flush([2]string{"e", "5"}, [2]string{"x", ""})
+	v = db.currentVersion()
+	if len(v.levels[0]) != 0 || len(v.levels[1]) != 1 {
+		t.Fatalf("after second L0 compaction: L0=%d L1=%d files", len(v.levels[0]), len(v.levels[1]))
+	}
+	l1 := v.levels[1][0]
+	if found, deleted, _ := l1.reader.Exists([]byte("a")); !found || !deleted {
+		t.Errorf("L1 lost the tombstone for a: found=%v deleted=%v", found, deleted)
+	}
+	if !l1.reader.IsRangeDeleted([]byte("c")) {
+		t.Error("L1 lost the range tombstone over c")
+	}
+	if found, _, _ := l1.reader.Exists([]byte("x")); found {
+		t.Error("L1 kept the tombstone for x, which nothing older holds")
+	}
+	if l1.reader.IsRangeDeleted([]byte("y")) {
+		t.Error("L1 kept the range tombstone over y, which nothing older holds")
+	}
+	checkLevels(t, v)
+	v.unref()
+
+	want := map[string]string{"a": "", "b": "2", "c": "", "e": "5", "x": ""}
+	check := func(stage string) {
+		t.Helper()
+		for k, wv := range want {
+			got, found, err := db.Get([]byte(k))
+			if err != nil || found != (wv != "") || string(got) != wv {
+				t.Errorf("%s: Get(%q) = %q, %v, %v; want %q", stage, k, got, found, err, wv)
+			}
+		}
+	}
+	check("compacted")
+
+	// Levels survive a reopen through the manifest.
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	db, err = Open(Options{DataDir: tmpDir, L0CompactionTrigger: 2})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	v = db.currentVersion()
+	if len(v.levels[1]) != 1 || len(v.levels[numLevels-1]) != 1 {
+		t.Errorf("levels after reopen: L1=%d L%d=%d", len(v.levels[1]), numLevels-1, len(v.levels[numLevels-1]))
+	}
+	v.unref()
+	check("reopened")
+	if s := db.Stats(); len(s.Levels) != numLevels || s.Levels[1].Files != 1 || s.SSTableCount != 2 {
+		t.Errorf("unexpected level stats: %+v", s.Levels)
+	}
+}
+
+func TestBloomBitsPerLevel(t *testing.T) {
+	db, err := Open(Options{
+		DataDir:             t.TempDir(),
+		L0CompactionTrigger: 2,
+		BloomBitsPerKey:     []int{-1, 10},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	flush := func(keys ...string) {
+		t.Helper()
+		for _, k := range keys {
+			if err := db.Put([]byte(k), []byte("v")); err != nil {
+				t.Fatalf("Put(%q): %v", k, err)
+			}
+		}
+		if err := db.rotateMemtable(); err != nil {
+			t.Fatalf("Rotate: %v", err)
+		}
+		db.flushWg.Wait()
+		db.compactWg.Wait()
+	}
+	bloomChecks := func() uint64 {
+		db.Get([]byte("b")) // absent, but inside every file's key range
+		return db.Stats().BloomChecks
+	}
+
+	flush("a", "c")
+	if n := bloomChecks(); n != 0 {
+		t.Errorf("L0 file without a filter reported %d bloom checks", n)
+	}
+
+	flush("a", "d")
+	v := db.currentVersion()
+	if len(v.levels[0]) != 0 || len(v.levels[1]) != 1 {
+		t.Fatalf("expected a single L1 file, got L0=%d L1=%d", len(v.levels[0]), len(v.levels[1]))
+	}
+	v.unref()
+	if n := bloomChecks(); n != 1 {
+		t.Errorf("L1 file reported %d bloom checks, want 1", n)
+	}
+}
+
+func TestExistsRespectsNewerTombstone(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	sstPath := filepath.Join(tmpDir, "base.sst")
+	writeTestSSTable(t, sstPath, [][2]string{{"deleted", "old"}, {"kept", "v"}})
+	if err := rewriteManifest(tmpDir, Identity{}, pathEntries([]string{sstPath})); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	db, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Delete([]byte("deleted")); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if err := db.Put([]byte("fresh"), []byte("v")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	cases := map[string]bool{"deleted": false, "kept": true, "fresh": true, "missing": false}
+	for k, want := range cases {
+		got, err := db.Exists([]byte(k))
+		if err != nil {
+			t.Fatalf("Exists(%q) error: %v", k, err)
+		}
+		if got != want {
+			t.Errorf("Exists(%q) = %v, want %v", k, got, want)
+		}
+		if _, found, _ := db.Get([]byte(k)); found != want {
+			t.Errorf("Get(%q) found = %v, want %v", k, found, want)
+		}
+	}
+}
+
+func TestCompactionMetricsAbort(t *testing.T) {
+	tmpDir := t.TempDir()
+	out := filepath.Join(tmpDir, "compact-1-0.sst")
+	writeTestSSTable(t, out, [][2]string{{"a", "1"}})
+	st, err := os.Stat(out)
+	if err != nil {
+		t.Fatalf("Failed to stat output: %v", err)
+	}
+
+	var cm compactionMetrics
+	cm.recordAborted(AbortReasonInputsChanged, []string{out, filepath.Join(tmpDir, "missing.sst")})
+	cm.recordAborted(AbortReasonClosed, nil)
+
+	m := cm.snapshot()
+	if m.Aborted != 2 {
+		t.Errorf("Aborted = %d, want 2", m.Aborted)
+	}
+	if m.AbortsByReason[AbortReasonInputsChanged] != 1 || m.AbortsByReason[AbortReasonClosed] != 1 {
+		t.Errorf("unexpected abort reasons: %v", m.AbortsByReason)
+	}
+	if m.WastedBytes != uint64(st.Size()) {
+		t.Errorf("WastedBytes = %d, want %d", m.WastedBytes, st.Size())
+	}
+
+	// Snapshots must not alias the live reason map.
+	m.AbortsByReason[AbortReasonClosed] = 100
+	if cm.snapshot().AbortsByReason[AbortReasonClosed] != 1 {
+		t.Error("snapshot shares its map with the live metrics")
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	sstPath := filepath.Join(tmpDir, "base.sst")
+	writeTestSSTable(t, sstPath, [][2]string{
+		{"user:1", "a"}, {"user:2", "b"}, {"user:3", "c"}, {"zebra", "z"},
+	})
+	if err := rewriteManifest(tmpDir, Identity{}, pathEntries([]string{sstPath})); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	db, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	if err := db.Put([]byte("user:4"), []byte("d")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.DeleteRange([]byte("user:"), []byte("user;")); err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+	if err := db.Put([]byte("user:2"), []byte("b2")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := db.DeleteRange([]byte("b"), []byte("a")); err != ErrInvalidRange {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+
+	want := map[string]string{"user:1": "", "user:2": "b2", "user:3": "", "user:4": "", "zebra": "z"}
+	check := func(stage string) {
+		t.Helper()
+		for k, wv := range want {
+			got, found, err := db.Get([]byte(k))
+			if err != nil {
+				t.Fatalf("%s: Get(%q) error: %v", stage, k, err)
+			}
+			if found != (wv != "") || string(got) != wv {
+				t.Errorf("%s: Get(%q) = %q, found=%v; want %q", stage, k, got, found, wv)
+			}
+		}
+	}
+	check("memtable")
+
+	// Flush the range tombstone into an SSTable.
+	if err := db.rotateMemtable(); err != nil {
+		t.Fatalf("Failed to rotate memtable: %v", err)
+	}
+	db.flushWg.Wait()
+	check("flushed")
+
+	// Compaction applies the tombstone and drops it.
+	db.compactTrigger = 2
+	db.compactWg.Add(1)
+	db.compactSSTables()
+	db.compactWg.Wait()
+	check("compacted")
+
+	v := db.currentVersion()
+	for _, f := range v.files {
+		if n := len(f.reader.RangeTombstones()); n != 0 {
+			t.Errorf("compacted file %s still has %d range tombstones", f.path, n)
+		}
+	}
+	v.unref()
+	db.Close()
+
+	// Reopen from WAL + manifest.
+	db, err = Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	check("reopened")
+}
+
+func TestVerifyChecksumsInRange(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	sstPath := filepath.Join(tmpDir, "base.sst")
+	writeTestSSTable(t, sstPath, [][2]string{{"a", "1"}, {"b", "2"}})
+	if err := rewriteManifest(tmpDir, Identity{}, pathEntries([]string{sstPath})); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	db, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if err := db.VerifyChecksumsInRange([]byte("a"), []byte("c")); err != nil {
+		t.Errorf("verify on healthy DB failed: %v", err)
+	}
+	db.Close()
+
+	if err := db.VerifyChecksumsInRange(nil, nil); err != ErrClosed {
+		t.Errorf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestLatencyMonitorYield(t *testing.T) {
+	m := newLatencyMonitor(time.Millisecond)
+	if m.congested() {
+		t.Fatal("Monitor without samples should not be congested")
+	}
+
+	for i := 0; i < 32; i++ {
+		m.observe(10 * time.Millisecond)
+	}
+	if !m.congested() {
+		t.Fatal("Monitor should be congested after slow foreground reads")
+	}
+	start := time.Now()
+	m.yield()
+	if time.Since(start) < maxYieldSteps*yieldSleep {
+		t.Error("yield should back off while congested")
+	}
+
+	for i := 0; i < 64; i++ {
+		m.observe(0)
+	}
+	if m.congested() {
+		t.Error("Monitor should recover once foreground reads are fast again")
+	}
+
+	disabled := newLatencyMonitor(-1)
+	disabled.observe(time.Second)
+	if disabled.congested() {
+		t.Error("Negative threshold should disable yielding")
+	}
+}
+
+func TestOpenLocksDataDir(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "test-db")
+
+	db, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	if _, err := Open(Options{DataDir: tmpDir}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Second Open: expected ErrLocked, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	db2, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Reopen after Close failed: %v", err)
+	}
+	db2.Close()
+}
+
+func TestOpenThroughSymlinkAndMove(t *testing.T) {
+	root := t.TempDir()
+	realDir := filepath.Join(root, "real")
+	link := filepath.Join(root, "link")
+	if err := os.MkdirAll(realDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(realDir, link); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+
+	db, err := Open(Options{DataDir: link})
+	if err != nil {
+		t.Fatalf("Open through symlink: %v", err)
+	}
+	if _, err := Open(Options{DataDir: realDir}); !errors.Is(err, ErrLocked) {
+		t.Errorf("Open of link target while open: expected ErrLocked, got %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	db.rotateMemtable()
+	db.flushWg.Wait()
+	db.Close()
+
+	manifest, err := os.ReadFile(manifestPath(realDir))
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if bytes.Contains(manifest, []byte(root)) {
+		t.Errorf("manifest holds absolute paths:\n%s", manifest)
+	}
+
+	moved := filepath.Join(root, "moved")
+	if err := os.Rename(realDir, moved); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(Options{DataDir: moved})
+	if err != nil {
+		t.Fatalf("Open after move: %v", err)
+	}
+	defer db.Close()
+	if val, found, err := db.Get([]byte("key")); err != nil || !found || string(val) != "value" {
+		t.Errorf("Get after move = %q, %v, %v", val, found, err)
+	}
+}
+
+func TestOpenRejectsManifestTraversal(t *testing.T) {
+	root := t.TempDir()
+	tmpDir := filepath.Join(root, "db")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestSSTable(t, filepath.Join(root, "outside.sst"), [][2]string{{"k", "v"}})
+
+	for _, line := range []string{"../outside.sst", filepath.Join(root, "outside.sst"), "a/../../outside.sst"} {
+		if err := os.WriteFile(manifestPath(tmpDir), []byte(line+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(Options{DataDir: tmpDir}); !errors.Is(err, ErrInvalidManifestPath) {
+			t.Errorf("manifest line %q: expected ErrInvalidManifestPath, got %v", line, err)
+		}
+	}
+}
+
+func TestCloseWaitsForCompaction(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var paths []string
+	for i := 0; i < 4; i++ {
+		p := filepath.Join(tmpDir, fmt.Sprintf("sst-%d.sst", i))
+		writeTestSSTable(t, p, [][2]string{{fmt.Sprintf("key%d", i), "v"}})
+		paths = append(paths, p)
+	}
+	if err := rewriteManifest(tmpDir, Identity{}, pathEntries(paths)); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	db, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	db.compactWg.Add(1)
+	go db.compactSSTables()
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	db.mu.RLock()
+	compacting := db.compacting
+	db.mu.RUnlock()
+	if compacting {
+		t.Fatal("Close returned while a compaction was still running")
+	}
+	manifestPaths, err := loadManifest(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to load manifest: %v", err)
+	}
+	for _, e := range manifestPaths {
+		p := e.path
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("Manifest references missing SSTable %s: %v", p, err)
+		}
+	}
+
+	// Everything written before Close is visible after reopening, whether
+	// or not the compaction won the race with Close.
+	db, err = Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if _, found, err := db.Get([]byte(key)); err != nil || !found {
+			t.Errorf("Get(%s) after reopen: found=%v err=%v", key, found, err)
+		}
+	}
+}
+
+func TestAuditHook(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		events  []AuditEvent
+		batches int
+	)
+	hook := func(batch []AuditEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, batch...)
+		batches++
+	}
+
+	db, err := Open(Options{
+		DataDir:            t.TempDir(),
+		AuditHook:          hook,
+		AuditBatchSize:     2,
+		AuditFlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	ctx := WithPrincipal(context.Background(), "alice")
+	if err := db.PutContext(ctx, []byte("k1"), []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := db.DeleteContext(ctx, []byte("k1")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := db.DeleteRange([]byte("a"), []byte("z")); err != nil {
+		t.Fatalf("DeleteRange failed: %v", err)
+	}
+	if err := db.DeleteRange([]byte("z"), []byte("a")); err == nil {
+		t.Fatal("Expected invalid DeleteRange to fail")
+	}
+
+	mu.Lock()
+	if batches != 1 || len(events) != 2 {
+		t.Errorf("Expected one full batch of 2 before Close, got %d batches, %d events", batches, len(events))
+	}
+	mu.Unlock()
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	want := []AuditEvent{
+		{Op: AuditOpPut, Key: []byte("k1"), Size: 5, Seq: 1, Principal: "alice"},
+		{Op: AuditOpDelete, Key: []byte("k1"), Seq: 2, Principal: "alice"},
+		{Op: AuditOpDeleteRange, Key: []byte("a"), End: []byte("z"), Seq: 3},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events after Close, got %d", len(want), len(events))
+	}
+	for i, w := range want {
+		got := events[i]
+		if got.Op != w.Op || !bytes.Equal(got.Key, w.Key) || !bytes.Equal(got.End, w.End) ||
+			got.Size != w.Size || got.Seq != w.Seq || got.Principal != w.Principal {
+			t.Errorf("Event %d = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestOperationsAfterClose(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if _, _, err := db.Get([]byte("key")); err != ErrClosed {
+		t.Errorf("Get: expected ErrClosed, got %v", err)
+	}
+	if _, err := db.Exists([]byte("key")); err != ErrClosed {
+		t.Errorf("Exists: expected ErrClosed, got %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("v")); err != ErrClosed {
+		t.Errorf("Put: expected ErrClosed, got %v", err)
+	}
+	if err := db.Delete([]byte("key")); err != ErrClosed {
+		t.Errorf("Delete: expected ErrClosed, got %v", err)
+	}
+	if err := db.DeleteRange([]byte("a"), []byte("b")); err != ErrClosed {
+		t.Errorf("DeleteRange: expected ErrClosed, got %v", err)
+	}
+	if err := db.Close(); err != ErrClosed {
+		t.Errorf("Close: expected ErrClosed, got %v", err)
+	}
+	if err := db.CloseAndFlush(); err != ErrClosed {
+		t.Errorf("CloseAndFlush: expected ErrClosed, got %v", err)
+	}
+}
+
+func TestCloseAndFlush(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	for round := 0; round < 2; round++ {
+		db, err := Open(Options{DataDir: tmpDir})
+		if err != nil {
+			t.Fatalf("Round %d: failed to open DB: %v", round, err)
+		}
+		key := []byte(fmt.Sprintf("key%d", round))
+		if err := db.Put(key, []byte("value")); err != nil {
+			t.Fatalf("Round %d: Put failed: %v", round, err)
+		}
+		if err := db.CloseAndFlush(); err != nil {
+			t.Fatalf("Round %d: CloseAndFlush failed: %v", round, err)
+		}
+		if err := db.Put(key, []byte("value")); !errors.Is(err, ErrClosed) {
+			t.Errorf("Round %d: Put after close: expected ErrClosed, got %v", round, err)
+		}
+
+		wals, err := filepath.Glob(filepath.Join(tmpDir, "*.wal"))
+		if err != nil {
+			t.Fatalf("Glob failed: %v", err)
+		}
+		if len(wals) != 0 {
+			t.Errorf("Round %d: expected no WAL left to replay, found %v", round, wals)
+		}
+	}
+
+	db, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	if n := len(db.current.files); n != 2 {
+		t.Errorf("Expected 2 SSTables, got %d", n)
+	}
+	for _, key := range []string{"key0", "key1"} {
+		if _, found, err := db.Get([]byte(key)); err != nil || !found {
+			t.Errorf("Get(%s) after reopen: found=%v err=%v", key, found, err)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	tmpDir := t.TempDir()
+	older := filepath.Join(tmpDir, "sst-0.sst")
+	writeTestSSTable(t, older, [][2]string{{"a", "1"}, {"b", "2"}})
+	if err := rewriteManifest(tmpDir, Identity{}, pathEntries([]string{older})); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	db, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	db.Get([]byte("key")) // memtable hit: no SSTable probe
+	db.Get([]byte("a"))   // one SSTable probe
+
+	s := db.Stats()
+	if s.MemtableBytes != len("key")+len("value") {
+		t.Errorf("MemtableBytes = %d", s.MemtableBytes)
+	}
+	if s.SSTableCount != 1 || len(s.Levels) != 1 || s.Levels[0].Files != 1 {
+		t.Errorf("Unexpected SSTable stats: count=%d levels=%+v", s.SSTableCount, s.Levels)
+	}
+	if st, _ := os.Stat(older); s.SSTableBytes != uint64(st.Size()) {
+		t.Errorf("SSTableBytes = %d, want %d", s.SSTableBytes, st.Size())
+	}
+	if s.UserBytesWritten != 8 {
+		t.Errorf("UserBytesWritten = %d, want 8", s.UserBytesWritten)
+	}
+	if s.WALBytesWritten <= s.UserBytesWritten {
+		t.Errorf("WALBytesWritten = %d should include record headers", s.WALBytesWritten)
+	}
+	if s.ReadAmplification != 0.5 {
+		t.Errorf("ReadAmplification = %v, want 0.5", s.ReadAmplification)
+	}
+
+	if err := db.rotateMemtable(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	db.flushWg.Wait()
+
+	s = db.Stats()
+	if s.SSTableCount != 2 || s.ImmutableMemtables != 0 || s.MemtableBytes != 0 {
+		t.Errorf("After flush: count=%d immutable=%d memtable=%d", s.SSTableCount, s.ImmutableMemtables, s.MemtableBytes)
+	}
+	if s.FlushBytesWritten == 0 || s.WriteAmplification <= 1 {
+		t.Errorf("After flush: flush bytes=%d write amp=%v", s.FlushBytesWritten, s.WriteAmplification)
+	}
+}
+
+func TestMemtableMaxEntriesRotates(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir(), MemtableMaxEntries: 4})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 4; i++ {
+		if err := db.Delete([]byte(fmt.Sprintf("key%d", i))); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	db.flushWg.Wait()
+
+	s := db.Stats()
+	if s.SSTableCount != 1 || s.MemtableEntries != 0 {
+		t.Errorf("Expected the 4th entry to rotate the memtable: sstables=%d entries=%d", s.SSTableCount, s.MemtableEntries)
+	}
+}
+
+func TestWriteStall(t *testing.T) {
+	// One worker, kept busy, so flushes queue up behind it.
+	sched := NewScheduler(1, nil)
+	release := make(chan struct{})
+	sched.Go("block", func() { <-release })
+
+	db, err := Open(Options{
+		DataDir:                 t.TempDir(),
+		MemtableMaxEntries:      2,
+		Scheduler:               sched,
+		L0SlowdownWritesTrigger: 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	put := func(k string) error { return db.Put([]byte(k), []byte("v")) }
+	// a, b fill the memtable and rotate it; c, d fill the next one, which
+	// cannot rotate while a, b wait for their flush.
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := put(k); err != nil {
+			t.Fatalf("Put(%q): %v", k, err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- put("e") }()
+	select {
+	case err := <-done:
+		t.Fatalf("Put on a full memtable returned %v while the flush was stuck", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Stalled Put: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Put stayed stalled after the flush finished")
+	}
+	db.flushWg.Wait()
+
+	// L0 now holds a file, which reaches the slowdown trigger.
+	if err := put("f"); err != nil {
+		t.Fatalf("Put(f): %v", err)
+	}
+	s := db.Stats()
+	if s.WriteStops != 1 || s.WriteSlowdowns == 0 || s.WriteStallTime < 50*time.Millisecond {
+		t.Errorf("stall stats: stops=%d slowdowns=%d time=%v", s.WriteStops, s.WriteSlowdowns, s.WriteStallTime)
+	}
+	for _, k := range []string{"a", "c", "e", "f"} {
+		if _, found, err := db.Get([]byte(k)); err != nil || !found {
+			t.Errorf("Get(%q) = %v, %v", k, found, err)
+		}
+	}
+}
+
+func TestCompactionDurationClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1700000000, 0))
+	db, err := Open(Options{DataDir: t.TempDir(), Clock: fake})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 2; i++ {
+		db.Put([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	db.compactTrigger = 2
+	db.compactWg.Add(1)
+	db.compactSSTables()
+	db.compactWg.Wait()
+	// The fake clock stood still, so the compaction took no time on it.
+	if m := db.CompactionMetrics(); m.Completed == 0 || m.TotalDuration != 0 {
+		t.Errorf("CompactionMetrics = %d completed in %v, want some in 0s", m.Completed, m.TotalDuration)
+	}
+}
+
+func TestWriteSlowdownClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1700000000, 0))
+	db, err := Open(Options{DataDir: t.TempDir(), Clock: fake, L0SlowdownWritesTrigger: 1})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	db.Put([]byte("a"), []byte("1"))
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// L0 holds a file, so the next write waits out the slowdown delay on
+	// the DB clock, however long that takes in real time.
+	done := make(chan error, 1)
+	go func() { done <- db.Put([]byte("b"), []byte("2")) }()
+	for db.Stats().WriteSlowdowns == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("Put returned %v before the slowdown delay", err)
+	default:
+	}
+	for {
+		fake.Advance(writeSlowdownDelay)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		case <-time.After(time.Millisecond):
+			continue
+		}
+		break
+	}
+	if s := db.Stats(); s.WriteSlowdowns != 1 || s.WriteStallTime < writeSlowdownDelay {
+		t.Errorf("stall stats: slowdowns=%d time=%v; want 1 and at least %v", s.WriteSlowdowns, s.WriteStallTime, writeSlowdownDelay)
+	}
+}
+
+func TestMultipleImmutableMemtables(t *testing.T) {
+	sched := NewScheduler(1, nil)
+	release := make(chan struct{})
+	sched.Go("block", func() { <-release })
+
+	dir := t.TempDir()
+	db, err := Open(Options{
+		DataDir:               dir,
+		MemtableMaxEntries:    2,
+		MaxImmutableMemtables: 3,
+		Scheduler:             sched,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	// Three memtables fill up and queue for flushing without blocking.
+	for i, kvs := range [][2][2]string{
+		{{"k1", "1"}, {"k2", "1"}},
+		{{"k1", "2"}, {"k3", "2"}},
+		{{"k1", "3"}, {"k2", ""}},
+	} {
+		for _, kv := range kvs {
+			var val []byte
+			if kv[1] != "" {
+				val = []byte(kv[1])
+			}
+			if err := db.Put([]byte(kv[0]), val); err != nil {
+				t.Fatalf("batch %d: Put(%q): %v", i, kv[0], err)
+			}
+		}
+	}
+	if s := db.Stats(); s.ImmutableMemtables != 3 || s.WriteStops != 0 {
+		t.Fatalf("immutable memtables = %d, write stops = %d", s.ImmutableMemtables, s.WriteStops)
+	}
+
+	want := map[string]string{"k1": "3", "k2": "", "k3": "2"}
+	check := func(stage string) {
+		t.Helper()
+		for k, wv := range want {
+			got, found, err := db.Get([]byte(k))
+			if err != nil || found != (wv != "") || string(got) != wv {
+				t.Errorf("%s: Get(%q) = %q, %v, %v; want %q", stage, k, got, found, err, wv)
+			}
+		}
+		it, err := db.NewIterator(IterOptions{})
+		if err != nil {
+			t.Fatalf("NewIterator: %v", err)
+		}
+		defer it.Close()
+		var keys []string
+		for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+			keys = append(keys, string(it.Key())+"="+string(it.Value()))
+		}
+		if got := fmt.Sprint(keys); got != "[k1=3 k3=2]" {
+			t.Errorf("%s: iterator saw %s", stage, got)
+		}
+	}
+	check("queued")
+
+	// The queue drains oldest first, so L0 keeps the write order.
+	close(release)
+	db.flushWg.Wait()
+	if s := db.Stats(); s.ImmutableMemtables != 0 || s.Levels[0].Files != 3 {
+		t.Fatalf("after flushing: immutable=%d L0=%d", s.ImmutableMemtables, s.Levels[0].Files)
+	}
+	check("flushed")
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	db, err = Open(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	check("reopened")
+}
+
+func TestBackup(t *testing.T) {
+	tmpDir := t.TempDir()
+	db, err := Open(Options{DataDir: filepath.Join(tmpDir, "db")})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// One key in an SSTable, one in the active memtable's WAL.
+	if err := db.Put([]byte("flushed"), []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := db.rotateMemtable(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	db.flushWg.Wait()
+	if err := db.Put([]byte("buffered"), []byte("2")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	backupDir := filepath.Join(tmpDir, "backup")
+	if err := db.Backup(backupDir); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := db.Backup(backupDir); !errors.Is(err, ErrBackupDirNotEmpty) {
+		t.Errorf("Backup into a used directory: expected ErrBackupDirNotEmpty, got %v", err)
+	}
+
+	// Writes after the backup must not leak into it.
+	if err := db.Put([]byte("later"), []byte("3")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	restored, err := Open(Options{DataDir: backupDir})
+	if err != nil {
+		t.Fatalf("Failed to open backup: %v", err)
+	}
+	defer restored.Close()
+	for k, want := range map[string]string{"flushed": "1", "buffered": "2"} {
+		if v, found, err := restored.Get([]byte(k)); err != nil || !found || string(v) != want {
+			t.Errorf("Backup Get(%s) = %q, %v, %v; want %q", k, v, found, err, want)
+		}
+	}
+	if _, found, _ := restored.Get([]byte("later")); found {
+		t.Error("Write made after Backup appeared in the backup")
+	}
+}
+
+func TestFakeClockFileNames(t *testing.T) {
+	tmpDir := t.TempDir()
+	fake := clock.NewFake(time.Unix(1700000000, 0))
+	db, err := Open(Options{DataDir: tmpDir, Clock: fake, RandSeed: 1})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// The clock never moves, yet every rotation needs a fresh WAL name.
+	for i := 0; i < 3; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := db.rotateMemtable(); err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+		db.flushWg.Wait()
+	}
+
+	const want = "active-1700000000000000002.wal" // third name handed out
+	wals, _ := filepath.Glob(filepath.Join(tmpDir, "*.wal"))
+	if len(wals) != 1 || filepath.Base(wals[0]) != want {
+		t.Errorf("Expected only %s left, got %v", want, wals)
+	}
+	for i := 0; i < 3; i++ {
+		if v, found, err := db.Get([]byte(fmt.Sprintf("key%d", i))); err != nil || !found || string(v) != "v" {
+			t.Errorf("Get(key%d) = %q, %v, %v", i, v, found, err)
+		}
+	}
+}
+
+func TestEnvSharesSyncGroupPerDevice(t *testing.T) {
+	env := NewEnv(EnvOptions{Clock: clock.NewFake(time.Unix(1700000000, 0))})
+	defer env.Close()
+
+	tmpDir := t.TempDir()
+	var dbs []*DB
+	for _, name := range []string{"a", "b"} {
+		db, err := Open(Options{DataDir: filepath.Join(tmpDir, name), Env: env})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		dbs = append(dbs, db)
+	}
+
+	// Both directories live on the same device, so their WALs share a group.
+	if n := env.SyncGroups(); n != 1 {
+		t.Fatalf("Expected 1 sync group, got %d", n)
+	}
+	group, err := env.syncGroup(tmpDir)
+	if err != nil {
+		t.Fatalf("syncGroup failed: %v", err)
+	}
+	if n := group.Writers(); n != 2 {
+		t.Errorf("Expected both WALs in the group, got %d", n)
+	}
+	if dbs[0].sched != env.sched {
+		t.Error("Expected the DB to use the Env's scheduler")
+	}
+
+	for _, db := range dbs {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+	if n := group.Writers(); n != 0 {
+		t.Errorf("Expected closed DBs to leave the group, got %d writers", n)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	tmpDir := t.TempDir()
+	db, err := Open(Options{DataDir: filepath.Join(tmpDir, "db")})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("flushed"), []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := db.rotateMemtable(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	db.flushWg.Wait()
+	if err := db.Put([]byte("buffered"), []byte("2")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	cp := filepath.Join(tmpDir, "checkpoint")
+	if err := db.Checkpoint(cp); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+
+	// SSTables are shared with the DB, not copied.
+	ssts, _ := filepath.Glob(filepath.Join(cp, "*.sst"))
+	if len(ssts) != 1 {
+		t.Fatalf("Expected 1 SSTable in the checkpoint, got %v", ssts)
+	}
+	cpInfo, _ := os.Stat(ssts[0])
+	dbInfo, _ := os.Stat(filepath.Join(tmpDir, "db", filepath.Base(ssts[0])))
+	if !os.SameFile(cpInfo, dbInfo) {
+		t.Error("Expected the checkpoint SSTable to be a hard link")
+	}
+
+	// The checkpoint diverges from the DB once opened.
+	cdb, err := Open(Options{DataDir: cp})
+	if err != nil {
+		t.Fatalf("Failed to open checkpoint: %v", err)
+	}
+	defer cdb.Close()
+	if err := cdb.Put([]byte("replica"), []byte("3")); err != nil {
+		t.Fatalf("Put to checkpoint failed: %v", err)
+	}
+	for k, want := range map[string]string{"flushed": "1", "buffered": "2"} {
+		if v, found, err := cdb.Get([]byte(k)); err != nil || !found || string(v) != want {
+			t.Errorf("Checkpoint Get(%s) = %q, %v, %v", k, v, found, err)
+		}
+	}
+	if _, found, _ := db.Get([]byte("replica")); found {
+		t.Error("Write to the checkpoint leaked into the DB")
+	}
+}
+
+func TestIncrementalBackupAndRestore(t *testing.T) {
+	tmpDir := t.TempDir()
+	db, err := Open(Options{DataDir: filepath.Join(tmpDir, "db")})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	putAndFlush := func(key string) {
+		t.Helper()
+		if err := db.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := db.rotateMemtable(); err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+		db.flushWg.Wait()
+	}
+
+	putAndFlush("k1")
+	full := filepath.Join(tmpDir, "full")
+	if _, err := db.BackupWithOptions(full, BackupOptions{}); err != nil {
+		t.Fatalf("Full backup failed: %v", err)
+	}
+
+	putAndFlush("k2")
+	incr := filepath.Join(tmpDir, "incr")
+	stats, err := db.BackupWithOptions(incr, BackupOptions{Previous: full})
+	if err != nil {
+		t.Fatalf("Incremental backup failed: %v", err)
+	}
+	if stats.Reused != 1 {
+		t.Errorf("Expected the first SSTable to be reused, got %+v", stats)
+	}
+
+	restored := filepath.Join(tmpDir, "restored")
+	if err := Restore(incr, restored); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	rdb, err := Open(Options{DataDir: restored})
+	if err != nil {
+		t.Fatalf("Failed to open restored DB: %v", err)
+	}
+	defer rdb.Close()
+	for _, k := range []string{"k1", "k2"} {
+		if _, found, err := rdb.Get([]byte(k)); err != nil || !found {
+			t.Errorf("Restored Get(%s): found=%v err=%v", k, found, err)
+		}
+	}
+
+	// A damaged backup is rejected before anything is written.
+	mf := filepath.Join(full, manifestFileName)
+	if err := os.WriteFile(mf, []byte("garbage\n"), 0o644); err != nil {
+		t.Fatalf("Failed to damage manifest: %v", err)
+	}
+	target := filepath.Join(tmpDir, "rejected")
+	if err := Restore(full, target); !errors.Is(err, ErrBackupCorrupt) {
+		t.Errorf("Expected ErrBackupCorrupt, got %v", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("Restore of a corrupt backup created %s", target)
+	}
+}
+
+func TestBlockCacheStats(t *testing.T) {
+	tmpDir := t.TempDir()
+	sst := filepath.Join(tmpDir, "sst-0.sst")
+	writeTestSSTable(t, sst, [][2]string{{"a", "1"}, {"b", "2"}})
+	if err := rewriteManifest(tmpDir, Identity{}, pathEntries([]string{sst})); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	db, err := Open(Options{DataDir: tmpDir, BlockCacheSize: 1 << 20, BlockCachePolicy: CachePolicyTinyLFU})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		if v, found, err := db.Get([]byte("a")); err != nil || !found || string(v) != "1" {
+			t.Fatalf("Get = %q, %v, %v", v, found, err)
+		}
+	}
+
+	cs := db.Stats().BlockCache
+	if cs == nil {
+		t.Fatal("Expected block cache stats")
+	}
+	if cs.Policy != CachePolicyTinyLFU || cs.Misses != 1 || cs.Hits != 2 || cs.HitRate() < 0.6 {
+		t.Errorf("Unexpected block cache stats: %+v", *cs)
+	}
+}
+
+func TestWriteThrottle(t *testing.T) {
+	var events []WriteThrottleEvent
+	fake := clock.NewFake(time.Unix(1700000000, 0))
+	wt := newWriteThrottle(fake, 10*time.Millisecond, 1000, func(ev WriteThrottleEvent) {
+		events = append(events, ev)
+	})
+
+	wt.admit(1 << 20) // healthy disk: no delay
+	for i := 0; i < 8; i++ {
+		wt.observeSync(100 * time.Millisecond)
+	}
+	if throttled, _ := wt.state(); !throttled {
+		t.Fatal("Expected throttling after slow fsyncs")
+	}
+
+	// 50 bytes at 1000 B/s from an empty bucket take 50ms.
+	done := make(chan struct{})
+	go func() {
+		wt.admit(50)
+		close(done)
+	}()
+	for fake.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("Throttled admit returned before its time")
+	default:
+	}
+	fake.Advance(50 * time.Millisecond)
+	<-done
+
+	for i := 0; i < 32; i++ {
+		wt.observeSync(0)
+	}
+	if throttled, _ := wt.state(); throttled {
+		t.Fatal("Expected throttling to stop once fsyncs are fast again")
+	}
+
+	if len(events) != 2 || !events[0].Throttled || events[1].Throttled {
+		t.Errorf("Expected start and stop events, got %+v", events)
+	}
+}
+
+func TestCompactionRateLimit(t *testing.T) {
+	rl := newRateLimiter(nil, 1000)
+	start := time.Now()
+	rl.wait(50) // 50 bytes at 1000 B/s from an empty bucket
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("Rate limited write returned after %v", waited)
+	}
+	rl.close()
+	start = time.Now()
+	rl.wait(1 << 20)
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("Closed limiter held a write for %v", waited)
+	}
+
+	db, err := Open(Options{DataDir: t.TempDir(), CompactionRateLimit: 1 << 20})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if db.writerOptions(0).BeforeWrite != nil {
+		t.Error("Flushes are rate limited without RateLimitFlushes")
+	}
+	if db.writerOptions(1).BeforeWrite == nil {
+		t.Error("Compaction outputs are not rate limited")
+	}
+	// Close must not wait for a throttled compaction to catch up.
+	db.rateLimiter.tokens = -1 << 30
+	done := make(chan struct{})
+	go func() {
+		db.rateLimiter.wait(1)
+		close(done)
+	}()
+	db.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not release a rate limited writer")
+	}
+}
+
+func TestRecoverUpToSequence(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	db, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	db.Put([]byte("k1"), []byte("v1")) // seq 1
+	db.Put([]byte("k2"), []byte("v2")) // seq 2
+	db.Put([]byte("k1"), []byte("v3")) // seq 3
+	if seq := db.LastSequence(); seq != 3 {
+		t.Fatalf("LastSequence = %d, want 3", seq)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	ro, err := Open(Options{DataDir: tmpDir, RecoverUpToSequence: 2})
+	if err != nil {
+		t.Fatalf("Failed to open at sequence 2: %v", err)
+	}
+	if val, found, _ := ro.Get([]byte("k1")); !found || string(val) != "v1" {
+		t.Errorf("k1 at sequence 2 = %q, %v; want v1", val, found)
+	}
+	if _, found, _ := ro.Get([]byte("k2")); !found {
+		t.Error("k2 should exist at sequence 2")
+	}
+	if err := ro.Put([]byte("k3"), []byte("x")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put on recovery view: expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.CloseAndFlush(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The historical open must not have touched the WAL.
+	db, err = Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if val, _, _ := db.Get([]byte("k1")); string(val) != "v3" {
+		t.Errorf("k1 after reopen = %q, want v3", val)
+	}
+	if err := db.CloseAndFlush(); err != nil {
+		t.Fatalf("CloseAndFlush failed: %v", err)
+	}
+
+	// Sequence numbers survive the WAL being flushed away...
+	db, err = Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if seq := db.LastSequence(); seq != 3 {
+		t.Errorf("LastSequence after flush = %d, want 3", seq)
+	}
+	db.Close()
+
+	// ...but a target older than flushed data can no longer be served.
+	if _, err := Open(Options{DataDir: tmpDir, RecoverUpToSequence: 2}); !errors.Is(err, ErrRecoveryTargetUnavailable) {
+		t.Errorf("Expected ErrRecoveryTargetUnavailable, got %v", err)
+	}
+}
+
+func TestFlushFailureIsFailStop(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var reported []error
+	var mu sync.Mutex
+	db, err := Open(Options{
+		DataDir:           tmpDir,
+		BackgroundRetries: -1,
+		OnBackgroundError: func(err error) {
+			mu.Lock()
+			reported = append(reported, err)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// A directory where the flush wants to create its SSTable makes it fail.
+	blocker := filepath.Join(tmpDir, "active.sst")
+	if err := os.Mkdir(blocker, 0o755); err != nil {
+		t.Fatalf("Failed to create blocker: %v", err)
+	}
+	if err := db.rotateMemtable(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	db.flushWg.Wait()
+
+	var bgErr *BackgroundError
+	if err := db.Err(); !errors.As(err, &bgErr) || bgErr.Op != BackgroundOpFlush || !bgErr.FailStop {
+		t.Fatalf("Err() = %v, want a fail-stop flush error", err)
+	}
+	mu.Lock()
+	if len(reported) != 1 {
+		t.Errorf("OnBackgroundError called %d times, want 1", len(reported))
+	}
+	mu.Unlock()
+
+	if err := db.Put([]byte("other"), []byte("v")); !errors.As(err, &bgErr) {
+		t.Errorf("Put in fail-stop mode: got %v", err)
+	}
+	if val, found, err := db.Get([]byte("key")); err != nil || !found || string(val) != "value" {
+		t.Errorf("Get in fail-stop mode = %q, %v, %v", val, found, err)
+	}
+	db.Close()
+
+	// The WAL was kept, so the data comes back once the disk is fixed.
+	os.Remove(blocker)
+	db, err = Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	if err := db.Err(); err != nil {
+		t.Errorf("Err() after reopen = %v", err)
+	}
+	if _, found, _ := db.Get([]byte("key")); !found {
+		t.Error("key lost after failed flush")
+	}
+}
+
+// tagCodec stores values as tag + value.
+type tagCodec string
+
+
+func TestFlushRetry(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// A non-empty directory where a flush wants to create its SSTable makes
+	// it fail, and survives the cleanup of the failed attempt.
+	block := func(path string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(path, "x"), 0o755); err != nil {
+			t.Fatalf("Failed to create blocker: %v", err)
+		}
+	}
+	blocker := filepath.Join(tmpDir, "active.sst")
+	block(blocker)
+
+	// The first failure clears the blocker before the retry is scheduled.
+	reported := make(chan *BackgroundError, 16)
+	var once sync.Once
+	db, err := Open(Options{
+		DataDir:              tmpDir,
+		BackgroundRetries:    2,
+		BackgroundRetryDelay: time.Millisecond,
+		OnBackgroundError: func(err error) {
+			once.Do(func() { os.RemoveAll(blocker) })
+			reported <- err.(*BackgroundError)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("key"), []byte("value"))
+	if err := db.rotateMemtable(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	db.flushWg.Wait()
+	if e := <-reported; e.Attempt != 1 || !e.Retrying || e.FailStop {
+		t.Errorf("first failure = %+v, want a retrying attempt 1", e)
+	}
+	if len(reported) != 0 {
+		t.Errorf("%d more failures reported, want the retry to succeed", len(reported))
+	}
+	if err := db.Err(); err != nil {
+		t.Fatalf("Err() after a successful retry = %v", err)
+	}
+	if n := db.Stats().SSTableCount; n != 1 {
+		t.Errorf("SSTableCount = %d, want 1", n)
+	}
+
+	// Retries run out: the last failure is fail-stop.
+	db.Put([]byte("other"), []byte("value"))
+	db.mu.Lock()
+	block(walSSTablePath(db.dataDir, db.active.WalPath()))
+	db.mu.Unlock()
+	if err := db.rotateMemtable(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	db.flushWg.Wait()
+	var last *BackgroundError
+	for n := 1; n <= 3; n++ {
+		last = <-reported
+		if last.Attempt != n || last.Retrying != (n < 3) {
+			t.Errorf("failure %d = %+v", n, last)
+		}
+	}
+	if !last.FailStop || !errors.Is(db.Err(), last.Err) {
+		t.Errorf("Err() = %v after retries ran out, want fail-stop", db.Err())
+	}
+}
+
+func TestFlushWatchdog(t *testing.T) {
+	tmpDir := t.TempDir()
+	blocker := filepath.Join(tmpDir, "active.sst")
+	if err := os.MkdirAll(filepath.Join(blocker, "x"), 0o755); err != nil {
+		t.Fatalf("Failed to create blocker: %v", err)
+	}
+
+	stalls := make(chan FlushStallEvent, 16)
+	db, err := Open(Options{
+		DataDir:           tmpDir,
+		BackgroundRetries: -1,
+		FlushStallTimeout: 20 * time.Millisecond,
+		OnFlushStall:      func(ev FlushStallEvent) { stalls <- ev },
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("key"), []byte("value"))
+	if err := db.rotateMemtable(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	db.flushWg.Wait()
+	if err := db.Put([]byte("other"), []byte("value")); err == nil {
+		t.Fatal("Put succeeded after a failed flush, want fail-stop")
+	}
+
+	// The watchdog keeps restarting the flush until the blocker is gone.
+	ev := <-stalls
+	if ev.WALPath != filepath.Join(tmpDir, "active.wal") || ev.Queued != 1 || ev.Err == nil {
+		t.Errorf("stall event = %+v", ev)
+	}
+	if ev.Stalled < 20*time.Millisecond {
+		t.Errorf("Stalled = %v, want at least the timeout", ev.Stalled)
+	}
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatalf("Failed to remove blocker: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().SSTableCount == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("memtable was never flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	db.flushWg.Wait()
+
+	if err := db.Err(); err != nil {
+		t.Fatalf("Err() after the flush went through = %v", err)
+	}
+	if err := db.Put([]byte("other"), []byte("value")); err != nil {
+		t.Fatalf("Put after recovery failed: %v", err)
+	}
+	if val, found, err := db.Get([]byte("key")); err != nil || !found || string(val) != "value" {
+		t.Errorf("Get(key) = %q, %v, %v", val, found, err)
+	}
+}
+func (c tagCodec) Encode(key, value []byte) ([]byte, error) {
+	return append([]byte(c), value...), nil
+}
+
+func (c tagCodec) Decode(key, stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, []byte(c)) {
+		return nil, fmt.Errorf("value of %q not tagged %q", key, string(c))
+	}
+	return stored[len(c):], nil
+}
+
+func TestValueCodecs(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "test-db")
+	opts := Options{
+		DataDir: tmpDir,
+		ValueCodecs: []PrefixCodec{
+			{Prefix: []byte("user:"), Codec: tagCodec("v1|")},
+			{Prefix: []byte("user:admin:"), Codec: tagCodec("secret|")},
+			{Prefix: []byte("raw:"), Codec: tagCodec("")},
+		},
+	}
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	puts := map[string]string{"user:1": "alice", "user:admin:1": "root", "plain": "raw", "user:empty": ""}
+	for k, v := range puts {
+		if err := db.Put([]byte(k), []byte(v)); err != nil {
+			t.Fatalf("Put(%q): %v", k, err)
+		}
+	}
+	stored := map[string]string{"user:1": "v1|alice", "user:admin:1": "secret|root", "plain": "raw"}
+	for k, want := range stored {
+		if got, _, _ := db.getStored([]byte(k), ReadOptions{}); string(got) != want {
+			t.Errorf("stored value of %q = %q, want %q", k, got, want)
+		}
+	}
+	// An empty encoding would be a tombstone once flushed.
+	if err := db.Put([]byte("raw:1"), []byte{}); !errors.Is(err, ErrEmptyEncoding) {
+		t.Errorf("Put with an empty encoding: expected ErrEmptyEncoding, got %v", err)
+	}
+
+	// Values go to SSTables in stored form and are decoded after reopen.
+	db.rotateMemtable()
+	db.flushWg.Wait()
+	db.Close()
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	for k, want := range puts {
+		if got, found, err := db.Get([]byte(k)); err != nil || !found || string(got) != want {
+			t.Errorf("Get(%q) = %q, %v, %v; want %q", k, got, found, err, want)
+		}
+	}
+
+	if err := db.Delete([]byte("user:1")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, found, err := db.Get([]byte("user:1")); err != nil || found {
+		t.Errorf("Get after Delete = %v, %v", found, err)
+	}
+
+	if _, err := Open(Options{DataDir: t.TempDir(), ValueCodecs: []PrefixCodec{{Prefix: []byte("a")}}}); err == nil {
+		t.Error("Open with a nil codec succeeded")
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "test-db")
+	fake := clock.NewFake(time.Unix(1700000000, 0))
+	db, err := Open(Options{DataDir: tmpDir, Clock: fake, SoftDelete: true, TrashRetention: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	key := []byte("doc")
+	if err := db.Put(key, []byte("draft")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := db.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, found, _ := db.Get(key); found {
+		t.Fatal("key visible after Delete")
+	}
+	if err := db.Undelete(key); err != nil {
+		t.Fatalf("Undelete: %v", err)
+	}
+	if val, found, err := db.Get(key); err != nil || !found || string(val) != "draft" {
+		t.Errorf("Get after Undelete = %q, %v, %v", val, found, err)
+	}
+	if err := db.Undelete(key); !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("second Undelete: expected ErrNotInTrash, got %v", err)
+	}
+
+	// Trash past its retention can no longer be restored and is dropped
+	// by compaction.
+	if err := db.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	db.rotateMemtable()
+	db.flushWg.Wait()
+	db.Put([]byte("other"), []byte("v"))
+	db.rotateMemtable()
+	db.flushWg.Wait()
+	fake.Advance(2 * time.Hour)
+	if err := db.Undelete(key); !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("Undelete after retention: expected ErrNotInTrash, got %v", err)
+	}
+	db.compactTrigger = 2
+	db.compactWg.Add(1)
+	db.compactSSTables()
+	db.compactWg.Wait()
+	if _, found, _ := db.getStored(trashKey(key), ReadOptions{}); found {
+		t.Error("expired trash entry survived compaction")
+	}
+
+	if err := db.Put(key, []byte("v2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	db.Delete(key)
+	if err := db.PurgeTrash(key); err != nil {
+		t.Fatalf("PurgeTrash: %v", err)
+	}
+	if err := db.Undelete(key); !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("Undelete after PurgeTrash: expected ErrNotInTrash, got %v", err)
+	}
+}
+
+func TestSoftDeleteAtomic(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir(), SoftDelete: true})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// The trash entry and the tombstone, and then the restored value and
+	// the trash removal, share a WAL batch record.
+	key := []byte("doc")
+	db.Put(key, []byte("draft"))
+	if err := db.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := db.Undelete(key); err != nil {
+		t.Fatalf("Undelete: %v", err)
+	}
+	if _, err := db.active.SyncWAL(); err != nil {
+		t.Fatalf("SyncWAL: %v", err)
+	}
+	var recs []wal.Record
+	if _, err := wal.ReplayFile(db.active.WalPath(), func(rec wal.Record) bool {
+		recs = append(recs, rec)
+		return true
+	}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(recs) != 5 || recs[1].BatchEnd != recs[2].Seq || recs[3].BatchEnd != recs[4].Seq {
+		t.Errorf("WAL holds %d records, want a put and two batches of two", len(recs))
+	}
+
+	// Of concurrent Undeletes, only one restores the value.
+	for i := 0; i < 50; i++ {
+		if err := db.Delete(key); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		var restored atomic.Int32
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				switch err := db.Undelete(key); {
+				case err == nil:
+					restored.Add(1)
+				case !errors.Is(err, ErrNotInTrash):
+					t.Errorf("Undelete: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := restored.Load(); n != 1 {
+			t.Fatalf("%d concurrent Undeletes restored the value, want 1", n)
+		}
+	}
+}
+
+func TestCountRange(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "test-db")
+	db, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 300; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	db.rotateMemtable()
+	db.flushWg.Wait()
+	for i := 300; i < 400; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	if n, err := db.CountRange(nil, nil); err != nil || n != 400 {
+		t.Errorf("CountRange(nil, nil) = %d, %v; want 400", n, err)
+	}
+	// key350..key399 are only in the memtable, which counts exactly.
+	if n, err := db.CountRange([]byte("key350"), []byte("key400")); err != nil || n != 50 {
+		t.Errorf("CountRange over the memtable = %d, %v; want 50", n, err)
+	}
+	if n, err := db.CountRange([]byte("key100"), []byte("key200")); err != nil || n < 100 || n > 300 {
+		t.Errorf("CountRange over the SSTable = %d, %v; want about 100", n, err)
+	}
+	if n, err := db.CountRange([]byte("b"), []byte("a")); err != nil || n != 0 {
+		t.Errorf("CountRange of an empty range = %d, %v", n, err)
+	}
+}
+
+func TestTokenIndex(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "test-db")
+	db, err := Open(Options{DataDir: tmpDir, Tokenizer: WordTokenizer})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	search := func(token string) string {
+		t.Helper()
+		keys, err := db.SearchToken(token)
+		if err != nil {
+			t.Fatalf("SearchToken(%q): %v", token, err)
+		}
+		return fmt.Sprintf("%q", keys)
+	}
+
+	db.Put([]byte("doc1"), []byte("Hello, world"))
+	db.Put([]byte("doc2"), []byte("hello there"))
+	if got := search("hello"); got != `["doc1" "doc2"]` {
+		t.Errorf("hello = %s", got)
+	}
+
+	// Postings follow updates and deletes, across a flush.
+	db.Put([]byte("doc1"), []byte("goodbye world"))
+	db.rotateMemtable()
+	db.flushWg.Wait()
+	db.Delete([]byte("doc2"))
+	if got := search("hello"); got != `[]` {
+		t.Errorf("hello after update and delete = %s", got)
+	}
+	if got := search("world"); got != `["doc1"]` {
+		t.Errorf("world = %s", got)
+	}
+
+	// A stale posting, as older versions could leave behind on a crash
+	// between the writes, is filtered out.
+	db.putStored(context.Background(), postingKey("there", []byte("doc1")), postingValue, 0)
+	if got := search("there"); got != `[]` {
+		t.Errorf("stale posting returned: %s", got)
+	}
+
+	// A key of the largest size is indexed, in one batch with its value.
+	long := bytes.Repeat([]byte("k"), db.maxKeySize)
+	db.rotateMemtable()
+	db.flushWg.Wait()
+	if err := db.Put(long, []byte("long key")); err != nil {
+		t.Fatalf("Put of a %dB key: %v", len(long), err)
+	}
+	if keys, err := db.SearchToken("long"); err != nil || len(keys) != 1 || !bytes.Equal(keys[0], long) {
+		t.Errorf("SearchToken(long) = %d keys, %v", len(keys), err)
+	}
+	if _, err := db.active.SyncWAL(); err != nil {
+		t.Fatalf("SyncWAL: %v", err)
+	}
+	var recs []wal.Record
+	if _, err := wal.ReplayFile(db.active.WalPath(), func(rec wal.Record) bool {
+		recs = append(recs, rec)
+		return true
+	}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(recs) != 3 || recs[0].BatchEnd != recs[2].Seq {
+		t.Errorf("WAL holds %d records, want the value and its two postings in one batch", len(recs))
+	}
+
+	plain, err := Open(Options{DataDir: filepath.Join(t.TempDir(), "plain")})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer plain.Close()
+	if _, err := plain.SearchToken("x"); !errors.Is(err, ErrNoTokenizer) {
+		t.Errorf("SearchToken without a tokenizer: got %v", err)
+	}
+}
+
+func TestInternalKeysRejected(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir(), SoftDelete: true, Tokenizer: WordTokenizer})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	db.Put([]byte("a"), []byte("hello"))
+	db.Put([]byte("b"), []byte("gone"))
+	db.Delete([]byte("b"))
+
+	trash := trashKey([]byte("b"))
+	posting := postingKey("hello", []byte("a"))
+	writes := map[string]func() error{
+		"Put":    func() error { return db.Put(trash, []byte("forged")) },
+		"Delete": func() error { return db.Delete(posting) },
+		"Update": func() error {
+			return db.Update(posting, func([]byte) ([]byte, error) { return nil, nil })
+		},
+		"Undelete":    func() error { return db.Undelete(trash) },
+		"PurgeTrash":  func() error { return db.PurgeTrash(trash) },
+		"DeleteRange": func() error { return db.DeleteRange(posting, []byte("z")) },
+		"Write": func() error {
+			var b WriteBatch
+			b.Put([]byte("c"), []byte("v"))
+			b.Put(trash, []byte("forged"))
+			return db.Write(&b)
+		},
+		"Write range": func() error {
+			var b WriteBatch
+			b.DeleteRange([]byte(""), trash)
+			return db.Write(&b)
+		},
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrInternalKey) {
+			t.Errorf("%s of an internal key: expected ErrInternalKey, got %v", name, err)
+		}
+	}
+	if _, found, _ := db.Get([]byte("c")); found {
+		t.Error("a batch with an internal key was written")
+	}
+
+	// A range over every user key leaves the internal keys alone.
+	if err := db.DeleteRange([]byte(""), []byte("\xff")); err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+	if _, found, _ := db.Get([]byte("a")); found {
+		t.Error("a survived DeleteRange")
+	}
+	if _, found, _ := db.getStored(posting, ReadOptions{}); !found {
+		t.Error("DeleteRange removed a posting")
+	}
+	if err := db.Undelete([]byte("b")); err != nil {
+		t.Errorf("Undelete after DeleteRange: %v", err)
+	}
+}
+
+func TestMoveAndReadOnlyOpen(t *testing.T) {
+	root := t.TempDir()
+	oldDir := filepath.Join(root, "old")
+	newDir := filepath.Join(root, "new")
+
+	db, err := Open(Options{DataDir: oldDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	db.Put([]byte("flushed"), []byte("1"))
+	db.rotateMemtable()
+	db.flushWg.Wait()
+	db.Put([]byte("logged"), []byte("2"))
+	if err := Move(oldDir, "", newDir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Move of an open DB: expected ErrLocked, got %v", err)
+	}
+	db.Close()
+
+	if err := Move(oldDir, "", newDir); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Errorf("old directory still exists: %v", err)
+	}
+	if err := os.MkdirAll(oldDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Move(oldDir, "", newDir); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Move onto an existing directory: got %v", err)
+	}
+
+	// The cross-filesystem path copies everything but the lock.
+	copied := filepath.Join(root, "copied")
+	if err := copyDataDir(newDir, copied); err != nil {
+		t.Fatalf("copyDataDir: %v", err)
+	}
+
+	for _, dir := range []string{newDir, copied} {
+		before, _ := os.ReadDir(dir)
+		db, err := Open(Options{DataDir: dir, ReadOnly: true})
+		if err != nil {
+			t.Fatalf("Open read-only %s: %v", dir, err)
+		}
+		for k, want := range map[string]string{"flushed": "1", "logged": "2"} {
+			if val, found, err := db.Get([]byte(k)); err != nil || !found || string(val) != want {
+				t.Errorf("%s: Get(%s) = %q, %v, %v", dir, k, val, found, err)
+			}
+		}
+		if err := db.Put([]byte("k"), []byte("v")); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Put on a read-only DB: got %v", err)
+		}
+		db.Close()
+		if after, _ := os.ReadDir(dir); len(after) != len(before) {
+			t.Errorf("read-only open changed %s: %d entries, then %d", dir, len(before), len(after))
+		}
+	}
+
+	if _, err := Open(Options{DataDir: filepath.Join(root, "missing"), ReadOnly: true}); err == nil {
+		t.Error("read-only Open of a missing directory succeeded")
+	}
+}
+
+func TestIterator(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "test-db")
+	db, err := Open(Options{DataDir: tmpDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		db.Put([]byte(k), []byte("old"))
+	}
+	db.rotateMemtable()
+	db.flushWg.Wait()
+	db.Put([]byte("b"), []byte("new"))
+	db.Delete([]byte("c"))
+	db.DeleteRange([]byte("d"), []byte("e"))
+	db.Put([]byte("f"), []byte("new"))
+	db.putStored(context.Background(), trashKey([]byte("x")), []byte("internal"), 0)
+
+	collect := func(opts IterOptions, reverse bool) string {
+		t.Helper()
+		it, err := db.NewIterator(opts)
+		if err != nil {
+			t.Fatalf("NewIterator: %v", err)
+		}
+		defer it.Close()
+		var got []string
+		if reverse {
+			for err = it.SeekToLast(); err == nil && it.Valid(); err = it.Prev() {
+				got = append(got, string(it.Key())+"="+string(it.Value()))
+			}
+		} else {
+			for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+				got = append(got, string(it.Key())+"="+string(it.Value()))
+			}
+		}
+		if err != nil {
+			t.Fatalf("iteration: %v", err)
+		}
+		return fmt.Sprint(got)
+	}
+
+	if got := collect(IterOptions{}, false); got != "[a=old b=new e=old f=new]" {
+		t.Errorf("forward = %s", got)
+	}
+	if got := collect(IterOptions{}, true); got != "[f=new e=old b=new a=old]" {
+		t.Errorf("reverse = %s", got)
+	}
+	bounded := IterOptions{LowerBound: []byte("b"), UpperBound: []byte("f")}
+	if got := collect(bounded, false); got != "[b=new e=old]" {
+		t.Errorf("bounded forward = %s", got)
+	}
+	if got := collect(bounded, true); got != "[e=old b=new]" {
+		t.Errorf("bounded reverse = %s", got)
+	}
+
+	it, err := db.NewIterator(IterOptions{})
+	if err != nil {
+		t.Fatalf("NewIterator: %v", err)
+	}
+	defer it.Close()
+	it.Seek([]byte("c"))
+	if string(it.Key()) != "e" {
+		t.Errorf("Seek(c) = %s, want e", it.Key())
+	}
+	it.Prev()
+	it.Prev()
+	if string(it.Key()) != "a" {
+		t.Errorf("Prev x2 from e = %s, want a", it.Key())
+	}
+	it.Next()
+	if string(it.Key()) != "b" {
+		t.Errorf("Next after Prev = %s, want b", it.Key())
+	}
+
+	// Iterating while writers insert into the active memtable.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			db.Put([]byte(fmt.Sprintf("w%03d", i)), []byte("v"))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		collect(IterOptions{}, i%2 == 0)
+	}
+	<-done
+}
+
+func TestIteratorStrictMode(t *testing.T) {
+	// misused runs f and checks it reports want, as an error or, in builds
+	// with the siltkv_assert tag, as a panic.
+	misused := func(want error, f func() error) {
+		t.Helper()
+		var err error
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err, _ = r.(error)
+					if !assertMisuse {
+						t.Fatalf("misuse panicked without siltkv_assert: %v", r)
+					}
+				}
+			}()
+			err = f()
+		}()
+		if !errors.Is(err, want) {
+			t.Errorf("misuse reported %v, want %v", err, want)
+		}
+	}
+
+	for _, strict := range []bool{false, true} {
+		db, err := Open(Options{DataDir: t.TempDir(), Strict: strict})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		db.Put([]byte("a"), []byte("1"))
+		it, err := db.NewIterator(IterOptions{})
+		if err != nil {
+			t.Fatalf("NewIterator: %v", err)
+		}
+
+		if !strict {
+			// Misuse is tolerated
+			if err := it.Next(); err != nil || it.Key() != nil || it.Err() != nil {
+				t.Errorf("lenient Next on unpositioned iterator: %v, %q, %v", err, it.Key(), it.Err())
+			}
+			it.Close()
+			if err := it.Close(); err != nil {
+				t.Errorf("lenient second Close: %v", err)
+			}
+			db.Close()
+			continue
+		}
+
+		misused(ErrIteratorInvalid, it.Next)
+		misused(ErrIteratorInvalid, func() error { it.Value(); return it.Err() })
+		if err := it.SeekToFirst(); err != nil || string(it.Key()) != "a" {
+			t.Fatalf("SeekToFirst: %v, %q", err, it.Key())
+		}
+		it.Next()
+		misused(ErrIteratorInvalid, it.Prev)
+
+		it.Close()
+		misused(ErrIteratorClosed, it.Close)
+		misused(ErrIteratorClosed, it.SeekToFirst)
+		misused(ErrIteratorClosed, func() error { return it.Seek([]byte("a")) })
+		misused(ErrIteratorClosed, it.Next)
+		db.Close()
+	}
+}
+
+func TestGetTo(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "test-db")
+	db, err := Open(Options{DataDir: tmpDir, ValueCodecs: []PrefixCodec{{Prefix: []byte("t/"), Codec: tagCodec("v1|")}}})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("disk"), []byte("on-disk"))
+	db.Put([]byte("gone"), []byte("x"))
+	db.rotateMemtable()
+	db.flushWg.Wait()
+	db.Put([]byte("mem"), []byte("in-memory"))
+	db.Put([]byte("t/coded"), []byte("plain"))
+	db.Delete([]byte("gone"))
+
+	buf := make([]byte, 0, 64)
+	for key, want := range map[string]string{"mem": "in-memory", "disk": "on-disk", "t/coded": "plain"} {
+		got, found, err := db.GetTo([]byte(key), append(buf[:0], "pre:"...))
+		if err != nil || !found || string(got) != "pre:"+want {
+			t.Errorf("GetTo(%s) = %q, %v, %v", key, got, found, err)
+		}
+		if &got[0] != &buf[:1][0] {
+			t.Errorf("GetTo(%s) did not reuse the buffer", key)
+		}
+	}
+	for _, key := range []string{"gone", "missing"} {
+		got, found, err := db.GetTo([]byte(key), append(buf[:0], "pre:"...))
+		if err != nil || found || string(got) != "pre:" {
+			t.Errorf("GetTo(%s) = %q, %v, %v", key, got, found, err)
+		}
+	}
+
+	memKey := []byte("mem")
+	allocs := testing.AllocsPerRun(100, func() {
+		db.GetTo(memKey, buf[:0])
+	})
+	if allocs != 0 {
+		t.Errorf("GetTo from memtable allocated %v times per call", allocs)
+	}
+}
+
+func TestSecondaryReader(t *testing.T) {
+	tmpDir := t.TempDir()
+	db, err := Open(Options{DataDir: tmpDir, L0CompactionTrigger: 2})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	flush := func(key, value string) {
+		t.Helper()
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+		if err := db.rotateMemtable(); err != nil {
+			t.Fatalf("Rotate: %v", err)
+		}
+		db.flushWg.Wait()
+		db.compactWg.Wait()
+	}
+	flush("a", "1")
+	db.Put([]byte("logged"), []byte("1"))
+
+	// Poll rarely so that only Refresh moves the reader forward.
+	opts := Options{DataDir: tmpDir, Secondary: true, SecondaryPollInterval: time.Hour}
+	readers := make([]*DB, 2)
+	for i := range readers {
+		if readers[i], err = Open(opts); err != nil {
+			t.Fatalf("Open secondary %d: %v", i, err)
+		}
+		defer readers[i].Close()
+	}
+	r := readers[0]
+	if v, ok, err := r.Get([]byte("a")); err != nil || !ok || string(v) != "1" {
+		t.Errorf("Get(a) = %q, %v, %v", v, ok, err)
+	}
+	if _, ok, _ := r.Get([]byte("logged")); ok {
+		t.Error("secondary read the writer's WAL")
+	}
+	if err := r.Put([]byte("b"), []byte("1")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put on secondary: expected ErrReadOnly, got %v", err)
+	}
+	if changed, err := r.Refresh(); changed || err != nil {
+		t.Errorf("Refresh of an unchanged manifest = %v, %v", changed, err)
+	}
+
+	// A pinned iterator keeps the old files while the writer compacts them away.
+	it, err := r.NewIterator(IterOptions{})
+	if err != nil {
+		t.Fatalf("NewIterator: %v", err)
+	}
+	defer it.Close()
+	if err := it.SeekToFirst(); err != nil {
+		t.Fatalf("SeekToFirst: %v", err)
+	}
+	flush("a", "2")
+	if v := db.currentVersion(); len(v.levels[1]) != 1 {
+		t.Fatalf("expected a compaction into L1, got %d files", len(v.levels[1]))
+	} else {
+		v.unref()
+	}
+	if changed, err := r.Refresh(); !changed || err != nil {
+		t.Fatalf("Refresh after compaction = %v, %v", changed, err)
+	}
+	if v, ok, err := r.Get([]byte("a")); err != nil || !ok || string(v) != "2" {
+		t.Errorf("Get(a) after refresh = %q, %v, %v", v, ok, err)
+	}
+	if v, _, _ := readers[1].Get([]byte("a")); string(v) != "1" {
+		t.Errorf("unrefreshed reader: Get(a) = %q", v)
+	}
+	if !it.Valid() || string(it.Value()) != "1" {
+		t.Errorf("pinned iterator lost its view: valid=%v value=%q", it.Valid(), it.Value())
+	}
+	// The second flush took "logged" along.
+	if r.LastSequence() != db.LastSequence() {
+		t.Errorf("LastSequence = %d, writer at %d", r.LastSequence(), db.LastSequence())
+	}
+
+	if _, err := db.Refresh(); !errors.Is(err, ErrNotSecondary) {
+		t.Errorf("Refresh on the writer: expected ErrNotSecondary, got %v", err)
+	}
+	if err := Move(tmpDir, "", tmpDir+"-moved"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Move with readers attached: expected ErrLocked, got %v", err)
+	}
+}
+
+func TestSubcompactions(t *testing.T) {
+	tmpDir := t.TempDir()
+	db, err := Open(Options{DataDir: tmpDir, L0CompactionTrigger: 4, MaxCompactionConcurrency: 4})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Flush i overwrites keys from i*20 on, so the L0 files start at
+	// different keys and the compaction can be cut between them.
+	for i := 0; i < 4; i++ {
+		for k := i * 20; k < 100; k++ {
+			if err := db.Put([]byte(fmt.Sprintf("key%03d", k)), []byte(strconv.Itoa(i))); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		if err := db.rotateMemtable(); err != nil {
+			t.Fatalf("Rotate: %v", err)
+		}
+		db.flushWg.Wait()
+	}
+	db.compactWg.Wait()
+
+	v := db.currentVersion()
+	defer v.unref()
+	l1 := v.levels[1]
+	if len(v.levels[0]) != 0 || len(l1) != 4 {
+		t.Fatalf("expected 4 subcompaction outputs in L1, got L0=%d L1=%d", len(v.levels[0]), len(l1))
+	}
+	for i := 1; i < len(l1); i++ {
+		if bytes.Compare(l1[i-1].largest, l1[i].smallest) >= 0 {
+			t.Errorf("L1 files overlap: %q >= %q", l1[i-1].largest, l1[i].smallest)
+		}
+	}
+	for k := 0; k < 100; k++ {
+		want := strconv.Itoa(min(k/20, 3))
+		if v, ok, err := db.Get([]byte(fmt.Sprintf("key%03d", k))); err != nil || !ok || string(v) != want {
+			t.Errorf("Get(key%03d) = %q, %v, %v; want %q", k, v, ok, err, want)
+		}
+	}
+}
+
+func TestCompactionPriority(t *testing.T) {
+	tmpDir := t.TempDir()
+	// write creates an SSTable of n keys from prefix, the first deleted
+	// of them as tombstones, and returns its manifest entry.
+	write := func(name string, level int, prefix string, n, deleted int) manifestEntry {
+		var kvs [][2]string
+		for i := 0; i < n; i++ {
+			v := "v"
+			if i < deleted {
+				v = ""
+			}
+			kvs = append(kvs, [2]string{fmt.Sprintf("%s%03d", prefix, i), v})
+		}
+		path := filepath.Join(tmpDir, name)
+		writeTestSSTable(t, path, kvs)
+		return manifestEntry{path: path, level: level}
+	}
+	hour := int64(time.Hour)
+	entries := []manifestEntry{
+		write("compact-1-0.sst", 2, "a", 100, 0),
+		write(fmt.Sprintf("compact-%d-0.sst", 2*hour), 1, "a", 100, 80), // mostly tombstones over a*
+		write(fmt.Sprintf("compact-%d-0.sst", 3*hour), 1, "b", 10, 0),
+		write(fmt.Sprintf("compact-%d-0.sst", 4*hour), 1, "c", 10, 0),
+	}
+	if err := rewriteManifest(tmpDir, Identity{}, entries); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	fake := clock.NewFake(time.Unix(0, 5*hour))
+	open := func(opts Options) (*DB, *version) {
+		t.Helper()
+		opts.DataDir, opts.Clock = tmpDir, fake
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		return db, db.currentVersion()
+	}
+
+	// L1 is far below its size limit, but one file is 80% tombstones.
+	db, v := open(Options{})
+	if s := db.compactionScore(v, 1); s < 1 {
+		t.Errorf("tombstone-heavy L1 scored %.2f", s)
+	}
+	c := db.pickCompaction(v)
+	if c == nil || c.level != 1 || c.inputs[0].path != entries[1].path || len(c.next) != 1 {
+		t.Errorf("expected the tombstone-heavy file merged with L2, got %+v", c)
+	}
+	v.unref()
+	db.Close()
+
+	db, v = open(Options{TombstoneCompactionRatio: -1})
+	if c := db.pickCompaction(v); c != nil {
+		t.Errorf("tombstone compaction disabled, but picked L%d", c.level)
+	}
+	v.unref()
+	db.Close()
+
+	// Over the size limit, a file that overlaps nothing below is cheaper
+	// than one that drags a large L2 file along, and the older of two
+	// such files goes first.
+	db, v = open(Options{TombstoneCompactionRatio: -1, LevelBaseSize: 1})
+	defer db.Close()
+	defer v.unref()
+	if c := db.pickCompaction(v); c == nil || c.inputs[0].path != entries[2].path || len(c.next) != 0 {
+		t.Errorf("expected the older file without overlap, got %+v", c)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	increment := func(old []byte) ([]byte, error) {
+		n := 0
+		if old != nil {
+			var err error
+			if n, err = strconv.Atoi(string(old)); err != nil {
+				return nil, err
+			}
+		}
+		return []byte(strconv.Itoa(n + 1)), nil
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := db.Update([]byte("counter"), increment); err != nil {
+					t.Errorf("Update: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _, _ := db.Get([]byte("counter")); string(v) != "800" {
+		t.Errorf("counter = %q after 800 concurrent increments", v)
+	}
+
+	errAbort := errors.New("abort")
+	if err := db.Update([]byte("counter"), func([]byte) ([]byte, error) { return []byte("x"), errAbort }); err != errAbort {
+		t.Errorf("Update returned %v, want the callback's error", err)
+	}
+	if v, _, _ := db.Get([]byte("counter")); string(v) != "800" {
+		t.Errorf("aborted Update wrote %q", v)
+	}
+	if err := db.Update([]byte("counter"), func([]byte) ([]byte, error) { return nil, nil }); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, found, _ := db.Get([]byte("counter")); found {
+		t.Error("Update returning nil should delete the key")
+	}
+	db.Update([]byte("counter"), func(old []byte) ([]byte, error) {
+		if old != nil {
+			t.Errorf("deleted key passed as %q", old)
+		}
+		return old, nil
+	})
+}
+
+func TestFlushAndCompact(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir(), L0CompactionTrigger: 2})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush of an empty DB: %v", err)
+	}
+	if s := db.Stats(); s.SSTableCount != 0 {
+		t.Errorf("empty Flush wrote %d SSTables", s.SSTableCount)
+	}
+
+	db.Put([]byte("a"), []byte("1"))
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if s := db.Stats(); s.MemtableEntries != 0 || s.ImmutableMemtables != 0 || s.Levels[0].Files != 1 {
+		t.Errorf("after Flush: %d memtable entries, %d immutables, %d L0 files",
+			s.MemtableEntries, s.ImmutableMemtables, s.Levels[0].Files)
+	}
+
+	// Tiny level limits leave work that only Compact gets done.
+	db.Put([]byte("b"), []byte("2"))
+	db.levelBaseSize, db.levelMultiplier = 1, 1
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	v := db.currentVersion()
+	if db.needsCompaction(v) || len(v.levels[numLevels-1]) != 1 {
+		t.Errorf("after Compact: %d files, %d in the last level", len(v.files), len(v.levels[numLevels-1]))
+	}
+	v.unref()
+	for k, want := range map[string]string{"a": "1", "b": "2"} {
+		if got, _, _ := db.Get([]byte(k)); string(got) != want {
+			t.Errorf("Get(%q) = %q, want %q", k, got, want)
+		}
+	}
+
+	db.Close()
+	if err := db.Flush(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Flush after Close: %v", err)
+	}
+	if err := db.Compact(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Compact after Close: %v", err)
+	}
+}
+
+func TestProfileLabels(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{DataDir: dir, ProfileLabels: map[string]string{"tenant": "acme"}})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// A goroutine dump taken from inside a background job lists the labels
+	// of that job and of the WAL sync loop.
+	done := make(chan string)
+	db.runBackground(BackgroundOpFlush, func() {
+		var buf bytes.Buffer
+		pprof.Lookup("goroutine").WriteTo(&buf, 1)
+		done <- buf.String()
+	})
+	dump := <-done
+	for _, want := range []string{
+		fmt.Sprintf("%q:%q", LabelOp, BackgroundOpFlush),
+		fmt.Sprintf("%q:%q", LabelOp, LabelOpWALSync),
+		fmt.Sprintf("%q:%q", LabelDB, dir),
+		fmt.Sprintf("%q:", LabelJob),
+		`"tenant":"acme"`,
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("goroutine profile has no label %s", want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := db.Profile(&buf, "heap"); err != nil {
+		t.Fatalf("Profile(heap): %v", err)
+	}
+	if buf.Len() == 0 {
+		t.Error("Profile(heap) wrote nothing")
+	}
+	if err := db.Profile(&buf, "nope"); err == nil {
+		t.Error("Profile accepted an unknown kind")
+	}
+}
+
+func TestOpenRemovesOrphanedFiles(t *testing.T) {
+	for _, quarantine := range []bool{false, true} {
+		t.Run(fmt.Sprintf("quarantine=%v", quarantine), func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := Open(Options{DataDir: dir})
+			if err != nil {
+				t.Fatalf("Failed to open DB: %v", err)
+			}
+			if err := db.Put([]byte("k"), []byte("v")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if err := db.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			// What a compaction that crashed before rewriting the
+			// manifest leaves behind.
+			orphan := filepath.Join(dir, "compact-1-0.sst")
+			writeTestSSTable(t, orphan, [][2]string{{"k", "stale"}})
+			tmp := manifestPath(dir) + ".tmp"
+			if err := os.WriteFile(tmp, []byte("partial"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// Read-only opens leave them alone.
+			ro, err := Open(Options{DataDir: dir, ReadOnly: true})
+			if err != nil {
+				t.Fatalf("Open read-only: %v", err)
+			}
+			ro.Close()
+			if _, err := os.Stat(orphan); err != nil {
+				t.Fatalf("read-only Open touched the orphan: %v", err)
+			}
+
+			db, err = Open(Options{DataDir: dir, QuarantineOrphans: quarantine})
+			if err != nil {
+				t.Fatalf("Failed to reopen DB: %v", err)
+			}
+			defer db.Close()
+			for _, p := range []string{orphan, tmp} {
+				if _, err := os.Stat(p); !os.IsNotExist(err) {
+					t.Errorf("%s still exists after Open: %v", filepath.Base(p), err)
+				}
+				_, err := os.Stat(filepath.Join(dir, orphanDirName, filepath.Base(p)))
+				if quarantine != (err == nil) {
+					t.Errorf("%s quarantined = %v, want %v", filepath.Base(p), err == nil, quarantine)
+				}
+			}
+			if val, found, err := db.Get([]byte("k")); err != nil || !found || string(val) != "v" {
+				t.Errorf("Get(k) = %q, %v, %v; want v", val, found, err)
+			}
+		})
+	}
+}
+
+func TestFlushCrashRecovery(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if err := db.Put([]byte("k"), []byte("v1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := db.active.SyncWAL(); err != nil {
+		t.Fatalf("SyncWAL: %v", err)
+	}
+	walData, err := os.ReadFile(db.active.WalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := db.Put([]byte("k"), []byte("v2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A crash after the first flush reached the manifest but before its WAL
+	// was deleted, under a name that no longer matches its SSTable, and one
+	// in the middle of a manifest append.
+	staleWAL := filepath.Join(dir, "active-1.wal")
+	if err := os.WriteFile(staleWAL, walData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(manifestPath(dir), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("active-99.s")
+	f.Close()
+
+	db, err = Open(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if _, err := os.Stat(staleWAL); !os.IsNotExist(err) {
+		t.Errorf("flushed WAL still exists after Open: %v", err)
+	}
+	if val, _, err := db.Get([]byte("k")); err != nil || string(val) != "v2" {
+		t.Errorf("Get(k) = %q, %v; want v2", val, err)
+	}
+	if n := db.Stats().SSTableCount; n != 2 {
+		t.Errorf("SSTableCount = %d, want 2", n)
+	}
+
+	// The torn line is gone, so the next flush appends a readable entry.
+	if err := db.Put([]byte("k2"), []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	db.Close()
+	entries, err := loadManifest(dir)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("loadManifest = %d entries, %v; want 3", len(entries), err)
+	}
+}
+
+func TestManifestFeatureGating(t *testing.T) {
+	dir := t.TempDir()
+	sst := filepath.Join(dir, "active-1.sst")
+	writeTestSSTable(t, sst, [][2]string{{"k", "v"}})
+
+	// A text manifest from before the header is read as legacy and
+	// converted by a writable Open, but not by a read-only one.
+	if err := os.WriteFile(manifestPath(dir), []byte("active-1.sst\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := Open(Options{DataDir: dir, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open read-only: %v", err)
+	}
+	ro.Close()
+	if data, _ := os.ReadFile(manifestPath(dir)); strings.HasPrefix(string(data), manifestHeaderPrefix) {
+		t.Error("read-only Open rewrote the manifest")
+	}
+	db, err := Open(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if val, _, err := db.Get([]byte("k")); err != nil || string(val) != "v" {
+		t.Errorf("Get(k) = %q, %v; want v", val, err)
+	}
+	db.Close()
+	data, err := os.ReadFile(manifestPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), manifestMagic) {
+		t.Errorf("manifest not converted:\n%q", data)
+	}
+	if entries, repair, err := readManifest(dir); err != nil || repair || len(entries) != 1 {
+		t.Errorf("readManifest = %d entries, repair %v, %v; want 1 entry", len(entries), repair, err)
+	}
+
+	// A newer engine's features are refused, and named in the error.
+	newer := fmt.Sprintf("%s\tengine=%d\tfeatures=%s,zstd-blocks\tcreated=x\nactive-1.sst\n",
+		manifestHeaderPrefix, EngineVersion+1, FeatureLevels)
+	if err := os.WriteFile(manifestPath(dir), []byte(newer), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(Options{DataDir: dir})
+	var incompat *IncompatibleError
+	if !errors.Is(err, ErrIncompatible) || !errors.As(err, &incompat) {
+		t.Fatalf("Open = %v, want an IncompatibleError", err)
+	}
+	if incompat.Engine != EngineVersion+1 || len(incompat.Features) != 1 || incompat.Features[0] != "zstd-blocks" {
+		t.Errorf("IncompatibleError = %+v", incompat)
+	}
+	if data, _ := os.ReadFile(manifestPath(dir)); string(data) != newer {
+		t.Error("refused Open modified the manifest")
+	}
+}
+
+func TestPurgeDeletedBefore(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir(), L0CompactionTrigger: 100})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.PurgeDeletedBefore(0, time.Time{}); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("PurgeDeletedBefore without a horizon = %v, want os.ErrInvalid", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("v"))
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Delete([]byte(fmt.Sprintf("key%02d", i)))
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	v := db.currentVersion()
+	horizon := v.levels[0][0].maxSeq
+	v.unref()
+
+	// Deletes after the horizon are kept.
+	for i := 10; i < 15; i++ {
+		db.Delete([]byte(fmt.Sprintf("key%02d", i)))
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if err := db.PurgeDeletedBefore(horizon, time.Time{}); err != nil {
+		t.Fatalf("PurgeDeletedBefore: %v", err)
+	}
+	v = db.currentVersion()
+	defer v.unref()
+	var kept uint64
+	for _, f := range v.files {
+		if f.maxSeq <= horizon && f.tombstones() > 0 {
+			t.Errorf("L%d file %s still holds %d tombstones", f.level, filepath.Base(f.path), f.tombstones())
+		}
+		if f.maxSeq > horizon {
+			kept += f.tombstones()
+		}
+	}
+	if kept != 5 {
+		t.Errorf("%d tombstones after the horizon, want 5", kept)
+	}
+	for i := 0; i < 20; i++ {
+		_, found, err := db.Get([]byte(fmt.Sprintf("key%02d", i)))
+		if err != nil || found != (i >= 15) {
+			t.Errorf("Get(key%02d) found = %v, %v", i, found, err)
+		}
+	}
+}
+
+func TestManifestLog(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{DataDir: dir, L0CompactionTrigger: 100})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v"))
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	before, err := os.Stat(manifestPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A compaction is one record appended to the same file.
+	db.compactTrigger = 2
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	after, err := os.Stat(manifestPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) || after.Size() <= before.Size() {
+		t.Errorf("compaction rewrote the manifest instead of appending to it")
+	}
+	live := db.Stats().SSTableCount
+	db.Close()
+
+	entries, repair, err := readManifest(dir)
+	if err != nil || !repair || len(entries) != live {
+		t.Fatalf("readManifest = %d entries, repair %v, %v; want %d entries to fold", len(entries), repair, err, live)
+	}
+
+	// A record cut short is ignored; a bad checksum before the end is not.
+	data, err := os.ReadFile(manifestPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := append(slices.Clone(data), encodeManifestRecord([]byte{editTagDelete, 1, 'x'})[:6]...)
+	if err := os.WriteFile(manifestPath(dir), torn, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := readManifest(dir); err != nil || len(got) != live {
+		t.Errorf("torn manifest: %d entries, %v; want %d", len(got), err, live)
+	}
+	corrupt := slices.Clone(data)
+	corrupt[len(manifestMagic)+manifestRecordHeaderSize] ^= 0xff
+	if err := os.WriteFile(manifestPath(dir), corrupt, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(Options{DataDir: dir}); !errors.Is(err, ErrManifestCorrupt) {
+		t.Errorf("Open with a corrupt manifest = %v, want ErrManifestCorrupt", err)
+	}
+
+	// Reopening folds the log into a single snapshot.
+	if err := os.WriteFile(manifestPath(dir), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	if got, repair, err := readManifest(dir); err != nil || repair || len(got) != live {
+		t.Errorf("after reopen: %d entries, repair %v, %v; want a %d-entry snapshot", len(got), repair, err, live)
+	}
+	for i := 0; i < 3; i++ {
+		if _, found, err := db.Get([]byte(fmt.Sprintf("key%d", i))); err != nil || !found {
+			t.Errorf("Get(key%d) = %v, %v", i, found, err)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{DataDir: dir, L0CompactionTrigger: 100})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("old"))
+		db.Put([]byte("shared"), []byte(fmt.Sprintf("v%d", i)))
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	inputs, _ := filepath.Glob(filepath.Join(dir, "active*.sst"))
+	saved := make(map[string][]byte)
+	for _, p := range inputs {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved[p] = data
+	}
+	db.compactTrigger = len(inputs)
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	db.Put([]byte("key0"), []byte("new"))
+	db.Delete([]byte("key1"))
+	db.Close()
+
+	// A crash left all but one input of the compaction behind, plus a
+	// table that is garbage, and the manifest is gone.
+	slices.Sort(inputs)
+	for _, p := range inputs[1:] {
+		if err := os.WriteFile(p, saved[p], 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bad.sst"), []byte("not a table"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(manifestPath(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(Options{DataDir: dir}); !errors.Is(err, ErrManifestMissing) {
+		t.Fatalf("Open without manifest = %v, want ErrManifestMissing", err)
+	}
+
+	res, err := Repair(dir, "")
+	if err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+	if len(res.Corrupt) != 1 || res.Corrupt[0] != "bad.sst" {
+		t.Errorf("Corrupt = %v", res.Corrupt)
+	}
+	if len(res.Superseded) != len(inputs)-1 {
+		t.Errorf("Superseded = %v, want the %d restored inputs", res.Superseded, len(inputs)-1)
+	}
+	if _, err := os.Stat(filepath.Join(dir, orphanDirName, "bad.sst")); err != nil {
+		t.Errorf("corrupt table not moved aside: %v", err)
+	}
+
+	db, err = Open(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Open after Repair: %v", err)
+	}
+	defer db.Close()
+	want := map[string]string{"key0": "new", "key2": "old", "shared": "v2"}
+	for k, v := range want {
+		if got, found, err := db.Get([]byte(k)); err != nil || !found || string(got) != v {
+			t.Errorf("Get(%s) = %q, %v, %v; want %q", k, got, found, err, v)
+		}
+	}
+	if _, found, _ := db.Get([]byte("key1")); found {
+		t.Error("deleted key1 came back")
+	}
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 2; i++ {
+		db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if err := db.VerifyIntegrity(); err != nil {
+		t.Fatalf("VerifyIntegrity on intact files: %v", err)
+	}
+
+	// Flip the last byte before the footer of one file, which no block
+	// checksum covers.
+	v := db.currentVersion()
+	r := v.files[0].reader
+	footer := r.Footer()
+	off := r.Size() - footer.Size() - 1
+	v.unref()
+	f, err := os.OpenFile(r.Path(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, off)
+	f.WriteAt([]byte{b[0] ^ 1}, off)
+	f.Close()
+
+	if err := db.VerifyIntegrity(); !errors.Is(err, sstable.ErrFileChecksumMismatch) {
+		t.Errorf("VerifyIntegrity = %v, want ErrFileChecksumMismatch", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"status":"active","roles":["reader","writer"],"region":"eu-west-1"}`, i))
+	}
+	tableBytes := func(c Compression) int64 {
+		t.Helper()
+		dir := t.TempDir()
+		db, err := Open(Options{DataDir: dir, Compression: c})
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		for i := 0; i < 500; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("user:%04d", i)), value(i)); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		if db, err = Open(Options{DataDir: dir}); err != nil {
+			t.Fatalf("Failed to reopen DB: %v", err)
+		}
+		defer db.Close()
+		for _, i := range []int{0, 250, 499} {
+			if val, found, err := db.Get([]byte(fmt.Sprintf("user:%04d", i))); err != nil || !found || !bytes.Equal(val, value(i)) {
+				t.Errorf("%s: Get(user:%04d) = %q, %v, %v", c, i, val, found, err)
+			}
+		}
+		if err := db.VerifyIntegrity(); err != nil {
+			t.Errorf("%s: VerifyIntegrity: %v", c, err)
+		}
+		var total int64
+		v := db.currentVersion()
+		for _, r := range v.readers() {
+			total += r.Size()
+		}
+		v.unref()
+		return total
+	}
+
+	plain := tableBytes(NoCompression)
+	for _, c := range []Compression{SnappyCompression, ZstdCompression} {
+		if n := tableBytes(c); n*2 > plain {
+			t.Errorf("%s tables take %d bytes, uncompressed %d", c, n, plain)
+		}
+	}
+}
+
+func TestRowCache(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{DataDir: dir, RowCacheSize: 64 << 10})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	get := func(key string) string {
+		t.Helper()
+		val, found, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+		if !found {
+			return "<none>"
+		}
+		return string(val)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if got := get("key3"); got != "v3" {
+		t.Fatalf("Get(key3) = %s, want v3", got)
+	}
+	if rs := db.Stats().RowCache; rs == nil || rs.Hits != 1 || rs.Entries != 10 {
+		t.Fatalf("after Puts and a Get: %+v", rs)
+	}
+
+	// Overwrites, deletes and range deletes must not leave old values behind.
+	if err := db.Put([]byte("key3"), []byte("new")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := db.Delete([]byte("key4")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := db.DeleteRange([]byte("key6"), []byte("key8")); err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+	for key, want := range map[string]string{"key3": "new", "key4": "<none>", "key5": "v5", "key6": "<none>", "key7": "<none>", "key8": "v8"} {
+		if got := get(key); got != want {
+			t.Errorf("Get(%s) = %s, want %s", key, got, want)
+		}
+	}
+	if rs := db.Stats().RowCache; rs.Invalidations != 4 {
+		t.Errorf("Invalidations = %d, want 4", rs.Invalidations)
+	}
+
+	// Gets fill the cache with what they read from SSTables.
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if db, err = Open(Options{DataDir: dir, RowCacheSize: 64 << 10}); err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	get("key1")
+	get("key1")
+	if rs := db.Stats().RowCache; rs.Hits != 1 || rs.Misses != 1 || rs.Entries != 1 {
+		t.Errorf("after two Gets of a flushed key: %+v", rs)
+	}
+
+	// The size, overhead included, stays within the capacity.
+	big := bytes.Repeat([]byte("x"), 1000)
+	for i := 0; i < 200; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("big%03d", i)), big); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	rs := db.Stats().RowCache
+	if rs.Size > rs.Capacity || rs.Evictions == 0 {
+		t.Errorf("after filling the cache: %+v", rs)
+	}
+	if got := get("big000"); got != string(big) {
+		t.Errorf("Get(big000) after eviction = %d bytes", len(got))
+	}
+
+	// Readers racing a writer never see a value older than one they saw.
+	var wg sync.WaitGroup
+	const writes = 2000
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := -1
+			for last < writes-1 {
+				val, found, err := db.Get([]byte("counter"))
+				if err != nil {
+					t.Errorf("Get: %v", err)
+					return
+				}
+				if !found {
+					continue
+				}
+				n, _ := strconv.Atoi(string(val))
+				if n < last {
+					t.Errorf("Get(counter) = %d after %d", n, last)
+					return
+				}
+				last = n
+			}
+		}()
+	}
+	for i := 0; i < writes; i++ {
+		if err := db.Put([]byte("counter"), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestTablePropertiesSkipFiles(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1700000000, 0))
+	db, err := Open(Options{DataDir: t.TempDir(), Clock: fake})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 20; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%s%02d", prefix, i)), []byte("v")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	v := db.currentVersion()
+	for _, r := range v.readers() {
+		props, err := r.Properties()
+		if err != nil {
+			t.Fatalf("Properties: %v", err)
+		}
+		if props[sstable.PropCreationTime] != strconv.FormatInt(fake.Now().UnixNano(), 10) {
+			t.Errorf("%s: creation time %s", r.Path(), props[sstable.PropCreationTime])
+		}
+		if props[sstable.PropSmallestKey][1:] != "00" || props[sstable.PropLargestKey][1:] != "19" {
+			t.Errorf("%s: key bounds %s, %s", r.Path(), props[sstable.PropSmallestKey], props[sstable.PropLargestKey])
+		}
+	}
+	v.unref()
+
+	// An iterator over one file's range only opens that file.
+	it, err := db.NewIterator(IterOptions{LowerBound: []byte("b"), UpperBound: []byte("c")})
+	if err != nil {
+		t.Fatalf("NewIterator: %v", err)
+	}
+	defer it.Close()
+	if n := len(it.layers) - len(db.memtables()); n != 1 {
+		t.Errorf("iterator over [b, c) opened %d SSTables, want 1", n)
+	}
+	n := 0
+	for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+		n++
+	}
+	if err != nil || n != 20 {
+		t.Errorf("iterated %d keys, %v; want 20", n, err)
+	}
+	// Partly covered blocks count in full.
+	if c, err := db.CountRange([]byte("b05"), []byte("b10")); err != nil || c != 20 {
+		t.Errorf("CountRange(b05, b10) = %d, %v; want 20", c, err)
+	}
+}
+
+func TestGetSkipsL0FilesByRange(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir(), L0CompactionTrigger: 100})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for _, prefix := range []string{"a", "b", "c", "d"} {
+		for i := 0; i < 10; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%s%d", prefix, i)), []byte("v")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if s := db.Stats(); s.Levels[0].Files != 4 {
+		t.Fatalf("L0 holds %d files, want 4", s.Levels[0].Files)
+	}
+
+	// One file holds b5; none holds e0. Neither lookup touches the others'
+	// bloom filters.
+	if _, found, err := db.Get([]byte("b5")); err != nil || !found {
+		t.Fatalf("Get(b5) = %v, %v", found, err)
+	}
+	if _, found, err := db.Get([]byte("e0")); err != nil || found {
+		t.Fatalf("Get(e0) = %v, %v", found, err)
+	}
+	s := db.Stats()
+	if s.ReadAmplification != 0.5 {
+		t.Errorf("ReadAmplification = %v, want 0.5", s.ReadAmplification)
+	}
+	if s.BloomChecks != 1 {
+		t.Errorf("BloomChecks = %d, want 1", s.BloomChecks)
+	}
+}
+
+func TestFileDeletionHold(t *testing.T) {
+	dir := t.TempDir()
+	fake := clock.NewFake(time.Unix(1700000000, 0))
+	db, err := Open(Options{DataDir: dir, Clock: fake, ObsoleteFileGracePeriod: time.Hour, L0CompactionTrigger: 3})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	flush := func(prefix string) {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%s%d", prefix, i)), []byte("v")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		db.flushWg.Wait() // the WAL goes after Flush returns
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	// The grace period keeps the flushed WAL until a later deletion finds
+	// it due.
+	walPath := db.active.WalPath()
+	flush("a")
+	if !exists(walPath) || db.Stats().ObsoleteFilesPending != 1 {
+		t.Fatalf("flushed WAL deleted within the grace period")
+	}
+	fake.Advance(time.Hour)
+	flush("b")
+	if exists(walPath) {
+		t.Errorf("flushed WAL kept past the grace period")
+	}
+
+	// A hold keeps the inputs of a compaction past the grace period.
+	fake.Advance(time.Hour)
+	v := db.currentVersion()
+	var inputs []string
+	for _, r := range v.readers() {
+		inputs = append(inputs, r.Path())
+	}
+	v.unref()
+	hold := db.HoldFileDeletions("test")
+	fake.Advance(time.Hour)
+	flush("c") // the third L0 file starts a compaction
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	fake.Advance(time.Hour)
+	flush("d") // deletes what is due
+	for _, path := range inputs {
+		if !exists(path) {
+			t.Errorf("%s deleted during a hold", path)
+		}
+	}
+	if s := db.Stats(); s.FileDeletionHolds != 1 || s.ObsoleteFilesPending < len(inputs) {
+		t.Errorf("during the hold: %d holds, %d pending", s.FileDeletionHolds, s.ObsoleteFilesPending)
+	}
+	hold.Release()
+	hold.Release()
+	for _, path := range inputs {
+		if exists(path) {
+			t.Errorf("%s kept after the hold was released", path)
+		}
+	}
+	if s := db.Stats(); s.FileDeletionHolds != 0 {
+		t.Errorf("%d holds after Release", s.FileDeletionHolds)
+	}
+
+	// Close deletes what only the grace period keeps.
+	walPath = db.active.WalPath()
+	flush("e")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if exists(walPath) {
+		t.Errorf("flushed WAL left behind by Close")
+	}
+}
+
+func TestAdminHistory(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{DataDir: dir, MemtableMaxEntries: 500})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if err := db.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	backupDir := filepath.Join(t.TempDir(), "backup")
+	if err := db.Backup(backupDir); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	// A failed operation is recorded with its error.
+	if err := db.Checkpoint(dir); err == nil {
+		t.Fatalf("Checkpoint into the data directory succeeded")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// Nothing is recorded for a closed DB.
+	db.Compact()
+	if _, err := Repair(dir, ""); err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+
+	recs, err := ReadAdminHistory(dir)
+	if err != nil {
+		t.Fatalf("ReadAdminHistory: %v", err)
+	}
+	var ops []AdminOp
+	for _, r := range recs {
+		ops = append(ops, r.Op)
+	}
+	if got := fmt.Sprint(ops); got != "[open compact backup checkpoint repair]" {
+		t.Fatalf("ops = %s", got)
+	}
+	if !strings.Contains(recs[0].Detail, "MemtableMaxEntries=500") || strings.Contains(recs[0].Detail, dir) {
+		t.Errorf("open detail = %q", recs[0].Detail)
+	}
+	if recs[1].Err != "" || recs[1].Time.IsZero() {
+		t.Errorf("compact record = %+v", recs[1])
+	}
+	if recs[2].Detail != "dir="+backupDir {
+		t.Errorf("backup detail = %q", recs[2].Detail)
+	}
+	if recs[3].Err == "" {
+		t.Errorf("failed checkpoint recorded without its error")
+	}
+	if recs[4].Detail != "tables=1 superseded=0 corrupt=0" {
+		t.Errorf("repair detail = %q", recs[4].Detail)
+	}
+
+	// Read-only opens record nothing; the history survives reopening.
+	ro, err := Open(Options{DataDir: dir, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open read-only: %v", err)
+	}
+	if recs, err := ro.AdminHistory(); err != nil || len(recs) != 5 {
+		t.Errorf("AdminHistory = %d records, %v; want 5", len(recs), err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := ro.AdminHistory(); !errors.Is(err, ErrClosed) {
+		t.Errorf("AdminHistory after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestScanInto(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Half the keys in an SSTable, half in the memtable, some deleted.
+	for i := 0; i < 2500; i++ {
+		if i == 1250 {
+			if err := db.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+		}
+		if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	for i := 0; i < 2500; i += 10 {
+		if err := db.Delete([]byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+
+	buf := &ResultBuffer{MaxRows: 500}
+	var pages, rows int
+	for start := []byte("key00100"); ; {
+		if err := db.ScanInto(start, []byte("key02400"), buf); err != nil {
+			t.Fatalf("ScanInto: %v", err)
+		}
+		pages++
+		for i := 0; i < buf.Len(); i++ {
+			want := 101 + rows + rows/9 // every tenth key is deleted
+			if k, v := string(buf.Key(i)), string(buf.Value(i)); k != fmt.Sprintf("key%05d", want) || v != fmt.Sprintf("value%d", want) {
+				t.Fatalf("page %d row %d = %s=%s, want key%05d", pages, i, k, v, want)
+			}
+			rows++
+		}
+		if start = buf.NextKey(); start == nil {
+			break
+		}
+	}
+	if pages != 5 || rows != 2070 {
+		t.Errorf("scan took %d pages of %d rows, want 5 pages of 2070", pages, rows)
+	}
+
+	// MaxBytes ends a page early, but never before its first pair.
+	buf = &ResultBuffer{MaxBytes: 40}
+	if err := db.ScanInto([]byte("key00001"), nil, buf); err != nil {
+		t.Fatalf("ScanInto: %v", err)
+	}
+	if buf.Len() != 2 || string(buf.NextKey()) != "key00003" {
+		t.Errorf("page of 40 bytes holds %d pairs up to %q", buf.Len(), buf.NextKey())
+	}
+	buf.MaxBytes = 1
+	if err := db.ScanInto(nil, nil, buf); err != nil || buf.Len() != 1 {
+		t.Errorf("page of 1 byte holds %d pairs, %v", buf.Len(), err)
+	}
+
+	// Once the buffer has grown, a page costs a few allocations, not a few
+	// per row.
+	buf = &ResultBuffer{}
+	allocs := testing.AllocsPerRun(10, func() {
+		if err := db.ScanInto(nil, nil, buf); err != nil {
+			t.Fatalf("ScanInto: %v", err)
+		}
+	})
+	if buf.Len() != 1000 || allocs > 100 {
+		t.Errorf("page of %d rows took %.0f allocations", buf.Len(), allocs)
+	}
+}
+
+func TestObsoleteFileDeletionRetry(t *testing.T) {
+	dir := t.TempDir()
+	fake := clock.NewFake(time.Unix(1700000000, 0))
+	db, err := Open(Options{DataDir: dir, Clock: fake})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	// Deletions fail as they do on Windows while another process has the
+	// file open.
+	var mu sync.Mutex
+	inUse := true
+	db.deleter.remove = func(path string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if inUse {
+			return &os.PathError{Op: "remove", Path: path, Err: errors.New("file in use")}
+		}
+		return os.Remove(path)
+	}
+	flush := func(key string) {
+		t.Helper()
+		if err := db.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		db.flushWg.Wait()
+	}
+
+	walPath := db.active.WalPath()
+	flush("a")
+	if s := db.Stats(); s.ObsoleteFilesPending != 1 || s.ObsoleteFileDeleteFailures != 1 {
+		t.Fatalf("after a failed deletion: %d pending, %d failures", s.ObsoleteFilesPending, s.ObsoleteFileDeleteFailures)
+	}
+	// The file was renamed so it no longer passes for a WAL.
+	if _, err := os.Stat(walPath); !os.IsNotExist(err) {
+		t.Errorf("undeletable WAL left under its name: %v", err)
+	}
+	if _, err := os.Stat(walPath + obsoleteSuffix); err != nil {
+		t.Errorf("undeletable WAL not renamed: %v", err)
+	}
+
+	// The retry waits for its backoff, then succeeds once the file is free.
+	mu.Lock()
+	inUse = false
+	mu.Unlock()
+	flush("b")
+	if s := db.Stats(); s.ObsoleteFilesPending != 1 {
+		t.Errorf("retried before the backoff: %d pending", s.ObsoleteFilesPending)
+	}
+	fake.Advance(obsoleteRetryDelay)
+	flush("c")
+	if s := db.Stats(); s.ObsoleteFilesPending != 0 {
+		t.Errorf("after the backoff: %d pending", s.ObsoleteFilesPending)
+	}
+	if _, err := os.Stat(walPath + obsoleteSuffix); !os.IsNotExist(err) {
+		t.Errorf("renamed WAL left behind: %v", err)
+	}
+
+	// What Close cannot delete, the next Open does.
+	mu.Lock()
+	inUse = true
+	mu.Unlock()
+	walPath = db.active.WalPath()
+	flush("d")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(walPath + obsoleteSuffix); err != nil {
+		t.Fatalf("undeletable WAL not left for Open: %v", err)
+	}
+	if db, err = Open(Options{DataDir: dir, Clock: fake}); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if _, err := os.Stat(walPath + obsoleteSuffix); !os.IsNotExist(err) {
+		t.Errorf("Open left the renamed WAL behind: %v", err)
+	}
+	if val, found, err := db.Get([]byte("d")); err != nil || !found || string(val) != "v" {
+		t.Errorf("Get(d) after reopen = %q, %v, %v", val, found, err)
+	}
+}
+
+func TestFullKeyIndex(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{DataDir: dir, FullKeyIndex: true}
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	flush := func() {
+		t.Helper()
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		db.flushWg.Wait()
+	}
+	for i := 0; i < 200; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("v1-%d", i))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	flush()
+	for i := 0; i < 200; i += 2 {
+		if err := db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("v2-%d", i))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := db.Delete([]byte("key005")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := db.DeleteRange([]byte("key100"), []byte("key110")); err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+	flush()
+
+	want := func(i int) (string, bool) {
+		switch {
+		case i == 5, i >= 100 && i < 110:
+			return "", false
+		case i%2 == 0:
+			return fmt.Sprintf("v2-%d", i), true
+		default:
+			return fmt.Sprintf("v1-%d", i), true
+		}
+	}
+	check := func(stage string) {
+		t.Helper()
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			wantVal, wantFound := want(i)
+			val, found, err := db.Get([]byte(key))
+			if err != nil || found != wantFound || string(val) != wantVal {
+				t.Fatalf("%s: Get(%s) = %q, %v, %v; want %q, %v", stage, key, val, found, err, wantVal, wantFound)
+			}
+		}
+		// Absent keys read no SSTable, not even a bloom filter.
+		before := db.Stats()
+		probes := atomic.LoadUint64(&db.io.sstProbes)
+		for i := 0; i < 50; i++ {
+			if _, found, err := db.Get([]byte(fmt.Sprintf("missing%03d", i))); err != nil || found {
+				t.Fatalf("%s: Get(missing%03d) = %v, %v", stage, i, found, err)
+			}
+		}
+		if after := db.Stats(); after.BloomChecks != before.BloomChecks {
+			t.Errorf("%s: absent keys checked %d bloom filters", stage, after.BloomChecks-before.BloomChecks)
+		}
+		if n := atomic.LoadUint64(&db.io.sstProbes) - probes; n != 0 {
+			t.Errorf("%s: absent keys probed %d SSTables", stage, n)
+		}
+	}
+	check("after flushes")
+	// Both versions of the even keys, the point tombstone and the keys
+	// under the range tombstone are indexed.
+	if n := db.Stats().KeyIndexEntries; n != 200 {
+		t.Errorf("KeyIndexEntries = %d, want 200", n)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	check("after compaction")
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if db, err = Open(opts); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	check("after reopen")
+}
+
+func TestCompactionDeferredForDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	fake := clock.NewFake(time.Unix(1_700_000_000, 0))
+	var mu sync.Mutex
+	var events []CompactionDeferredEvent
+	db, err := Open(Options{
+		DataDir:             dir,
+		Clock:               fake,
+		L0CompactionTrigger: 2,
+		OnCompactionDeferred: func(ev CompactionDeferredEvent) {
+			mu.Lock()
+			events = append(events, ev)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// The disk has room for the reserve but not for the outputs as well.
+	free := uint64(defaultCompactionFreeSpaceReserve + 100)
+	db.diskFree = func(string) (uint64, bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return free, true, nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%d", i)), bytes.Repeat([]byte("v"), 1000)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		db.flushWg.Wait()
+	}
+
+	if err := db.Compact(); !errors.Is(err, ErrCompactionDeferred) {
+		t.Fatalf("Compact with a full disk = %v, want ErrCompactionDeferred", err)
+	}
+	m := db.CompactionMetrics()
+	if m.Deferred == 0 || m.Completed != 0 {
+		t.Errorf("metrics after deferral: %d deferred, %d completed", m.Deferred, m.Completed)
+	}
+	mu.Lock()
+	if len(events) == 0 {
+		t.Fatal("no CompactionDeferredEvent")
+	}
+	ev := events[0]
+	mu.Unlock()
+	if ev.Level != 0 || ev.Inputs != 2 || ev.FreeBytes != free || ev.NeededBytes <= ev.FreeBytes {
+		t.Errorf("event = %+v", ev)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "compact-*.sst")); len(matches) != 0 {
+		t.Errorf("deferred compaction wrote %v", matches)
+	}
+
+	// Once space is freed, the compaction runs after the delay.
+	mu.Lock()
+	free = 1 << 40
+	mu.Unlock()
+	for i := 0; i < 100 && db.CompactionMetrics().Completed == 0; i++ {
+		fake.Advance(compactionDeferDelay)
+		time.Sleep(10 * time.Millisecond)
+	}
+	db.compactWg.Wait()
+	if m := db.CompactionMetrics(); m.Completed == 0 {
+		t.Errorf("deferred compaction never ran: %+v", m)
+	}
+	for i := 0; i < 2; i++ {
+		if _, found, err := db.Get([]byte(fmt.Sprintf("key%d", i))); err != nil || !found {
+			t.Errorf("Get(key%d) = %v, %v", i, found, err)
+		}
+	}
+}
+
+func TestGetFailsOnCorruptSSTable(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	oldPath := filepath.Join(tmpDir, "old.sst")
+	newPath := filepath.Join(tmpDir, "new.sst")
+	footPath := filepath.Join(tmpDir, "foot.sst")
+	writeTestSSTable(t, oldPath, [][2]string{{"a", "old"}})
+	writeTestSSTable(t, newPath, [][2]string{{"a", "new"}})
+	writeTestSSTable(t, footPath, [][2]string{{"z", "1"}})
+	if err := rewriteManifest(tmpDir, Identity{}, pathEntries([]string{oldPath, newPath, footPath})); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	// Flip a byte of the newer table's only data block, and cut the footer
+	// off the last.
+	data, err := os.ReadFile(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0xff
+	if err := os.WriteFile(newPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(footPath, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var reported []*BackgroundError
+	db, err := Open(Options{DataDir: tmpDir, OnBackgroundError: func(err error) {
+		mu.Lock()
+		reported = append(reported, err.(*BackgroundError))
+		mu.Unlock()
+	}})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if val, found, err := db.Get([]byte("a")); !errors.Is(err, sstable.ErrCorruptBlock) {
+		t.Fatalf("Get over a corrupt block = %q, %v, %v; want ErrCorruptBlock", val, found, err)
+	}
+	if _, err := db.Exists([]byte("a")); !errors.Is(err, sstable.ErrChecksumMismatch) {
+		t.Errorf("Exists over a corrupt block: %v, want ErrChecksumMismatch", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reported) != 3 {
+		t.Fatalf("got %d background errors, want 3: %v", len(reported), reported)
+	}
+	if e := reported[0]; e.Op != BackgroundOpRead || e.Path != footPath || !errors.Is(e, sstable.ErrCorruptFooter) {
+		t.Errorf("Open reported %v, want the footer of %s", e, footPath)
+	}
+	for _, e := range reported[1:] {
+		if e.Op != BackgroundOpRead || e.Path != newPath || e.FailStop || !errors.Is(e, sstable.ErrCorruptBlock) {
+			t.Errorf("read reported %v, want the block of %s", e, newPath)
+		}
+	}
+	if db.Err() != nil {
+		t.Errorf("corruption put the DB into fail-stop mode: %v", db.Err())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.EndTrace(); err != ErrNoTrace {
+		t.Errorf("EndTrace without a trace = %v, want ErrNoTrace", err)
+	}
+	var buf bytes.Buffer
+	if err := db.StartTrace(&buf, TraceOptions{}); err != nil {
+		t.Fatalf("StartTrace: %v", err)
+	}
+	if err := db.StartTrace(io.Discard, TraceOptions{}); err != ErrTraceActive {
+		t.Errorf("second StartTrace = %v, want ErrTraceActive", err)
+	}
+	db.Put([]byte("alpha"), []byte("value"))
+	db.Get([]byte("alpha"))
+	db.Delete([]byte("alpha"))
+	db.DeleteRange([]byte("b"), []byte("c"))
+	it, err := db.NewIterator(IterOptions{LowerBound: []byte("lower")})
+	if err != nil {
+		t.Fatalf("NewIterator: %v", err)
+	}
+	it.Close()
+	if err := db.EndTrace(); err != nil {
+		t.Fatalf("EndTrace: %v", err)
+	}
+	db.Get([]byte("untraced"))
+
+	tr, err := NewTraceReader(&buf)
+	if err != nil {
+		t.Fatalf("NewTraceReader: %v", err)
+	}
+	want := []struct {
+		op        TraceOp
+		key       string
+		valueSize int
+	}{
+		{TraceOpPut, "alpha", 5},
+		{TraceOpGet, "alpha", 0},
+		{TraceOpDelete, "alpha", 0},
+		{TraceOpDeleteRange, "b", 0},
+		{TraceOpScan, "lower", 0},
+	}
+	var recs []TraceRecord
+	for {
+		rec, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != len(want) {
+		t.Fatalf("got %d records, want %d: %+v", len(recs), len(want), recs)
+	}
+	for i, w := range want {
+		h := fnv.New64a()
+		h.Write([]byte(w.key))
+		rec := recs[i]
+		if rec.Op != w.op || rec.KeyHash != h.Sum64() || rec.KeySize != len(w.key) || rec.ValueSize != w.valueSize {
+			t.Errorf("record %d = %+v, want %s of %q with %d value bytes", i, rec, w.op, w.key, w.valueSize)
+		}
+		if i > 0 && rec.Time < recs[i-1].Time {
+			t.Errorf("record %d at %s, before the previous one", i, rec.Time)
+		}
+	}
+	if k := recs[0].Key(); len(k) != 5 || !bytes.Equal(k, recs[1].Key()) || bytes.Equal(k, recs[3].Key()) {
+		t.Errorf("replay keys %q, %q, %q", k, recs[1].Key(), recs[3].Key())
+	}
+
+	// Sampled: every third operation
+	buf.Reset()
+	db.StartTrace(&buf, TraceOptions{SampleEvery: 3})
+	for i := 0; i < 9; i++ {
+		db.Get([]byte{byte(i)})
+	}
+	db.EndTrace()
+	tr, err = NewTraceReader(&buf)
+	if err != nil {
+		t.Fatalf("NewTraceReader: %v", err)
+	}
+	n := 0
+	for _, err := tr.Next(); err == nil; _, err = tr.Next() {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("sampled trace has %d records, want 3", n)
+	}
+
+	if _, err := NewTraceReader(bytes.NewReader([]byte("not a trace file"))); err != ErrBadTrace {
+		t.Errorf("NewTraceReader on garbage = %v, want ErrBadTrace", err)
+	}
+}
+
+func TestRangeSeq(t *testing.T) {
+	var bgErrs atomic.Int32
+	db, err := Open(Options{DataDir: t.TempDir(), OnBackgroundError: func(error) { bgErrs.Add(1) }})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		db.Put([]byte(k), []byte("v"+k))
+	}
+	db.Flush()
+	db.Put([]byte("b"), []byte("new"))
+
+	var got []string
+	for kv, err := range db.Range(context.Background(), []byte("b"), []byte("d")) {
+		if err != nil {
+			t.Fatalf("Range(b, d): %v", err)
+		}
+		got = append(got, string(kv.Key)+"="+string(kv.Value))
+	}
+	if !slices.Equal(got, []string{"b=new", "c=vc"}) {
+		t.Errorf("Range(b, d) = %v", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got = got[:0]
+	var last error
+	for kv, err := range db.All(ctx) {
+		if last = err; err == nil {
+			got = append(got, string(kv.Key))
+		}
+		cancel()
+	}
+	if !slices.Equal(got, []string{"a"}) || !errors.Is(last, context.Canceled) {
+		t.Errorf("All after cancel = %v, %v; want the first key, then context.Canceled", got, last)
+	}
+
+	// Every loop closed its iterator, so nothing pins the old version
+	db.mu.RLock()
+	refs := atomic.LoadInt32(&db.current.refs)
+	db.mu.RUnlock()
+	if refs != 1 {
+		t.Errorf("current version has %d refs after the loops, want 1", refs)
+	}
+
+	db.Close()
+	for kv, err := range db.All(context.Background()) {
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("All on a closed DB = %q, %v; want ErrClosed", kv.Key, err)
+		}
+	}
+	if n := bgErrs.Load(); n != 0 {
+		t.Errorf("%d background errors, want none", n)
+	}
+
+	// A read error ends the sequence with it.
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bad.sst")
+	writeTestSSTable(t, path, [][2]string{{"a", "1"}})
+	if err := rewriteManifest(dir, Identity{}, pathEntries([]string{path})); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	last = nil
+	for _, err := range db.All(context.Background()) {
+		last = err
+	}
+	if !errors.Is(last, sstable.ErrCorruptBlock) {
+		t.Errorf("All over a corrupt block ended with %v, want ErrCorruptBlock", last)
+	}
+}
+
+func TestDBIdentity(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	db, err := Open(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	id := db.ID()
+	if len(id.ID) != 36 || id.ID[14] != '4' || id.EngineVersion != EngineVersion || time.Since(id.Created) > time.Minute {
+		t.Errorf("new DB has identity %+v", id)
+	}
+	db.Put([]byte("k"), []byte("v"))
+	db.Flush()
+	cp := filepath.Join(t.TempDir(), "checkpoint")
+	if err := db.Checkpoint(cp); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	db.Close()
+
+	// The identity follows the directory through a move, and the
+	// checkpoint describes the same DB.
+	moved := filepath.Join(t.TempDir(), "moved")
+	if err := Move(dir, "", moved); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	for _, d := range []string{moved, cp} {
+		db, err := Open(Options{DataDir: d})
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", d, err)
+		}
+		if got := db.ID(); got.ID != id.ID || !got.Created.Equal(id.Created) || got.EngineVersion != id.EngineVersion {
+			t.Errorf("%s has identity %+v, want %+v", d, got, id)
+		}
+		db.Close()
+	}
+
+	other, err := Open(Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if other.ID().ID == id.ID {
+		t.Error("two new DBs share an identity")
+	}
+	other.Close()
+
+	// Repair keeps the identity the old manifest starts with
+	if _, err := Repair(moved, ""); err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+	if _, got, _, err := readManifestIdentity(moved); err != nil || got.ID != id.ID {
+		t.Errorf("identity after Repair = %+v, %v; want %s", got, err, id.ID)
+	}
+
+	// A manifest from before identities gets one on the first writable Open
+	old := t.TempDir()
+	if err := rewriteManifest(old, Identity{}, nil); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	ro, err := Open(Options{DataDir: old, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open read-only: %v", err)
+	}
+	if !ro.ID().IsZero() {
+		t.Errorf("read-only Open gave an old manifest identity %+v", ro.ID())
+	}
+	ro.Close()
+	db, err = Open(Options{DataDir: old})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	assigned := db.ID()
+	db.Close()
+	if _, got, _, err := readManifestIdentity(old); err != nil || assigned.IsZero() || got.ID != assigned.ID {
+		t.Errorf("identity given to an old manifest %+v, stored %+v, %v", assigned, got, err)
+	}
+}
+
+func TestConfiguredKeyValueSizes(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte("k"), 1024)
+	value := bytes.Repeat([]byte("v"), 64*1024)
+
+	db, err := Open(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if err := db.Put(key, []byte("v")); !errors.Is(err, wal.ErrInvalidSize) {
+		t.Errorf("Put of a 1KB key with default limits: got %v, want wal.ErrInvalidSize", err)
+	}
+	db.Close()
+
+	opts := Options{DataDir: dir, MaxKeySize: 2048, MaxValueSize: 128 * 1024}
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if err := db.Put(key, value); err != nil {
+		t.Fatalf("Put within configured limits: %v", err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	// The second key stays in the WAL and is replayed on reopen.
+	key2 := bytes.Repeat([]byte("j"), 1024)
+	if err := db.Put(key2, value); err != nil {
+		t.Fatalf("Put within configured limits: %v", err)
+	}
+	db.Close()
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	for _, k := range [][]byte{key, key2} {
+		got, found, err := db.Get(k)
+		if err != nil || !found || !bytes.Equal(got, value) {
+			t.Errorf("Get of a %dB key: %d bytes, found %v, err %v", len(k), len(got), found, err)
+		}
+	}
+}
+
+func TestSoftDeleteMaxSizes(t *testing.T) {
+	for _, opts := range []Options{
+		{SoftDelete: true},
+		{SoftDelete: true, MaxKeySize: wal.KeySizeLimit, MaxValueSize: wal.ValueSizeLimit},
+	} {
+		opts.DataDir = t.TempDir()
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		key := bytes.Repeat([]byte("k"), db.maxKeySize)
+		value := bytes.Repeat([]byte("v"), db.maxValueSize)
+		if err := db.Put(append(key, 'k'), []byte("v")); !errors.Is(err, wal.ErrInvalidSize) {
+			t.Errorf("Put of a %dB key: got %v, want wal.ErrInvalidSize", len(key)+1, err)
+		}
+		if err := db.Put(key, value); err != nil {
+			t.Fatalf("Put of a %dB key and %dB value: %v", len(key), len(value), err)
+		}
+		// The trash entry is longer than both, and must be written anyway.
+		if err := db.Delete(key); err != nil {
+			t.Fatalf("Delete of a %dB key: %v", len(key), err)
+		}
+		if err := db.Undelete(key); err != nil {
+			t.Fatalf("Undelete of a %dB key: %v", len(key), err)
+		}
+		if got, found, err := db.Get(key); err != nil || !found || !bytes.Equal(got, value) {
+			t.Errorf("Get after Undelete: %d bytes, found %v, err %v", len(got), found, err)
+		}
+		db.Close()
+	}
+}
+
+func TestValueLog(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{DataDir: dir, ValueLogThreshold: 1024, ValueLogFileSize: 64 << 10}
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	value := func(i, gen int) []byte {
+		return bytes.Repeat([]byte{byte('a' + (i+gen)%26)}, 16<<10)
+	}
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	const n = 40
+	for i := 0; i < n; i++ {
+		if err := db.Put(key(i), value(i, 0)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := db.Put([]byte("small"), []byte("inline")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	s := db.Stats()
+	if s.ValueLogFiles < 2 || s.ValueLogBytes < n*16<<10 || s.SSTableBytes > 16<<10 {
+		t.Errorf("after flush: %d blob files, %d blob bytes, %d SSTable bytes", s.ValueLogFiles, s.ValueLogBytes, s.SSTableBytes)
+	}
+
+	// Overwrite most values, so that the older blob files are mostly
+	// garbage. An iterator opened before the collection keeps reading the
+	// values it pinned.
+	for i := 0; i < n; i++ {
+		if i%4 != 0 {
+			if err := db.Put(key(i), value(i, 1)); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+	}
+	it, err := db.NewIterator(IterOptions{})
+	if err != nil {
+		t.Fatalf("NewIterator: %v", err)
+	}
+	before := db.Stats().ValueLogBytes
+	gc, err := db.CollectValueLog(0.5)
+	if err != nil {
+		t.Fatalf("CollectValueLog: %v", err)
+	}
+	if gc.FilesCollected == 0 || gc.ValuesMoved == 0 || gc.BytesReclaimed == 0 {
+		t.Errorf("CollectValueLog: %+v", gc)
+	}
+	if after := db.Stats().ValueLogBytes; after >= before {
+		t.Errorf("value log holds %d bytes after collection, %d before", after, before)
+	}
+	count := 0
+	for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+		count++
+	}
+	if err != nil || count != n+1 {
+		t.Errorf("iterator from before the collection: %d keys, err %v", count, err)
+	}
+	it.Close()
+
+	check := func(db *DB) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			want := value(i, 1)
+			if i%4 == 0 {
+				want = value(i, 0)
+			}
+			got, found, err := db.Get(key(i))
+			if err != nil || !found || !bytes.Equal(got, want) {
+				t.Fatalf("Get(%s): %d bytes, found %v, err %v", key(i), len(got), found, err)
+			}
+		}
+		if got, _, _ := db.Get([]byte("small")); string(got) != "inline" {
+			t.Fatalf("Get(small) = %q", got)
+		}
+	}
+	check(db)
+
+	backup := filepath.Join(t.TempDir(), "backup")
+	if err := db.Backup(backup); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	db.Close()
+
+	// The directory keeps its value log without the option.
+	db, err = Open(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	check(db)
+	db.Close()
+
+	restored := filepath.Join(t.TempDir(), "restored")
+	if err := Restore(backup, restored); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	db, err = Open(Options{DataDir: restored})
+	if err != nil {
+		t.Fatalf("Failed to open restored DB: %v", err)
+	}
+	check(db)
+	db.Close()
+
+	// A directory with data written without a value log cannot get one.
+	plain := t.TempDir()
+	db, err = Open(Options{DataDir: plain})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	db.Put([]byte("k"), []byte("v"))
+	if _, err := db.CollectValueLog(0); !errors.Is(err, ErrNoValueLog) {
+		t.Errorf("CollectValueLog without a value log: got %v, want ErrNoValueLog", err)
+	}
+	db.Close()
+	if _, err := Open(Options{DataDir: plain, ValueLogThreshold: 1024}); !errors.Is(err, ErrNoValueLog) {
+		t.Errorf("Open of a plain directory with ValueLogThreshold: got %v, want ErrNoValueLog", err)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	db, err := Open(Options{DataDir: tmpDir, Tokenizer: WordTokenizer})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	db.Put([]byte("a"), []byte("red apple")) // seq 1
+	db.Put([]byte("c"), []byte("x"))         // seq 2
+
+	var b WriteBatch
+	b.Put([]byte("a"), []byte("green apple"))
+	b.Put([]byte("b"), []byte("blue"))
+	b.DeleteRange([]byte("c"), []byte("d"))
+	b.Put([]byte("b"), []byte("blue berry"))
+	b.Delete([]byte("missing"))
+	if b.Len() != 5 {
+		t.Fatalf("Len = %d, want 5", b.Len())
+	}
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var bad WriteBatch
+	bad.Put([]byte("z"), []byte("1"))
+	bad.DeleteRange([]byte("y"), []byte("x"))
+	if err := db.Write(&bad); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+	if err := db.Write(&WriteBatch{}); err != nil {
+		t.Errorf("Empty batch: %v", err)
+	}
+
+	check := func(db *DB, when string) {
+		t.Helper()
+		for key, want := range map[string]string{"a": "green apple", "b": "blue berry", "c": "", "z": ""} {
+			val, found, err := db.Get([]byte(key))
+			if err != nil || found != (want != "") || string(val) != want {
+				t.Errorf("%s: Get(%q) = %q, %v, %v; want %q", when, key, val, found, err, want)
+			}
+		}
+		for token, want := range map[string]string{"apple": "a", "green": "a", "red": "", "berry": "b"} {
+			keys, err := db.SearchToken(token)
+			if err != nil {
+				t.Fatalf("%s: SearchToken(%q): %v", when, token, err)
+			}
+			if (want == "") != (len(keys) == 0) || (want != "" && (len(keys) != 1 || string(keys[0]) != want)) {
+				t.Errorf("%s: SearchToken(%q) = %q, want %q", when, token, keys, want)
+			}
+		}
+	}
+	check(db, "before reopen")
+	last := db.LastSequence()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	db, err = Open(Options{DataDir: tmpDir, Tokenizer: WordTokenizer})
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	check(db, "after reopen")
+	db.Close()
+
+	// A recovery target inside the batch leaves all of it out.
+	ro, err := Open(Options{DataDir: tmpDir, RecoverUpToSequence: last - 1})
+	if err != nil {
+		t.Fatalf("Failed to open at sequence %d: %v", last-1, err)
+	}
+	defer ro.Close()
+	if val, _, _ := ro.Get([]byte("a")); string(val) != "red apple" {
+		t.Errorf("a before the batch = %q, want %q", val, "red apple")
+	}
+	if _, found, _ := ro.Get([]byte("b")); found {
+		t.Error("b should not exist before the batch")
+	}
+	if _, found, _ := ro.Get([]byte("c")); !found {
+		t.Error("c should exist before the batch")
+	}
+}
+
+func TestWriteBatchSoftDelete(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir(), SoftDelete: true, MaxValueSize: 64})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	db.Put([]byte("a"), []byte("old"))
+	db.Put([]byte("b"), []byte("old"))
+
+	// A rejected batch leaves no trash behind.
+	var b WriteBatch
+	b.Delete([]byte("a"))
+	b.Put([]byte("big"), bytes.Repeat([]byte("v"), 65))
+	if err := db.Write(&b); !errors.Is(err, wal.ErrInvalidSize) {
+		t.Fatalf("Write with an oversized value: expected wal.ErrInvalidSize, got %v", err)
+	}
+	if _, found, _ := db.getStored(trashKey([]byte("a")), ReadOptions{}); found {
+		t.Error("a rejected batch moved a value to the trash")
+	}
+
+	// A delete trashes the value the batch itself wrote before it, and
+	// nothing for a key the batch already deleted.
+	b.Reset()
+	b.Put([]byte("a"), []byte("new"))
+	b.Delete([]byte("a"))
+	b.DeleteRange([]byte("b"), []byte("c"))
+	b.Delete([]byte("b"))
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Undelete([]byte("a")); err != nil {
+		t.Fatalf("Undelete(a): %v", err)
+	}
+	if val, _, _ := db.Get([]byte("a")); string(val) != "new" {
+		t.Errorf("a after Undelete = %q, want %q", val, "new")
+	}
+	if err := db.Undelete([]byte("b")); !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("Undelete(b): expected ErrNotInTrash, got %v", err)
+	}
+}
+
+func TestWriteBatchTooLarge(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir(), MaxBatchSize: 1 << 10})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	var b WriteBatch
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 9; i++ {
+		b.Put([]byte(fmt.Sprintf("key%d", i)), value)
+	}
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("Write of %d bytes: %v", 9*(4+100+batchOpOverhead), err)
+	}
+	b.Put([]byte("key9"), value)
+	if err := db.Write(&b); !errors.Is(err, ErrBatchTooLarge) {
+		t.Fatalf("Write over MaxBatchSize: expected ErrBatchTooLarge, got %v", err)
+	}
+	if _, found, _ := db.Get([]byte("key9")); found {
+		t.Error("part of a rejected batch was written")
+	}
+}
+
+func TestWALCompression(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := Options{DataDir: tmpDir, WALCompression: true, MaxValueSize: 8 << 10}
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	value := bytes.Repeat([]byte(`{"status":"ok","items":[]}`), 200)
+	const n = 200
+	for i := 0; i < n; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	var walBytes int64
+	matches, _ := filepath.Glob(filepath.Join(tmpDir, "*.wal"))
+	for _, m := range matches {
+		if fi, err := os.Stat(m); err == nil {
+			walBytes += fi.Size()
+		}
+	}
+	if walBytes == 0 || walBytes > n*int64(len(value))/10 {
+		t.Errorf("WAL holds %d bytes for %d bytes of values", walBytes, n*len(value))
+	}
+
+	// The log is read back with or without the option.
+	opts.WALCompression = false
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < n; i++ {
+		got, found, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if err != nil || !found || !bytes.Equal(got, value) {
+			t.Fatalf("Get(key%03d) = %d bytes, %v, %v", i, len(got), found, err)
+		}
+	}
+}
+
+func TestWALArchiveReplayTo(t *testing.T) {
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "db")
+	archiveDir := filepath.Join(dir, "archive")
+	db, err := Open(Options{DataDir: dataDir, WALArchiveDir: archiveDir})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	put := func(k, v string) {
+		t.Helper()
+		if err := db.Put([]byte(k), []byte(v)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	put("a", "1") // seq 1
+	put("b", "1") // seq 2
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	backupDir := filepath.Join(dir, "backup")
+	if err := db.Backup(backupDir); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	put("a", "2") // seq 3
+	var b WriteBatch
+	b.Put([]byte("c"), []byte("1"))
+	b.Delete([]byte("b"))
+	if err := db.Write(&b); err != nil { // seq 4-5
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	put("a", "3") // seq 6
+	if err := db.CloseAndFlush(); err != nil {
+		t.Fatalf("CloseAndFlush: %v", err)
+	}
+	names, _ := filepath.Glob(filepath.Join(archiveDir, "*.wal"))
+	if len(names) != 3 || filepath.Base(names[0]) != archiveWALName(1, 2) {
+		t.Fatalf("archive holds %q", names)
+	}
+
+	check := func(dir string, want map[string]string) {
+		t.Helper()
+		db, err := Open(Options{DataDir: dir})
+		if err != nil {
+			t.Fatalf("Open %s: %v", dir, err)
+		}
+		defer db.Close()
+		for k, w := range want {
+			v, found, err := db.Get([]byte(k))
+			if err != nil || found != (w != "") || string(v) != w {
+				t.Errorf("%s: Get(%q) = %q, %v, %v; want %q", filepath.Base(dir), k, v, found, err, w)
+			}
+		}
+	}
+
+	// From the backup, to a target inside the batch, which is left out.
+	restored := filepath.Join(dir, "restored")
+	if err := Restore(backupDir, restored); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if last, err := ReplayTo(restored, archiveDir, PointInTime{Sequence: 4}); err != nil || last != 3 {
+		t.Fatalf("ReplayTo = %d, %v; want 3", last, err)
+	}
+	check(restored, map[string]string{"a": "2", "b": "1", "c": ""})
+	// Rolling on continues from there, with the same sequence numbers.
+	if last, err := ReplayTo(restored, archiveDir, PointInTime{Sequence: 100}); err != nil || last != 6 {
+		t.Fatalf("ReplayTo = %d, %v; want 6", last, err)
+	}
+	check(restored, map[string]string{"a": "3", "b": "", "c": "1"})
+
+	// From nothing, with the archive alone.
+	rebuilt := filepath.Join(dir, "rebuilt")
+	if last, err := ReplayTo(rebuilt, archiveDir, PointInTime{Time: time.Now()}); err != nil || last != 6 {
+		t.Fatalf("ReplayTo = %d, %v; want 6", last, err)
+	}
+	check(rebuilt, map[string]string{"a": "3", "b": "", "c": "1"})
+
+	// A missing archive file is a gap.
+	if err := os.Remove(names[0]); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := ReplayTo(filepath.Join(dir, "gap"), archiveDir, PointInTime{Sequence: 6}); !errors.Is(err, ErrArchiveGap) {
+		t.Errorf("Expected ErrArchiveGap, got %v", err)
+	}
+
+	vlogDir := filepath.Join(dir, "vlog-db")
+	if db, err := Open(Options{DataDir: vlogDir, ValueLogThreshold: 1024}); err != nil {
+		t.Fatalf("Open: %v", err)
+	} else {
+		db.Close()
+	}
+	if _, err := Open(Options{DataDir: vlogDir, WALArchiveDir: archiveDir}); !errors.Is(err, ErrArchiveValueLog) {
+		t.Errorf("Expected ErrArchiveValueLog, got %v", err)
+	}
+}
+
+func TestTailWAL(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{DataDir: filepath.Join(dir, "db"), WALArchiveDir: filepath.Join(dir, "archive")})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	put := func(db *DB, k, v string) {
+		t.Helper()
+		if err := db.Put([]byte(k), []byte(v)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	// Stands in for the periodic sync, which makes the records durable.
+	sync := func(db *DB) {
+		t.Helper()
+		db.mu.RLock()
+		mt := db.active
+		db.mu.RUnlock()
+		if _, err := mt.SyncWAL(); err != nil {
+			t.Fatalf("SyncWAL: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	expect := func(tail *WALTail, seq uint64, key, value string) {
+		t.Helper()
+		rec, err := tail.Next(ctx)
+		if err != nil || rec.Seq != seq || string(rec.Key) != key || string(rec.Value) != value || (rec.Value == nil) != (value == "") {
+			t.Fatalf("Next = %d %q=%q, %v; want %d %q=%q", rec.Seq, rec.Key, rec.Value, err, seq, key, value)
+		}
+	}
+
+	put(db, "a", "1") // seq 1
+	put(db, "b", "1") // seq 2
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	put(db, "a", "2") // seq 3
+	var b WriteBatch
+	b.Put([]byte("c"), []byte("1"))
+	b.Delete([]byte("b"))
+	if err := db.Write(&b); err != nil { // seq 4-5
+		t.Fatalf("Write: %v", err)
+	}
+	sync(db)
+
+	// Record 2 comes from the archive, the rest from the active WAL.
+	tail, err := db.TailWAL(2)
+	if err != nil {
+		t.Fatalf("TailWAL: %v", err)
+	}
+	defer tail.Close()
+	expect(tail, 2, "b", "1")
+	expect(tail, 3, "a", "2")
+	expect(tail, 4, "c", "1")
+	expect(tail, 5, "b", "")
+
+	// Caught up, Next waits for the next durable record.
+	short, stop := context.WithTimeout(ctx, 50*time.Millisecond)
+	if _, err := tail.Next(short); err != context.DeadlineExceeded {
+		t.Fatalf("Next with nothing to read: %v; want deadline exceeded", err)
+	}
+	stop()
+	put(db, "d", "1") // seq 6
+	sync(db)
+	expect(tail, 6, "d", "1")
+
+	// Without an archive, flushed records are gone.
+	other, err := Open(Options{DataDir: filepath.Join(dir, "other")})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	put(other, "x", "1")
+	if err := other.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	put(other, "y", "1")
+	sync(other)
+	gap, _ := other.TailWAL(1)
+	defer gap.Close()
+	if _, err := gap.Next(ctx); !errors.Is(err, ErrWALTailGap) {
+		t.Fatalf("Next past flushed records: %v; want ErrWALTailGap", err)
+	}
+	oldest, _ := other.TailWAL(0)
+	defer oldest.Close()
+	expect(oldest, 2, "y", "1")
+	other.Close()
+	if _, err := oldest.Next(ctx); err != ErrClosed {
+		t.Fatalf("Next after Close: %v; want ErrClosed", err)
+	}
+}
+
+func TestWALErrorFailStop(t *testing.T) {
+	reported := make(chan *BackgroundError, 4)
+	db, err := Open(Options{DataDir: t.TempDir(), OnBackgroundError: func(err error) { reported <- err.(*BackgroundError) }})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// The WAL of the next active memtable fails every fsync.
+	errDisk := errors.New("disk failed")
+	db.mu.Lock()
+	db.memOpts.BeforeWALSync = func() error { return errDisk }
+	err = db.rotateMemtableLocked()
+	db.mu.Unlock()
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if err := db.Put([]byte("b"), []byte("1")); err != nil {
+		t.Fatalf("Put before the sync: %v", err)
+	}
+
+	// The periodic sync fails, and the DB stops taking writes.
+	select {
+	case e := <-reported:
+		if e.Op != BackgroundOpWAL || !e.FailStop || !errors.Is(e, errDisk) {
+			t.Fatalf("reported %+v; want a fail-stop WAL error", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("WAL sync error not reported")
+	}
+	if err := db.Err(); !errors.Is(err, errDisk) {
+		t.Fatalf("Err = %v; want %v", err, errDisk)
+	}
+	if err := db.Put([]byte("c"), []byte("1")); !errors.Is(err, errDisk) {
+		t.Fatalf("Put after the failure: %v; want %v", err, errDisk)
+	}
+	if s := db.Stats(); !strings.Contains(s.FailStopReason, errDisk.Error()) {
+		t.Errorf("FailStopReason = %q", s.FailStopReason)
+	}
+	for _, k := range []string{"a", "b"} {
+		if _, found, err := db.Get([]byte(k)); !found || err != nil {
+			t.Errorf("Get(%q) = %v, %v; reads should keep working", k, found, err)
+		}
+	}
+}
+
+func TestWALDir(t *testing.T) {
+	dataDir, walDir := t.TempDir(), filepath.Join(t.TempDir(), "wal")
+	opts := Options{DataDir: dataDir, WALDir: walDir}
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if err := db.Put([]byte("flushed"), []byte("1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := db.Put([]byte("logged"), []byte("2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// The WAL dir is locked along with the data dir.
+	if _, err := Open(Options{DataDir: t.TempDir(), WALDir: walDir}); !errors.Is(err, ErrLocked) {
+		t.Errorf("Open sharing the WAL dir: expected ErrLocked, got %v", err)
+	}
+
+	// And so are Repair and Move.
+	if _, err := Repair(t.TempDir(), walDir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Repair sharing the WAL dir: expected ErrLocked, got %v", err)
+	}
+
+	if wals, _ := filepath.Glob(filepath.Join(walDir, "*.wal")); len(wals) == 0 {
+		t.Errorf("no WAL in the WAL dir")
+	}
+	if wals, _ := filepath.Glob(filepath.Join(dataDir, "*.wal")); len(wals) != 0 {
+		t.Errorf("WALs in the data dir: %v", wals)
+	}
+	if ssts, _ := filepath.Glob(filepath.Join(dataDir, "*.sst")); len(ssts) == 0 {
+		t.Errorf("no SSTable in the data dir")
+	}
+
+	// A checkpoint puts the WALs next to its SSTables, and opens without
+	// a WAL dir.
+	cpDir := filepath.Join(t.TempDir(), "cp")
+	if err := db.Checkpoint(cpDir); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	check := func(o Options) {
+		t.Helper()
+		db, err := Open(o)
+		if err != nil {
+			t.Fatalf("Open(%+v): %v", o, err)
+		}
+		for _, k := range []string{"flushed", "logged"} {
+			if _, found, err := db.Get([]byte(k)); !found || err != nil {
+				t.Errorf("Open(%+v): Get(%q) = %v, %v", o, k, found, err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	check(Options{DataDir: cpDir})
+
+	// Repair leaves the WALs in the WAL dir for the next Open.
+	res, err := Repair(dataDir, walDir)
+	if err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+	if len(res.WALs) != 1 || filepath.Dir(res.WALs[0]) != db.walDir {
+		t.Errorf("Repair found WALs %v, want one in %s", res.WALs, db.walDir)
+	}
+	check(opts)
+
+	// Move takes the WALs along, so the moved DB needs no WAL dir.
+	movedDir := filepath.Join(t.TempDir(), "moved")
+	if err := Move(dataDir, walDir, movedDir); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if wals, _ := filepath.Glob(filepath.Join(walDir, "*.wal")); len(wals) != 0 {
+		t.Errorf("WALs left in the WAL dir after Move: %v", wals)
+	}
+	check(Options{DataDir: movedDir})
+}
+
+func TestCloseReturnsWALError(t *testing.T) {
+	db, err := Open(Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	errDisk := errors.New("disk failed")
+	db.mu.Lock()
+	db.memOpts.BeforeWALSync = func() error { return errDisk }
+	err = db.rotateMemtableLocked()
+	db.mu.Unlock()
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	db.Put([]byte("a"), []byte("1"))
+
+	// The final sync of the WAL fails; Close must not report success.
+	if err := db.Close(); !errors.Is(err, errDisk) {
+		t.Errorf("Close = %v; want %v", err, errDisk)
+	}
+}
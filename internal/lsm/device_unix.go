@@ -0,0 +1,21 @@
+//go:build unix
+
+package lsm
+
+import (
+	"os"
+	"syscall"
+)
+
+// deviceID returns the ID of the device holding dir.
+func deviceID(dir string) (uint64, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return 0, err
+	}
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, nil
+	}
+	return uint64(sys.Dev), nil
+}
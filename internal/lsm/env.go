@@ -0,0 +1,104 @@
+package lsm
+
+import (
+	"sync"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/clock"
+	"github.com/return2faye/SiltKV/internal/wal"
+)
+
+// Env holds resources shared by the DBs of one process: the background
+// Scheduler and, per storage device, a WAL SyncGroup. DBs opened with the
+// same Env on the same device have their periodic WAL fsyncs batched into
+// one window per interval instead of each running its own ticker.
+type Env struct {
+	sched        *Scheduler
+	clock        clock.Clock
+	syncInterval time.Duration
+	syncJitter   time.Duration
+
+	mu     sync.Mutex
+	groups map[uint64]*wal.SyncGroup // by device ID
+}
+
+// EnvOptions configures an Env. The zero value gives the defaults.
+type EnvOptions struct {
+	// Scheduler runs flushes and compactions for every DB in the Env.
+	// Nil uses DefaultScheduler().
+	Scheduler *Scheduler
+
+	// WALSyncInterval is the period of the per-device sync windows
+	// (default 1s). WALSyncJitter bounds a random per-device phase so that
+	// devices do not all sync at the same instant (default a tenth of the
+	// interval; negative disables it).
+	WALSyncInterval time.Duration
+	WALSyncJitter   time.Duration
+
+	// Clock drives the sync windows. Nil uses the wall clock.
+	Clock clock.Clock
+}
+
+// NewEnv creates an Env. Pass it in Options.Env to every DB that should share it.
+func NewEnv(opts EnvOptions) *Env {
+	e := &Env{
+		sched:        opts.Scheduler,
+		clock:        opts.Clock,
+		syncInterval: opts.WALSyncInterval,
+		syncJitter:   opts.WALSyncJitter,
+		groups:       make(map[uint64]*wal.SyncGroup),
+	}
+	if e.sched == nil {
+		e.sched = DefaultScheduler()
+	}
+	if e.syncInterval <= 0 {
+		e.syncInterval = time.Second
+	}
+	if e.syncJitter == 0 {
+		e.syncJitter = e.syncInterval / 10
+	} else if e.syncJitter < 0 {
+		e.syncJitter = 0
+	}
+	return e
+}
+
+// syncGroup returns the SyncGroup for the device holding dir, creating it on
+// first use.
+func (e *Env) syncGroup(dir string) (*wal.SyncGroup, error) {
+	dev, err := deviceID(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	g, ok := e.groups[dev]
+	if !ok {
+		g = wal.NewSyncGroup(wal.SyncGroupOptions{
+			Interval: e.syncInterval,
+			Jitter:   e.syncJitter,
+			Clock:    e.clock,
+		})
+		e.groups[dev] = g
+	}
+	return g, nil
+}
+
+// SyncGroups returns the number of devices the Env is batching WAL syncs for.
+func (e *Env) SyncGroups() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.groups)
+}
+
+// Close stops the Env's sync windows. Close every DB that uses the Env first.
+func (e *Env) Close() {
+	e.mu.Lock()
+	groups := e.groups
+	e.groups = make(map[uint64]*wal.SyncGroup)
+	e.mu.Unlock()
+
+	for _, g := range groups {
+		g.Close()
+	}
+}
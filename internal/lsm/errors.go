@@ -0,0 +1,102 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/return2faye/SiltKV/internal/sstable"
+)
+
+// Background operations that can report a BackgroundError.
+const (
+	BackgroundOpFlush      = "flush"
+	BackgroundOpCompaction = "compaction"
+	// BackgroundOpRead reports a corrupt SSTable met by Get or Exists, which
+	// fail with the same error, or left out by Open.
+	BackgroundOpRead = "read"
+	// BackgroundOpArchive reports a flushed WAL that could not be put into
+	// Options.WALArchiveDir. It stays in the data directory, and the next
+	// Open archives it.
+	BackgroundOpArchive = "archive"
+	// BackgroundOpWAL reports a failed write or fsync of a WAL. Whether
+	// the records it held reached the disk is unknown, so the DB goes
+	// fail-stop: writes fail, and what it holds in memory is still flushed.
+	BackgroundOpWAL = "wal"
+)
+
+// BackgroundError describes a failure in a flush or compaction, which has no
+// caller to return an error to. It is passed to Options.OnBackgroundError
+// and, if it put the DB into fail-stop mode, returned by DB.Err and by every
+// subsequent write.
+type BackgroundError struct {
+	Op   string // BackgroundOp* constant
+	Path string // file being written, if any
+	Err  error
+	// Attempt counts the failures of this operation in a row, starting at 1.
+	Attempt int
+	// Retrying is true if the operation will be tried again after a
+	// backoff; see Options.BackgroundRetries.
+	Retrying bool
+	// FailStop is true if the DB stopped accepting writes because of it.
+	FailStop bool
+}
+
+func (e *BackgroundError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("lsm: background %s failed: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("lsm: background %s of %s failed: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *BackgroundError) Unwrap() error {
+	return e.Err
+}
+
+// reportBackgroundError records err and notifies Options.OnBackgroundError.
+//
+// A flush that keeps failing is fatal: the immutable memtable cannot be
+// retired, so new writes would only pile up in memory. The DB then goes
+// read-only ("fail-stop"); the unflushed data is still served from memory
+// and remains in its WAL for the next Open. Failed compactions leave the
+// previous files in place and are only reported. See retryBackground for
+// the retries before either.
+func (db *DB) reportBackgroundError(op, path string, err error, failStop bool) {
+	db.notifyBackgroundError(&BackgroundError{Op: op, Path: path, Err: err, Attempt: 1, FailStop: failStop})
+}
+
+// notifyBackgroundError is reportBackgroundError for a prepared error.
+func (db *DB) notifyBackgroundError(bgErr *BackgroundError) {
+	if bgErr.FailStop {
+		db.mu.Lock()
+		if db.bgErr == nil {
+			db.bgErr = bgErr
+		}
+		db.wakeStalledWriters()
+		db.mu.Unlock()
+	}
+	if db.onBgError != nil {
+		db.onBgError(bgErr)
+	}
+}
+
+// readError passes err, from reading f for a caller, to
+// Options.OnBackgroundError if it is corruption, and returns it for the
+// caller to fail with. Corruption is not fail-stop: other keys, and the
+// writes that may replace the damaged file, still work.
+func (db *DB) readError(f *fileMeta, err error) error {
+	if errors.Is(err, sstable.ErrCorruptSSTable) {
+		db.reportBackgroundError(BackgroundOpRead, f.path, err, false)
+	}
+	return err
+}
+
+// Err returns the error that put the DB into fail-stop mode, or nil while it
+// is healthy. Once set, all writes fail with this error; reads keep working.
+func (db *DB) Err() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.bgErr == nil {
+		return nil
+	}
+	return db.bgErr
+}
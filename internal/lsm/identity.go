@@ -0,0 +1,47 @@
+package lsm
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// Identity tells data directories apart. It is generated when a directory
+// is first opened for writing and kept in its manifest, so it follows the
+// directory through moves, backups and checkpoints, which describe the same
+// DB, while a DB created elsewhere gets its own.
+type Identity struct {
+	ID      string    // random UUID (version 4)
+	Created time.Time // when the identity was generated
+	// EngineVersion is the EngineVersion that generated it. Directories
+	// created before identities existed get one on their first writable
+	// Open, with that Open's engine.
+	EngineVersion int
+}
+
+// IsZero reports whether id is unset, as for a directory opened read-only
+// that has not been opened for writing since identities were introduced.
+func (id Identity) IsZero() bool {
+	return id.ID == ""
+}
+
+// newIdentity generates an identity created at now.
+func newIdentity(now time.Time) (Identity, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return Identity{}, err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	id := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	return Identity{ID: id, Created: now, EngineVersion: EngineVersion}, nil
+}
+
+// ID returns the identity of the data directory: a UUID, when it was
+// generated and by which engine version. Replication, backup catalogs and
+// monitoring can key on it instead of a path, which changes with a move
+// and is reused by an unrelated DB. It is zero only for a directory never
+// opened for writing by an engine that records identities.
+func (db *DB) ID() Identity {
+	return db.identity
+}
@@ -0,0 +1,188 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"unicode"
+
+	"github.com/return2faye/SiltKV/internal/utils"
+	"github.com/return2faye/SiltKV/internal/wal"
+)
+
+// ErrNoTokenizer is returned by SearchToken when Options.Tokenizer is unset.
+var ErrNoTokenizer = errors.New("lsm: token index is not enabled")
+
+// Tokenizer extracts the search tokens of a value for the token index.
+// Empty tokens, tokens containing a NUL byte and tokens too long to index
+// along with the key are ignored.
+type Tokenizer func(key, value []byte) []string
+
+// WordTokenizer splits a value into lower-cased runs of letters and digits.
+func WordTokenizer(key, value []byte) []string {
+	return strings.FieldsFunc(strings.ToLower(string(value)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// ErrInternalKey is returned for a write of a key that starts with the
+// prefix the DB reserves for its own bookkeeping.
+var ErrInternalKey = errors.New("lsm: key uses the prefix reserved for internal keys")
+
+// internalPrefix starts every key the DB writes for its own bookkeeping
+// (the trash and the token index). Writes of user keys starting with it
+// fail with ErrInternalKey.
+const internalPrefix = "\x00silt-"
+
+// internalEnd is the first key past the internal keys.
+var internalEnd = prefixEnd([]byte(internalPrefix))
+
+// indexPrefix marks posting keys of the token index: indexPrefix, the
+// token, a NUL byte, then the indexed key.
+var indexPrefix = []byte(internalPrefix + "index\x00")
+
+// postingValue is what a posting key holds; its presence is the posting.
+// It must be non-empty, as SSTables store empty values as tombstones.
+var postingValue = []byte{1}
+
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(internalPrefix))
+}
+
+// checkUserKey fails with ErrInternalKey for a key a user may not write.
+func checkUserKey(key []byte) error {
+	if isInternalKey(key) {
+		return ErrInternalKey
+	}
+	return nil
+}
+
+// userRanges returns the range deletes that delete the user keys in
+// [start, end), a non-empty range: the range itself, or the parts on
+// either side of the internal keys if it spans them. A bound that is an
+// internal key fails with ErrInternalKey.
+func userRanges(start, end []byte) ([]batchOp, error) {
+	if isInternalKey(start) || isInternalKey(end) {
+		return nil, ErrInternalKey
+	}
+	internal := []byte(internalPrefix)
+	if bytes.Compare(start, internal) >= 0 || bytes.Compare(end, internalEnd) < 0 {
+		return []batchOp{{key: start, value: end, stored: end, rangeDelete: true}}, nil
+	}
+	ops := []batchOp{{key: start, value: internal, stored: internal, rangeDelete: true}}
+	if bytes.Compare(end, internalEnd) > 0 {
+		ops = append(ops, batchOp{key: internalEnd, value: end, stored: end, rangeDelete: true})
+	}
+	return ops, nil
+}
+
+func postingPrefix(token string) []byte {
+	p := make([]byte, 0, len(indexPrefix)+len(token)+1)
+	p = append(p, indexPrefix...)
+	p = append(p, token...)
+	return append(p, 0)
+}
+
+func postingKey(token string, key []byte) []byte {
+	return append(postingPrefix(token), key...)
+}
+
+// tokens returns the distinct usable tokens of value: those whose posting
+// key for key fits in a WAL record.
+func (db *DB) tokens(key, value []byte) map[string]struct{} {
+	set := make(map[string]struct{})
+	if value == nil {
+		return set
+	}
+	for _, t := range db.tokenizer(key, value) {
+		if t != "" && !strings.ContainsRune(t, 0) && len(indexPrefix)+len(t)+1+len(key) <= wal.KeySizeLimit {
+			set[t] = struct{}{}
+		}
+	}
+	return set
+}
+
+// putValue writes a user key in stored form, keeping the token index up to
+// date if there is one.
+func (db *DB) putValue(ctx context.Context, key, stored []byte, valueLen int) error {
+	if db.tokenizer == nil || isInternalKey(key) {
+		return db.putStored(ctx, key, stored, valueLen)
+	}
+	return db.putIndexed(ctx, key, stored)
+}
+
+// putIndexed writes key and the posting updates of the token index as one
+// batch, so that a crash keeps all of them or none.
+func (db *DB) putIndexed(ctx context.Context, key, stored []byte) error {
+	var value []byte
+	if stored != nil {
+		var err error
+		if value, err = db.codecs.decode(key, stored); err != nil {
+			return err
+		}
+	}
+	return db.applyBatch(ctx, []batchOp{{key: key, value: value, stored: stored}})
+}
+
+// SearchToken returns, in key order, the keys whose current value has the
+// given token according to Options.Tokenizer.
+func (db *DB) SearchToken(token string) ([][]byte, error) {
+	if db.tokenizer == nil {
+		return nil, ErrNoTokenizer
+	}
+	prefix := postingPrefix(token)
+	postings, err := db.scanStored(prefix, prefixEnd(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	for _, p := range postings {
+		key := p.key[len(prefix):]
+		value, found, err := db.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		if _, ok := db.tokens(key, value)[token]; ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := utils.CopyBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+type storedEntry struct {
+	key, value []byte
+}
+
+// scanStored returns the live entries in [start, end) in key order, with
+// values in stored form and internal keys included.
+func (db *DB) scanStored(start, end []byte) ([]storedEntry, error) {
+	it, err := db.NewIterator(IterOptions{LowerBound: start, UpperBound: end, raw: true})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var live []storedEntry
+	for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+		live = append(live, storedEntry{it.Key(), it.Value()})
+	}
+	return live, err
+}
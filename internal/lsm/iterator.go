@@ -0,0 +1,444 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/return2faye/SiltKV/internal/memtable"
+	"github.com/return2faye/SiltKV/internal/sstable"
+	"github.com/return2faye/SiltKV/internal/utils"
+)
+
+var (
+	// ErrIteratorInvalid is returned in strict mode by Next and Prev on an
+	// iterator that is not positioned at a key.
+	ErrIteratorInvalid = errors.New("lsm: iterator is not valid")
+	// ErrIteratorClosed is returned in strict mode by any use of a closed
+	// iterator.
+	ErrIteratorClosed = errors.New("lsm: iterator is closed")
+)
+
+// misuse reports API misuse detected in strict mode: it returns err, or
+// panics with it in builds with the siltkv_assert tag so that tests stop at
+// the faulty call.
+func misuse(err error) error {
+	if assertMisuse {
+		panic(err)
+	}
+	return err
+}
+
+// IterOptions configures an Iterator.
+type IterOptions struct {
+	ReadOptions
+
+	// LowerBound and UpperBound restrict the iterator to keys in
+	// [LowerBound, UpperBound). Nil leaves that side open.
+	LowerBound []byte
+	UpperBound []byte
+
+	// Readahead is how many blocks of each SSTable to read ahead, in the
+	// background, while the iterator moves forward through them; see
+	// sstable.IteratorOptions.Readahead. Zero disables, which suits seeks
+	// and short scans.
+	Readahead int
+
+	// raw makes the iterator return internal keys and stored values,
+	// for the DB's own scans.
+	raw bool
+	// reuse makes Key and Value return buffers that the next move of the
+	// iterator overwrites, for callers that copy them right away.
+	reuse bool
+}
+
+// layerIterator is what Iterator merges: a memtable or SSTable iterator.
+type layerIterator interface {
+	Valid() bool
+	Key() []byte
+	Value() []byte // nil for a tombstone
+	Next() error
+	Prev() error
+	Seek(target []byte) error
+	SeekToFirst() error
+	SeekToLast() error
+}
+
+// memIterator adapts a memtable iterator, which cannot fail.
+type memIterator struct {
+	*memtable.SLIterator
+}
+
+func (m memIterator) Next() error              { m.SLIterator.Next(); return nil }
+func (m memIterator) Prev() error              { m.SLIterator.Prev(); return nil }
+func (m memIterator) Seek(target []byte) error { m.SLIterator.Seek(target); return nil }
+func (m memIterator) SeekToFirst() error       { m.SLIterator.SeekToFirst(); return nil }
+func (m memIterator) SeekToLast() error        { m.SLIterator.SeekToLast(); return nil }
+
+// Iterator walks the live keys of a DB in order, merging the active and
+// immutable memtables and the SSTables. Like Get, the newest layer holding
+// a key decides it, and tombstones and range-deleted keys are skipped.
+//
+// The SSTables are pinned at NewIterator, so compactions cannot remove
+// them underneath. Writes made after NewIterator may or may not be seen.
+// An Iterator is not safe for concurrent use and must be closed.
+//
+// A new Iterator is not positioned; call SeekToFirst, SeekToLast or Seek.
+type Iterator struct {
+	db     *DB
+	v      *version
+	layers []layerIterator // newest first
+	// rangeDeleted[i] reports whether layer i has a range tombstone for key.
+	rangeDeleted []func(key []byte) bool
+	opts         IterOptions
+
+	key, value []byte
+	valid      bool
+	// keyBuf and valueBuf back key and value with IterOptions.reuse.
+	keyBuf, valueBuf []byte
+	// reverse is set while moving backwards. Going forward, every layer
+	// sits past the current key; going backward, before it.
+	reverse bool
+
+	strict bool  // see Options.Strict
+	closed bool  // set by Close
+	err    error // first misuse seen by Key or Value in strict mode
+
+	// vlogDone ends the iterator's read of the value log; nil without one
+	// or once closed.
+	vlogDone func()
+}
+
+// NewIterator returns an iterator over the DB. PriorityBackground makes it
+// pause before SSTable blocks while foreground reads are slow.
+func (db *DB) NewIterator(opts IterOptions) (*Iterator, error) {
+	if t := db.trace(); t != nil && !opts.raw {
+		defer t.record(TraceOpScan, opts.LowerBound, 0, db.clock.Now())
+	}
+	var vlogDone func()
+	if db.vlog != nil {
+		vlogDone = db.vlog.enter()
+	}
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		if vlogDone != nil {
+			vlogDone()
+		}
+		return nil, ErrClosed
+	}
+	it := &Iterator{db: db, opts: opts, strict: db.strict, vlogDone: vlogDone}
+	for _, mt := range db.memtables() {
+		it.layers = append(it.layers, memIterator{mt.NewIterator()})
+		it.rangeDeleted = append(it.rangeDeleted, mt.IsRangeDeleted)
+	}
+	it.v = db.current
+	if it.v != nil {
+		it.v.ref()
+	}
+	db.mu.RUnlock()
+
+	iterOpts := sstable.IteratorOptions{ReuseBuffers: opts.reuse, Readahead: opts.Readahead}
+	if opts.Priority == PriorityBackground {
+		iterOpts.BeforeBlock = db.fgLatency.yield
+	}
+	if it.v != nil {
+		for _, f := range it.v.files {
+			// Files outside the bounds hold nothing the iterator returns
+			if !f.overlapsRange(opts.LowerBound, opts.UpperBound) {
+				continue
+			}
+			it.layers = append(it.layers, f.reader.NewIteratorWithOptions(iterOpts))
+			it.rangeDeleted = append(it.rangeDeleted, f.reader.IsRangeDeleted)
+		}
+	}
+	return it, nil
+}
+
+// Close releases the SSTables pinned by the iterator.
+func (it *Iterator) Close() error {
+	if it.closed && it.strict {
+		return misuse(ErrIteratorClosed)
+	}
+	it.closed = true
+	for _, l := range it.layers {
+		// SSTable iterators may still be reading ahead from their file
+		if sit, ok := l.(*sstable.Iterator); ok {
+			sit.Close()
+		}
+	}
+	if it.v != nil {
+		it.v.unref()
+		it.v = nil
+	}
+	if it.vlogDone != nil {
+		it.vlogDone()
+		it.vlogDone = nil
+	}
+	it.layers = nil
+	it.valid = false
+	return nil
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the current key. It stays valid after the iterator moves.
+func (it *Iterator) Key() []byte {
+	it.checkPositioned()
+	return it.key
+}
+
+// Value returns the current value. It stays valid after the iterator moves.
+func (it *Iterator) Value() []byte {
+	it.checkPositioned()
+	return it.value
+}
+
+// Err returns the first misuse recorded by Key or Value in strict mode,
+// which have no error result of their own: a call on an iterator that is
+// not valid or already closed.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// checkPositioned records a Key or Value call on an iterator that is not
+// positioned at a key.
+func (it *Iterator) checkPositioned() {
+	if it.strict && !it.valid && it.err == nil {
+		it.err = misuse(it.invalidErr())
+	}
+}
+
+// invalidErr is the error for moving or reading an iterator that is not
+// valid.
+func (it *Iterator) invalidErr() error {
+	if it.closed {
+		return ErrIteratorClosed
+	}
+	return ErrIteratorInvalid
+}
+
+// checkOpen rejects repositioning a closed iterator in strict mode.
+func (it *Iterator) checkOpen() error {
+	if it.closed && it.strict {
+		return misuse(ErrIteratorClosed)
+	}
+	return nil
+}
+
+// SeekToFirst positions the iterator at the first key.
+func (it *Iterator) SeekToFirst() error {
+	if err := it.checkOpen(); err != nil {
+		return err
+	}
+	if it.opts.LowerBound != nil {
+		return it.Seek(it.opts.LowerBound)
+	}
+	for _, l := range it.layers {
+		if err := l.SeekToFirst(); err != nil {
+			return err
+		}
+	}
+	it.reverse = false
+	return it.forward()
+}
+
+// Seek positions the iterator at the first key >= target.
+func (it *Iterator) Seek(target []byte) error {
+	if err := it.checkOpen(); err != nil {
+		return err
+	}
+	if it.opts.LowerBound != nil && bytes.Compare(target, it.opts.LowerBound) < 0 {
+		target = it.opts.LowerBound
+	}
+	for _, l := range it.layers {
+		if err := l.Seek(target); err != nil {
+			return err
+		}
+	}
+	it.reverse = false
+	return it.forward()
+}
+
+// SeekToLast positions the iterator at the last key.
+func (it *Iterator) SeekToLast() error {
+	if err := it.checkOpen(); err != nil {
+		return err
+	}
+	for _, l := range it.layers {
+		if err := seekBefore(l, it.opts.UpperBound); err != nil {
+			return err
+		}
+	}
+	it.reverse = true
+	return it.backward()
+}
+
+// Next moves to the next key. Next on an invalid iterator does nothing,
+// or fails in strict mode.
+func (it *Iterator) Next() error {
+	if !it.valid {
+		if it.strict {
+			return misuse(it.invalidErr())
+		}
+		return nil
+	}
+	if it.reverse {
+		// Move every layer to the first key after the current one.
+		for _, l := range it.layers {
+			if err := l.Seek(it.key); err != nil {
+				return err
+			}
+			if l.Valid() && bytes.Equal(l.Key(), it.key) {
+				if err := l.Next(); err != nil {
+					return err
+				}
+			}
+		}
+		it.reverse = false
+	}
+	return it.forward()
+}
+
+// Prev moves to the previous key. Prev on an invalid iterator does nothing,
+// or fails in strict mode.
+func (it *Iterator) Prev() error {
+	if !it.valid {
+		if it.strict {
+			return misuse(it.invalidErr())
+		}
+		return nil
+	}
+	if !it.reverse {
+		// Move every layer to the last key before the current one.
+		for _, l := range it.layers {
+			if err := seekBefore(l, it.key); err != nil {
+				return err
+			}
+		}
+		it.reverse = true
+	}
+	return it.backward()
+}
+
+// seekBefore positions l at its last key < target, or its last key if
+// target is nil.
+func seekBefore(l layerIterator, target []byte) error {
+	if target == nil {
+		return l.SeekToLast()
+	}
+	if err := l.Seek(target); err != nil {
+		return err
+	}
+	if !l.Valid() {
+		return l.SeekToLast()
+	}
+	return l.Prev()
+}
+
+// forward steps to the smallest visible key at or after the layers'
+// positions.
+func (it *Iterator) forward() error {
+	for {
+		var minKey []byte
+		for _, l := range it.layers {
+			if l.Valid() && (minKey == nil || bytes.Compare(l.Key(), minKey) < 0) {
+				minKey = l.Key()
+			}
+		}
+		if minKey == nil || (it.opts.UpperBound != nil && bytes.Compare(minKey, it.opts.UpperBound) >= 0) {
+			it.valid = false
+			return nil
+		}
+		visible, err := it.take(minKey, func(l layerIterator) error { return l.Next() })
+		if err != nil || visible {
+			return err
+		}
+	}
+}
+
+// backward is forward in reverse.
+func (it *Iterator) backward() error {
+	for {
+		var maxKey []byte
+		for _, l := range it.layers {
+			if l.Valid() && (maxKey == nil || bytes.Compare(l.Key(), maxKey) > 0) {
+				maxKey = l.Key()
+			}
+		}
+		if maxKey == nil || (it.opts.LowerBound != nil && bytes.Compare(maxKey, it.opts.LowerBound) < 0) {
+			it.valid = false
+			return nil
+		}
+		visible, err := it.take(maxKey, func(l layerIterator) error { return l.Prev() })
+		if err != nil || visible {
+			return err
+		}
+	}
+}
+
+// take resolves key from the newest layer holding it, steps every layer
+// holding it with step, and reports whether the key is visible. If it is,
+// the iterator is positioned at it.
+func (it *Iterator) take(key []byte, step func(layerIterator) error) (bool, error) {
+	key = it.copyOut(&it.keyBuf, key)
+	winner := -1
+	var value []byte
+	for i, l := range it.layers {
+		if !l.Valid() || !bytes.Equal(l.Key(), key) {
+			continue
+		}
+		if winner < 0 {
+			winner = i
+			value = it.copyOut(&it.valueBuf, l.Value())
+		}
+		if err := step(l); err != nil {
+			return false, err
+		}
+	}
+
+	if value == nil {
+		return false, nil // tombstone
+	}
+	for _, deleted := range it.rangeDeleted[:winner] {
+		if deleted(key) {
+			return false, nil
+		}
+	}
+	if it.db.vlog != nil && !isInternalKey(key) {
+		var err error
+		if value, err = it.db.vlog.resolve(key, value); err != nil {
+			it.db.reportBackgroundError(BackgroundOpRead, it.db.vlog.dir, err, false)
+			return false, err
+		}
+	}
+	if !it.opts.raw {
+		if isInternalKey(key) {
+			return false, nil
+		}
+		var err error
+		if value, err = it.db.codecs.decode(key, value); err != nil {
+			return false, err
+		}
+	}
+	it.key, it.value, it.valid = key, value, true
+	return true, nil
+}
+
+// copyOut copies b out of a layer before the layer moves: into *buf with
+// IterOptions.reuse, else into a new slice. Nil, a tombstone, stays nil.
+func (it *Iterator) copyOut(buf *[]byte, b []byte) []byte {
+	if !it.opts.reuse {
+		return utils.CopyBytes(b)
+	}
+	if b == nil {
+		return nil
+	}
+	*buf = append((*buf)[:0], b...)
+	if *buf == nil {
+		*buf = []byte{}
+	}
+	return *buf
+}
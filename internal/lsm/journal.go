@@ -0,0 +1,170 @@
+package lsm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminJournalName is the file in the data directory that records admin
+// operations, one per line:
+//
+//	time(RFC 3339)\top\tduration\tdetail(quoted)\terror(quoted, "" on success)
+//
+// It is only ever appended to; Move carries it along and Repair leaves it in
+// place.
+const adminJournalName = "ADMIN_LOG"
+
+// AdminOp identifies the kind of operation in an AdminRecord.
+type AdminOp string
+
+const (
+	AdminOpCompact         AdminOp = "compact"
+	AdminOpPurgeDeleted    AdminOp = "purge_deleted"
+	AdminOpBackup          AdminOp = "backup"
+	AdminOpCheckpoint      AdminOp = "checkpoint"
+	AdminOpVerifyIntegrity AdminOp = "verify_integrity"
+	AdminOpRepair          AdminOp = "repair"
+	AdminOpOpen            AdminOp = "open"
+	AdminOpCollectValueLog AdminOp = "collect_value_log"
+)
+
+// AdminRecord is one admin operation from the journal.
+type AdminRecord struct {
+	Time     time.Time // when it started
+	Op       AdminOp
+	Duration time.Duration
+	// Detail holds the arguments, such as the backup directory, and for
+	// AdminOpOpen the options that differ from the defaults.
+	Detail string
+	// Err is the error the operation returned, or "" if it succeeded.
+	Err string
+}
+
+// journalMu serializes appends to the journals of all DBs in the process.
+// Admin operations are rare; one lock is plenty.
+var journalMu sync.Mutex
+
+// appendAdminRecord appends rec to the journal in dataDir. The journal is a
+// record for operators, not state the DB depends on, so a failure to write
+// it does not fail the operation.
+func appendAdminRecord(dataDir string, rec AdminRecord) {
+	line := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n", rec.Time.UTC().Format(time.RFC3339Nano), rec.Op,
+		rec.Duration, strconv.Quote(rec.Detail), strconv.Quote(rec.Err))
+
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(dataDir, adminJournalName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return
+	}
+	f.WriteString(line)
+	f.Close()
+}
+
+// journal records an admin operation that started at start and ended with
+// *errp; operations defer it with a pointer to their named error result.
+// Read-only DBs must not modify the data directory and record nothing, and
+// neither do calls on a closed DB, which no longer owns it.
+func (db *DB) journal(op AdminOp, detail string, start time.Time, errp *error) {
+	var err error
+	if errp != nil {
+		err = *errp
+	}
+	if db.readOnly || errors.Is(err, ErrClosed) {
+		return
+	}
+	rec := AdminRecord{Time: start, Op: op, Duration: db.clock.Now().Sub(start), Detail: detail}
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	appendAdminRecord(db.dataDir, rec)
+}
+
+// AdminHistory returns the admin operations recorded in the DB's data
+// directory, oldest first: compactions and purges started by a caller,
+// backups, checkpoints, integrity checks, repairs and writable Opens.
+// Use ReadAdminHistory once the DB is closed.
+func (db *DB) AdminHistory() ([]AdminRecord, error) {
+	db.mu.RLock()
+	closed := db.closed
+	db.mu.RUnlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	return ReadAdminHistory(db.dataDir)
+}
+
+// ReadAdminHistory is DB.AdminHistory for a data directory that need not be
+// open, for example after an incident. A directory without a journal has
+// no history; lines that do not parse, such as one torn by a crash, are
+// skipped.
+func ReadAdminHistory(dataDir string) ([]AdminRecord, error) {
+	f, err := os.Open(filepath.Join(dataDir, adminJournalName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []AdminRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if rec, ok := parseAdminRecord(scanner.Text()); ok {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, scanner.Err()
+}
+
+func parseAdminRecord(line string) (AdminRecord, bool) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 5 {
+		return AdminRecord{}, false
+	}
+	t, err1 := time.Parse(time.RFC3339Nano, fields[0])
+	d, err2 := time.ParseDuration(fields[2])
+	detail, err3 := strconv.Unquote(fields[3])
+	errText, err4 := strconv.Unquote(fields[4])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return AdminRecord{}, false
+	}
+	return AdminRecord{Time: t, Op: AdminOp(fields[1]), Duration: d, Detail: detail, Err: errText}, true
+}
+
+// optionsSummary lists the options set to something other than their zero
+// value, such as "BlockCacheSize=8388608 Compression=zstd", leaving out
+// DataDir and those that are functions or objects rather than settings.
+func optionsSummary(opts Options) string {
+	var parts []string
+	v := reflect.ValueOf(opts)
+	for i := 0; i < v.NumField(); i++ {
+		name, f := v.Type().Field(i).Name, v.Field(i)
+		if name == "DataDir" || !v.Type().Field(i).IsExported() || f.IsZero() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64, reflect.String:
+		case reflect.Slice:
+			if k := f.Type().Elem().Kind(); k < reflect.Bool || k > reflect.Float64 {
+				continue
+			}
+		default:
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s=%v", name, f.Interface()))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,142 @@
+package lsm
+
+// keyIndex is the in-memory index of Options.FullKeyIndex. It maps every
+// key with a record in the SSTables of the current version, tombstones
+// included, to the newest file holding one and the block it is in. A Get
+// of a key missing from it touches no SSTable at all; any other reads one
+// block. It is only read and changed under db.mu, together with
+// db.current, so its files always belong to the current version.
+type keyIndex struct {
+	locs map[string]keyLoc
+}
+
+type keyLoc struct {
+	file  *fileMeta
+	block int // -1 for a table without a block index
+}
+
+// fileKeys are the keys of a file with their blocks, read before db.mu is
+// taken to update the index.
+type fileKeys struct {
+	file   *fileMeta
+	keys   []string
+	blocks []int
+}
+
+func readFileKeys(f *fileMeta) (fileKeys, error) {
+	fk := fileKeys{file: f}
+	it := f.reader.NewIterator()
+	var err error
+	for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+		fk.keys = append(fk.keys, string(it.Key()))
+		fk.blocks = append(fk.blocks, it.Block())
+	}
+	return fk, err
+}
+
+// buildKeyIndex indexes the files of v.
+func buildKeyIndex(v *version) (*keyIndex, error) {
+	idx := &keyIndex{locs: make(map[string]keyLoc)}
+	// Oldest first, so that newer files overwrite the keys they share
+	for i := len(v.files) - 1; i >= 0; i-- {
+		fk, err := readFileKeys(v.files[i])
+		if err != nil {
+			return nil, err
+		}
+		idx.addNewest(fk)
+	}
+	return idx, nil
+}
+
+// addNewest records a file newer than every indexed one: a flush.
+func (idx *keyIndex) addNewest(fk fileKeys) {
+	for i, k := range fk.keys {
+		idx.locs[k] = keyLoc{file: fk.file, block: fk.blocks[i]}
+	}
+}
+
+// replace records a compaction of inputs into outputs. Keys whose newest
+// file was an input move to their output; those the compaction dropped
+// were deleted or shadowed, so nothing older answers for them either.
+// Files newer than the inputs keep the keys they share with them.
+func (idx *keyIndex) replace(inputs, outputs []fileKeys) {
+	isInput := make(map[*fileMeta]bool, len(inputs))
+	for _, fk := range inputs {
+		isInput[fk.file] = true
+	}
+	for _, fk := range outputs {
+		for i, k := range fk.keys {
+			if loc, ok := idx.locs[k]; !ok || isInput[loc.file] {
+				idx.locs[k] = keyLoc{file: fk.file, block: fk.blocks[i]}
+			}
+		}
+	}
+	for _, fk := range inputs {
+		for _, k := range fk.keys {
+			if isInput[idx.locs[k].file] {
+				delete(idx.locs, k)
+			}
+		}
+	}
+}
+
+// getIndexed is the SSTable part of a Get through the index: loc is the
+// index entry of key in v.
+func getIndexed(v *version, key, dst []byte, loc keyLoc) ([]byte, bool, error) {
+	// A range tombstone in a newer file may still cover the record
+	for _, f := range v.files {
+		if f == loc.file {
+			break
+		}
+		if f.reader.IsRangeDeleted(key) {
+			return nil, false, nil
+		}
+	}
+	var val []byte
+	var found bool
+	var err error
+	if loc.block < 0 {
+		// A table without a block index
+		val, found, err = loc.file.reader.GetTo(key, dst)
+	} else {
+		val, found, err = loc.file.reader.GetInBlock(key, dst, loc.block)
+	}
+	if err != nil || !found || val == nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+// len returns the number of keys in the index, or 0 without one.
+func (idx *keyIndex) len() int {
+	if idx == nil {
+		return 0
+	}
+	return len(idx.locs)
+}
+
+func readAllFileKeys(files []*fileMeta) ([]fileKeys, error) {
+	all := make([]fileKeys, 0, len(files))
+	for _, f := range files {
+		fk, err := readFileKeys(f)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, fk)
+	}
+	return all, nil
+}
+
+// updateKeyIndex applies update to the index after a new version was
+// installed, or drops the index if the keys it needed could not be read:
+// Gets then fall back to probing every candidate table. Callers hold db.mu.
+func (db *DB) updateKeyIndex(readErr error, update func(idx *keyIndex)) {
+	if db.keyIndex == nil {
+		return
+	}
+	if readErr != nil {
+		db.keyIndex = nil
+		return
+	}
+	update(db.keyIndex)
+}
@@ -0,0 +1,382 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/memtable"
+	"github.com/return2faye/SiltKV/internal/sstable"
+)
+
+// numLevels is the number of levels in a version, L0 included.
+const numLevels = 7
+
+const (
+	defaultL0CompactionTrigger      = 4
+	defaultLevelSizeMultiplier      = 10
+	defaultTombstoneCompactionRatio = 0.5
+
+	// tombstoneCompactionMinCount is how many tombstones a file needs
+	// before its tombstone density alone gets it compacted; below that the
+	// space it could free is not worth a rewrite.
+	tombstoneCompactionMinCount = 64
+
+	// compactionAgeHalfLife is the file age at which fileScore gives half
+	// of its largest bonus for age.
+	compactionAgeHalfLife = time.Hour
+)
+
+// defaultLevelBaseSize is the target size of L1.
+var defaultLevelBaseSize = 4 * sstable.MaxSSTableFileSize()
+
+// compaction is one unit of compaction work picked from a version: the
+// inputs of level are merged with the files of level+1 they overlap, and
+// the result replaces both in level+1.
+type compaction struct {
+	level  int
+	inputs []*fileMeta // files of level; newest first for L0
+	next   []*fileMeta // files of level+1 overlapping inputs, in key order
+}
+
+// files returns every input of c, newest first.
+func (c *compaction) files() []*fileMeta {
+	files := make([]*fileMeta, 0, len(c.inputs)+len(c.next))
+	files = append(files, c.inputs...)
+	return append(files, c.next...)
+}
+
+// outputLevel is the level the outputs of c go to.
+func (c *compaction) outputLevel() int {
+	return c.level + 1
+}
+
+// Table properties recording the provenance of compaction outputs, so that a
+// value can be traced back to the files it came from with cmd/sstdump.
+const (
+	// PropCompactionInputs lists the input files as "L<level>:<name>",
+	// separated by spaces, newest first.
+	PropCompactionInputs = "siltkv.compaction.inputs"
+	// PropCompactionOutputLevel is the level the output was written to.
+	PropCompactionOutputLevel = "siltkv.compaction.output_level"
+	// PropCompactionTime is when the compaction started, in RFC 3339.
+	PropCompactionTime = "siltkv.compaction.time"
+)
+
+// Table properties every flush and compaction output carries, so that
+// Repair can rebuild the manifest from the files alone.
+const (
+	// PropMaxSequence is the highest WAL sequence number of the data.
+	PropMaxSequence = "siltkv.max_seq"
+	// PropMaxTime is the write time of that record, in unix nanoseconds.
+	PropMaxTime = "siltkv.max_time"
+)
+
+// setPositionProperties records maxSeq and maxTime on w, if known.
+func setPositionProperties(w *sstable.Writer, maxSeq uint64, maxTime int64) {
+	if maxSeq == 0 {
+		return
+	}
+	w.SetProperty(PropMaxSequence, strconv.FormatUint(maxSeq, 10))
+	w.SetProperty(PropMaxTime, strconv.FormatInt(maxTime, 10))
+}
+
+// provenance returns the properties every output of c carries.
+func (c *compaction) provenance(start time.Time) map[string]string {
+	inputs := make([]string, 0, len(c.inputs)+len(c.next))
+	for _, f := range c.files() {
+		inputs = append(inputs, fmt.Sprintf("L%d:%s", f.level, filepath.Base(f.path)))
+	}
+	return map[string]string{
+		PropCompactionInputs:      strings.Join(inputs, " "),
+		PropCompactionOutputLevel: strconv.Itoa(c.outputLevel()),
+		PropCompactionTime:        start.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// newFileMeta wraps a freshly opened reader with a DB-unique file id and
+// loads its key bounds.
+func (db *DB) newFileMeta(r *sstable.Reader, level int) (*fileMeta, error) {
+	smallest, largest, err := r.Bounds()
+	if err != nil {
+		return nil, fmt.Errorf("lsm: bounds of %s: %w", r.Path(), err)
+	}
+	for _, rt := range r.RangeTombstones() {
+		if smallest == nil || bytes.Compare(rt.Start, smallest) < 0 {
+			smallest = rt.Start
+		}
+		if largest == nil || bytes.Compare(rt.End, largest) > 0 {
+			largest = rt.End
+		}
+	}
+	f := &fileMeta{
+		id:       atomic.AddUint64(&db.nextFileID, 1),
+		path:     r.Path(),
+		reader:   r,
+		level:    level,
+		smallest: smallest,
+		largest:  largest,
+		deleter:  db.deleter,
+	}
+	// The record counts only steer compaction priority; a table without
+	// readable properties is served all the same.
+	if props, err := r.Properties(); err == nil {
+		f.entries, _ = strconv.ParseUint(props[sstable.PropNumEntries], 10, 64)
+		f.deletions, _ = strconv.ParseUint(props[sstable.PropNumDeletions], 10, 64)
+	}
+	return f, nil
+}
+
+// writerOptions returns the options for an SSTable written to level.
+func (db *DB) writerOptions(level int) sstable.WriterOptions {
+	opts := sstable.WriterOptions{
+		Compression:        db.compression,
+		CreationTime:       db.clock.Now(),
+		PartitionedFilters: db.partitionedFilters,
+		PartitionedIndex:   db.partitionedIndex,
+	}
+	if n := len(db.bloomBits); n > 0 {
+		opts.BloomBitsPerKey = db.bloomBits[min(level, n-1)]
+	}
+	// Only flushes write to L0
+	if db.rateLimiter != nil && (level > 0 || db.rateLimitFlushes) {
+		opts.BeforeWrite = db.rateLimiter.wait
+	}
+	return opts
+}
+
+// maxBytesForLevel returns the size above which level (1 or deeper) is
+// compacted into the next one.
+func (db *DB) maxBytesForLevel(level int) int64 {
+	n := db.levelBaseSize
+	for l := 1; l < level; l++ {
+		n *= int64(db.levelMultiplier)
+	}
+	return n
+}
+
+// compactionScore rates how urgently level needs compaction; 1 or more
+// means it is over its limit. L0 is scored by file count, since every L0
+// file costs a probe on every read, and deeper levels by size or, if
+// higher, by their most tombstone-laden file. The last level has nowhere
+// to compact to and always scores 0.
+func (db *DB) compactionScore(v *version, level int) float64 {
+	switch {
+	case level == 0:
+		return float64(len(v.levels[0])) / float64(db.compactTrigger)
+	case level < numLevels-1:
+		return max(db.sizeScore(v, level), db.tombstoneScore(v, level))
+	}
+	return 0
+}
+
+// sizeScore is the size of level (1 or deeper) relative to its limit.
+func (db *DB) sizeScore(v *version, level int) float64 {
+	return float64(v.levelBytes(level)) / float64(db.maxBytesForLevel(level))
+}
+
+// tombstoneScore is the highest tombstone density among the files of level
+// that hold enough tombstones to be worth compacting, relative to
+// TombstoneCompactionRatio.
+func (db *DB) tombstoneScore(v *version, level int) float64 {
+	if db.tombstoneRatio <= 0 {
+		return 0
+	}
+	best := 0.0
+	for _, f := range v.levels[level] {
+		if f.tombstones() >= tombstoneCompactionMinCount {
+			best = max(best, f.tombstoneDensity()/db.tombstoneRatio)
+		}
+	}
+	return best
+}
+
+// fileScore rates how worthwhile it is to compact f out of its level (1 or
+// deeper). Tombstones raise it, since merging them down frees the space of
+// what they delete, and so does age, so that files that have sat in the
+// level longest move on while freshly written outputs are not merged again
+// right away. Every byte of the next level that f overlaps is rewritten
+// along with it, so overlap lowers it: a file spanning much of the next
+// level's cold data waits while cheaper work is available.
+func (db *DB) fileScore(v *version, f *fileMeta, now int64) float64 {
+	var overlap int64
+	if f.smallest != nil && f.level+1 < numLevels {
+		for _, o := range v.overlapping(f.level+1, f.smallest, f.largest) {
+			overlap += o.reader.Size()
+		}
+	}
+	ratio := float64(overlap) / float64(max(f.reader.Size(), 1))
+
+	age := 0.0
+	if created := fileNameTimestamp(f.path); created > 0 && now > created {
+		d := float64(now - created)
+		age = d / (d + float64(compactionAgeHalfLife))
+	}
+	return (1 + f.tombstoneDensity()) * (1 + age) / (1 + ratio)
+}
+
+// needsCompaction reports whether any level of v is over its limit.
+func (db *DB) needsCompaction(v *version) bool {
+	for level := 0; level < numLevels-1; level++ {
+		if db.compactionScore(v, level) >= 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// pickCompaction chooses the level with the highest score and the files to
+// compact from it, or returns nil if no level is over its limit.
+//
+// From L0 it takes the oldest L0CompactionTrigger files: newer L0 files may
+// stay behind because they shadow the outputs anyway. From a deeper level it
+// takes one file; see pickFile.
+func (db *DB) pickCompaction(v *version) *compaction {
+	best, bestScore := -1, 1.0
+	for level := 0; level < numLevels-1; level++ {
+		if s := db.compactionScore(v, level); s >= bestScore && (best < 0 || s > bestScore) {
+			best, bestScore = level, s
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	c := &compaction{level: best}
+	if best == 0 {
+		n := db.compactTrigger
+		if len(v.levels[0]) < n {
+			n = len(v.levels[0])
+		}
+		c.inputs = v.levels[0][len(v.levels[0])-n:]
+	} else {
+		c.inputs = []*fileMeta{db.pickFile(v, best)}
+	}
+
+	smallest, largest := keyRange(c.inputs)
+	if smallest != nil {
+		c.next = v.overlapping(c.outputLevel(), smallest, largest)
+	}
+	return c
+}
+
+// pickFile chooses the file to compact out of level (1 or deeper). A level
+// that is within its size limit is only compacted for its tombstones and
+// gives up its densest file; otherwise the file with the best fileScore
+// goes.
+func (db *DB) pickFile(v *version, level int) *fileMeta {
+	files := v.levels[level]
+	if db.sizeScore(v, level) < 1 {
+		var densest *fileMeta
+		for _, f := range files {
+			if f.tombstones() >= tombstoneCompactionMinCount &&
+				(densest == nil || f.tombstoneDensity() > densest.tombstoneDensity()) {
+				densest = f
+			}
+		}
+		if densest != nil {
+			return densest
+		}
+	}
+
+	now := db.clock.Now().UnixNano()
+	pick, best := files[0], -1.0
+	for _, f := range files {
+		if s := db.fileScore(v, f, now); s > best {
+			pick, best = f, s
+		}
+	}
+	return pick
+}
+
+// keyRange returns the union of the bounds of files, or nils if all of them
+// are empty.
+func keyRange(files []*fileMeta) (smallest, largest []byte) {
+	for _, f := range files {
+		if f.smallest == nil {
+			continue
+		}
+		if smallest == nil || bytes.Compare(f.smallest, smallest) < 0 {
+			smallest = f.smallest
+		}
+		if largest == nil || bytes.Compare(f.largest, largest) > 0 {
+			largest = f.largest
+		}
+	}
+	return smallest, largest
+}
+
+// olderFiles are the files outside a compaction that may hold older versions
+// of its keys: L0 files behind its oldest L0 input and every file below its
+// output level. Other files of the input and output levels either are
+// newer or do not overlap the compaction at all. A tombstone may only be
+// dropped if none of these files can contain its key; otherwise dropping it
+// would bring an older value back to life.
+type olderFiles struct {
+	l0     []*fileMeta   // overlapping key ranges, checked one by one
+	levels [][]*fileMeta // one sorted, disjoint slice per deeper level
+	pos    []int         // per level cursor for mayContain
+}
+
+// olderFiles collects the files older than c in v.
+func (c *compaction) olderFiles(v *version) *olderFiles {
+	o := &olderFiles{}
+	if c.level == 0 && len(c.inputs) > 0 {
+		oldest := c.inputs[len(c.inputs)-1]
+		for i, f := range v.levels[0] {
+			if f.id == oldest.id {
+				o.l0 = v.levels[0][i+1:]
+				break
+			}
+		}
+	}
+	for level := c.outputLevel() + 1; level < numLevels; level++ {
+		if len(v.levels[level]) > 0 {
+			o.levels = append(o.levels, v.levels[level])
+		}
+	}
+	o.pos = make([]int, len(o.levels))
+	return o
+}
+
+// mayContain reports whether an older file's key range holds key. Keys must
+// be passed in increasing order, which lets each level keep a cursor
+// instead of searching from scratch.
+func (o *olderFiles) mayContain(key []byte) bool {
+	for _, f := range o.l0 {
+		if f.contains(key) {
+			return true
+		}
+	}
+	for i, files := range o.levels {
+		for o.pos[i] < len(files) && bytes.Compare(files[o.pos[i]].largest, key) < 0 {
+			o.pos[i]++
+		}
+		if o.pos[i] < len(files) && files[o.pos[i]].contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps reports whether an older file's key range intersects the range
+// tombstone rt.
+func (o *olderFiles) overlaps(rt memtable.RangeTombstone) bool {
+	for _, f := range o.l0 {
+		if f.overlaps(rt.Start, rt.End) {
+			return true
+		}
+	}
+	for _, files := range o.levels {
+		for _, f := range files {
+			if f.overlaps(rt.Start, rt.End) {
+				return true
+			}
+		}
+	}
+	return false
+}
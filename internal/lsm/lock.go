@@ -0,0 +1,86 @@
+package lsm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ErrLocked is returned by Open when another process already holds the data
+// directory.
+var ErrLocked = errors.New("lsm: data directory is locked by another process")
+
+const (
+	lockFileName = "LOCK"
+	// readersLockFileName is share-locked by every Secondary reader, which
+	// does not take LOCK, so that Move can still tell the directory is in use.
+	readersLockFileName = "READERS"
+)
+
+// dirLock is a process-wide lock on a data directory. Two processes writing
+// the same manifest and WAL would corrupt both.
+type dirLock struct {
+	f    *os.File
+	next *dirLock // a lock taken along with this one, released with it
+}
+
+// lockDir acquires the LOCK file in dir. The holder's pid is written to the
+// file to help diagnose a stuck lock; it is informational only.
+func lockDir(dir string) (*dirLock, error) {
+	return lockPath(filepath.Join(dir, lockFileName), false)
+}
+
+// lockDirs locks dataDir and, if it is another directory, walDir, the
+// Options.WALDir of the DB; walDir may be empty.
+func lockDirs(dataDir, walDir string) (*dirLock, error) {
+	lock, err := lockDir(dataDir)
+	if err != nil || walDir == "" || walDir == dataDir {
+		return lock, err
+	}
+	if lock.next, err = lockDir(walDir); err != nil {
+		lock.release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// lockReaders acquires the READERS file in dir: shared for a Secondary
+// reader, exclusive to keep them all out.
+func lockReaders(dir string, shared bool) (*dirLock, error) {
+	return lockPath(filepath.Join(dir, readersLockFileName), shared)
+}
+
+func lockPath(path string, shared bool) (*dirLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, shared); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Several processes hold a shared lock; none of them owns the file.
+	if !shared {
+		if err := f.Truncate(0); err == nil {
+			f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		}
+	}
+	return &dirLock{f: f}, nil
+}
+
+// release drops the lock. The LOCK file itself is left in place.
+func (l *dirLock) release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	err := unlockFile(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	if nerr := l.next.release(); err == nil {
+		err = nerr
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package lsm
+
+import "os"
+
+// lockFile is a no-op on platforms without flock; the LOCK file is still
+// created so the layout is the same everywhere.
+func lockFile(f *os.File, shared bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,214 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/memtable"
+)
+
+// ErrCompactionAborted is returned by Compact when a compaction it ran was
+// abandoned, e.g. because writing an output failed. The error itself went
+// to Options.OnBackgroundError; CompactionMetrics counts it by reason.
+var ErrCompactionAborted = errors.New("lsm: compaction aborted")
+
+// Flush writes the memtables to SSTables and waits until they are in the
+// manifest, e.g. to make recent writes visible to Secondary readers or to
+// keep the next Open from replaying a long WAL. Writes made while it runs
+// may or may not be included. It returns the background error if a flush
+// fails.
+func (db *DB) Flush() error {
+	if err := db.writeErr(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Rotate the active memtable once the queue has room for it.
+	for {
+		if err := db.flushStateLocked(); err != nil {
+			return err
+		}
+		if db.active.Entries() == 0 {
+			break
+		}
+		if len(db.immutables) < db.maxImmutables {
+			if err := db.rotateMemtableLocked(); err != nil {
+				return err
+			}
+			break
+		}
+		db.stallCond.Wait()
+	}
+
+	// Flushes run oldest first, so the newest queued memtable is the last
+	// to leave the queue.
+	if len(db.immutables) == 0 {
+		return nil
+	}
+	newest := db.immutables[0]
+	for {
+		if err := db.flushStateLocked(); err != nil {
+			return err
+		}
+		if !containsMemtable(db.immutables, newest) {
+			return nil
+		}
+		db.stallCond.Wait()
+	}
+}
+
+// flushStateLocked reports why Flush cannot go on. Must be called with mu
+// held.
+func (db *DB) flushStateLocked() error {
+	switch {
+	case db.closing || db.closed:
+		return ErrClosed
+	case db.bgErr != nil:
+		return db.bgErr
+	}
+	return nil
+}
+
+// Compact runs compactions until no level is over its limit, waiting for
+// those already running in the background. It is useful after a bulk load
+// or a large DeleteRange, to settle the levels before a read-heavy phase.
+func (db *DB) Compact() (err error) {
+	defer db.journal(AdminOpCompact, "", db.clock.Now(), &err)
+	if err := db.writeErr(); err != nil {
+		return err
+	}
+	for {
+		db.compactWg.Wait()
+		db.mu.RLock()
+		closing := db.closing || db.closed
+		db.mu.RUnlock()
+		v := db.currentVersion()
+		if closing || v == nil {
+			if v != nil {
+				v.unref()
+			}
+			return ErrClosed
+		}
+		needed := db.needsCompaction(v)
+		v.unref()
+		if !needed {
+			return nil
+		}
+
+		before := db.compactStats.snapshot()
+		db.compactWg.Add(1)
+		db.compactSSTables()
+		after := db.compactStats.snapshot()
+		if after.Completed == before.Completed {
+			if after.Aborted > before.Aborted {
+				return ErrCompactionAborted
+			}
+			if after.Deferred > before.Deferred {
+				return ErrCompactionDeferred
+			}
+		}
+	}
+}
+
+func containsMemtable(mts []*memtable.Memtable, mt *memtable.Memtable) bool {
+	for _, m := range mts {
+		if m == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// PurgeDeletedBefore compacts away the tombstones, and the older versions
+// they delete, in every SSTable written entirely before a horizon: the
+// highest sequence number seq and the time t, either of which may be left
+// zero. It is meant for operators who archive deletes elsewhere, e.g. in
+// backups or replicas, and want to choose when their space is given back
+// rather than leave it to the size-based compaction schedule.
+//
+// It runs synchronously, moving the tombstones of each such file down one
+// level per compaction until they reach a level with nothing older beneath
+// them, where they are dropped. Files whose sequence numbers or times are
+// unknown are left alone, as are tombstones still in memtables; call Flush
+// first to include those.
+func (db *DB) PurgeDeletedBefore(seq uint64, t time.Time) (err error) {
+	defer db.journal(AdminOpPurgeDeleted, fmt.Sprintf("seq=%d time=%s", seq, t.UTC().Format(time.RFC3339Nano)), db.clock.Now(), &err)
+	// The horizon bounds files the way a recovery target bounds records.
+	h := recoveryTarget{seq: seq, t: t}
+	if !h.isSet() {
+		return fmt.Errorf("lsm: purge horizon not set: %w", os.ErrInvalid)
+	}
+	if err := db.writeErr(); err != nil {
+		return err
+	}
+	pick := func(v *version) *compaction { return pickPurgeCompaction(v, h) }
+	for {
+		db.compactWg.Wait()
+		v := db.currentVersion()
+		if v == nil {
+			return ErrClosed
+		}
+		db.mu.RLock()
+		closing := db.closing || db.closed
+		db.mu.RUnlock()
+		c := pickPurgeCompaction(v, h)
+		v.unref()
+		if closing {
+			return ErrClosed
+		}
+		if c == nil {
+			return nil
+		}
+
+		before := db.compactStats.snapshot()
+		db.compactWg.Add(1)
+		db.runCompaction(pick)
+		after := db.compactStats.snapshot()
+		if after.Completed == before.Completed {
+			if after.Aborted > before.Aborted {
+				return ErrCompactionAborted
+			}
+			if after.Deferred > before.Deferred {
+				return ErrCompactionDeferred
+			}
+		}
+	}
+}
+
+// pickPurgeCompaction returns a compaction of the shallowest file of v that
+// holds tombstones and was written before h, or nil if there is none. An L0
+// file takes every older L0 file along, which it must not move above.
+func pickPurgeCompaction(v *version, h recoveryTarget) *compaction {
+	for level := 0; level < numLevels-1; level++ {
+		files := v.levels[level]
+		for i, f := range files {
+			if f.tombstones() == 0 || !purgeable(f, h) {
+				continue
+			}
+			c := &compaction{level: level, inputs: []*fileMeta{f}}
+			if level == 0 {
+				c.inputs = files[i:]
+			}
+			smallest, largest := keyRange(c.inputs)
+			if smallest != nil {
+				c.next = v.overlapping(c.outputLevel(), smallest, largest)
+			}
+			return c
+		}
+	}
+	return nil
+}
+
+// purgeable reports whether every record of f was written before h.
+func purgeable(f *fileMeta, h recoveryTarget) bool {
+	if h.seq > 0 && (f.maxSeq == 0 || f.maxSeq > h.seq) {
+		return false
+	}
+	if !h.t.IsZero() && (f.maxTime == 0 || f.maxTime > h.t.UnixNano()) {
+		return false
+	}
+	return true
+}
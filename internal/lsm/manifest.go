@@ -1,10 +1,14 @@
 package lsm
 
 import (
-	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -17,93 +21,275 @@ import (
 //     which is critical for correct query results (newer data overrides older).
 //  2. Validity tracking: After compaction, old SSTable files are deleted but may
 //     still exist temporarily. Manifest only lists valid, active SSTables.
-//  3. Atomic updates: Using temp file + rename ensures Manifest updates are atomic,
-//     preventing corruption during crashes.
+//  3. Atomic updates: every change is one checksummed record appended to the
+//     log, or a complete new manifest renamed into place, so a crash never
+//     leaves a half-applied change behind.
 //  4. Portability: Relative paths in Manifest allow moving the entire data directory.
 //
-// Manifest file format:
-//   - One SSTable path per line (relative to dataDir)
-//   - Order: newest SSTable at the end (we read in reverse order)
-//   - Example:
-//     active-123.sst
-//     active-456.sst
-//     compact-789-0.sst
+// Manifest file format, a log of version edits:
+//   - The magic "SILTMAN1", then records of: a CRC-32 (IEEE) of the rest of
+//     the record, the payload length, both little-endian uint32s, and the
+//     payload, an encoded versionEdit.
+//   - The first record is a snapshot: the engine version, the format features
+//     in use, the identity of the DB (see Identity), and every live file. Each later record is the edit of one flush,
+//     which adds an L0 file, or one compaction, which deletes its inputs and
+//     adds its outputs in the same record.
+//   - Replaying the records lists deeper levels first, then the L0 files in
+//     the order they were added, so the newest L0 file is last (we read in
+//     reverse order).
+//   - A record cut short by a crash is ignored; its change had not taken
+//     effect yet. A bad checksum anywhere before the end is corruption.
+//   - The log is replaced by a fresh snapshot once edits make up most of it,
+//     and by every writable Open.
+//
+// Manifests written before the log format are text, one SSTable per line:
+// path (relative to dataDir, with forward slashes), then optionally a tab,
+// the highest WAL sequence number in the file, a tab, and the unix-nano time
+// of that record, and a fourth field with the level for files below L0. A
+// first line starting with "#siltkv" records the engine version and
+// features. They are still read, and converted by a writable Open:
+//
+//	#siltkv	engine=1	features=seqnums,levels,sstable-v6
+//	compact-789-0.sst	42	1700000005000000000	1
+//	active-123.sst	17	1700000000000000000
+//	active-456.sst	42	1700000005000000000
 const manifestFileName = "MANIFEST"
 
+const (
+	manifestMagic            = "SILTMAN1"
+	manifestRecordHeaderSize = 8 // CRC and payload length
+)
+
+// ErrManifestCorrupt is returned by Open when a manifest record other than
+// the last one fails its checksum or cannot be decoded. Repair rebuilds the
+// manifest from the SSTables.
+var ErrManifestCorrupt = errors.New("lsm: manifest is corrupt")
+
+// ErrInvalidManifestPath is returned by Open when a manifest entry names a
+// file outside the data directory, e.g. through ".." or an absolute path
+// from a tampered or foreign manifest.
+var ErrInvalidManifestPath = errors.New("lsm: manifest entry outside data directory")
+
+// manifestEntry is one line of the manifest.
+type manifestEntry struct {
+	path    string
+	maxSeq  uint64 // 0 if unknown
+	maxTime int64  // unix nanos; 0 if unknown
+	level   int
+}
+
+// parseManifestLine parses one line of a text manifest.
+func parseManifestLine(dataDir, line string) (manifestEntry, error) {
+	fields := strings.Split(line, "\t")
+	e := manifestEntry{path: fields[0]}
+	if len(fields) == 3 || len(fields) == 4 {
+		var err error
+		if e.maxSeq, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return e, fmt.Errorf("manifest: bad sequence in %q: %w", line, err)
+		}
+		if e.maxTime, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return e, fmt.Errorf("manifest: bad time in %q: %w", line, err)
+		}
+		if len(fields) == 4 {
+			if e.level, err = strconv.Atoi(fields[3]); err != nil || e.level < 0 || e.level >= numLevels {
+				return e, fmt.Errorf("manifest: bad level in %q", line)
+			}
+		}
+	} else if len(fields) != 1 {
+		return e, fmt.Errorf("manifest: malformed line %q", line)
+	}
+	var err error
+	e.path, err = resolveManifestPath(dataDir, e.path)
+	return e, err
+}
+
+// resolveManifestPath converts a path as stored in the manifest to an
+// absolute one. Old manifests may hold absolute paths; those are accepted
+// as long as they point into dataDir.
+func resolveManifestPath(dataDir, stored string) (string, error) {
+	path := filepath.FromSlash(stored)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dataDir, path)
+	}
+	if rel, err := filepath.Rel(dataDir, path); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidManifestPath, stored)
+	}
+	return path, nil
+}
+
+// storedManifestPath is the inverse of resolveManifestPath: path relative
+// to dataDir, with forward slashes.
+func storedManifestPath(dataDir, path string) string {
+	rel, err := filepath.Rel(dataDir, path)
+	if err != nil {
+		// If relative path fails, use absolute
+		rel = path
+	}
+	return filepath.ToSlash(rel)
+}
+
 // manifestPath returns the path to the manifest file
 func manifestPath(dataDir string) string {
 	return filepath.Join(dataDir, manifestFileName)
 }
 
-// loadManifest loads SSTable paths from manifest file.
+// loadManifest loads SSTable entries from manifest file.
 // This is called during DB.Open() to recover the list of valid SSTables.
 // Returns empty slice if manifest doesn't exist (first run, no SSTables yet).
-func loadManifest(dataDir string) ([]string, error) {
-	manifestPath := manifestPath(dataDir)
+func loadManifest(dataDir string) ([]manifestEntry, error) {
+	entries, _, err := readManifest(dataDir)
+	return entries, err
+}
+
+// readManifest is readManifestIdentity without the identity.
+func readManifest(dataDir string) (entries []manifestEntry, repair bool, err error) {
+	entries, _, repair, err = readManifestIdentity(dataDir)
+	return entries, repair, err
+}
 
-	file, err := os.Open(manifestPath)
+// readManifestIdentity is loadManifest that also returns the identity of
+// the DB, zero for a manifest without one, and reports whether the manifest
+// should be rewritten before the next edit is appended: because it ends in
+// a torn record, holds edits that a snapshot would fold in, or is in the
+// text format. The identity is returned even when a later record is
+// corrupt, for Repair to keep.
+//
+// A manifest written by a newer engine that uses features this binary
+// lacks fails with an *IncompatibleError.
+func readManifestIdentity(dataDir string) (entries []manifestEntry, id Identity, repair bool, err error) {
+	data, err := os.ReadFile(manifestPath(dataDir))
 	if err != nil {
 		if os.IsNotExist(err) {
 			// First run, no manifest yet
-			return []string{}, nil
+			return []manifestEntry{}, id, false, nil
 		}
-		return nil, err
+		return nil, id, false, err
+	}
+	if !bytes.HasPrefix(data, []byte(manifestMagic)) {
+		entries, err := readTextManifest(dataDir, data)
+		return entries, id, true, err
 	}
-	defer file.Close()
 
-	var paths []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+	entries = []manifestEntry{}
+	records := 0
+	for pos := len(manifestMagic); pos < len(data); {
+		rest := data[pos:]
+		if len(rest) < manifestRecordHeaderSize {
+			repair = true // torn
+			break
 		}
-		// Convert to absolute path if relative
-		if !filepath.IsAbs(line) {
-			line = filepath.Join(dataDir, line)
+		n := int(binary.LittleEndian.Uint32(rest[4:8]))
+		if n > len(rest)-manifestRecordHeaderSize {
+			repair = true // torn
+			break
 		}
-		paths = append(paths, line)
+		record := rest[:manifestRecordHeaderSize+n]
+		if crc32.ChecksumIEEE(record[4:]) != binary.LittleEndian.Uint32(record[:4]) {
+			if len(record) == len(rest) {
+				// A bad last record is a write a crash cut short.
+				repair = true
+				break
+			}
+			return nil, id, false, fmt.Errorf("%w: bad checksum at offset %d", ErrManifestCorrupt, pos)
+		}
+		edit, err := decodeVersionEdit(dataDir, record[manifestRecordHeaderSize:])
+		if err != nil {
+			return nil, id, false, fmt.Errorf("%w: record at offset %d: %v", ErrManifestCorrupt, pos, err)
+		}
+		if records == 0 {
+			if err := checkFeatures(edit.engine, edit.features); err != nil {
+				return nil, id, false, err
+			}
+			id = edit.identity
+		}
+		entries = edit.apply(entries)
+		records++
+		pos += len(record)
 	}
+	return entries, id, repair || records != 1, nil
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+// readTextManifest reads a manifest written before the log format.
+//
+// Every line was written with its newline, so a final line without one is
+// an append a crash cut short. It is left out: the flush that appended it
+// had not removed its WAL yet, so its data is replayed.
+func readTextManifest(dataDir string, data []byte) ([]manifestEntry, error) {
+	if n := bytes.LastIndexByte(data, '\n'); n < len(data)-1 {
+		data = data[:n+1]
 	}
-
-	return paths, nil
+	lines := strings.Split(string(data), "\n")
+	if len(lines) > 0 && strings.HasPrefix(lines[0], manifestHeaderPrefix) {
+		if err := checkManifestHeader(strings.TrimSpace(lines[0])); err != nil {
+			return nil, err
+		}
+		lines = lines[1:]
+	}
+	entries := []manifestEntry{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		e, err := parseManifestLine(dataDir, line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
 }
 
-// appendToManifest appends a new SSTable path to the manifest.
-// This is called after each flush when a new SSTable is created.
-// New SSTables are appended (newest at the end), but we read in reverse order
-// to maintain newest-first order in memory.
-func appendToManifest(dataDir string, sstPath string) error {
+// appendManifestEdit appends e to the manifest as one record and returns
+// the manifest's new size. A flush or compaction takes effect with it: the
+// record is durable when it returns, before the WAL or inputs it replaces
+// are deleted. A missing manifest is started with an empty snapshot of the
+// DB id.
+func appendManifestEdit(dataDir string, id Identity, e *versionEdit) (int64, error) {
 	manifestPath := manifestPath(dataDir)
 
-	// Convert to relative path for portability
-	relPath, err := filepath.Rel(dataDir, sstPath)
-	if err != nil {
-		// If relative path fails, use absolute
-		relPath = sstPath
-	}
-
+	_, err := os.Stat(manifestPath)
+	created := os.IsNotExist(err)
 	file, err := os.OpenFile(manifestPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer file.Close()
 
-	_, err = fmt.Fprintln(file, relPath)
-	return err
+	var buf []byte
+	if created {
+		buf = append([]byte(manifestMagic), encodeManifestRecord(newSnapshotEdit(id, nil).encode(dataDir))...)
+	}
+	buf = append(buf, encodeManifestRecord(e.encode(dataDir))...)
+	// A record cut short by a failed write is cut off again, so that a
+	// retried append does not land behind it.
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Truncate(fi.Size())
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Truncate(fi.Size())
+		return 0, err
+	}
+	if created {
+		if err := syncDir(dataDir); err != nil {
+			return 0, err
+		}
+	}
+	return fi.Size() + int64(len(buf)), nil
 }
 
-// rewriteManifest rewrites the entire manifest with current SSTable list.
-// This is used after compaction to:
-//   - Remove paths of deleted SSTables (that were merged)
-//   - Add paths of newly created merged SSTables
-//   - Maintain correct order of all valid SSTables
+// rewriteManifest replaces the manifest by a snapshot of entries, in order,
+// for the DB id. This is used to fold the edits logged so far into one
+// record, to convert a text manifest, and by tests and backups to write a
+// manifest from scratch.
 //
 // Uses atomic update (temp file + rename) to prevent corruption during crashes.
-func rewriteManifest(dataDir string, sstPaths []string) error {
+func rewriteManifest(dataDir string, id Identity, entries []manifestEntry) error {
 	manifestPath := manifestPath(dataDir)
 
 	// Create temp file
@@ -114,16 +300,10 @@ func rewriteManifest(dataDir string, sstPaths []string) error {
 	}
 	defer file.Close()
 
-	// Write all paths (as relative paths)
-	for _, sstPath := range sstPaths {
-		relPath, err := filepath.Rel(dataDir, sstPath)
-		if err != nil {
-			relPath = sstPath
-		}
-		if _, err := fmt.Fprintln(file, relPath); err != nil {
-			os.Remove(tmpPath)
-			return err
-		}
+	buf := append([]byte(manifestMagic), encodeManifestRecord(newSnapshotEdit(id, entries).encode(dataDir))...)
+	if _, err := file.Write(buf); err != nil {
+		os.Remove(tmpPath)
+		return err
 	}
 
 	// Sync and close
@@ -136,6 +316,55 @@ func rewriteManifest(dataDir string, sstPaths []string) error {
 		return err
 	}
 
-	// Atomic rename
-	return os.Rename(tmpPath, manifestPath)
+	// Atomic rename, made durable by syncing the directory
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		return err
+	}
+	return syncDir(dataDir)
+}
+
+// encodeManifestRecord frames payload as a manifest record.
+func encodeManifestRecord(payload []byte) []byte {
+	record := make([]byte, manifestRecordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(len(payload)))
+	copy(record[manifestRecordHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(record[:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// manifestMinRewriteSize is the manifest size below which edits are never
+// folded into a snapshot.
+const manifestMinRewriteSize = 64 << 10
+
+// logManifestEdit appends e to the manifest. Once the edits logged since the
+// last snapshot outgrow it, the manifest is replaced by a snapshot of v, the
+// version e leads to. Must be called with manifestMu held.
+//
+// Only the append decides whether e took effect. A failed snapshot leaves
+// the log as it was, and the next edit tries again.
+func (db *DB) logManifestEdit(e *versionEdit, v *version) error {
+	size, err := appendManifestEdit(db.dataDir, db.identity, e)
+	if err != nil {
+		return err
+	}
+	if size <= max(manifestMinRewriteSize, 2*db.manifestBase) {
+		return nil
+	}
+	db.snapshotManifest(v.manifest())
+	return nil
+}
+
+// snapshotManifest replaces the manifest by a snapshot of entries and
+// records its size. Must be called with manifestMu held, or before the DB
+// is shared.
+func (db *DB) snapshotManifest(entries []manifestEntry) error {
+	if err := rewriteManifest(db.dataDir, db.identity, entries); err != nil {
+		return err
+	}
+	fi, err := os.Stat(manifestPath(db.dataDir))
+	if err != nil {
+		return err
+	}
+	db.manifestBase = fi.Size()
+	return nil
 }
@@ -0,0 +1,192 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// versionEdit is the payload of one manifest record: a change to the set of
+// live files. The first record of a manifest is a snapshot, an edit that
+// also records the engine version, format features and identity of the DB
+// and adds every file.
+type versionEdit struct {
+	engine   int      // EngineVersion that wrote the snapshot; 0 in later edits
+	features []string // format features in use; snapshot only
+	identity Identity // snapshot only; zero in manifests from before identities
+	deleted  []string // paths of files no longer live
+	added    []manifestEntry
+}
+
+// Tags of the fields of an encoded versionEdit. Each field is a tag byte
+// followed by its value; strings are a uvarint length and the bytes, paths
+// are stored as by storedManifestPath.
+const (
+	editTagEngine  = 1 // uvarint
+	editTagFeature = 2 // string
+	editTagDelete  = 3 // path
+	editTagAdd     = 4 // path, uvarint level, uvarint maxSeq, varint maxTime
+	editTagID      = 5 // string UUID, varint unix-nano creation time, uvarint engine
+)
+
+var errEditTruncated = errors.New("truncated edit")
+
+// newSnapshotEdit returns the edit that starts a manifest of the DB id
+// holding entries.
+func newSnapshotEdit(id Identity, entries []manifestEntry) *versionEdit {
+	return &versionEdit{engine: EngineVersion, features: writtenFeatures, identity: id, added: entries}
+}
+
+// apply returns entries with e's deleted files removed and its added files
+// appended. Entries stay ordered as in a snapshot: deeper levels first, so
+// that L0 files, which keep the order they were added in, always follow the
+// data they shadow.
+func (e *versionEdit) apply(entries []manifestEntry) []manifestEntry {
+	if len(e.deleted) > 0 {
+		entries = slices.DeleteFunc(entries, func(m manifestEntry) bool {
+			return slices.Contains(e.deleted, m.path)
+		})
+	}
+	entries = append(entries, e.added...)
+	slices.SortStableFunc(entries, func(a, b manifestEntry) int {
+		return b.level - a.level
+	})
+	return entries
+}
+
+// encode returns the binary form of e.
+func (e *versionEdit) encode(dataDir string) []byte {
+	var buf []byte
+	putString := func(s string) {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	if e.engine > 0 {
+		buf = append(buf, editTagEngine)
+		buf = binary.AppendUvarint(buf, uint64(e.engine))
+	}
+	for _, f := range e.features {
+		buf = append(buf, editTagFeature)
+		putString(f)
+	}
+	if !e.identity.IsZero() {
+		buf = append(buf, editTagID)
+		putString(e.identity.ID)
+		buf = binary.AppendVarint(buf, e.identity.Created.UnixNano())
+		buf = binary.AppendUvarint(buf, uint64(e.identity.EngineVersion))
+	}
+	for _, p := range e.deleted {
+		buf = append(buf, editTagDelete)
+		putString(storedManifestPath(dataDir, p))
+	}
+	for _, m := range e.added {
+		buf = append(buf, editTagAdd)
+		putString(storedManifestPath(dataDir, m.path))
+		buf = binary.AppendUvarint(buf, uint64(m.level))
+		buf = binary.AppendUvarint(buf, m.maxSeq)
+		buf = binary.AppendVarint(buf, m.maxTime)
+	}
+	return buf
+}
+
+// decodeVersionEdit is the inverse of versionEdit.encode.
+func decodeVersionEdit(dataDir string, data []byte) (*versionEdit, error) {
+	e := &versionEdit{}
+	uvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errEditTruncated
+		}
+		data = data[n:]
+		return v, nil
+	}
+	str := func() (string, error) {
+		n, err := uvarint()
+		if err != nil {
+			return "", err
+		}
+		if n > uint64(len(data)) {
+			return "", errEditTruncated
+		}
+		s := string(data[:n])
+		data = data[n:]
+		return s, nil
+	}
+	path := func() (string, error) {
+		s, err := str()
+		if err != nil {
+			return "", err
+		}
+		return resolveManifestPath(dataDir, s)
+	}
+
+	for len(data) > 0 {
+		tag := data[0]
+		data = data[1:]
+		switch tag {
+		case editTagEngine:
+			v, err := uvarint()
+			if err != nil {
+				return nil, err
+			}
+			e.engine = int(v)
+		case editTagFeature:
+			f, err := str()
+			if err != nil {
+				return nil, err
+			}
+			e.features = append(e.features, f)
+		case editTagID:
+			id, err := str()
+			if err != nil {
+				return nil, err
+			}
+			created, n := binary.Varint(data)
+			if n <= 0 {
+				return nil, errEditTruncated
+			}
+			data = data[n:]
+			engine, err := uvarint()
+			if err != nil {
+				return nil, err
+			}
+			e.identity = Identity{ID: id, Created: time.Unix(0, created), EngineVersion: int(engine)}
+		case editTagDelete:
+			p, err := path()
+			if err != nil {
+				return nil, err
+			}
+			e.deleted = append(e.deleted, p)
+		case editTagAdd:
+			var m manifestEntry
+			var err error
+			if m.path, err = path(); err != nil {
+				return nil, err
+			}
+			level, err := uvarint()
+			if err != nil {
+				return nil, err
+			}
+			if level >= numLevels {
+				return nil, fmt.Errorf("bad level %d", level)
+			}
+			m.level = int(level)
+			if m.maxSeq, err = uvarint(); err != nil {
+				return nil, err
+			}
+			t, n := binary.Varint(data)
+			if n <= 0 {
+				return nil, errEditTruncated
+			}
+			data = data[n:]
+			m.maxTime = t
+			e.added = append(e.added, m)
+		default:
+			// Tags are not skippable, so an unknown one cannot be read past.
+			return nil, fmt.Errorf("unknown tag %d", tag)
+		}
+	}
+	return e, nil
+}
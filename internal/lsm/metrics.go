@@ -0,0 +1,92 @@
+package lsm
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Reasons a compaction can be abandoned after it started writing outputs.
+const (
+	AbortReasonIOError       = "io_error"       // reading inputs or writing outputs failed
+	AbortReasonInputsChanged = "inputs_changed" // an input left the current version
+	AbortReasonClosed        = "closed"         // DB was closed before install
+)
+
+// CompactionMetrics is a point-in-time copy of the compaction counters.
+//
+// An aborted compaction discards every output file it produced; WastedBytes
+// is the on-disk size of those files and is the I/O that bought nothing.
+type CompactionMetrics struct {
+	Completed      uint64            // compactions installed into a version
+	Aborted        uint64            // compactions discarded after starting
+	AbortsByReason map[string]uint64 // keyed by AbortReason* constants
+	Retries        uint64            // compactions re-attempted after an abort
+	Deferred       uint64            // compactions not started for lack of disk space
+	BytesWritten   uint64            // output bytes of completed compactions
+	WastedBytes    uint64            // output bytes of aborted compactions
+	TotalDuration  time.Duration     // time spent in completed compactions, by Options.Clock
+}
+
+// compactionMetrics accumulates CompactionMetrics for a DB.
+type compactionMetrics struct {
+	mu sync.Mutex
+	m  CompactionMetrics
+}
+
+func (cm *compactionMetrics) recordCompleted(outputPaths []string, took time.Duration) {
+	written := filesSize(outputPaths)
+	cm.mu.Lock()
+	cm.m.Completed++
+	cm.m.BytesWritten += written
+	cm.m.TotalDuration += took
+	cm.mu.Unlock()
+}
+
+// recordAborted must be called before the outputs are removed from disk,
+// since it stats them to measure the wasted bytes.
+func (cm *compactionMetrics) recordAborted(reason string, outputPaths []string) {
+	wasted := filesSize(outputPaths)
+	cm.mu.Lock()
+	cm.m.Aborted++
+	if cm.m.AbortsByReason == nil {
+		cm.m.AbortsByReason = make(map[string]uint64)
+	}
+	cm.m.AbortsByReason[reason]++
+	cm.m.WastedBytes += wasted
+	cm.mu.Unlock()
+}
+
+func (cm *compactionMetrics) recordDeferred() {
+	cm.mu.Lock()
+	cm.m.Deferred++
+	cm.mu.Unlock()
+}
+
+func (cm *compactionMetrics) recordRetry() {
+	cm.mu.Lock()
+	cm.m.Retries++
+	cm.mu.Unlock()
+}
+
+func (cm *compactionMetrics) snapshot() CompactionMetrics {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	out := cm.m
+	out.AbortsByReason = make(map[string]uint64, len(cm.m.AbortsByReason))
+	for k, v := range cm.m.AbortsByReason {
+		out.AbortsByReason[k] = v
+	}
+	return out
+}
+
+// filesSize sums the sizes of the given files, ignoring any that are missing.
+func filesSize(paths []string) uint64 {
+	var total uint64
+	for _, p := range paths {
+		if st, err := os.Stat(p); err == nil {
+			total += uint64(st.Size())
+		}
+	}
+	return total
+}
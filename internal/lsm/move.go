@@ -0,0 +1,165 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Move relocates the closed DB in dataDir to newDir, which must not exist.
+// walDir is the Options.WALDir of the DB, if it has one: its WALs are moved
+// into the data directory first, so the DB at newDir opens without a
+// WALDir or with a new one. A crash before the data directory moves leaves
+// the DB where it was, with its WALs in either place.
+//
+// It holds the directory locks throughout, so it fails with ErrLocked while
+// the DB is open, including by a Secondary reader. The manifest is validated and rewritten with relative
+// paths first, so a manifest from an older version that recorded absolute
+// paths cannot keep pointing into the old location. Within one filesystem
+// the directory is renamed, which is atomic. Across filesystems the files
+// are copied into a temporary directory next to newDir and synced, which
+// is then renamed into place before dataDir is removed; a crash in between
+// leaves two complete copies, never a partial one under newDir.
+func Move(dataDir, walDir, newDir string) error {
+	src, err := canonicalDir(dataDir)
+	if err != nil {
+		return err
+	}
+	if walDir != "" {
+		if walDir, err = canonicalDir(walDir); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Lstat(newDir); err == nil {
+		return fmt.Errorf("lsm: move %s: %w", newDir, os.ErrExist)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	lock, err := lockDirs(src, walDir)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	readers, err := lockReaders(src, false)
+	if err != nil {
+		return err
+	}
+	defer readers.release()
+
+	entries, id, _, err := readManifestIdentity(src)
+	if err != nil {
+		return fmt.Errorf("failed to load manifest: %w", err)
+	}
+	if len(entries) > 0 {
+		if err := rewriteManifest(src, id, entries); err != nil {
+			return err
+		}
+	}
+	if walDir != "" && walDir != src {
+		if err := moveWALs(walDir, src); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(src, newDir); err == nil {
+		if err := syncDir(filepath.Dir(newDir)); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(src))
+	}
+
+	// Most likely a different filesystem: copy, then swap in.
+	tmp := newDir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := copyDataDir(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, newDir); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := syncDir(filepath.Dir(newDir)); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// moveWALs moves the WALs in walDir into dataDir: renamed, or copied and
+// synced before the original is removed. A crash in between leaves a WAL
+// in both, which Open replays from dataDir alone.
+func moveWALs(walDir, dataDir string) error {
+	segs, err := listWALSegments(walDir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		dst := filepath.Join(dataDir, filepath.Base(s.path))
+		if _, err := os.Lstat(dst); err == nil {
+			return fmt.Errorf("lsm: move %s: %w", dst, os.ErrExist)
+		}
+		if err := os.Rename(s.path, dst); err == nil {
+			continue
+		}
+		in, err := os.Open(s.path)
+		if err != nil {
+			return err
+		}
+		_, err = copyFile(in, dst+".tmp", -1)
+		in.Close()
+		if err == nil {
+			err = os.Rename(dst+".tmp", dst)
+		}
+		if err == nil {
+			err = syncDir(dataDir)
+		}
+		if err != nil {
+			os.Remove(dst + ".tmp")
+			return fmt.Errorf("lsm: move %s: %w", s.path, err)
+		}
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(dataDir); err != nil {
+		return err
+	}
+	return syncDir(walDir)
+}
+
+// copyDataDir copies the regular files of a closed data directory, except
+// its lock files, and its value log into a new directory dst and syncs
+// them.
+func copyDataDir(src, dst string) error {
+	if err := os.Mkdir(dst, 0o755); err != nil {
+		return err
+	}
+	names, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, d := range names {
+		if d.IsDir() && d.Name() == valueLogDirName {
+			if err := copyDataDir(filepath.Join(src, d.Name()), filepath.Join(dst, d.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		if !d.Type().IsRegular() || d.Name() == lockFileName || d.Name() == readersLockFileName {
+			continue
+		}
+		in, err := os.Open(filepath.Join(src, d.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = copyFile(in, filepath.Join(dst, d.Name()), -1)
+		in.Close()
+		if err != nil {
+			return fmt.Errorf("lsm: move %s: %w", d.Name(), err)
+		}
+	}
+	return syncDir(dst)
+}
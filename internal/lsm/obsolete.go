@@ -0,0 +1,179 @@
+package lsm
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/clock"
+)
+
+// FileDeletionHold keeps the DB from deleting the SSTables and WALs that
+// compactions and flushes make obsolete, until it is released. Backup and
+// Checkpoint hold one while they copy; HoldFileDeletions gives one to
+// tools that copy the data directory by themselves.
+type FileDeletionHold struct {
+	d    *fileDeleter
+	id   uint64
+	once sync.Once
+}
+
+// Release ends the hold and deletes the files it kept, unless another hold
+// or the grace period still keeps them. Releasing twice does nothing.
+func (h *FileDeletionHold) Release() {
+	h.once.Do(func() { h.d.release(h.id) })
+}
+
+// HoldFileDeletions stops the DB from deleting obsolete files until the
+// returned hold is released, so that the SSTables and WALs in the data
+// directory when it is called stay there for a copy. reason only serves
+// debugging. Holding deletions for long lets obsolete files pile up on
+// disk.
+func (db *DB) HoldFileDeletions(reason string) *FileDeletionHold {
+	return db.deleter.hold(reason)
+}
+
+const (
+	// obsoleteSuffix is appended to an obsolete file that could not be
+	// deleted, so that it no longer looks like a live file. Open deletes
+	// what is left of such files.
+	obsoleteSuffix = ".obsolete"
+
+	// obsoleteRetryDelay is the wait before retrying a deletion that
+	// failed, doubling with every failure up to obsoleteRetryMaxDelay.
+	obsoleteRetryDelay    = time.Second
+	obsoleteRetryMaxDelay = time.Minute
+)
+
+// fileDeleter deletes obsolete files: SSTables that a compaction replaced
+// once no version references them, and WALs once their memtable is
+// flushed. It defers each deletion while any hold is active and until the
+// file has been obsolete for the grace period. Deferred files are deleted by
+// the next deletion or release that finds them due, and at Close; a crash
+// leaves them to the next Open, which recognizes them as obsolete.
+//
+// Deleting a file fails on Windows while any process has it open, such as
+// a backup tool copying it. The file is then renamed out of the way if the
+// platform allows, and its deletion retried with backoff by the next
+// deletions or release, and at Close.
+type fileDeleter struct {
+	clock  clock.Clock
+	grace  time.Duration
+	remove func(path string) error // os.Remove, replaced by tests
+
+	mu       sync.Mutex
+	holds    map[uint64]string // reason per active hold
+	nextHold uint64
+	pending  []pendingDeletion
+	failures uint64 // deletions that failed, retried or not
+}
+
+type pendingDeletion struct {
+	path  string
+	since time.Time // when the file became obsolete
+	// After a failed deletion: the number of failures and when to retry.
+	failures int
+	retryAt  time.Time
+}
+
+func newFileDeleter(c clock.Clock, grace time.Duration) *fileDeleter {
+	return &fileDeleter{clock: c, grace: grace, remove: os.Remove, holds: make(map[uint64]string)}
+}
+
+// obsolete deletes the obsolete file at path, now or once nothing holds it
+// back.
+func (d *fileDeleter) obsolete(path string) {
+	if d == nil {
+		os.Remove(path)
+		return
+	}
+	d.mu.Lock()
+	d.pending = append(d.pending, pendingDeletion{path: path, since: d.clock.Now()})
+	d.mu.Unlock()
+	d.purge(false)
+}
+
+func (d *fileDeleter) hold(reason string) *FileDeletionHold {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextHold++
+	d.holds[d.nextHold] = reason
+	return &FileDeletionHold{d: d, id: d.nextHold}
+}
+
+func (d *fileDeleter) release(id uint64) {
+	d.mu.Lock()
+	delete(d.holds, id)
+	d.mu.Unlock()
+	d.purge(false)
+}
+
+// purge deletes the pending files that are due: all of them if force is
+// set, otherwise those obsolete for at least the grace period and not
+// waiting for a retry. Nothing is deleted while a hold is active.
+func (d *fileDeleter) purge(force bool) {
+	d.mu.Lock()
+	if len(d.holds) > 0 {
+		d.mu.Unlock()
+		return
+	}
+	now := d.clock.Now()
+	var due []pendingDeletion
+	kept := d.pending[:0]
+	for _, p := range d.pending {
+		if force || (now.Sub(p.since) >= d.grace && !now.Before(p.retryAt)) {
+			due = append(due, p)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	clear(d.pending[len(kept):])
+	d.pending = kept
+	d.mu.Unlock()
+
+	var failed []pendingDeletion
+	for _, p := range due {
+		path, err := d.deleteFile(p.path)
+		if err == nil {
+			continue
+		}
+		p.path = path
+		p.failures++
+		p.retryAt = now.Add(min(obsoleteRetryDelay<<(p.failures-1), obsoleteRetryMaxDelay))
+		failed = append(failed, p)
+	}
+	if len(failed) > 0 {
+		d.mu.Lock()
+		d.pending = append(d.pending, failed...)
+		d.failures += uint64(len(failed))
+		d.mu.Unlock()
+	}
+}
+
+// deleteFile deletes path. If that fails, it renames the file to carry
+// obsoleteSuffix, which Windows allows for some open files, so that a
+// later Open does not take it for a live file, and tries again under the
+// new name. It returns the name the file is left under on failure.
+func (d *fileDeleter) deleteFile(path string) (string, error) {
+	err := d.remove(path)
+	if err == nil || os.IsNotExist(err) {
+		return "", nil
+	}
+	if strings.HasSuffix(path, obsoleteSuffix) || os.Rename(path, path+obsoleteSuffix) != nil {
+		return path, err
+	}
+	path += obsoleteSuffix
+	if err := d.remove(path); err != nil && !os.IsNotExist(err) {
+		return path, err
+	}
+	return "", nil
+}
+
+// stats returns the number of files waiting to be deleted, of active holds
+// and of failed deletions.
+func (d *fileDeleter) stats() (pending, holds int, failures uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending), len(d.holds), d.failures
+}
@@ -0,0 +1,65 @@
+package lsm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// orphanDirName is the directory under the data directory that orphaned
+// files are moved to when Options.QuarantineOrphans is set.
+const orphanDirName = "orphans"
+
+// removeOrphans deletes the SSTables in dataDir that the manifest does not
+// list, and any leftover temp files and obsolete files whose deletion
+// failed, or moves them to the orphans directory if quarantine is set. It
+// returns the names of the files it handled.
+//
+// Such files are left behind by a crash: a compaction writes its outputs
+// before the manifest names them, and a flush writes its SSTable before the
+// manifest names it. In both cases the inputs are still live (the older
+// SSTables, or the WAL that is flushed again on Open), so the orphans hold
+// nothing that would be lost, and nothing would ever delete them otherwise.
+func removeOrphans(dataDir string, entries []manifestEntry, quarantine bool) ([]string, error) {
+	live := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		live[filepath.Clean(e.path)] = true
+	}
+	dirEntries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, de := range dirEntries {
+		name := de.Name()
+		if !de.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dataDir, name)
+		switch {
+		case strings.HasSuffix(name, ".tmp"), strings.HasSuffix(name, obsoleteSuffix):
+		case strings.HasSuffix(name, ".sst") && !live[path]:
+		default:
+			continue
+		}
+		if quarantine {
+			err = quarantineFile(dataDir, name)
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return orphans, err
+		}
+		orphans = append(orphans, name)
+	}
+	return orphans, nil
+}
+
+// quarantineFile moves the file name in dataDir to the orphans directory.
+func quarantineFile(dataDir, name string) error {
+	dir := filepath.Join(dataDir, orphanDirName)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(dataDir, name), filepath.Join(dir, name))
+}
@@ -0,0 +1,81 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Priority tells the DB how a read competes with other work.
+type Priority int
+
+const (
+	// PriorityForeground is the default: latency-sensitive reads whose
+	// latency is tracked to decide when background work should back off.
+	PriorityForeground Priority = iota
+	// PriorityBackground marks bulk or maintenance reads. They pause before
+	// touching SSTable blocks while foreground reads are slow.
+	PriorityBackground
+)
+
+// ReadOptions carries per-request read hints.
+type ReadOptions struct {
+	Priority Priority
+}
+
+const (
+	// defaultForegroundLatencyThreshold is the foreground read latency above
+	// which background reads start yielding.
+	defaultForegroundLatencyThreshold = 2 * time.Millisecond
+	// yieldSleep is how long a background read sleeps per back-off step.
+	yieldSleep = time.Millisecond
+	// maxYieldSteps caps the back-off per block so background work always
+	// makes progress, even under sustained foreground load.
+	maxYieldSteps = 20
+	// latencySampleTTL is how long a foreground sample stays relevant. With
+	// no recent foreground reads there is nothing to protect.
+	latencySampleTTL = time.Second
+)
+
+// latencyMonitor keeps an exponentially weighted moving average of
+// foreground read latency.
+type latencyMonitor struct {
+	threshold time.Duration // <= 0 disables yielding
+	ewma      int64         // atomic; nanoseconds
+	lastNanos int64         // atomic; wall time of the last sample
+}
+
+func newLatencyMonitor(threshold time.Duration) *latencyMonitor {
+	return &latencyMonitor{threshold: threshold}
+}
+
+// observe folds one foreground latency sample into the average (alpha = 1/8).
+func (m *latencyMonitor) observe(d time.Duration) {
+	for {
+		old := atomic.LoadInt64(&m.ewma)
+		next := old + (int64(d)-old)/8
+		if atomic.CompareAndSwapInt64(&m.ewma, old, next) {
+			break
+		}
+	}
+	atomic.StoreInt64(&m.lastNanos, time.Now().UnixNano())
+}
+
+// congested reports whether foreground reads are currently too slow.
+func (m *latencyMonitor) congested() bool {
+	if m.threshold <= 0 {
+		return false
+	}
+	last := atomic.LoadInt64(&m.lastNanos)
+	if last == 0 || time.Since(time.Unix(0, last)) > latencySampleTTL {
+		return false
+	}
+	return time.Duration(atomic.LoadInt64(&m.ewma)) > m.threshold
+}
+
+// yield blocks a background reader while the foreground is congested,
+// up to maxYieldSteps sleeps.
+func (m *latencyMonitor) yield() {
+	for i := 0; i < maxYieldSteps && m.congested(); i++ {
+		time.Sleep(yieldSleep)
+	}
+}
@@ -0,0 +1,68 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"runtime/pprof"
+	"sort"
+	"time"
+)
+
+// pprof label keys set on the DB's background goroutines. Profiles can be
+// filtered by them, e.g. with pprof -tagfocus=siltkv.op=compaction.
+const (
+	LabelDB  = "siltkv.db"  // data directory of the DB
+	LabelOp  = "siltkv.op"  // BackgroundOp* of the work, or a LabelOp* constant
+	LabelJob = "siltkv.job" // number of the flush or compaction, per DB
+)
+
+// LabelOpWALSync is the LabelOp of a WAL writer's periodic fsync loop.
+const LabelOpWALSync = "wal_sync"
+
+// cpuProfileDuration is how long Profile samples for the "cpu" kind.
+const cpuProfileDuration = 30 * time.Second
+
+// profileLabels returns the pprof label pairs for background work of kind
+// op, followed by Options.ProfileLabels in key order. job is left out when
+// empty. The built-in keys win over user labels of the same name.
+func (db *DB) profileLabels(op, job string) []string {
+	labels := []string{LabelDB, db.dataDir, LabelOp, op}
+	if job != "" {
+		labels = append(labels, LabelJob, job)
+	}
+	keys := make([]string, 0, len(db.userLabels))
+	for k := range db.userLabels {
+		if k != LabelDB && k != LabelOp && k != LabelJob {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		labels = append(labels, k, db.userLabels[k])
+	}
+	return labels
+}
+
+// Profile writes a pprof profile of the process in the compressed protobuf
+// format, as read by go tool pprof. kind is "cpu", which samples for 30
+// seconds, or the name of a runtime profile such as "heap", "allocs",
+// "goroutine", "block", "mutex" or "threadcreate". Samples taken in the
+// DB's background goroutines carry the Label* labels.
+//
+// The profile covers the whole process, not just this DB; filter it by
+// LabelDB to tell several DBs apart.
+func (db *DB) Profile(w io.Writer, kind string) error {
+	if kind == "cpu" {
+		if err := pprof.StartCPUProfile(w); err != nil {
+			return fmt.Errorf("lsm: cpu profile: %w", err)
+		}
+		time.Sleep(cpuProfileDuration)
+		pprof.StopCPUProfile()
+		return nil
+	}
+	p := pprof.Lookup(kind)
+	if p == nil {
+		return fmt.Errorf("lsm: unknown profile %q", kind)
+	}
+	return p.WriteTo(w, 0)
+}
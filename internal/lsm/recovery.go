@@ -0,0 +1,70 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/memtable"
+	"github.com/return2faye/SiltKV/internal/wal"
+)
+
+var (
+	// ErrReadOnly is returned by writes to a DB opened with Options.ReadOnly
+	// or at a recovery target.
+	ErrReadOnly = errors.New("lsm: db is read-only")
+	// ErrRecoveryTargetUnavailable is returned by Open when data newer than
+	// the requested recovery target has already been flushed to SSTables,
+	// so the historical view can no longer be reconstructed.
+	ErrRecoveryTargetUnavailable = errors.New("lsm: recovery target is older than flushed data")
+)
+
+// recoveryTarget is the point in time a read-only DB is opened at.
+type recoveryTarget struct {
+	seq uint64    // 0 means no sequence bound
+	t   time.Time // zero means no time bound
+}
+
+func (rt recoveryTarget) isSet() bool {
+	return rt.seq > 0 || !rt.t.IsZero()
+}
+
+// past reports whether a record with the given sequence number and time lies
+// beyond the target. Records without sequence information (written by older
+// versions) never do.
+func (rt recoveryTarget) past(seq uint64, t time.Time) bool {
+	if rt.seq > 0 && seq > rt.seq {
+		return true
+	}
+	return !rt.t.IsZero() && !t.IsZero() && t.After(rt.t)
+}
+
+// checkRecoveryTarget fails if any SSTable holds records beyond rt. SSTables
+// carry no per-record sequence numbers, so their data cannot be cut at the
+// target the way WAL replay can.
+func checkRecoveryTarget(rt recoveryTarget, entries []manifestEntry) error {
+	for _, e := range entries {
+		var t time.Time
+		if e.maxTime != 0 {
+			t = time.Unix(0, e.maxTime)
+		}
+		if rt.past(e.maxSeq, t) {
+			return fmt.Errorf("%w: %s holds records up to sequence %d", ErrRecoveryTargetUnavailable, e.path, e.maxSeq)
+		}
+	}
+	return nil
+}
+
+// openRecoveryMemtable replays every WAL segment (oldest first) up to rt into
+// a single read-only memtable. No WAL file is created, modified or deleted.
+func openRecoveryMemtable(rt recoveryTarget, segs []walSegment, opts memtable.Options) (*memtable.Memtable, error) {
+	paths := make([]string, len(segs))
+	for i, seg := range segs {
+		paths[i] = seg.path
+	}
+	return memtable.NewReadOnlyMemtable(paths, opts, func(rec wal.Record) bool {
+		// A batch is only restored whole, so one that ends past the
+		// target stops the replay at its first op.
+		return rt.past(max(rec.Seq, rec.BatchEnd), rec.Time)
+	})
+}
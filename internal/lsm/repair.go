@@ -0,0 +1,307 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/sstable"
+)
+
+// ErrManifestMissing is returned by Open when the data directory holds
+// SSTables but no manifest to list them. Opening it anyway would lose them;
+// Repair rebuilds the manifest instead.
+var ErrManifestMissing = errors.New("lsm: manifest is missing")
+
+// RepairResult describes what Repair found in the data directory.
+type RepairResult struct {
+	// Tables are the SSTables the new manifest lists.
+	Tables []string
+	// Superseded are SSTables whose data other tables also hold: the inputs
+	// of a compaction that completed, or the outputs of one that did not.
+	Superseded []string
+	// Corrupt are SSTables that failed to open or validate.
+	Corrupt []string
+	// WALs are the paths of the WALs left for the next Open to replay, in
+	// the data directory and the WAL directory.
+	WALs []string
+}
+
+// Repair rebuilds the manifest of the closed DB in dataDir from the SSTables
+// found there, for a manifest that is missing or corrupt (ErrManifestMissing,
+// ErrManifestCorrupt). walDir is the Options.WALDir of the DB, or empty. It
+// fails with ErrLocked while the DB is open.
+//
+// Every table is opened and checked. The level and the newest WAL position
+// of each come from its properties (see PropMaxSequence); tables written
+// before those existed count as the oldest L0 files. A crash can leave both
+// the inputs and the outputs of a compaction behind, which the inputs
+// recorded in the outputs tell apart. Corrupt and superseded tables, and the
+// old manifest, are moved to the orphans directory rather than deleted.
+// The identity of the DB is kept if the old manifest still starts with it,
+// and generated anew otherwise. WALs are left alone, in whichever of
+// dataDir and walDir they are: the next Open replays what they hold beyond
+// the tables, so it must be given the same WALDir.
+func Repair(dataDir, walDir string) (*RepairResult, error) {
+	dataDir, err := canonicalDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if walDir != "" {
+		if walDir, err = canonicalDir(walDir); err != nil {
+			return nil, err
+		}
+	}
+	lock, err := lockDirs(dataDir, walDir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+
+	start := time.Now()
+	res, err := repairLocked(dataDir)
+	if err == nil {
+		var segs []walSegment
+		if segs, err = listWALSegments(dataDir, walDir); err == nil {
+			for _, s := range segs {
+				res.WALs = append(res.WALs, s.path)
+			}
+		}
+	}
+	rec := AdminRecord{Time: start, Op: AdminOpRepair, Duration: time.Since(start)}
+	if err != nil {
+		rec.Err = err.Error()
+	} else {
+		rec.Detail = fmt.Sprintf("tables=%d superseded=%d corrupt=%d", len(res.Tables), len(res.Superseded), len(res.Corrupt))
+	}
+	appendAdminRecord(dataDir, rec)
+	return res, err
+}
+
+// repairLocked does the work of Repair with the directory lock held.
+func repairLocked(dataDir string) (*RepairResult, error) {
+	dirEntries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	res := &RepairResult{}
+	tables := make(map[string]*repairTable)
+	for _, de := range dirEntries {
+		name := de.Name()
+		if !de.Type().IsRegular() || !strings.HasSuffix(name, ".sst") {
+			continue
+		}
+		t, err := loadRepairTable(filepath.Join(dataDir, name))
+		if err != nil {
+			res.Corrupt = append(res.Corrupt, name)
+			continue
+		}
+		tables[name] = t
+	}
+
+	// A compaction that was installed may have left its inputs behind; one
+	// that was not may have left some of its outputs. It was installed if an
+	// input is gone, as inputs are only deleted after that, or if a later
+	// compaction read an output, as only installed files are read. Else
+	// every input is there and holds everything the outputs do.
+	referenced := make(map[string]bool)
+	groups := make(map[string][]*repairTable)
+	for _, t := range tables {
+		for _, in := range t.inputs {
+			referenced[in] = true
+		}
+		if len(t.inputs) > 0 {
+			key := t.compacted.String() + " " + strings.Join(t.inputs, " ")
+			groups[key] = append(groups[key], t)
+		}
+	}
+	superseded := make(map[string]bool)
+	for _, outputs := range groups {
+		installed := false
+		for _, in := range outputs[0].inputs {
+			installed = installed || tables[in] == nil
+		}
+		for _, t := range outputs {
+			installed = installed || referenced[t.name]
+		}
+		if installed {
+			for _, in := range outputs[0].inputs {
+				if tables[in] != nil {
+					superseded[in] = true
+				}
+			}
+		} else {
+			for _, t := range outputs {
+				superseded[t.name] = true
+			}
+		}
+	}
+
+	var entries []manifestEntry
+	for name, t := range tables {
+		if superseded[name] {
+			res.Superseded = append(res.Superseded, name)
+			continue
+		}
+		entries = append(entries, t.entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.level != b.level {
+			return a.level > b.level
+		}
+		if a.maxSeq != b.maxSeq {
+			return a.maxSeq < b.maxSeq
+		}
+		return a.path < b.path
+	})
+	if err := checkRepairedLevels(entries, tables); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(res.Corrupt)
+	sort.Strings(res.Superseded)
+	for _, name := range append(res.Corrupt, res.Superseded...) {
+		if err := quarantineFile(dataDir, name); err != nil {
+			return nil, err
+		}
+	}
+	_, id, _, _ := readManifestIdentity(dataDir)
+	if id.IsZero() {
+		if id, err = newIdentity(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := os.Stat(manifestPath(dataDir)); err == nil {
+		old := fmt.Sprintf("%s-%d", manifestFileName, time.Now().UnixNano())
+		if err := os.Rename(manifestPath(dataDir), filepath.Join(dataDir, old)); err != nil {
+			return nil, err
+		}
+		if err := quarantineFile(dataDir, old); err != nil {
+			return nil, err
+		}
+	}
+	if err := rewriteManifest(dataDir, id, entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		res.Tables = append(res.Tables, filepath.Base(e.path))
+	}
+	return res, nil
+}
+
+// checkManifestPresent returns ErrManifestMissing if dataDir has no
+// manifest but SSTables that would be lost without one. An SSTable whose
+// WAL, in dataDir or walDir, is still there is not: a crash before the
+// very first manifest append leaves just that, and the WAL is replayed.
+func checkManifestPresent(dataDir, walDir string) error {
+	if _, err := os.Stat(manifestPath(dataDir)); !os.IsNotExist(err) {
+		return nil
+	}
+	dirEntries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+	for _, de := range dirEntries {
+		name := de.Name()
+		if !de.Type().IsRegular() || !strings.HasSuffix(name, ".sst") {
+			continue
+		}
+		wal := strings.TrimSuffix(name, ".sst") + ".wal"
+		_, err := os.Stat(filepath.Join(dataDir, wal))
+		if os.IsNotExist(err) {
+			_, err = os.Stat(filepath.Join(walDir, wal))
+		}
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s has SSTables, run Repair", ErrManifestMissing, dataDir)
+		}
+	}
+	return nil
+}
+
+// repairTable is what Repair learns about one SSTable.
+type repairTable struct {
+	name      string
+	entry     manifestEntry
+	smallest  []byte
+	largest   []byte
+	inputs    []string  // names of the compaction inputs, if an output
+	compacted time.Time // when that compaction started
+}
+
+// loadRepairTable opens the SSTable at path, verifies its blocks and reads
+// its properties.
+func loadRepairTable(path string) (*repairTable, error) {
+	r, err := sstable.NewReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if _, err := r.VerifyChecksumsInRange(nil, nil); err != nil {
+		return nil, err
+	}
+	props, err := r.Properties()
+	if err != nil {
+		return nil, err
+	}
+	t := &repairTable{name: filepath.Base(path), entry: manifestEntry{path: path}}
+	if t.smallest, t.largest, err = r.Bounds(); err != nil {
+		return nil, err
+	}
+	for _, rt := range r.RangeTombstones() {
+		if t.smallest == nil || bytes.Compare(rt.Start, t.smallest) < 0 {
+			t.smallest = rt.Start
+		}
+		if t.largest == nil || bytes.Compare(rt.End, t.largest) > 0 {
+			t.largest = rt.End
+		}
+	}
+	if v, ok := props[PropMaxSequence]; ok {
+		if t.entry.maxSeq, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("%s: %w", PropMaxSequence, err)
+		}
+		if t.entry.maxTime, err = strconv.ParseInt(props[PropMaxTime], 10, 64); err != nil {
+			return nil, fmt.Errorf("%s: %w", PropMaxTime, err)
+		}
+	}
+	if v, ok := props[PropCompactionOutputLevel]; ok {
+		if t.entry.level, err = strconv.Atoi(v); err != nil || t.entry.level < 1 || t.entry.level >= numLevels {
+			return nil, fmt.Errorf("%s: invalid level %q", PropCompactionOutputLevel, v)
+		}
+		if t.compacted, err = time.Parse(time.RFC3339Nano, props[PropCompactionTime]); err != nil {
+			return nil, fmt.Errorf("%s: %w", PropCompactionTime, err)
+		}
+		for _, in := range strings.Fields(props[PropCompactionInputs]) {
+			if _, name, ok := strings.Cut(in, ":"); ok {
+				t.inputs = append(t.inputs, name)
+			}
+		}
+	}
+	return t, nil
+}
+
+// checkRepairedLevels fails if two files of a level below L0 overlap, which
+// Repair cannot order.
+func checkRepairedLevels(entries []manifestEntry, tables map[string]*repairTable) error {
+	byLevel := make(map[int][]*repairTable)
+	for _, e := range entries {
+		if e.level > 0 {
+			byLevel[e.level] = append(byLevel[e.level], tables[filepath.Base(e.path)])
+		}
+	}
+	for level, ts := range byLevel {
+		sort.Slice(ts, func(i, j int) bool { return bytes.Compare(ts[i].smallest, ts[j].smallest) < 0 })
+		for i := 1; i < len(ts); i++ {
+			if bytes.Compare(ts[i].smallest, ts[i-1].largest) < 0 {
+				return fmt.Errorf("lsm: repair: %s and %s overlap in L%d", ts[i-1].name, ts[i].name, level)
+			}
+		}
+	}
+	return nil
+}
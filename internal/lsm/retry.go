@@ -0,0 +1,68 @@
+package lsm
+
+import "time"
+
+const (
+	defaultBackgroundRetries       = 3
+	defaultBackgroundRetryDelay    = 100 * time.Millisecond
+	defaultBackgroundRetryMaxDelay = 10 * time.Second
+)
+
+// retryDelay returns how long to wait before retrying an operation that has
+// failed attempt times in a row: the base delay, doubled for every earlier
+// failure, capped at the maximum.
+func (db *DB) retryDelay(attempt int) time.Duration {
+	d := db.bgRetryDelay
+	for i := 1; i < attempt && d < db.bgRetryMaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, db.bgRetryMaxDelay)
+}
+
+// canRetry reports whether an operation that has failed attempt times in a
+// row may be tried again. Nothing is retried once Close has started.
+func (db *DB) canRetry(attempt int) bool {
+	if attempt > db.bgRetries {
+		return false
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return !db.closing && !db.closed
+}
+
+// waitRetry sleeps for the backoff of attempt and reports whether the DB
+// is still open afterwards.
+func (db *DB) waitRetry(attempt int) bool {
+	select {
+	case <-db.clock.After(db.retryDelay(attempt)):
+	case <-db.closingCh:
+		return false
+	}
+	return db.canRetry(attempt)
+}
+
+// retryBackground handles the failure of attempt of a background op. If it
+// may be retried, err is reported as such and retry is submitted to the
+// scheduler once the backoff has passed; wg is held for it meanwhile, and
+// retry must release it, so that Close and Flush wait for the outcome. A
+// retry still waiting when Close starts is dropped. Otherwise err is
+// reported as final, with failStop. It returns whether a retry is pending.
+func (db *DB) retryBackground(op, path string, err error, attempt int, failStop bool, wg interface {
+	Add(int)
+	Done()
+}, retry func()) bool {
+	if !db.canRetry(attempt) {
+		db.notifyBackgroundError(&BackgroundError{Op: op, Path: path, Err: err, Attempt: attempt, FailStop: failStop})
+		return false
+	}
+	wg.Add(1)
+	db.notifyBackgroundError(&BackgroundError{Op: op, Path: path, Err: err, Attempt: attempt, Retrying: true})
+	go func() {
+		if !db.waitRetry(attempt) {
+			wg.Done()
+			return
+		}
+		db.runBackground(op, retry)
+	}()
+	return true
+}
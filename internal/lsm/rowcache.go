@@ -0,0 +1,235 @@
+package lsm
+
+import (
+	"bytes"
+	"container/list"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	// rowCacheShards is the number of independently locked parts of the
+	// row cache. Each holds an equal share of the capacity.
+	rowCacheShards = 16
+
+	// rowCacheEntryOverhead is charged against the capacity for every entry
+	// on top of its key and value: the map slot, list element and entry.
+	rowCacheEntryOverhead = 96
+)
+
+// RowCacheStats is a snapshot of the row cache counters.
+type RowCacheStats struct {
+	Capacity  int64 // bytes
+	Size      int64 // bytes currently charged, overhead included
+	Entries   int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Invalidations counts cached values that a Put, Delete or DeleteRange
+	// replaced or removed.
+	Invalidations uint64
+}
+
+// HitRate returns Hits / (Hits + Misses), or 0 before any lookup.
+func (s RowCacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// rowCache maps keys to their current value as stored, so that a Get of a
+// hot key skips the memtables and SSTables altogether. Puts fill it; so do
+// Gets, unless a write of a key of the same shard came in between.
+//
+// Writes must not overtake each other on the way from the memtable to the
+// cache, or the cache would keep the older of two values. Every write of a
+// key holds its shard's writeMu across both steps; the memtable already
+// serializes writes, so this costs next to nothing.
+type rowCache struct {
+	capacity int64
+	shards   [rowCacheShards]rowCacheShard
+}
+
+type rowCacheShard struct {
+	writeMu sync.Mutex // held by writes of this shard's keys, see rowCache
+
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List // most recently used at the front
+	// epoch changes with every write of one of the shard's keys. A Get
+	// only fills the cache if it did not change during the lookup.
+	epoch uint64
+
+	hits, misses, evictions, invalidations uint64
+}
+
+type rowCacheEntry struct {
+	key   string
+	value []byte
+}
+
+func (e *rowCacheEntry) charge() int64 {
+	return int64(len(e.key)+len(e.value)) + rowCacheEntryOverhead
+}
+
+// newRowCache creates a cache charging up to capacity bytes.
+func newRowCache(capacity int64) *rowCache {
+	c := &rowCache{capacity: capacity}
+	for i := range c.shards {
+		c.shards[i] = rowCacheShard{
+			capacity: capacity / rowCacheShards,
+			entries:  make(map[string]*list.Element),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+func (c *rowCache) shard(key []byte) *rowCacheShard {
+	h := fnv.New32a()
+	h.Write(key)
+	return &c.shards[h.Sum32()%rowCacheShards]
+}
+
+// get returns the cached value of key, which must not be modified. On a
+// miss it returns the epoch to pass to fill.
+func (c *rowCache) get(key []byte) (value []byte, epoch uint64, ok bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[string(key)]
+	if !ok {
+		s.misses++
+		return nil, s.epoch, false
+	}
+	s.hits++
+	s.lru.MoveToFront(el)
+	return el.Value.(*rowCacheEntry).value, 0, true
+}
+
+// fill caches the value a Get found for key, unless a write of the shard
+// happened since get returned epoch.
+func (c *rowCache) fill(key, value []byte, epoch uint64) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.epoch != epoch {
+		return
+	}
+	if _, ok := s.entries[string(key)]; ok {
+		return
+	}
+	s.insertLocked(&rowCacheEntry{key: string(key), value: bytes.Clone(value)})
+}
+
+// lockWrite locks the shard of key against other writes; see rowCache.
+func (c *rowCache) lockWrite(key []byte) *sync.Mutex {
+	mu := &c.shard(key).writeMu
+	mu.Lock()
+	return mu
+}
+
+// put records that key now has value as stored, or none if value is nil.
+// It must be called with the shard's write lock held, after the memtable
+// took the write.
+func (c *rowCache) put(key, value []byte) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.epoch++
+	if el, ok := s.entries[string(key)]; ok {
+		s.removeLocked(el)
+		s.invalidations++
+	}
+	if value != nil {
+		s.insertLocked(&rowCacheEntry{key: string(key), value: bytes.Clone(value)})
+	}
+}
+
+// lockAllWrites locks every shard against writes, for a DeleteRange or a
+// WriteBatch.
+func (c *rowCache) lockAllWrites() {
+	for i := range c.shards {
+		c.shards[i].writeMu.Lock()
+	}
+}
+
+func (c *rowCache) unlockAllWrites() {
+	for i := range c.shards {
+		c.shards[i].writeMu.Unlock()
+	}
+}
+
+// deleteRange drops the cached keys in [start, end). It must be called
+// with every write lock held, after the memtable took the range tombstone.
+func (c *rowCache) deleteRange(start, end []byte) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		s.epoch++
+		for k, el := range s.entries {
+			if k >= string(start) && k < string(end) {
+				s.removeLocked(el)
+				s.invalidations++
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// clear drops every entry, for when the DB switched to another set of files
+// under the cache.
+func (c *rowCache) clear() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		s.epoch++
+		s.invalidations += uint64(len(s.entries))
+		clear(s.entries)
+		s.lru.Init()
+		s.size = 0
+		s.mu.Unlock()
+	}
+}
+
+// insertLocked adds e, evicting the least recently used entries to make
+// room. Entries larger than the shard's capacity are not cached.
+func (s *rowCacheShard) insertLocked(e *rowCacheEntry) {
+	charge := e.charge()
+	if charge > s.capacity {
+		return
+	}
+	for s.size+charge > s.capacity {
+		s.removeLocked(s.lru.Back())
+		s.evictions++
+	}
+	s.entries[e.key] = s.lru.PushFront(e)
+	s.size += charge
+}
+
+func (s *rowCacheShard) removeLocked(el *list.Element) {
+	e := s.lru.Remove(el).(*rowCacheEntry)
+	delete(s.entries, e.key)
+	s.size -= e.charge()
+}
+
+// stats returns a snapshot of the counters of all shards.
+func (c *rowCache) stats() RowCacheStats {
+	st := RowCacheStats{Capacity: c.capacity}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		st.Size += s.size
+		st.Entries += len(s.entries)
+		st.Hits += s.hits
+		st.Misses += s.misses
+		st.Evictions += s.evictions
+		st.Invalidations += s.invalidations
+		s.mu.Unlock()
+	}
+	return st
+}
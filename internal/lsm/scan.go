@@ -0,0 +1,105 @@
+package lsm
+
+// defaultScanPageRows is the page size of a ResultBuffer without MaxRows.
+const defaultScanPageRows = 1000
+
+// ResultBuffer receives the pages of ScanInto. Its memory is reused from
+// page to page, so a caller paging through a large range allocates nothing
+// per row once the buffer has grown to the page size. Keys and values
+// returned by Key and Value point into the buffer and are overwritten by
+// the next ScanInto or Reset. The zero value is ready to use; a
+// ResultBuffer is not safe for concurrent use.
+type ResultBuffer struct {
+	// MaxRows caps the pairs per page. Zero uses 1000.
+	MaxRows int
+	// MaxBytes caps the key and value bytes per page; a page holds at least
+	// one pair however large. Zero leaves the size to MaxRows.
+	MaxBytes int
+
+	data  []byte // keys and values of the page, back to back
+	ends  []int  // per pair, the end of its key and of its value in data
+	start []byte // copy of the start key of the current page
+	next  []byte // first key after the page, see NextKey
+	more  bool
+}
+
+// Len returns the number of pairs in the page.
+func (b *ResultBuffer) Len() int {
+	return len(b.ends) / 2
+}
+
+// Key returns the key of pair i.
+func (b *ResultBuffer) Key(i int) []byte {
+	start := 0
+	if i > 0 {
+		start = b.ends[2*i-1]
+	}
+	end := b.ends[2*i]
+	return b.data[start:end:end]
+}
+
+// Value returns the value of pair i.
+func (b *ResultBuffer) Value(i int) []byte {
+	start, end := b.ends[2*i], b.ends[2*i+1]
+	return b.data[start:end:end]
+}
+
+// NextKey returns the start key of the next page, or nil if the page ended
+// the scan.
+func (b *ResultBuffer) NextKey() []byte {
+	if !b.more {
+		return nil
+	}
+	return b.next
+}
+
+// Reset empties the buffer, keeping its memory.
+func (b *ResultBuffer) Reset() {
+	b.data = b.data[:0]
+	b.ends = b.ends[:0]
+	b.more = false
+}
+
+// ScanInto fills buf with the next page of live keys in [start, end) in key
+// order, replacing its previous contents. A nil end scans to the last key.
+// Passing buf.NextKey() as start fetches the following page:
+//
+//	for start := from; ; {
+//		if err := db.ScanInto(start, to, buf); err != nil { ... }
+//		for i := 0; i < buf.Len(); i++ { use(buf.Key(i), buf.Value(i)) }
+//		if start = buf.NextKey(); start == nil { break }
+//	}
+//
+// Each page is read from its own Iterator, so pages are consistent on
+// their own but not with each other.
+func (db *DB) ScanInto(start, end []byte, buf *ResultBuffer) error {
+	// start may be buf.next, which this page overwrites
+	buf.start = append(buf.start[:0], start...)
+	buf.Reset()
+	maxRows := buf.MaxRows
+	if maxRows <= 0 {
+		maxRows = defaultScanPageRows
+	}
+
+	it, err := db.NewIterator(IterOptions{LowerBound: buf.start, UpperBound: end, reuse: true})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+		key, value := it.Key(), it.Value()
+		full := buf.Len() >= maxRows ||
+			(buf.MaxBytes > 0 && buf.Len() > 0 && len(buf.data)+len(key)+len(value) > buf.MaxBytes)
+		if full {
+			buf.next = append(buf.next[:0], key...)
+			buf.more = true
+			return nil
+		}
+		buf.data = append(buf.data, key...)
+		buf.ends = append(buf.ends, len(buf.data))
+		buf.data = append(buf.data, value...)
+		buf.ends = append(buf.ends, len(buf.data))
+	}
+	return err
+}
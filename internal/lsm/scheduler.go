@@ -0,0 +1,153 @@
+package lsm
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Scheduler runs background work (flushes and compactions) on a bounded
+// number of goroutines. One Scheduler can be shared by many DBs so that a
+// process embedding lots of them has predictable goroutine usage.
+//
+// Submitting never blocks: tasks wait in a FIFO queue until a worker is free.
+// A task that panics is recovered and counted; the worker keeps going.
+type Scheduler struct {
+	parallelism int
+	onPanic     func(name string, v any)
+
+	mu        sync.Mutex
+	queue     []schedTask
+	running   int
+	completed uint64
+	panics    uint64
+}
+
+type schedTask struct {
+	name string
+	fn   func()
+}
+
+// SchedulerStats is a point-in-time copy of a Scheduler's counters.
+type SchedulerStats struct {
+	Parallelism int
+	Running     int    // tasks executing now
+	Queued      int    // tasks waiting for a worker
+	Completed   uint64 // tasks finished, including those that panicked
+	Panics      uint64 // tasks that panicked
+}
+
+// NewScheduler returns a Scheduler running at most parallelism tasks at once
+// (at least 1). onPanic, if not nil, is called with the task name and the
+// recovered value whenever a task panics.
+func NewScheduler(parallelism int, onPanic func(name string, v any)) *Scheduler {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	return &Scheduler{parallelism: parallelism, onPanic: onPanic}
+}
+
+var (
+	defaultSchedulerOnce sync.Once
+	defaultScheduler     *Scheduler
+)
+
+// DefaultScheduler is the process-wide Scheduler used by DBs that do not set
+// Options.Scheduler. It allows GOMAXPROCS tasks at once, and at least two so
+// a long compaction never holds up a flush.
+func DefaultScheduler() *Scheduler {
+	defaultSchedulerOnce.Do(func() {
+		n := runtime.GOMAXPROCS(0)
+		if n < 2 {
+			n = 2
+		}
+		defaultScheduler = NewScheduler(n, nil)
+	})
+	return defaultScheduler
+}
+
+// Go queues fn to run in the background.
+func (s *Scheduler) Go(name string, fn func()) {
+	s.mu.Lock()
+	s.queue = append(s.queue, schedTask{name: name, fn: fn})
+	if s.running >= s.parallelism {
+		s.mu.Unlock()
+		return
+	}
+	s.running++
+	s.mu.Unlock()
+	go s.worker()
+}
+
+// worker runs queued tasks until the queue is empty.
+func (s *Scheduler) worker() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.running--
+			s.mu.Unlock()
+			return
+		}
+		t := s.queue[0]
+		s.queue[0] = schedTask{}
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		panicked := s.run(t)
+
+		s.mu.Lock()
+		s.completed++
+		if panicked {
+			s.panics++
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Scheduler) run(t schedTask) (panicked bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			panicked = true
+			if s.onPanic != nil {
+				s.onPanic(t.name, v)
+			}
+		}
+	}()
+	t.fn()
+	return false
+}
+
+// Stats returns the Scheduler's current counters.
+func (s *Scheduler) Stats() SchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SchedulerStats{
+		Parallelism: s.parallelism,
+		Running:     s.running,
+		Queued:      len(s.queue),
+		Completed:   s.completed,
+		Panics:      s.panics,
+	}
+}
+
+// runBackground submits a flush or compaction to the DB's scheduler. A panic
+// in fn is reported as a BackgroundError (fail-stop for flushes) instead of
+// crashing the process. fn runs with the pprof labels of a new job.
+func (db *DB) runBackground(op string, fn func()) {
+	job := strconv.FormatUint(atomic.AddUint64(&db.jobs, 1), 10)
+	labels := pprof.Labels(db.profileLabels(op, job)...)
+	db.sched.Go(op, func() {
+		defer func() {
+			if v := recover(); v != nil {
+				db.reportBackgroundError(op, "", fmt.Errorf("panic: %v", v), op == BackgroundOpFlush)
+			}
+		}()
+		pprof.Do(context.Background(), labels, func(context.Context) {
+			fn()
+		})
+	})
+}
@@ -0,0 +1,71 @@
+package lsm
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerBoundsParallelism(t *testing.T) {
+	s := NewScheduler(2, nil)
+
+	var running, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		s.Go("task", func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+
+	if peak > 2 {
+		t.Errorf("Peak concurrency %d exceeds parallelism 2", peak)
+	}
+	// Workers update counters after the task body returns.
+	deadline := time.Now().Add(time.Second)
+	for s.Stats().Completed != 10 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if st := s.Stats(); st.Completed != 10 || st.Queued != 0 {
+		t.Errorf("Unexpected stats: %+v", st)
+	}
+}
+
+func TestSchedulerRecoversPanics(t *testing.T) {
+	recovered := make(chan string, 1)
+	s := NewScheduler(1, func(name string, v any) {
+		recovered <- name
+	})
+
+	s.Go("bad", func() { panic("boom") })
+	if name := <-recovered; name != "bad" {
+		t.Errorf("onPanic got task %q", name)
+	}
+
+	// The worker survives and keeps running tasks.
+	done := make(chan struct{})
+	s.Go("good", func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Task after a panic never ran")
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.Stats().Completed != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if st := s.Stats(); st.Panics != 1 || st.Completed != 2 {
+		t.Errorf("Unexpected stats: %+v", st)
+	}
+}
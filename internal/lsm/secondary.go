@@ -0,0 +1,235 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/memtable"
+	"github.com/return2faye/SiltKV/internal/sstable"
+)
+
+// BackgroundOpRefresh reports a Secondary reader that failed to load the
+// manifest or open the SSTables it lists. The reader keeps serving its
+// previous view and tries again on the next poll.
+const BackgroundOpRefresh = "refresh"
+
+// ErrNotSecondary is returned by Refresh on a DB not opened with
+// Options.Secondary.
+var ErrNotSecondary = errors.New("lsm: db is not a secondary reader")
+
+const defaultSecondaryPollInterval = time.Second
+
+// manifestPoller keeps a Secondary reader's version in step with the
+// manifest of the writer in another process.
+//
+// The writer appends to the manifest after a flush and replaces it after a
+// compaction, so its generation is identified by the file it resolves to
+// together with its size and modification time. The version is rebuilt only
+// when that changes; files that are still listed keep their open readers.
+type manifestPoller struct {
+	mu     sync.Mutex  // serializes refreshes
+	loaded bool        // a refresh has succeeded
+	last   os.FileInfo // manifest as of the installed version; nil if missing
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// sameGeneration reports whether a and b describe the same manifest
+// contents. A missing manifest (nil) only matches another missing one.
+func sameGeneration(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// secondaryOpenAttempts bounds how often Open reloads the manifest when a
+// file it lists disappears before it can be opened.
+const secondaryOpenAttempts = 3
+
+// openSecondary finishes Open for a Secondary reader: the WALs are left to
+// the writer, so the memtable stays empty, and the files are loaded afresh
+// in case a compaction replaced some of them while Open ran.
+func (db *DB) openSecondary(interval time.Duration) error {
+	mt, err := memtable.NewReadOnlyMemtable(nil, db.memOpts, nil)
+	if err != nil {
+		return err
+	}
+	db.poller = &manifestPoller{}
+	for attempt := 1; ; attempt++ {
+		_, err = db.refresh(true)
+		if err == nil || attempt == secondaryOpenAttempts || !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		mt.Close()
+		return err
+	}
+	db.active = mt
+	if interval <= 0 {
+		interval = defaultSecondaryPollInterval
+	}
+	db.startPolling(interval)
+	return nil
+}
+
+// startPolling refreshes the version every interval until Close.
+func (db *DB) startPolling(interval time.Duration) {
+	p := db.poller
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	labels := pprof.Labels(db.profileLabels(BackgroundOpRefresh, "")...)
+	pprof.Do(context.Background(), labels, func(context.Context) {
+		go db.pollManifest(interval)
+	})
+}
+
+// pollManifest is the loop started by startPolling.
+func (db *DB) pollManifest(interval time.Duration) {
+	p := db.poller
+	defer close(p.done)
+	ticker := db.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C():
+		}
+		if _, err := db.refresh(false); err != nil && !errors.Is(err, ErrClosed) &&
+			!errors.Is(err, fs.ErrNotExist) {
+			// A file the writer deleted between our reading the
+			// manifest and opening it is expected; the manifest
+			// has changed again by then and the next poll sees it.
+			db.reportBackgroundError(BackgroundOpRefresh, manifestPath(db.dataDir), err, false)
+		}
+	}
+}
+
+// stopPolling stops the poller and waits for a running refresh to finish.
+func (p *manifestPoller) stopPolling() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+}
+
+// Refresh makes the SSTables the writer has flushed or compacted so far
+// visible to a Secondary reader, without waiting for the next poll. It
+// reports whether the view changed. Iterators and snapshots created before
+// keep reading the files they started with.
+func (db *DB) Refresh() (bool, error) {
+	if db.poller == nil {
+		return false, ErrNotSecondary
+	}
+	return db.refresh(false)
+}
+
+// refresh installs a version built from the current manifest if the
+// manifest changed since the last refresh, or unconditionally if force is
+// set. On error the previous version stays in place and the manifest is
+// reloaded again next time.
+func (db *DB) refresh(force bool) (bool, error) {
+	p := db.poller
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fi, err := os.Stat(manifestPath(db.dataDir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+		fi = nil
+	}
+	if !force && p.loaded && sameGeneration(p.last, fi) {
+		return false, nil
+	}
+	// The manifest may change again while it is read; fi then no longer
+	// matches, and the next refresh reloads it.
+	entries, err := loadManifest(db.dataDir)
+	if err != nil {
+		return false, err
+	}
+
+	db.mu.RLock()
+	cur := db.current
+	if db.closing || db.closed || cur == nil {
+		db.mu.RUnlock()
+		return false, ErrClosed
+	}
+	cur.ref()
+	db.mu.RUnlock()
+	defer cur.unref()
+
+	open := make(map[string]*fileMeta, len(cur.files))
+	for _, f := range cur.files {
+		open[f.path] = f
+	}
+	var files, opened []*fileMeta
+	abandon := func() {
+		for _, f := range opened {
+			f.reader.Close()
+		}
+	}
+	var maxSeq uint64
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.maxSeq > maxSeq {
+			maxSeq = e.maxSeq
+		}
+		if f, ok := open[e.path]; ok && f.level == e.level {
+			files = append(files, f)
+			continue
+		}
+		reader, err := sstable.NewReaderWithOptions(e.path, db.readerOpts)
+		if err != nil {
+			abandon()
+			return false, err
+		}
+		f, err := db.newFileMeta(reader, e.level)
+		if err != nil {
+			reader.Close()
+			abandon()
+			return false, err
+		}
+		f.maxSeq, f.maxTime = e.maxSeq, e.maxTime
+		files = append(files, f)
+		opened = append(opened, f)
+	}
+	v := newVersion(files)
+	var idx *keyIndex
+	if db.fullKeyIndex {
+		if idx, err = buildKeyIndex(v); err != nil {
+			v.unref()
+			return false, err
+		}
+	}
+
+	db.mu.Lock()
+	if db.closing || db.closed {
+		db.mu.Unlock()
+		v.unref()
+		return false, ErrClosed
+	}
+	db.installVersion(v)
+	db.keyIndex = idx
+	if db.rowCache != nil {
+		db.rowCache.clear()
+	}
+	if maxSeq > atomic.LoadUint64(&db.seq) {
+		atomic.StoreUint64(&db.seq, maxSeq)
+	}
+	db.mu.Unlock()
+	p.loaded, p.last = true, fi
+	return true, nil
+}
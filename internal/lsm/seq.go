@@ -0,0 +1,52 @@
+package lsm
+
+import (
+	"context"
+	"iter"
+)
+
+// KV is a key and its value, as yielded by All and Range.
+type KV struct {
+	Key, Value []byte
+}
+
+// All returns the live keys of the DB and their values in key order, for
+// use with range-over-func:
+//
+//	for kv, err := range db.All(ctx) {
+//		if err != nil { ... }
+//		...
+//	}
+//
+// Each loop runs its own Iterator, closed when the loop ends, whether it
+// runs out, breaks or panics. Keys and values stay valid after the loop
+// moves on. A read error, ctx being done or the DB being closed ends the
+// sequence with a last pair holding the error, so a scan that runs out
+// without one is complete.
+func (db *DB) All(ctx context.Context) iter.Seq2[KV, error] {
+	return db.Range(ctx, nil, nil)
+}
+
+// Range is All restricted to keys in [start, end). A nil start or end
+// leaves that side open.
+func (db *DB) Range(ctx context.Context, start, end []byte) iter.Seq2[KV, error] {
+	return func(yield func(KV, error) bool) {
+		it, err := db.NewIterator(IterOptions{LowerBound: start, UpperBound: end})
+		if err != nil {
+			yield(KV{}, err)
+			return
+		}
+		defer it.Close()
+		for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			if !yield(KV{it.Key(), it.Value()}, nil) {
+				return
+			}
+		}
+		if err != nil {
+			yield(KV{}, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package lsm
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	defaultCompactionFreeSpaceReserve = 64 << 20
+	// compactionDeferDelay is how long a compaction deferred for lack of
+	// disk space waits before it checks again.
+	compactionDeferDelay = 10 * time.Second
+)
+
+// ErrCompactionDeferred is returned by Compact and PurgeDeletedBefore when
+// a compaction they needed was not started because the disk lacks the
+// space for its outputs; see Options.CompactionFreeSpaceReserve.
+var ErrCompactionDeferred = errors.New("lsm: compaction deferred for lack of disk space")
+
+// CompactionDeferredEvent reports a compaction that was not started
+// because the data directory lacks the space for its outputs. It is tried
+// again after a delay, and whenever a flush calls for a compaction.
+type CompactionDeferredEvent struct {
+	Level       int    // level the inputs were picked from
+	Inputs      int    // input files, from both levels
+	NeededBytes uint64 // estimated output size plus the reserve
+	FreeBytes   uint64 // free space in the data directory
+}
+
+// hasCompactionSpace reports whether the data directory has room for the
+// outputs of c, estimated at the size of its inputs, plus the reserve. If
+// not, the compaction is counted and reported as deferred. Without a
+// reading of the free space, as on platforms that give none, it compacts
+// as before.
+func (db *DB) hasCompactionSpace(c *compaction) bool {
+	if db.spaceReserve < 0 {
+		return true
+	}
+	free, ok, err := db.diskFree(db.dataDir)
+	if err != nil || !ok {
+		return true
+	}
+	files := c.files()
+	need := uint64(db.spaceReserve)
+	for _, f := range files {
+		need += uint64(f.reader.Size())
+	}
+	if free >= need {
+		return true
+	}
+	db.compactStats.recordDeferred()
+	if db.onCompactionDeferred != nil {
+		db.onCompactionDeferred(CompactionDeferredEvent{
+			Level:       c.level,
+			Inputs:      len(files),
+			NeededBytes: need,
+			FreeBytes:   free,
+		})
+	}
+	return false
+}
+
+// retryDeferredCompaction submits another compaction once
+// compactionDeferDelay has passed, unless one is already waiting. Unlike a
+// retry it does not hold compactWg while it waits, so that Compact reports
+// the deferral instead of waiting for the disk to free up; it is dropped
+// when Close starts.
+func (db *DB) retryDeferredCompaction() {
+	db.mu.Lock()
+	if db.compactDeferred || db.closing || db.closed {
+		db.mu.Unlock()
+		return
+	}
+	db.compactDeferred = true
+	db.mu.Unlock()
+
+	go func() {
+		select {
+		case <-db.clock.After(compactionDeferDelay):
+		case <-db.closingCh:
+		}
+		db.mu.Lock()
+		db.compactDeferred = false
+		run := !db.closing && !db.closed
+		if run {
+			// Added under mu, so Close sees it before it waits
+			db.compactWg.Add(1)
+		}
+		db.mu.Unlock()
+		if run {
+			db.runBackground(BackgroundOpCompaction, db.compactSSTables)
+		}
+	}()
+}
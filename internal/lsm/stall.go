@@ -0,0 +1,97 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultL0SlowdownWritesTrigger is the number of L0 files from which
+	// every write is delayed by writeSlowdownDelay.
+	defaultL0SlowdownWritesTrigger = 8
+	// defaultL0StopWritesTrigger is the number of L0 files at which a full
+	// memtable is not rotated until compaction has caught up.
+	defaultL0StopWritesTrigger = 12
+
+	writeSlowdownDelay = time.Millisecond
+
+	// defaultMaxImmutableMemtables is how many full memtables may wait for
+	// their flush before writes stop.
+	defaultMaxImmutableMemtables = 1
+)
+
+// stallStats counts writes held back by makeRoomForWrite. All fields are
+// atomic.
+type stallStats struct {
+	slowdowns  uint64 // writes delayed because L0 is filling up
+	stops      uint64 // writes that blocked on a flush or compaction
+	stallNanos uint64 // total time writes spent blocked or delayed
+}
+
+// makeRoomForWrite holds a write back while background work is behind, so
+// that memory and L0 stay bounded instead of growing with the write rate.
+//
+// It works in two steps. Once L0 reaches the slowdown trigger, the write is
+// delayed by a millisecond, which hands some CPU and disk time to the
+// compaction and spreads a stall over many writes instead of hitting one
+// of them with a long pause. Writes then stop while the active memtable is
+// full and cannot be rotated: MaxImmutableMemtables earlier memtables are
+// still waiting for their flush, or L0 is at the stop trigger. A blocked
+// write waits for a flush or compaction to install a new version and
+// rotates the memtable itself once there is room.
+//
+// Writes are never held back once Close has started or the DB has failed;
+// the caller reports those.
+func (db *DB) makeRoomForWrite() error {
+	var start time.Time
+	slowedDown := false
+	defer func() {
+		if !start.IsZero() {
+			atomic.AddUint64(&db.stalls.stallNanos, uint64(db.clock.Now().Sub(start)))
+		}
+	}()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stopped := false
+	for {
+		if db.closing || db.closed || db.bgErr != nil || db.active == nil || db.current == nil {
+			return nil
+		}
+		l0 := len(db.current.levels[0])
+		switch {
+		case !slowedDown && db.l0SlowdownTrigger > 0 && l0 >= db.l0SlowdownTrigger:
+			slowedDown = true
+			if start.IsZero() {
+				start = db.clock.Now()
+			}
+			atomic.AddUint64(&db.stalls.slowdowns, 1)
+			db.mu.Unlock()
+			select {
+			case <-db.clock.After(writeSlowdownDelay):
+			case <-db.closingCh:
+			}
+			db.mu.Lock()
+		case !db.active.IsFull():
+			return nil
+		case len(db.immutables) >= db.maxImmutables || (db.l0StopTrigger > 0 && l0 >= db.l0StopTrigger):
+			if !stopped {
+				stopped = true
+				if start.IsZero() {
+					start = db.clock.Now()
+				}
+				atomic.AddUint64(&db.stalls.stops, 1)
+			}
+			db.stallCond.Wait()
+		default:
+			return db.rotateMemtableLocked()
+		}
+	}
+}
+
+// wakeStalledWriters lets writers blocked in makeRoomForWrite recheck
+// whether there is room. Called with mu held whenever a flush or compaction
+// finishes, a background error stops writes, or Close starts.
+func (db *DB) wakeStalledWriters() {
+	db.stallCond.Broadcast()
+}
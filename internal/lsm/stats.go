@@ -0,0 +1,177 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/sstable"
+)
+
+// Stats is a point-in-time snapshot of DB internals.
+type Stats struct {
+	MemtableBytes      int // estimated size of the active memtable
+	MemtableEntries    int // entries in the active memtable, tombstones included
+	ImmutableMemtables int // memtables waiting to be flushed (up to MaxImmutableMemtables)
+	ImmutableBytes     int // estimated size of those memtables
+
+	// Levels describes the SSTables per level, from L0 down to the deepest
+	// level that holds any file.
+	Levels       []LevelStats
+	SSTableCount int
+	SSTableBytes uint64
+
+	// Bloom filter effectiveness over the live SSTables. BloomHitRate is the
+	// fraction of checked lookups the filter ruled out (0 if none checked).
+	BloomChecks    uint64
+	BloomNegatives uint64
+	BloomHitRate   float64
+
+	// BlockCache is nil unless Options.BlockCacheSize is set.
+	BlockCache *sstable.CacheStats
+	// RowCache is nil unless Options.RowCacheSize is set.
+	RowCache *RowCacheStats
+	// KeyIndexEntries is the number of keys in the index of
+	// Options.FullKeyIndex, 0 without one.
+	KeyIndexEntries int
+
+	UserBytesWritten  uint64 // key and value bytes accepted by Put, Delete and DeleteRange
+	WALBytesWritten   uint64 // bytes logged to the WAL since Open
+	FlushBytesWritten uint64 // SSTable bytes written by memtable flushes
+
+	WALSyncLatency time.Duration // smoothed WAL fsync latency
+	WriteThrottled bool          // writes are being slowed because fsyncs are slow
+
+	// FailStopReason is the error that put the DB into fail-stop mode, as
+	// DB.Err returns it, or empty while the DB takes writes.
+	FailStopReason string
+
+	// Write stalls while flushes or compactions are behind: writes delayed
+	// because L0 reached L0SlowdownWritesTrigger, writes that blocked on a
+	// full memtable, and the total time writes were held back.
+	WriteSlowdowns uint64
+	WriteStops     uint64
+	WriteStallTime time.Duration
+
+	// Obsolete files waiting to be deleted, held back by the active
+	// FileDeletionHolds, by ObsoleteFileGracePeriod or, after a failed
+	// deletion, by the wait before its retry. ObsoleteFileDeleteFailures
+	// counts failed deletions, as happen on Windows while another process
+	// has the file open.
+	ObsoleteFilesPending       int
+	FileDeletionHolds          int
+	ObsoleteFileDeleteFailures uint64
+
+	// ValueLogFiles and ValueLogBytes describe the blob files of the value
+	// log, collected ones waiting for reads excluded; 0 without one.
+	ValueLogFiles int
+	ValueLogBytes int64
+
+	Compaction CompactionMetrics
+	Scheduler  SchedulerStats // of the (possibly shared) background scheduler
+
+	// WriteAmplification is (WAL + flush + compaction bytes) / user bytes.
+	// ReadAmplification is the average number of SSTables probed per Get.
+	// Both are 0 until there is something to divide by.
+	WriteAmplification float64
+	ReadAmplification  float64
+}
+
+// LevelStats describes the SSTables of one level.
+type LevelStats struct {
+	Level int
+	Files int
+	Bytes uint64
+}
+
+// ioStats holds the DB's cumulative I/O counters. All fields are atomic.
+type ioStats struct {
+	userBytes  uint64
+	walRetired uint64 // WAL bytes of memtables that have been flushed
+	flushBytes uint64
+	gets       uint64
+	sstProbes  uint64
+}
+
+// Stats returns a snapshot of the DB's size, I/O and compaction counters.
+func (db *DB) Stats() Stats {
+	var s Stats
+
+	db.mu.RLock()
+	active, immutables, v := db.active, db.immutables, db.current
+	s.KeyIndexEntries = db.keyIndex.len()
+	if db.bgErr != nil {
+		s.FailStopReason = db.bgErr.Error()
+	}
+	if v != nil {
+		v.ref()
+		defer v.unref()
+	}
+	db.mu.RUnlock()
+
+	s.WALBytesWritten = atomic.LoadUint64(&db.io.walRetired)
+	if active != nil {
+		s.MemtableBytes = active.Size()
+		s.MemtableEntries = active.Entries()
+		s.WALBytesWritten += active.WALBytesWritten()
+	}
+	s.ImmutableMemtables = len(immutables)
+	for _, mt := range immutables {
+		s.ImmutableBytes += mt.Size()
+		s.WALBytesWritten += mt.WALBytesWritten()
+	}
+
+	s.Levels = []LevelStats{{Level: 0}}
+	if v != nil {
+		for level, files := range v.levels {
+			if len(files) == 0 {
+				continue
+			}
+			for len(s.Levels) <= level {
+				s.Levels = append(s.Levels, LevelStats{Level: len(s.Levels)})
+			}
+			ls := &s.Levels[level]
+			for _, f := range files {
+				ls.Files++
+				ls.Bytes += uint64(f.reader.Size())
+				checks, negatives := f.reader.BloomStats()
+				s.BloomChecks += checks
+				s.BloomNegatives += negatives
+			}
+			s.SSTableCount += ls.Files
+			s.SSTableBytes += ls.Bytes
+		}
+	}
+	if s.BloomChecks > 0 {
+		s.BloomHitRate = float64(s.BloomNegatives) / float64(s.BloomChecks)
+	}
+
+	s.UserBytesWritten = atomic.LoadUint64(&db.io.userBytes)
+	s.FlushBytesWritten = atomic.LoadUint64(&db.io.flushBytes)
+	s.Compaction = db.compactStats.snapshot()
+	s.Scheduler = db.sched.Stats()
+	if c := db.readerOpts.Cache; c != nil {
+		cs := c.Stats()
+		s.BlockCache = &cs
+	}
+	if db.rowCache != nil {
+		rs := db.rowCache.stats()
+		s.RowCache = &rs
+	}
+	s.ObsoleteFilesPending, s.FileDeletionHolds, s.ObsoleteFileDeleteFailures = db.deleter.stats()
+	if db.vlog != nil {
+		s.ValueLogFiles, s.ValueLogBytes = db.vlog.stats()
+	}
+	s.WriteThrottled, s.WALSyncLatency = db.throttle.state()
+	s.WriteSlowdowns = atomic.LoadUint64(&db.stalls.slowdowns)
+	s.WriteStops = atomic.LoadUint64(&db.stalls.stops)
+	s.WriteStallTime = time.Duration(atomic.LoadUint64(&db.stalls.stallNanos))
+
+	if s.UserBytesWritten > 0 {
+		written := s.WALBytesWritten + s.FlushBytesWritten + s.Compaction.BytesWritten
+		s.WriteAmplification = float64(written) / float64(s.UserBytesWritten)
+	}
+	if gets := atomic.LoadUint64(&db.io.gets); gets > 0 {
+		s.ReadAmplification = float64(atomic.LoadUint64(&db.io.sstProbes)) / float64(gets)
+	}
+	return s
+}
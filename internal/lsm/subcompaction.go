@@ -0,0 +1,220 @@
+package lsm
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/memtable"
+	"github.com/return2faye/SiltKV/internal/sstable"
+	"github.com/return2faye/SiltKV/internal/utils"
+)
+
+// compactionJob is the state every subcompaction of one compaction shares.
+// It is read-only while they run.
+type compactionJob struct {
+	c    *compaction
+	base *version // pinned for the duration of the compaction
+	now  time.Time
+
+	readers       []*sstable.Reader // inputs, newest first
+	rangeDels     [][]memtable.RangeTombstone
+	keptRangeDels []memtable.RangeTombstone
+
+	nextPath  func() string // a fresh output file name
+	newWriter func(path string) (*sstable.Writer, error)
+}
+
+// subcompaction merges the keys in [start, end) of a compaction; nil leaves
+// that side open. Subcompactions of one compaction cover disjoint ranges, so
+// they can run in parallel and their outputs still line up in key order.
+type subcompaction struct {
+	start, end []byte
+
+	outputs []*sstable.Reader // finished outputs, in key order
+	paths   []string          // every output file created, for cleanup
+
+	err     error
+	errPath string // file being written when err occurred, if any
+}
+
+// splitCompaction divides c into at most db.maxSubcompactions key ranges.
+// The ranges are cut at the smallest keys of the input files, so that each
+// one gets a similar share of the files to merge.
+func (db *DB) splitCompaction(c *compaction) []*subcompaction {
+	n := db.maxSubcompactions
+	var bounds [][]byte
+	if n > 1 {
+		files := c.files()
+		smallest, _ := keyRange(files)
+		for _, f := range files {
+			if f.smallest != nil && bytes.Compare(f.smallest, smallest) > 0 {
+				bounds = append(bounds, f.smallest)
+			}
+		}
+		sort.Slice(bounds, func(i, j int) bool {
+			return bytes.Compare(bounds[i], bounds[j]) < 0
+		})
+		uniq := bounds[:0]
+		for _, b := range bounds {
+			if len(uniq) == 0 || !bytes.Equal(uniq[len(uniq)-1], b) {
+				uniq = append(uniq, b)
+			}
+		}
+		bounds = uniq
+	}
+	if n > len(bounds)+1 {
+		n = len(bounds) + 1
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	subs := make([]*subcompaction, n)
+	var start []byte
+	for i := range subs {
+		var end []byte
+		if i < n-1 {
+			end = bounds[(i+1)*len(bounds)/n]
+		}
+		subs[i] = &subcompaction{start: start, end: end}
+		start = end
+	}
+	return subs
+}
+
+// runSubcompaction merges the inputs of job within sc's key range into new
+// SSTables, splitting at the file size limit. The outcome is left in sc; on
+// error the caller removes every file in sc.paths.
+func (db *DB) runSubcompaction(job *compactionJob, sc *subcompaction) {
+	fail := func(path string, err error) {
+		sc.err, sc.errPath = err, path
+	}
+
+	// Each subcompaction walks its own range, so it needs its own cursors.
+	older := job.c.olderFiles(job.base)
+
+	// Create merge iterator. Compaction is bulk work, so it yields to slow
+	// foreground reads between blocks.
+	mergeIt, err := sstable.NewMergeIteratorWithOptions(job.readers, sstable.IteratorOptions{
+		BeforeBlock: db.fgLatency.yield,
+	})
+	if err != nil {
+		fail("", err)
+		return
+	}
+	if sc.start != nil {
+		if err := mergeIt.Seek(sc.start); err != nil {
+			fail("", err)
+			return
+		}
+	}
+
+	// Create first writer
+	outputPath := job.nextPath()
+	writer, err := job.newWriter(outputPath)
+	if err != nil {
+		fail(outputPath, err)
+		return
+	}
+	sc.paths = append(sc.paths, outputPath)
+
+	// Range tombstones that are kept are split at the output boundaries, so
+	// that each output's key range covers exactly the tombstones it holds and
+	// files in the output level stay disjoint. outputStart is the first key
+	// of the current output, the start of the range for the first one.
+	outputStart := sc.start
+	written := 0
+
+	// Write merged data, splitting into multiple SSTables if needed
+	for mergeIt.Valid() {
+		key := mergeIt.Key()
+		value := mergeIt.Value()
+		if sc.end != nil && bytes.Compare(key, sc.end) >= 0 {
+			break
+		}
+
+		// Expired trash is purged the same way as a tombstone.
+		if value != nil && db.trashExpired(key, value, job.now) {
+			value = nil
+		}
+
+		// A value is gone if a range tombstone of a newer input covers it. Such
+		// a tombstone is either dropped together with everything it deletes,
+		// or kept in the outputs, where it still hides older levels.
+		//
+		// Point tombstones are written out only while an older file may hold
+		// the key, so they keep shadowing its older versions further down.
+		covered := coveredByNewerInput(job.rangeDels, mergeIt.Source(), key)
+		if !covered && (value != nil || older.mayContain(key)) {
+			// Check if current file would exceed size limit
+			recordSize := int64(8 + len(key) + len(value))
+			if writer.Size()+recordSize > sstable.MaxSSTableFileSize() && writer.Size() > 0 {
+				addClippedRangeTombstones(writer, job.keptRangeDels, outputStart, key)
+				outputStart = utils.CopyBytes(key)
+
+				// Close current writer and create new one
+				if err := writer.Close(); err != nil {
+					fail(outputPath, err)
+					return
+				}
+
+				// Open reader for completed file
+				reader, err := sstable.NewReaderWithOptions(outputPath, db.readerOpts)
+				if err != nil {
+					fail(outputPath, err)
+					return
+				}
+				sc.outputs = append(sc.outputs, reader)
+
+				// Create new writer
+				outputPath = job.nextPath()
+				writer, err = job.newWriter(outputPath)
+				if err != nil {
+					fail(outputPath, err)
+					return
+				}
+				sc.paths = append(sc.paths, outputPath)
+				written = 0
+			}
+
+			// Write key-value pair (nil is a tombstone)
+			if _, err := writer.Write(key, value); err != nil {
+				writer.Close()
+				fail(outputPath, err)
+				return
+			}
+			written++
+		}
+
+		if err := mergeIt.Next(); err != nil {
+			// Finishing here would silently drop the rest of the inputs.
+			writer.Close()
+			fail("", err)
+			return
+		}
+	}
+
+	// Close last writer
+	n := addClippedRangeTombstones(writer, job.keptRangeDels, outputStart, sc.end)
+	if err := writer.Close(); err != nil {
+		fail(outputPath, err)
+		return
+	}
+
+	if written == 0 && n == 0 {
+		// Everything was deleted; an empty file would sit in its level
+		// forever without a key range to ever be picked by.
+		os.Remove(outputPath)
+		sc.paths = sc.paths[:len(sc.paths)-1]
+		return
+	}
+	// Open reader for last file
+	lastReader, err := sstable.NewReaderWithOptions(outputPath, db.readerOpts)
+	if err != nil {
+		fail(outputPath, err)
+		return
+	}
+	sc.outputs = append(sc.outputs, lastReader)
+}
@@ -0,0 +1,280 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/wal"
+)
+
+// ErrWALTailGap is returned by WALTail.Next when the records it is to
+// return next are no longer kept: their WAL was flushed and deleted, and
+// is not in the WAL archive either.
+var ErrWALTailGap = errors.New("lsm: WAL records to tail are no longer kept")
+
+// tailPollInterval is how often a WALTail that has caught up with the
+// active WAL looks for new records.
+const tailPollInterval = 10 * time.Millisecond
+
+// WALTail streams the records the DB logs, in sequence order, for change
+// data capture; see DB.TailWAL. A WALTail is not safe for concurrent use.
+type WALTail struct {
+	db   *DB
+	next uint64 // sequence number of the next record, or 0 for any
+	path string // the WAL being read
+	file *durablePrefix
+	rd   *wal.Reader
+}
+
+// TailWAL returns a WALTail that streams the records the DB logs, from
+// sequence number fromSeq on, or from the oldest record its WALs still
+// hold if fromSeq is 0. A consumer that stores the Seq of the last record
+// it handled resumes after a restart with TailWAL(seq+1).
+//
+// Only durable records are returned, so a crash cannot undo one that was
+// shipped. A write becomes durable with the next periodic sync of the
+// WAL, about a second after it is made. Records whose WAL was flushed
+// meanwhile are read from the WAL archive, if Options.WALArchiveDir is
+// set; otherwise Next fails with ErrWALTailGap once the tail falls that
+// far behind.
+//
+// Records hold user keys and values, decoded by any value codec. The
+// writes the DB makes for itself, such as the postings of the token index,
+// are left out, so the last record of a batch may come before BatchEnd.
+func (db *DB) TailWAL(fromSeq uint64) (*WALTail, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	switch {
+	case db.closed:
+		return nil, ErrClosed
+	case db.readOnly:
+		return nil, ErrReadOnly
+	}
+	return &WALTail{db: db, next: fromSeq}, nil
+}
+
+// Next returns the next record, waiting for one to be logged once the
+// tail has caught up, until ctx is done. Key and Value are only valid
+// until the next call. Next fails with ErrClosed once the DB is closed.
+func (t *WALTail) Next(ctx context.Context) (wal.Record, error) {
+	for {
+		if t.rd == nil {
+			if err := t.open(""); err != nil {
+				return wal.Record{}, err
+			}
+		}
+		rec, err := t.rd.Next()
+		switch {
+		case err == io.EOF:
+			if err := t.advance(ctx); err != nil {
+				return wal.Record{}, err
+			}
+			continue
+		case err != nil:
+			return wal.Record{}, err
+		case rec.Seq == 0 || rec.Seq < t.next:
+			// Logged before sequence numbers existed, or already returned
+			continue
+		case t.next != 0 && rec.Seq > t.next:
+			if err := t.openArchived(); err != nil {
+				return wal.Record{}, err
+			}
+			continue
+		}
+		t.next = rec.Seq + 1
+		if isInternalKey(rec.Key) {
+			continue
+		}
+		if rec.Value != nil && !rec.RangeDelete {
+			if rec.Value, err = t.userValue(rec.Key, rec.Value); err != nil {
+				return wal.Record{}, err
+			}
+		}
+		return rec, nil
+	}
+}
+
+// userValue returns the user value of key from what its WAL record holds.
+func (t *WALTail) userValue(key, value []byte) ([]byte, error) {
+	db := t.db
+	if db.vlog != nil {
+		defer db.vlog.enter()()
+		var err error
+		if value, err = db.vlog.resolve(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return db.codecs.decode(key, value)
+}
+
+// Close stops the tail and closes the WAL it reads.
+func (t *WALTail) Close() error {
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.f.Close()
+	t.file, t.rd = nil, nil
+	return err
+}
+
+// tailSegment is a live WAL as a WALTail sees it.
+type tailSegment struct {
+	path string
+	last uint64 // sequence number of its newest record
+	end  int64  // bytes of it that are durable
+}
+
+// tailSegments returns the WALs of the memtables, oldest first, so the
+// active one is last.
+func (db *DB) tailSegments() ([]tailSegment, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed || db.active == nil {
+		return nil, ErrClosed
+	}
+	segs := make([]tailSegment, 0, len(db.immutables)+1)
+	for _, mt := range append(slices.Clone(db.immutables), db.active) {
+		last, _ := mt.LastSequence()
+		segs = append(segs, tailSegment{path: mt.WalPath(), last: last, end: mt.DurableWALSize()})
+	}
+	// immutables are newest first
+	slices.Reverse(segs[:len(segs)-1])
+	return segs, nil
+}
+
+// open starts reading the live WAL that holds record t.next, or the oldest
+// one if t.next is 0, passing over after and the WALs before it. The WAL
+// chosen is the active one if none of the others can hold t.next.
+func (t *WALTail) open(after string) error {
+	for {
+		segs, err := t.db.tailSegments()
+		if err != nil {
+			return err
+		}
+		i := 0
+		if j := slices.IndexFunc(segs, func(s tailSegment) bool { return s.path == after }); j >= 0 {
+			i = min(j+1, len(segs)-1)
+		}
+		for i < len(segs)-1 && t.next != 0 && segs[i].last < t.next {
+			i++
+		}
+		err = t.openFile(segs[i].path, segs[i].end)
+		if !os.IsNotExist(err) {
+			return err
+		}
+		// Flushed and deleted since: look again
+	}
+}
+
+// openArchived switches to the archived WAL that holds record t.next,
+// which the WAL being read lacks, or fails with ErrWALTailGap.
+func (t *WALTail) openArchived() error {
+	if dir := t.db.archiveDir; dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, e := range entries {
+			first, last, ok := parseArchiveWALName(e.Name())
+			path := filepath.Join(dir, e.Name())
+			if !ok || t.next < first || t.next > last || path == t.path {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				return err
+			}
+			return t.openFile(path, info.Size())
+		}
+	}
+	return fmt.Errorf("%w: record %d", ErrWALTailGap, t.next)
+}
+
+// openFile starts reading the first end bytes of the WAL at path.
+func (t *WALTail) openFile(path string, end int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	t.Close()
+	t.path = path
+	t.file = &durablePrefix{f: f, end: end}
+	t.rd = wal.NewReader(t.file)
+	return nil
+}
+
+// advance is called once the tail has read its WAL as far as it is
+// durable. It lets the tail read on when more of the WAL is durable, moves
+// it to the next WAL once this one is complete, or else waits for either.
+func (t *WALTail) advance(ctx context.Context) error {
+	for {
+		segs, err := t.db.tailSegments()
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(segs, func(s tailSegment) bool { return s.path == t.path })
+		switch {
+		case i < 0:
+			// Flushed since, or archived: the file is complete.
+			info, err := t.file.f.Stat()
+			if err != nil {
+				return err
+			}
+			if info.Size() > t.file.end {
+				t.file.end = info.Size()
+				return nil
+			}
+			return t.open(t.path)
+		case segs[i].end > t.file.end:
+			t.file.end = segs[i].end
+			return nil
+		case i < len(segs)-1:
+			// Frozen, which synced all of it
+			return t.open(t.path)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.db.clock.After(tailPollInterval):
+		}
+	}
+}
+
+// durablePrefix reads a WAL file up to end, the part of it known to be
+// durable.
+type durablePrefix struct {
+	f   *os.File
+	off int64
+	end int64
+}
+
+func (p *durablePrefix) Read(b []byte) (int, error) {
+	if p.off >= p.end {
+		return 0, io.EOF
+	}
+	b = b[:min(int64(len(b)), p.end-p.off)]
+	n, err := p.f.ReadAt(b, p.off)
+	p.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (p *durablePrefix) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += p.off
+	default:
+		return 0, fmt.Errorf("lsm: seek relative to the end of a WAL: %w", os.ErrInvalid)
+	}
+	p.off = offset
+	return offset, nil
+}
@@ -0,0 +1,170 @@
+package lsm
+
+import (
+	"sync"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/clock"
+)
+
+const (
+	// defaultWALSyncLatencyThreshold is the smoothed fsync latency above
+	// which the disk is considered degraded and writes are throttled.
+	defaultWALSyncLatencyThreshold = 200 * time.Millisecond
+	// defaultThrottledWriteRate is the write admission rate, in key+value
+	// bytes per second, while the disk is degraded.
+	defaultThrottledWriteRate = 4 << 20
+)
+
+// WriteThrottleEvent reports a change in write admission.
+type WriteThrottleEvent struct {
+	Throttled   bool          // true when throttling starts, false when it ends
+	SyncLatency time.Duration // smoothed WAL fsync latency at the transition
+}
+
+// writeThrottle slows Put admission while WAL fsyncs are slow, so a degraded
+// disk shows up as higher write latency instead of an ever-growing backlog
+// of unsynced WAL data and memtable memory.
+//
+// It enters the throttled state when the fsync EWMA exceeds threshold and
+// leaves it once the EWMA falls below half of it. While throttled, writers
+// draw from a rateLimiter refilled at rate bytes per second.
+type writeThrottle struct {
+	threshold time.Duration // <= 0 disables throttling
+	limiter   *rateLimiter
+	onChange  func(WriteThrottleEvent)
+
+	mu        sync.Mutex
+	ewma      time.Duration
+	throttled bool
+}
+
+func newWriteThrottle(c clock.Clock, threshold time.Duration, rate int, onChange func(WriteThrottleEvent)) *writeThrottle {
+	if rate <= 0 {
+		rate = defaultThrottledWriteRate
+	}
+	return &writeThrottle{threshold: threshold, limiter: newRateLimiter(c, int64(rate)), onChange: onChange}
+}
+
+// observeSync folds one fsync latency into the average (alpha = 1/4) and
+// switches the throttled state when it crosses the thresholds.
+func (t *writeThrottle) observeSync(d time.Duration) {
+	if t.threshold <= 0 {
+		return
+	}
+	t.mu.Lock()
+	t.ewma += (d - t.ewma) / 4
+	changed := false
+	switch {
+	case !t.throttled && t.ewma > t.threshold:
+		t.throttled = true
+		t.limiter.reset()
+		changed = true
+	case t.throttled && t.ewma < t.threshold/2:
+		t.throttled = false
+		changed = true
+	}
+	ev := WriteThrottleEvent{Throttled: t.throttled, SyncLatency: t.ewma}
+	t.mu.Unlock()
+
+	if changed && t.onChange != nil {
+		t.onChange(ev)
+	}
+}
+
+// admit blocks until n bytes may be written. It returns immediately unless
+// the disk is degraded, or once the throttle is closed.
+func (t *writeThrottle) admit(n int) {
+	t.mu.Lock()
+	throttled := t.throttled
+	t.mu.Unlock()
+	if throttled {
+		t.limiter.wait(n)
+	}
+}
+
+// close releases the writers waiting in admit, and those to come.
+func (t *writeThrottle) close() {
+	t.limiter.close()
+}
+
+// state returns whether writes are throttled and the smoothed fsync latency.
+func (t *writeThrottle) state() (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.throttled, t.ewma
+}
+
+// rateLimiter caps the bytes per second written: those that compactions,
+// and optionally flushes, write to SSTables, so that background merges
+// leave disk bandwidth to foreground writes and WAL syncs, and those a
+// writeThrottle admits. Writers draw from a token bucket holding at most
+// one second worth of bytes, timed by clock. A nil *rateLimiter does not
+// limit anything.
+type rateLimiter struct {
+	clock clock.Clock
+	rate  float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	stop     chan struct{} // closed by close to release waiting writers
+	stopOnce sync.Once
+}
+
+// newRateLimiter returns a limiter to bytesPerSec, or nil if it is not
+// positive. A nil c is the real clock.
+func newRateLimiter(c clock.Clock, bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	if c == nil {
+		c = clock.Real()
+	}
+	return &rateLimiter{clock: c, rate: float64(bytesPerSec), last: c.Now(), stop: make(chan struct{})}
+}
+
+// reset empties the bucket, so that writers get no burst.
+func (l *rateLimiter) reset() {
+	l.mu.Lock()
+	l.tokens, l.last = 0, l.clock.Now()
+	l.mu.Unlock()
+}
+
+// wait blocks until n more bytes may be written. It returns early once the
+// limiter is closed, so that Close does not wait out a slow compaction.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return
+	}
+	select {
+	case <-l.clock.After(wait):
+	case <-l.stop:
+	}
+}
+
+// close stops limiting: current and future waits return immediately.
+func (l *rateLimiter) close() {
+	if l == nil {
+		return
+	}
+	l.stopOnce.Do(func() { close(l.stop) })
+}
@@ -0,0 +1,234 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
+)
+
+// TraceOp identifies the operation in a TraceRecord.
+type TraceOp uint8
+
+const (
+	TraceOpGet TraceOp = 1 + iota
+	TraceOpPut
+	TraceOpDelete
+	TraceOpDeleteRange
+	TraceOpScan // a NewIterator, keyed by its LowerBound
+)
+
+func (op TraceOp) String() string {
+	switch op {
+	case TraceOpGet:
+		return "get"
+	case TraceOpPut:
+		return "put"
+	case TraceOpDelete:
+		return "delete"
+	case TraceOpDeleteRange:
+		return "delete_range"
+	case TraceOpScan:
+		return "scan"
+	}
+	return "unknown"
+}
+
+// TraceRecord is one operation in a trace. Keys are not recorded, only a
+// hash and their size, so a trace of production traffic holds no user
+// data yet keeps which operations hit the same key.
+type TraceRecord struct {
+	Op        TraceOp
+	Time      time.Duration // since the trace started
+	Latency   time.Duration // how long the operation took
+	KeyHash   uint64        // FNV-1a of the key
+	KeySize   int
+	ValueSize int // bytes written by a Put; 0 otherwise
+}
+
+// Key returns a key of r.KeySize bytes derived from r.KeyHash, for replays:
+// records of the same key get the same one, and keys of the same size sort
+// in the order of their hashes.
+func (r TraceRecord) Key() []byte {
+	key := make([]byte, r.KeySize)
+	var h [8]byte
+	binary.BigEndian.PutUint64(h[:], r.KeyHash)
+	for i := range key {
+		key[i] = h[i%8]
+	}
+	return key
+}
+
+// TraceOptions configures a trace started with DB.StartTrace.
+type TraceOptions struct {
+	// SampleEvery records one operation in this many, for busy DBs where a
+	// full trace costs too much. Zero or one records every operation.
+	SampleEvery int
+}
+
+// traceMagic starts every trace file, followed by the start time in Unix
+// nanoseconds. Each record is then the op byte, the time since the start
+// and the latency in nanoseconds as uvarints, the key hash as 8 bytes
+// little endian, and the key and value sizes as uvarints.
+const traceMagic = "SILTTRC1"
+
+var (
+	// ErrTraceActive is returned by StartTrace while a trace is running.
+	ErrTraceActive = errors.New("lsm: a trace is already running")
+	// ErrNoTrace is returned by EndTrace when no trace is running.
+	ErrNoTrace = errors.New("lsm: no trace is running")
+	// ErrBadTrace is returned by NewTraceReader and TraceReader.Next for
+	// input that is not a trace or is cut short inside a record.
+	ErrBadTrace = errors.New("lsm: malformed trace")
+)
+
+// tracer writes the records of a running trace. Operations on any
+// goroutine record into it; the first write error ends the trace.
+type tracer struct {
+	now         func() time.Time
+	start       time.Time
+	sampleEvery uint64
+
+	mu    sync.Mutex // guards the fields below
+	w     *bufio.Writer
+	seen  uint64 // operations considered, sampled or not
+	err   error
+	ended bool // set by EndTrace; later records are dropped
+	buf   []byte
+}
+
+// StartTrace starts recording the operations on the DB to w: Gets, Puts,
+// Deletes, DeleteRanges and new iterators, with their key sizes and
+// latencies. cmd/siltkv-bench replays such a trace against another DB to
+// reproduce a production workload. Only one trace runs at a time; EndTrace
+// ends it.
+func (db *DB) StartTrace(w io.Writer, opts TraceOptions) error {
+	t := &tracer{now: db.clock.Now, start: db.clock.Now(), sampleEvery: 1, w: bufio.NewWriter(w)}
+	if opts.SampleEvery > 1 {
+		t.sampleEvery = uint64(opts.SampleEvery)
+	}
+	// The header stays buffered, so a trace that loses the race below
+	// leaves nothing in w.
+	t.buf = append(t.buf, traceMagic...)
+	t.buf = binary.LittleEndian.AppendUint64(t.buf, uint64(t.start.UnixNano()))
+	t.flushBuf()
+	if !db.tracer.CompareAndSwap(nil, t) {
+		return ErrTraceActive
+	}
+	return nil
+}
+
+// EndTrace stops the running trace and flushes it to its writer. It
+// returns the first error writing the trace met, which stopped it early.
+func (db *DB) EndTrace() error {
+	t := db.tracer.Swap(nil)
+	if t == nil {
+		return ErrNoTrace
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ended = true
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+	return t.err
+}
+
+// trace returns the running trace, or nil. Operations record into it once
+// they are done, from a defer.
+func (db *DB) trace() *tracer {
+	return db.tracer.Load()
+}
+
+// record adds an operation that started at start to the trace, if it is
+// sampled. A nil tracer records nothing.
+func (t *tracer) record(op TraceOp, key []byte, valueSize int, start time.Time) {
+	if t == nil {
+		return
+	}
+	latency := t.now().Sub(start)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seen++
+	if t.err != nil || t.ended || (t.seen-1)%t.sampleEvery != 0 {
+		return
+	}
+	h := fnv.New64a()
+	h.Write(key)
+	t.buf = append(t.buf, byte(op))
+	t.buf = binary.AppendUvarint(t.buf, uint64(max(start.Sub(t.start), 0)))
+	t.buf = binary.AppendUvarint(t.buf, uint64(max(latency, 0)))
+	t.buf = binary.LittleEndian.AppendUint64(t.buf, h.Sum64())
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(key)))
+	t.buf = binary.AppendUvarint(t.buf, uint64(valueSize))
+	t.flushBuf()
+}
+
+// flushBuf hands the encoded record in buf to the writer.
+func (t *tracer) flushBuf() {
+	if _, err := t.w.Write(t.buf); err != nil && t.err == nil {
+		t.err = err
+	}
+	t.buf = t.buf[:0]
+}
+
+// TraceReader reads the records of a trace written by DB.StartTrace.
+type TraceReader struct {
+	r     *bufio.Reader
+	start time.Time
+}
+
+// NewTraceReader reads the header of the trace in r.
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(traceMagic)+8)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(traceMagic)]) != traceMagic {
+		return nil, ErrBadTrace
+	}
+	start := time.Unix(0, int64(binary.LittleEndian.Uint64(header[len(traceMagic):])))
+	return &TraceReader{r: br, start: start}, nil
+}
+
+// Start returns when the trace was started.
+func (tr *TraceReader) Start() time.Time {
+	return tr.start
+}
+
+// Next returns the next record, or io.EOF after the last one.
+func (tr *TraceReader) Next() (TraceRecord, error) {
+	op, err := tr.r.ReadByte()
+	if err == io.EOF {
+		return TraceRecord{}, io.EOF
+	}
+	if err != nil {
+		return TraceRecord{}, err
+	}
+	var fields [2]uint64
+	for i := range fields {
+		if fields[i], err = binary.ReadUvarint(tr.r); err != nil {
+			return TraceRecord{}, ErrBadTrace
+		}
+	}
+	var h [8]byte
+	if _, err := io.ReadFull(tr.r, h[:]); err != nil {
+		return TraceRecord{}, ErrBadTrace
+	}
+	var sizes [2]uint64
+	for i := range sizes {
+		if sizes[i], err = binary.ReadUvarint(tr.r); err != nil {
+			return TraceRecord{}, ErrBadTrace
+		}
+	}
+	return TraceRecord{
+		Op:        TraceOp(op),
+		Time:      time.Duration(fields[0]),
+		Latency:   time.Duration(fields[1]),
+		KeyHash:   binary.LittleEndian.Uint64(h[:]),
+		KeySize:   int(sizes[0]),
+		ValueSize: int(sizes[1]),
+	}, nil
+}
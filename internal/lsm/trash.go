@@ -0,0 +1,136 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ErrNotInTrash is returned by Undelete when the key has no trashed value,
+// either because it was never soft-deleted or because it was purged.
+var ErrNotInTrash = errors.New("lsm: key not in trash")
+
+// trashPrefix marks the internal keys that hold soft-deleted values.
+//
+// A trash entry is stored under trashPrefix+key. Its value is the unix-nano
+// deletion time (8 bytes, big-endian) followed by the deleted value in
+// stored form, so Undelete can put it back without going through its codec.
+var trashPrefix = []byte(internalPrefix + "trash\x00")
+
+// trashTimeSize is the size of the deletion time that starts a trash entry.
+const trashTimeSize = 8
+
+func trashKey(key []byte) []byte {
+	k := make([]byte, 0, len(trashPrefix)+len(key))
+	k = append(k, trashPrefix...)
+	return append(k, key...)
+}
+
+// trashBatch returns ops with a trash entry added before each delete of a
+// key that has a value at that point: the value an earlier op of the batch
+// wrote to the key, or else the one the DB holds. The entries thus go to
+// the WAL in the same batch record as the deletes.
+func (db *DB) trashBatch(ops []batchOp) ([]batchOp, error) {
+	now := uint64(db.clock.Now().UnixNano())
+	// latest is the stored value of each key as of the ops seen so far.
+	latest := make(map[string][]byte)
+	var ranges []batchOp
+	out := make([]batchOp, 0, len(ops))
+	for _, op := range ops {
+		switch {
+		case op.rangeDelete:
+			for k := range latest {
+				if k >= string(op.key) && k < string(op.value) {
+					latest[k] = nil
+				}
+			}
+			ranges = append(ranges, op)
+		case op.stored != nil:
+			latest[string(op.key)] = op.stored
+		default:
+			old, seen := latest[string(op.key)]
+			if !seen && !inRanges(ranges, op.key) {
+				stored, found, err := db.getStored(op.key, ReadOptions{})
+				if err != nil {
+					return nil, err
+				}
+				if found {
+					old = stored
+				}
+			}
+			if old != nil {
+				entry := make([]byte, trashTimeSize, trashTimeSize+len(old))
+				binary.BigEndian.PutUint64(entry, now)
+				out = append(out, batchOp{key: trashKey(op.key), stored: append(entry, old...)})
+			}
+			latest[string(op.key)] = nil
+		}
+		out = append(out, op)
+	}
+	return out, nil
+}
+
+// inRanges reports whether key falls in one of the range deletes.
+func inRanges(ranges []batchOp, key []byte) bool {
+	for _, r := range ranges {
+		if bytes.Compare(key, r.key) >= 0 && bytes.Compare(key, r.value) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Undelete restores the value key had when it was last soft-deleted and
+// removes it from the trash. It returns ErrNotInTrash if there is nothing
+// to restore. A value written to key after the delete is overwritten.
+func (db *DB) Undelete(key []byte) error {
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if err := db.writeErr(); err != nil {
+		return err
+	}
+	mu := db.updateLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	tk := trashKey(key)
+	entry, found, err := db.getStored(tk, ReadOptions{})
+	if err != nil {
+		return err
+	}
+	if !found || len(entry) < trashTimeSize || db.trashExpired(tk, entry, db.clock.Now()) {
+		return ErrNotInTrash
+	}
+	stored := entry[trashTimeSize:]
+	value, err := db.codecs.decode(key, stored)
+	if err != nil {
+		return err
+	}
+	// The restore and the removal from the trash are one batch, so a
+	// crash cannot leave the value both restored and in the trash.
+	return db.applyBatch(context.Background(), []batchOp{{key: key, value: value, stored: stored}, {key: tk}})
+}
+
+// PurgeTrash permanently discards the trashed value of key, if any.
+func (db *DB) PurgeTrash(key []byte) error {
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if err := db.writeErr(); err != nil {
+		return err
+	}
+	return db.putStored(context.Background(), trashKey(key), nil, 0)
+}
+
+// trashExpired reports whether key is a trash entry older than the
+// retention period at now.
+func (db *DB) trashExpired(key, value []byte, now time.Time) bool {
+	if db.trashRetention <= 0 || len(value) < trashTimeSize || !bytes.HasPrefix(key, trashPrefix) {
+		return false
+	}
+	deleted := time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+	return now.Sub(deleted) > db.trashRetention
+}
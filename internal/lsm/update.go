@@ -0,0 +1,82 @@
+package lsm
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+)
+
+// updateLockStripes is the number of locks Update spreads keys over. Two
+// keys sharing a stripe only serialize their updates with each other.
+const updateLockStripes = 64
+
+// updateLock returns the lock that serializes Updates of key.
+func (db *DB) updateLock(key []byte) *sync.Mutex {
+	return &db.updateLocks[updateStripe(key)]
+}
+
+func updateStripe(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % updateLockStripes
+}
+
+// lockKeys takes the update locks of the point writes in ops, in stripe
+// order so that two batches cannot deadlock, and returns a function that
+// releases them.
+func (db *DB) lockKeys(ops []batchOp) func() {
+	var stripes [updateLockStripes]bool
+	for _, op := range ops {
+		if !op.rangeDelete {
+			stripes[updateStripe(op.key)] = true
+		}
+	}
+	for i, ok := range stripes {
+		if ok {
+			db.updateLocks[i].Lock()
+		}
+	}
+	return func() {
+		for i, ok := range stripes {
+			if ok {
+				db.updateLocks[i].Unlock()
+			}
+		}
+	}
+}
+
+// Update runs a read-modify-write of key: fn receives the current value,
+// or nil if key is absent, and returns the value to store. Returning a nil
+// value deletes key; returning an error aborts the update without writing
+// anything and is passed through.
+//
+// Updates of the same key are serialized, so concurrent read-modify-write
+// cycles, such as counter increments, never lose each other's changes. A
+// plain Put or Delete of key is not held back, unless Options.SoftDelete is
+// set, and may be overwritten by an Update that read the value before it.
+// fn runs with the key's lock held:
+// it should be short and must not call Update itself.
+func (db *DB) Update(key []byte, fn func(old []byte) ([]byte, error)) error {
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if err := db.writeErr(); err != nil {
+		return err
+	}
+	mu := db.updateLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	old, found, err := db.Get(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		old = nil
+	}
+	value, err := fn(old)
+	if err != nil {
+		return err
+	}
+	return db.putContext(context.Background(), key, value, true)
+}
@@ -0,0 +1,252 @@
+package lsm
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+
+	"github.com/return2faye/SiltKV/internal/sstable"
+)
+
+// fileMeta describes a single live SSTable.
+//
+// Files are identified by a DB-unique id rather than by their position in a
+// slice, so a compaction can name its inputs precisely and later remove
+// exactly those files from whatever the current version looks like by then.
+type fileMeta struct {
+	id     uint64
+	path   string
+	reader *sstable.Reader
+	level  int
+
+	// smallest and largest bound the keys in the file, widened to cover its
+	// range tombstones (so largest may be a tombstone's exclusive end).
+	// Both are nil for a file that holds nothing.
+	smallest []byte
+	largest  []byte
+
+	// maxSeq and maxTime describe the newest WAL record in the file, as
+	// recorded in the manifest; 0 if unknown (files from older versions).
+	maxSeq  uint64
+	maxTime int64
+
+	// entries and deletions count the records and point tombstones in the
+	// file, from its table properties; 0 if unknown (files from older
+	// versions).
+	entries   uint64
+	deletions uint64
+
+	// refs counts the versions that reference this file. When it drops to
+	// zero the reader is closed, and the file is deleted if obsolete is set.
+	refs     int32
+	obsolete int32        // atomic flag: 1 once a compaction has replaced this file
+	deleter  *fileDeleter // deletes the file once obsolete; nil deletes it at once
+}
+
+func (f *fileMeta) ref() {
+	atomic.AddInt32(&f.refs, 1)
+}
+
+func (f *fileMeta) unref() {
+	if atomic.AddInt32(&f.refs, -1) != 0 {
+		return
+	}
+	f.reader.Close()
+	if atomic.LoadInt32(&f.obsolete) == 1 {
+		// Nobody can read this file anymore, so it is safe to remove.
+		f.deleter.obsolete(f.path)
+	}
+}
+
+// contains reports whether key falls inside f's bounds.
+func (f *fileMeta) contains(key []byte) bool {
+	return f.smallest != nil && bytes.Compare(key, f.smallest) >= 0 && bytes.Compare(key, f.largest) <= 0
+}
+
+// tombstones returns the number of point and range tombstones in f.
+func (f *fileMeta) tombstones() uint64 {
+	return f.deletions + uint64(len(f.reader.RangeTombstones()))
+}
+
+// tombstoneDensity is the share of f's records that are tombstones, with
+// each range tombstone counted as one record.
+func (f *fileMeta) tombstoneDensity() float64 {
+	total := f.entries + uint64(len(f.reader.RangeTombstones()))
+	if total == 0 {
+		return 0
+	}
+	return float64(f.tombstones()) / float64(total)
+}
+
+// overlaps reports whether f's bounds intersect [smallest, largest].
+func (f *fileMeta) overlaps(smallest, largest []byte) bool {
+	return f.smallest != nil && bytes.Compare(f.largest, smallest) >= 0 && bytes.Compare(f.smallest, largest) <= 0
+}
+
+// overlapsRange reports whether f's bounds intersect [start, end), where a
+// nil start or end leaves that side open.
+func (f *fileMeta) overlapsRange(start, end []byte) bool {
+	return f.smallest != nil && (start == nil || bytes.Compare(f.largest, start) >= 0) &&
+		(end == nil || bytes.Compare(f.smallest, end) < 0)
+}
+
+// version is an immutable view of the SSTable set, arranged in levels.
+//
+// L0 holds flushed files, newest first; their key ranges may overlap. Every
+// deeper level holds files with disjoint key ranges, sorted by key, and its
+// data is older than that of the levels above it.
+//
+// Readers pin a version for the duration of a lookup, which keeps every file
+// in it open even if a concurrent compaction replaces the file in a newer
+// version. Flush and compaction never modify a version in place; they build a
+// new one and install it as db.current.
+type version struct {
+	levels [numLevels][]*fileMeta
+
+	// files lists every file in lookup order: L0 newest first, then each
+	// deeper level in key order.
+	files []*fileMeta
+	refs  int32
+}
+
+// newVersion creates a version over files and takes a reference on each file.
+// Files are placed in their level; L0 files must be given newest first.
+// The returned version starts with one reference owned by the caller.
+func newVersion(files []*fileMeta) *version {
+	v := &version{refs: 1}
+	for _, f := range files {
+		f.ref()
+		v.levels[f.level] = append(v.levels[f.level], f)
+	}
+	v.files = make([]*fileMeta, 0, len(files))
+	for level, lf := range v.levels {
+		if level > 0 {
+			sort.Slice(lf, func(i, j int) bool {
+				return bytes.Compare(lf[i].smallest, lf[j].smallest) < 0
+			})
+		}
+		v.files = append(v.files, lf...)
+	}
+	return v
+}
+
+func (v *version) ref() {
+	atomic.AddInt32(&v.refs, 1)
+}
+
+func (v *version) unref() {
+	if atomic.AddInt32(&v.refs, -1) != 0 {
+		return
+	}
+	for _, f := range v.files {
+		f.unref()
+	}
+}
+
+// forEachCandidate calls fn for every file that may hold key, in lookup
+// order, until fn returns false. Deeper levels are binary searched, so a
+// lookup touches at most one or two files per level below L0.
+func (v *version) forEachCandidate(key []byte, fn func(*fileMeta) bool) {
+	for _, f := range v.levels[0] {
+		if f.contains(key) && !fn(f) {
+			return
+		}
+	}
+	for _, files := range v.levels[1:] {
+		i := sort.Search(len(files), func(i int) bool {
+			return bytes.Compare(files[i].largest, key) >= 0
+		})
+		// Adjacent files may share a boundary key when the first one ends
+		// in a range tombstone, so look past the first match.
+		for ; i < len(files) && bytes.Compare(files[i].smallest, key) <= 0; i++ {
+			if !fn(files[i]) {
+				return
+			}
+		}
+	}
+}
+
+// overlapping returns the files of level whose bounds intersect
+// [smallest, largest].
+func (v *version) overlapping(level int, smallest, largest []byte) []*fileMeta {
+	var out []*fileMeta
+	for _, f := range v.levels[level] {
+		if f.overlaps(smallest, largest) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// levelBytes returns the total size of the files in level.
+func (v *version) levelBytes(level int) int64 {
+	var n int64
+	for _, f := range v.levels[level] {
+		n += f.reader.Size()
+	}
+	return n
+}
+
+// readers returns the SSTable readers of this version in lookup order.
+func (v *version) readers() []*sstable.Reader {
+	readers := make([]*sstable.Reader, len(v.files))
+	for i, f := range v.files {
+		readers[i] = f.reader
+	}
+	return readers
+}
+
+// manifest returns the manifest entries of this version (oldest first): the
+// deepest level first and L0 last, so that reading it back in reverse gives
+// the lookup order again.
+func (v *version) manifest() []manifestEntry {
+	entries := make([]manifestEntry, len(v.files))
+	for i, f := range v.files {
+		entries[len(v.files)-1-i] = f.manifestEntry()
+	}
+	return entries
+}
+
+func (f *fileMeta) manifestEntry() manifestEntry {
+	return manifestEntry{path: f.path, maxSeq: f.maxSeq, maxTime: f.maxTime, level: f.level}
+}
+
+// withFlushed returns a new version with f added as the newest L0 file.
+func (v *version) withFlushed(f *fileMeta) *version {
+	files := make([]*fileMeta, 0, len(v.files)+1)
+	files = append(files, f)
+	files = append(files, v.files...)
+	return newVersion(files)
+}
+
+// withCompaction returns a new version in which the input files are replaced
+// by outputs. Outputs go to their own level; in L0 they would take the
+// position of the newest input, since they hold data that is older than
+// every file in front of it.
+//
+// Files that were added after the compaction started are unaffected. The only
+// conflict is an input that is no longer part of this version, in which case
+// ok is false and the compaction must be discarded.
+func (v *version) withCompaction(inputs, outputs []*fileMeta) (nv *version, ok bool) {
+	isInput := make(map[uint64]bool, len(inputs))
+	for _, f := range inputs {
+		isInput[f.id] = true
+	}
+
+	files := make([]*fileMeta, 0, len(v.files)-len(inputs)+len(outputs))
+	found := 0
+	for _, f := range v.files {
+		if !isInput[f.id] {
+			files = append(files, f)
+			continue
+		}
+		if found == 0 {
+			files = append(files, outputs...)
+		}
+		found++
+	}
+	if found != len(inputs) {
+		return nil, false
+	}
+	return newVersion(files), true
+}
@@ -0,0 +1,731 @@
+package lsm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/return2faye/SiltKV/internal/wal"
+)
+
+const (
+	// valueLogDirName is the directory under the data directory that holds
+	// the blob files of the value log. Its presence marks a DB created with
+	// a value log; see Options.ValueLogThreshold.
+	valueLogDirName = "vlog"
+	blobSuffix      = ".blob"
+
+	defaultValueLogFileSize = 64 << 20
+	defaultValueLogGCRatio  = 0.5
+)
+
+// In a DB with a value log, every value of a user key starts with a tag
+// saying where the stored value is. Internal keys are never tagged.
+const (
+	valueTagInline  = 0 // the stored value follows
+	valueTagPointer = 1 // uvarint blob file, offset and record length follow
+)
+
+var (
+	// ErrNoValueLog is returned by CollectValueLog on a DB without a value
+	// log, and by Open when ValueLogThreshold is set for a data directory
+	// that already holds data written without one.
+	ErrNoValueLog = errors.New("lsm: data directory has no value log")
+	// ErrCorruptValueLog is matched by errors.Is for a value whose blob
+	// record is missing, cut short or fails its checksum.
+	ErrCorruptValueLog = errors.New("lsm: corrupt value log")
+)
+
+// ValueLogGCStats describes what CollectValueLog did.
+type ValueLogGCStats struct {
+	FilesScanned   int   // sealed blob files examined
+	FilesCollected int   // files whose live values were moved and that were deleted
+	ValuesMoved    int   // live values rewritten at the head of the log
+	BytesReclaimed int64 // size of the collected files
+}
+
+var blobCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// blobPointer locates a record in the value log.
+//
+// A record is [crc32c(4)][keyLen(uvarint)][valueLen(uvarint)][key][value],
+// the checksum covering everything after it. The key lets a collection
+// find the entry that points at the record, and lets a read tell a record
+// from one that a stray pointer lands on.
+type blobPointer struct {
+	file   uint64
+	offset int64
+	length int // of the whole record
+}
+
+func (p blobPointer) encode() []byte {
+	b := []byte{valueTagPointer}
+	b = binary.AppendUvarint(b, p.file)
+	b = binary.AppendUvarint(b, uint64(p.offset))
+	return binary.AppendUvarint(b, uint64(p.length))
+}
+
+func decodeBlobPointer(b []byte) (blobPointer, bool) {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return blobPointer{}, false
+		}
+		fields[i], b = v, b[n:]
+	}
+	if len(b) > 0 || fields[1] > 1<<62 || fields[2] > 1<<31 {
+		return blobPointer{}, false
+	}
+	return blobPointer{file: fields[0], offset: int64(fields[1]), length: int(fields[2])}, true
+}
+
+// valueLog keeps large values out of the LSM, WiscKey style: they are
+// appended to blob files and the LSM holds a pointer to them, so flushes
+// and compactions move a few bytes per value instead of the whole value.
+// The space of overwritten and deleted values is reclaimed by
+// CollectValueLog.
+//
+// Records are appended through the page cache and synced before any WAL
+// is, through the WAL's BeforeSync hook, so a durable WAL record never
+// points past the durable end of the log.
+type valueLog struct {
+	dir       string
+	threshold int   // stored values at least this long go to the log; 0 for none
+	maxInline int   // stored values at least this long do not fit in the WAL
+	fileSize  int64 // the active file is sealed once this large
+	readOnly  bool
+	deleter   *fileDeleter
+
+	// writeMu is held shared by writes of user keys and exclusively by a
+	// collection while it moves one value, so that no write can land
+	// between its check that the value is live and the move.
+	writeMu sync.RWMutex
+	gcMu    sync.Mutex // one collection at a time
+
+	appendMu   sync.Mutex // serializes appends; guards the fields below
+	active     *os.File   // file taking appends; nil when read-only
+	activeID   uint64
+	activeSize int64
+	dirty      bool // records appended since the last sync
+
+	// mu guards the file handles and the reads in flight. A collected file
+	// stays readable until every read that started before it was
+	// collected, and may hold a pointer into it, is done.
+	mu      sync.Mutex
+	files   map[uint64]*os.File
+	epoch   uint64         // bumped by every collected file
+	readers map[uint64]int // reads in flight per epoch they started in
+	retired []retiredBlob
+}
+
+type retiredBlob struct {
+	id    uint64
+	file  *os.File
+	epoch uint64 // reads from this epoch or before may still use it
+}
+
+// openValueLog opens the value log of the data directory, if it has one.
+// A directory gets one when it is opened for writing with
+// ValueLogThreshold set while it holds no data, since values written
+// without a tag cannot be told from tagged ones later.
+func openValueLog(dataDir, walDir string, entries []manifestEntry, opts Options, readOnly bool, deleter *fileDeleter) (*valueLog, error) {
+	dir := filepath.Join(dataDir, valueLogDirName)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if opts.ValueLogThreshold <= 0 || readOnly {
+			return nil, nil
+		}
+		empty, err := holdsNoData(dataDir, walDir, entries)
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			return nil, fmt.Errorf("%w: %s was created without one, and ValueLogThreshold only applies to new data directories",
+				ErrNoValueLog, dataDir)
+		}
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			return nil, err
+		}
+		if err := syncDir(dataDir); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	v := &valueLog{
+		dir:       dir,
+		threshold: max(opts.ValueLogThreshold, 0),
+		fileSize:  opts.ValueLogFileSize,
+		readOnly:  readOnly,
+		deleter:   deleter,
+		files:     make(map[uint64]*os.File),
+		readers:   make(map[uint64]int),
+	}
+	_, v.maxInline = sizeLimits(opts)
+	if v.fileSize <= 0 {
+		v.fileSize = defaultValueLogFileSize
+	}
+	ids, err := v.listFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		f, err := os.Open(v.path(id))
+		if err != nil {
+			v.close()
+			return nil, err
+		}
+		v.files[id] = f
+	}
+	if readOnly {
+		return v, nil
+	}
+	if len(ids) == 0 {
+		err = v.openActive(1)
+	} else {
+		err = v.reopenActive(ids[len(ids)-1])
+	}
+	if err != nil {
+		v.close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// holdsNoData reports whether a data directory whose manifest lists
+// entries has neither SSTables nor WAL records, in it or in walDir.
+func holdsNoData(dataDir, walDir string, entries []manifestEntry) (bool, error) {
+	if len(entries) > 0 {
+		return false, nil
+	}
+	segs, err := listWALSegments(dataDir, walDir)
+	if err != nil {
+		return false, err
+	}
+	for _, seg := range segs {
+		if fi, err := os.Stat(seg.path); err != nil || fi.Size() > 0 {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (v *valueLog) path(id uint64) string {
+	return filepath.Join(v.dir, fmt.Sprintf("%06d%s", id, blobSuffix))
+}
+
+// listFiles returns the ids of the blob files in order. Leftovers of
+// deletions that failed, which a writable open removes, are skipped.
+func (v *valueLog) listFiles() ([]uint64, error) {
+	des, err := os.ReadDir(v.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, de := range des {
+		name := de.Name()
+		if strings.HasSuffix(name, obsoleteSuffix) {
+			if !v.readOnly {
+				os.Remove(filepath.Join(v.dir, name))
+			}
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, blobSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(name, blobSuffix) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// openActive creates blob file id and makes it take the appends.
+func (v *valueLog) openActive(id uint64) error {
+	f, err := os.OpenFile(v.path(id), os.O_CREATE|os.O_EXCL|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(v.dir); err != nil {
+		f.Close()
+		return err
+	}
+	v.mu.Lock()
+	v.files[id] = f
+	v.mu.Unlock()
+	v.active, v.activeID, v.activeSize = f, id, 0
+	return nil
+}
+
+// reopenActive makes the newest blob file, id, take the appends again.
+// A record cut short by a crash is cut off: nothing durable points at it,
+// as the WALs are synced after the log.
+func (v *valueLog) reopenActive(id uint64) error {
+	f, err := os.OpenFile(v.path(id), os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	end, _ := scanBlobFile(f, nil)
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return err
+	}
+	v.mu.Lock()
+	v.files[id].Close()
+	v.files[id] = f
+	v.mu.Unlock()
+	v.active, v.activeID, v.activeSize = f, id, end
+	return nil
+}
+
+// record returns what the LSM holds for the stored value of a user key:
+// the value itself behind an inline tag, or, when it is large, a pointer
+// to it after appending it to the log. Tombstones (nil) pass through.
+func (v *valueLog) record(key, stored []byte) ([]byte, error) {
+	if stored == nil {
+		return nil, nil
+	}
+	if (v.threshold > 0 && len(stored) >= v.threshold) || len(stored) >= v.maxInline {
+		p, err := v.append(key, stored)
+		if err != nil {
+			return nil, err
+		}
+		return p.encode(), nil
+	}
+	rec := make([]byte, 1+len(stored))
+	rec[0] = valueTagInline
+	copy(rec[1:], stored)
+	return rec, nil
+}
+
+// append writes a record of key and value at the head of the log.
+func (v *valueLog) append(key, value []byte) (blobPointer, error) {
+	if len(value) > wal.ValueSizeLimit || len(key) > wal.KeySizeLimit {
+		return blobPointer{}, wal.ErrInvalidSize
+	}
+	buf := make([]byte, 4, 4+2*binary.MaxVarintLen32+len(key)+len(value))
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(buf[4:], blobCRCTable))
+
+	v.appendMu.Lock()
+	defer v.appendMu.Unlock()
+	if v.active == nil {
+		return blobPointer{}, ErrClosed
+	}
+	if v.activeSize > 0 && v.activeSize+int64(len(buf)) > v.fileSize {
+		if err := v.active.Sync(); err != nil {
+			return blobPointer{}, err
+		}
+		if err := v.openActive(v.activeID + 1); err != nil {
+			return blobPointer{}, err
+		}
+	}
+	if _, err := v.active.Write(buf); err != nil {
+		return blobPointer{}, err
+	}
+	p := blobPointer{file: v.activeID, offset: v.activeSize, length: len(buf)}
+	v.activeSize += int64(len(buf))
+	v.dirty = true
+	return p, nil
+}
+
+// sync makes every record appended so far durable.
+func (v *valueLog) sync() error {
+	v.appendMu.Lock()
+	f, dirty := v.active, v.dirty
+	v.dirty = false
+	v.appendMu.Unlock()
+	if !dirty || f == nil {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		v.appendMu.Lock()
+		v.dirty = true
+		v.appendMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// resolve returns the stored value of key from rec, what the LSM holds
+// for it: the inline value, aliasing rec, or the one rec points to.
+func (v *valueLog) resolve(key, rec []byte) ([]byte, error) {
+	if len(rec) > 0 && rec[0] == valueTagInline {
+		return rec[1:], nil
+	}
+	if len(rec) == 0 || rec[0] != valueTagPointer {
+		return nil, fmt.Errorf("%w: bad value tag for %q", ErrCorruptValueLog, key)
+	}
+	p, ok := decodeBlobPointer(rec[1:])
+	if !ok {
+		return nil, fmt.Errorf("%w: bad pointer for %q", ErrCorruptValueLog, key)
+	}
+	f, err := v.file(p.file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptValueLog, err)
+	}
+	buf := make([]byte, p.length)
+	if _, err := f.ReadAt(buf, p.offset); err != nil {
+		return nil, fmt.Errorf("%w: %s at offset %d: %v", ErrCorruptValueLog, v.path(p.file), p.offset, err)
+	}
+	k, value, n, ok := parseBlobRecord(buf)
+	if !ok || n != len(buf) || !bytes.Equal(k, key) {
+		return nil, fmt.Errorf("%w: %s at offset %d does not hold %q", ErrCorruptValueLog, v.path(p.file), p.offset, key)
+	}
+	return value, nil
+}
+
+// file returns the handle of blob file id, opening it if the log has not:
+// a Secondary reader meets the files its writer creates that way.
+func (v *valueLog) file(id uint64) (*os.File, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if f := v.files[id]; f != nil {
+		return f, nil
+	}
+	for _, r := range v.retired {
+		if r.id == id {
+			return r.file, nil
+		}
+	}
+	f, err := os.Open(v.path(id))
+	if err != nil {
+		return nil, err
+	}
+	v.files[id] = f
+	return f, nil
+}
+
+// parseBlobRecord decodes the record at the start of b and returns its
+// size, or false if b does not start with an intact record.
+func parseBlobRecord(b []byte) (key, value []byte, n int, ok bool) {
+	if len(b) < 4 {
+		return nil, nil, 0, false
+	}
+	klen, n1 := binary.Uvarint(b[4:])
+	if n1 <= 0 {
+		return nil, nil, 0, false
+	}
+	vlen, n2 := binary.Uvarint(b[4+n1:])
+	if n2 <= 0 || klen > wal.KeySizeLimit || vlen > wal.ValueSizeLimit {
+		return nil, nil, 0, false
+	}
+	start := 4 + n1 + n2
+	end := start + int(klen) + int(vlen)
+	if end > len(b) || crc32.Checksum(b[4:end], blobCRCTable) != binary.LittleEndian.Uint32(b) {
+		return nil, nil, 0, false
+	}
+	return b[start : start+int(klen)], b[start+int(klen) : end], end, true
+}
+
+// scanBlobFile calls fn, if set, for every record of f in order, with a
+// pointer to it that leaves the file to the caller, until fn fails. It returns the end of the last intact
+// record, and ErrCorruptValueLog if it did not reach the end of the file.
+func scanBlobFile(f *os.File, fn func(p blobPointer, key, value []byte) error) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, 0, fi.Size()))
+	var off int64
+	var buf []byte
+	for off < fi.Size() {
+		head, _ := r.Peek(4 + 2*binary.MaxVarintLen64)
+		if len(head) < 4 {
+			break
+		}
+		klen, n1 := binary.Uvarint(head[4:])
+		vlen, n2 := binary.Uvarint(head[4+max(n1, 0):])
+		if n1 <= 0 || n2 <= 0 || klen > wal.KeySizeLimit || vlen > wal.ValueSizeLimit {
+			break
+		}
+		size := 4 + n1 + n2 + int(klen) + int(vlen)
+		if cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			break
+		}
+		key, value, _, ok := parseBlobRecord(buf)
+		if !ok {
+			break
+		}
+		if fn != nil {
+			if err := fn(blobPointer{offset: off, length: size}, key, value); err != nil {
+				return off, err
+			}
+		}
+		off += int64(size)
+	}
+	if off < fi.Size() {
+		return off, fmt.Errorf("%w: %s: bad record at offset %d", ErrCorruptValueLog, f.Name(), off)
+	}
+	return off, nil
+}
+
+// enter starts a read that may resolve pointers; the returned function
+// ends it. Files collected meanwhile stay readable until it has ended.
+func (v *valueLog) enter() func() {
+	v.mu.Lock()
+	epoch := v.epoch
+	v.readers[epoch]++
+	v.mu.Unlock()
+	return func() {
+		v.mu.Lock()
+		if v.readers[epoch]--; v.readers[epoch] == 0 {
+			delete(v.readers, epoch)
+		}
+		due := v.dueLocked()
+		v.mu.Unlock()
+		v.remove(due)
+	}
+}
+
+// retire drops blob file id, collected, once the reads in flight are done.
+func (v *valueLog) retire(id uint64) {
+	v.mu.Lock()
+	v.retired = append(v.retired, retiredBlob{id: id, file: v.files[id], epoch: v.epoch})
+	delete(v.files, id)
+	v.epoch++
+	due := v.dueLocked()
+	v.mu.Unlock()
+	v.remove(due)
+}
+
+// dueLocked takes the retired files no read in flight can use.
+func (v *valueLog) dueLocked() []retiredBlob {
+	oldest := v.epoch
+	for e := range v.readers {
+		oldest = min(oldest, e)
+	}
+	var due []retiredBlob
+	v.retired = slices.DeleteFunc(v.retired, func(r retiredBlob) bool {
+		if r.epoch < oldest {
+			due = append(due, r)
+			return true
+		}
+		return false
+	})
+	return due
+}
+
+// remove closes and deletes retired files, through the file deleter so
+// that backups and the grace period hold them like obsolete SSTables.
+func (v *valueLog) remove(due []retiredBlob) {
+	for _, r := range due {
+		if r.file != nil {
+			r.file.Close()
+		}
+		v.deleter.obsolete(v.path(r.id))
+	}
+}
+
+// sealed returns the ids of the files that no longer take appends, oldest
+// first.
+func (v *valueLog) sealed() []uint64 {
+	v.appendMu.Lock()
+	activeID := v.activeID
+	v.appendMu.Unlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var ids []uint64
+	for id := range v.files {
+		if id < activeID {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// blobFile is a blob file to copy into a backup or checkpoint.
+type blobFile struct {
+	path   string
+	size   int64 // bytes to copy
+	sealed bool  // the file no longer changes and may be linked
+}
+
+// snapshot returns the files of the log and how much of each to copy,
+// which covers every record a WAL synced before it points to.
+func (v *valueLog) snapshot() ([]blobFile, error) {
+	v.appendMu.Lock()
+	activeID, activeSize := v.activeID, v.activeSize
+	v.appendMu.Unlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var files []blobFile
+	for id, f := range v.files {
+		size := activeSize
+		if id < activeID {
+			fi, err := f.Stat()
+			if err != nil {
+				return nil, err
+			}
+			size = fi.Size()
+		}
+		files = append(files, blobFile{path: v.path(id), size: size, sealed: id < activeID})
+	}
+	slices.SortFunc(files, func(a, b blobFile) int { return strings.Compare(a.path, b.path) })
+	return files, nil
+}
+
+// stats returns the number of blob files and their total size.
+func (v *valueLog) stats() (files int, size int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, f := range v.files {
+		if fi, err := f.Stat(); err == nil {
+			files++
+			size += fi.Size()
+		}
+	}
+	return files, size
+}
+
+// close syncs the log and closes its files. Retired files still waiting
+// for reads are left on disk; a later collection finds nothing live in
+// them.
+func (v *valueLog) close() error {
+	err := v.sync()
+	v.appendMu.Lock()
+	v.active = nil
+	v.appendMu.Unlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for id, f := range v.files {
+		f.Close()
+		delete(v.files, id)
+	}
+	for _, r := range v.retired {
+		r.file.Close()
+	}
+	v.retired = nil
+	return err
+}
+
+// CollectValueLog reclaims the space of overwritten and deleted values in
+// the value log. Every sealed blob file in which at least minGarbage of
+// the bytes belong to such values has its live values rewritten at the
+// head of the log, and is then deleted once no read can still use it.
+// minGarbage is a fraction in (0, 1]; other values use 0.5.
+//
+// A collection looks up every key of the files it examines, so it costs a
+// read per value; run it when the DB is not busy, such as after bulk
+// deletes or overwrites of large values. Writes are only held off while a
+// value is moved, one at a time.
+func (db *DB) CollectValueLog(minGarbage float64) (stats ValueLogGCStats, err error) {
+	defer db.journal(AdminOpCollectValueLog, fmt.Sprintf("min_garbage=%g", minGarbage), db.clock.Now(), &err)
+	if db.vlog == nil {
+		return stats, ErrNoValueLog
+	}
+	if err := db.writeErr(); err != nil {
+		return stats, err
+	}
+	if minGarbage <= 0 || minGarbage > 1 {
+		minGarbage = defaultValueLogGCRatio
+	}
+	v := db.vlog
+	v.gcMu.Lock()
+	defer v.gcMu.Unlock()
+
+	for _, id := range v.sealed() {
+		stats.FilesScanned++
+		f, err := v.file(id)
+		if err != nil {
+			return stats, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return stats, err
+		}
+		var live int64
+		_, err = scanBlobFile(f, func(p blobPointer, key, _ []byte) error {
+			p.file = id
+			ok, err := db.blobLive(key, p)
+			if ok {
+				live += int64(p.length)
+			}
+			return err
+		})
+		if err != nil {
+			return stats, err
+		}
+		if fi.Size() == 0 || float64(fi.Size()-live) < minGarbage*float64(fi.Size()) {
+			continue
+		}
+
+		_, err = scanBlobFile(f, func(p blobPointer, key, value []byte) error {
+			p.file = id
+			moved, err := db.moveBlob(key, value, p)
+			if moved {
+				stats.ValuesMoved++
+			}
+			return err
+		})
+		if err != nil {
+			return stats, err
+		}
+		// The moved pointers must be durable before the file goes, and the
+		// WAL syncs the log before itself.
+		db.mu.RLock()
+		mt := db.active
+		db.mu.RUnlock()
+		if mt == nil {
+			return stats, ErrClosed
+		}
+		if _, err := mt.SyncWAL(); err != nil {
+			return stats, err
+		}
+		v.retire(id)
+		stats.FilesCollected++
+		stats.BytesReclaimed += fi.Size()
+	}
+	return stats, nil
+}
+
+// blobLive reports whether key's current value is the record at p.
+func (db *DB) blobLive(key []byte, p blobPointer) (bool, error) {
+	rec, found, err := db.getRecordTo(key, nil, ReadOptions{Priority: PriorityBackground})
+	if err != nil || !found {
+		return false, err
+	}
+	return bytes.Equal(rec, p.encode()), nil
+}
+
+// moveBlob rewrites the value of key, the record at p, at the head of the
+// log if it is still live, and points key at the copy.
+func (db *DB) moveBlob(key, value []byte, p blobPointer) (bool, error) {
+	v := db.vlog
+	v.writeMu.Lock()
+	live, err := db.blobLive(key, p)
+	if err != nil || !live {
+		v.writeMu.Unlock()
+		return false, err
+	}
+	np, err := v.append(key, value)
+	if err != nil {
+		v.writeMu.Unlock()
+		return false, err
+	}
+	mt, err := db.writeRecord(key, np.encode())
+	v.writeMu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, db.rotateIfFull(mt)
+}
@@ -0,0 +1,115 @@
+package lsm
+
+import (
+	"context"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultFlushStallTimeout = time.Minute
+
+// LabelOpFlushWatchdog is the LabelOp of the flush watchdog's loop.
+const LabelOpFlushWatchdog = "flush_watchdog"
+
+// FlushStallEvent reports an immutable memtable that no flush was running
+// for. The watchdog flushes it again right after.
+type FlushStallEvent struct {
+	WALPath string        // WAL of the memtable, which holds its data
+	Stalled time.Duration // how long it has waited with no flush running
+	Queued  int           // immutable memtables waiting to be flushed
+	// Err is the error that put the DB into fail-stop mode, if any. A
+	// successful flush of the memtable whose flush caused it clears it.
+	Err error
+}
+
+// flushWaitGroup is a WaitGroup that also counts the flushes it waits for,
+// so that the watchdog can tell a queued memtable that nobody will flush.
+type flushWaitGroup struct {
+	sync.WaitGroup
+	n atomic.Int64
+}
+
+func (wg *flushWaitGroup) Add(delta int) {
+	wg.n.Add(int64(delta))
+	wg.WaitGroup.Add(delta)
+}
+
+func (wg *flushWaitGroup) Done() {
+	wg.n.Add(-1)
+	wg.WaitGroup.Done()
+}
+
+// pending returns the number of flushes running or waiting to be retried.
+func (wg *flushWaitGroup) pending() int64 {
+	return wg.n.Load()
+}
+
+// startWatchdog checks every quarter of timeout for an immutable memtable
+// that has waited timeout with no flush running, until Close. Flushes only
+// stop for good when one has failed more often than it may be retried, so
+// it is an error, not slowness, the watchdog recovers from.
+func (db *DB) startWatchdog(timeout time.Duration) {
+	db.watchdogDone = make(chan struct{})
+	labels := pprof.Labels(db.profileLabels(LabelOpFlushWatchdog, "")...)
+	pprof.Do(context.Background(), labels, func(context.Context) {
+		go db.watchFlushes(timeout)
+	})
+}
+
+// watchFlushes is the loop started by startWatchdog.
+func (db *DB) watchFlushes(timeout time.Duration) {
+	defer close(db.watchdogDone)
+	ticker := db.clock.NewTicker(max(timeout/4, time.Millisecond))
+	defer ticker.Stop()
+	var since time.Time // when the queue was first seen stalled
+	for {
+		select {
+		case <-db.closingCh:
+			return
+		case <-ticker.C():
+		}
+		now := db.clock.Now()
+		db.mu.RLock()
+		stalled := db.flushStalledLocked()
+		db.mu.RUnlock()
+		switch {
+		case !stalled:
+			since = time.Time{}
+		case since.IsZero():
+			since = now
+		case now.Sub(since) >= timeout:
+			db.restartFlush(now.Sub(since))
+			since = time.Time{}
+		}
+	}
+}
+
+// flushStalledLocked reports whether immutable memtables are queued with no
+// flush running for them. Must be called with mu held.
+func (db *DB) flushStalledLocked() bool {
+	return len(db.immutables) > 0 && db.flushWg.pending() == 0 && !db.closing
+}
+
+// restartFlush reports the stalled flush queue and flushes its oldest
+// memtable again; the memtables behind it follow as usual.
+func (db *DB) restartFlush(stalled time.Duration) {
+	db.mu.Lock()
+	if !db.flushStalledLocked() {
+		db.mu.Unlock()
+		return
+	}
+	mt := db.immutables[len(db.immutables)-1]
+	ev := FlushStallEvent{WALPath: mt.WalPath(), Stalled: stalled, Queued: len(db.immutables)}
+	if db.bgErr != nil {
+		ev.Err = db.bgErr
+	}
+	db.flushWg.Add(1)
+	db.mu.Unlock()
+
+	if db.onFlushStall != nil {
+		db.onFlushStall(ev)
+	}
+	db.runBackground(BackgroundOpFlush, func() { db.flushMemtable(mt, mt.WalPath()) })
+}
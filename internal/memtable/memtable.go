@@ -3,9 +3,13 @@ package memtable
 import (
 	"errors"
 	"log"
+	"math/rand"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/return2faye/SiltKV/internal/clock"
+	"github.com/return2faye/SiltKV/internal/utils"
 	"github.com/return2faye/SiltKV/internal/wal"
 )
 
@@ -26,24 +30,109 @@ type Memtable struct {
 	size    int64        // current estimated size (atomic)
 	frozen  int32        // atomic flag: 0 = not frozen, 1 = frozen
 	mu      sync.RWMutex // protects WAL writes (must be sequential)
+
+	// rangeDels holds range tombstones in write order (guarded by mu).
+	rangeDels []RangeTombstone
+
+	// maxEntries is the entry count that also makes the memtable full
+	// (0 means no limit).
+	maxEntries int
+
+	// lastSeq and lastTime describe the newest record of a read-only
+	// memtable, which has no WAL writer to ask.
+	lastSeq  uint64
+	lastTime time.Time
+}
+
+// Options configures a Memtable. The zero value gives the defaults.
+type Options struct {
+	// KeyPrefixDelimiter enables key prefix interning in the SkipList.
+	// See SkipListOptions.PrefixDelimiter.
+	KeyPrefixDelimiter byte
+
+	// OnWALSync is passed to the WAL writer; see wal.WriterOptions.OnSync.
+	OnWALSync func(time.Duration)
+
+	// BeforeWALSync is passed to the WAL writer; see
+	// wal.WriterOptions.BeforeSync.
+	BeforeWALSync func() error
+
+	// OnWALError is called with the WAL path when writing or syncing the
+	// WAL fails; see wal.WriterOptions.OnError.
+	OnWALError func(path string, err error)
+
+	// Sequence is the DB-wide sequence counter; see wal.WriterOptions.Sequence.
+	Sequence *uint64
+
+	// MaxEntries makes the memtable full once it holds this many entries
+	// (point entries, tombstones and range tombstones), even if it is still
+	// below its byte limit. Zero means no entry limit.
+	MaxEntries int
+
+	// Clock, SyncGroup, ProfileLabels, MaxKeySize and MaxValueSize are
+	// passed to the WAL writer; see wal.WriterOptions.
+	Clock         clock.Clock
+	SyncGroup     *wal.SyncGroup
+	ProfileLabels []string
+	MaxKeySize    int
+	MaxValueSize  int
+
+	// WALCompression is passed to the WAL writer; see
+	// wal.WriterOptions.Compress.
+	WALCompression bool
+
+	// RandSeed, if non-zero, seeds the SkipList level generator so tests
+	// get the same structure on every run.
+	RandSeed int64
+}
+
+// skipListOptions derives the SkipList options from opts.
+func (opts Options) skipListOptions() SkipListOptions {
+	sl := SkipListOptions{PrefixDelimiter: opts.KeyPrefixDelimiter}
+	if opts.RandSeed != 0 {
+		sl.Rand = rand.New(rand.NewSource(opts.RandSeed))
+	}
+	return sl
 }
 
 // NewMemtable creates a new memtable with WAL support
 // It automatically recovers data from WAL if the file exists
 func NewMemtable(walPath string) (*Memtable, error) {
+	return NewMemtableWithOptions(walPath, Options{})
+}
+
+// NewMemtableWithOptions is NewMemtable with explicit options.
+func NewMemtableWithOptions(walPath string, opts Options) (*Memtable, error) {
+	var onError func(error)
+	if opts.OnWALError != nil {
+		onError = func(err error) { opts.OnWALError(walPath, err) }
+	}
 	// Create WAL writer (opens existing file or creates new one)
-	walWriter, err := wal.NewWalWriter(walPath)
+	walWriter, err := wal.NewWalWriterWithOptions(walPath, wal.WriterOptions{
+		OnSync:        opts.OnWALSync,
+		BeforeSync:    opts.BeforeWALSync,
+		OnError:       onError,
+		Sequence:      opts.Sequence,
+		Clock:         opts.Clock,
+		SyncGroup:     opts.SyncGroup,
+		ProfileLabels: opts.ProfileLabels,
+		MaxKeySize:    opts.MaxKeySize,
+		MaxValueSize:  opts.MaxValueSize,
+		Compress:      opts.WALCompression,
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	mt := &Memtable{
-		sl:      NewSkipList(),
+		sl:      NewSkipListWithOptions(opts.skipListOptions()),
 		wal:     walWriter,
 		walPath: walPath,
 		maxSize: DefaultMaxSize,
 		size:    0,
 		frozen:  0,
+
+		maxEntries: opts.MaxEntries,
 	}
 
 	// Recover data from WAL
@@ -58,6 +147,52 @@ func NewMemtable(walPath string) (*Memtable, error) {
 	return mt, nil
 }
 
+// NewReadOnlyMemtable replays walPaths, oldest first, into a frozen memtable
+// that has no WAL of its own. Replay stops at the first record for which
+// stop returns true, which gives a consistent view as of that point.
+// The WAL files are only read, never modified.
+func NewReadOnlyMemtable(walPaths []string, opts Options, stop func(rec wal.Record) bool) (*Memtable, error) {
+	mt := &Memtable{
+		sl:      NewSkipListWithOptions(opts.skipListOptions()),
+		maxSize: DefaultMaxSize,
+		frozen:  1,
+	}
+
+	stopped := false
+	for _, p := range walPaths {
+		_, err := wal.ReplayFile(p, func(rec wal.Record) bool {
+			if stop != nil && stop(rec) {
+				stopped = true
+				return false
+			}
+			mt.applyRecord(rec)
+			if rec.Seq > mt.lastSeq {
+				mt.lastSeq = rec.Seq
+			}
+			if rec.Time.After(mt.lastTime) {
+				mt.lastTime = rec.Time
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if stopped {
+			break
+		}
+	}
+	return mt, nil
+}
+
+// LastSequence returns the sequence number and time of the newest record in
+// this memtable (0 and the zero time if it holds none).
+func (mt *Memtable) LastSequence() (uint64, time.Time) {
+	if mt.wal == nil {
+		return mt.lastSeq, mt.lastTime
+	}
+	return mt.wal.LastSequence()
+}
+
 // Put inserts or updates a key-value pair
 // Writes to WAL first (for durability), then to SkipList (for fast access)
 func (mt *Memtable) Put(key, value []byte) error {
@@ -67,22 +202,53 @@ func (mt *Memtable) Put(key, value []byte) error {
 	}
 
 	// Step 1: Write to WAL first (persistence) - must be sequential
-	// We only hold the lock for WAL write to minimize contention
 	mt.mu.Lock()
+	defer mt.mu.Unlock()
 	// Double-check frozen after acquiring lock
 	if atomic.LoadInt32(&mt.frozen) == 1 {
-		mt.mu.Unlock()
 		return ErrFrozen
 	}
 	// If WAL write fails, we don't write to memory to maintain consistency
 	// Note: We don't Sync() here for performance. Sync happens when memtable is frozen (before flush).
 	if err := mt.wal.Write(key, value); err != nil {
-		mt.mu.Unlock()
 		return err
 	}
-	mt.mu.Unlock()
 
-	// Step 2: Write to SkipList (memory) - can happen concurrently after WAL write
+	// Step 2: Write to SkipList (memory). This stays under the same lock as
+	// the WAL write so the in-memory order matches the log order, which a
+	// concurrent DeleteRange relies on.
+	mt.applyPut(key, value)
+
+	return nil
+}
+
+// WriteBatch applies ops in order after logging them as one WAL batch
+// record, so recovery restores all of them or none.
+func (mt *Memtable) WriteBatch(ops []wal.BatchOp) error {
+	if atomic.LoadInt32(&mt.frozen) == 1 {
+		return ErrFrozen
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if atomic.LoadInt32(&mt.frozen) == 1 {
+		return ErrFrozen
+	}
+	if err := mt.wal.WriteBatch(ops); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.RangeDelete {
+			mt.applyRangeDelete(op.Key, op.Value)
+		} else {
+			mt.applyPut(op.Key, op.Value)
+		}
+	}
+	return nil
+}
+
+// applyPut writes to the SkipList and updates the size estimate.
+func (mt *Memtable) applyPut(key, value []byte) {
 	// Get old size before update to calculate size change
 	oldValue, existed := mt.sl.Get(key)
 	mt.sl.Put(key, value)
@@ -94,16 +260,69 @@ func (mt *Memtable) Put(key, value []byte) error {
 		sizeDelta -= int64(len(key) + len(oldValue))
 	}
 	atomic.AddInt64(&mt.size, sizeDelta)
+}
 
+// DeleteRange deletes every key in [start, end).
+// Entries already in this memtable become point tombstones, and a range
+// tombstone is kept for keys that live in older tables.
+func (mt *Memtable) DeleteRange(start, end []byte) error {
+	if atomic.LoadInt32(&mt.frozen) == 1 {
+		return ErrFrozen
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if atomic.LoadInt32(&mt.frozen) == 1 {
+		return ErrFrozen
+	}
+	if err := mt.wal.WriteRangeDelete(start, end); err != nil {
+		return err
+	}
+	mt.applyRangeDelete(start, end)
 	return nil
 }
 
+// applyRangeDelete updates memory state for a range tombstone. Must be called
+// with mu held (or during single-threaded recovery).
+func (mt *Memtable) applyRangeDelete(start, end []byte) {
+	mt.sl.DeleteRange(start, end)
+	mt.rangeDels = append(mt.rangeDels, RangeTombstone{
+		Start: utils.CopyBytes(start),
+		End:   utils.CopyBytes(end),
+	})
+	atomic.AddInt64(&mt.size, int64(len(start)+len(end)))
+}
+
+// IsRangeDeleted reports whether a range tombstone in this memtable covers key.
+// Callers check point entries first: those are always newer than the range
+// tombstones of the same memtable.
+func (mt *Memtable) IsRangeDeleted(key []byte) bool {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return CoveredBy(mt.rangeDels, key)
+}
+
+// RangeTombstones returns the range tombstones written to this memtable.
+func (mt *Memtable) RangeTombstones() []RangeTombstone {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	out := make([]RangeTombstone, len(mt.rangeDels))
+	copy(out, mt.rangeDels)
+	return out
+}
+
 // Get retrieves a value by key from SkipList
 // WAL is not queried because it's only for recovery, not for reads
 func (mt *Memtable) Get(key []byte) ([]byte, bool) {
 	return mt.sl.Get(key)
 }
 
+// Lookup retrieves a value by key, reporting tombstones as found with a nil value.
+// The returned slice is owned by the memtable and must not be modified.
+func (mt *Memtable) Lookup(key []byte) ([]byte, bool) {
+	return mt.sl.Lookup(key)
+}
+
 // Delete removes a key by writing a tombstone (value = nil)
 // This is written to both WAL and SkipList
 func (mt *Memtable) Delete(key []byte) error {
@@ -117,10 +336,28 @@ func (mt *Memtable) Size() int {
 	return int(atomic.LoadInt64(&mt.size))
 }
 
-// IsFull checks if memtable has reached maximum size
-// When full, memtable should be flushed to SSTable
+// Entries returns the number of entries in the memtable: keys (tombstones
+// included) plus range tombstones.
+func (mt *Memtable) Entries() int {
+	mt.mu.RLock()
+	rangeDels := len(mt.rangeDels)
+	mt.mu.RUnlock()
+	return mt.sl.Entries() + rangeDels
+}
+
+// CountRange returns the number of keys in [start, end), tombstones
+// included. A nil start or end leaves that side of the range open.
+func (mt *Memtable) CountRange(start, end []byte) int {
+	return mt.sl.CountRange(start, end)
+}
+
+// IsFull checks if memtable has reached maximum size or entry count,
+// whichever comes first. When full, memtable should be flushed to SSTable
 func (mt *Memtable) IsFull() bool {
-	return int(atomic.LoadInt64(&mt.size)) >= mt.maxSize
+	if int(atomic.LoadInt64(&mt.size)) >= mt.maxSize {
+		return true
+	}
+	return mt.maxEntries > 0 && mt.Entries() >= mt.maxEntries
 }
 
 // Freeze marks memtable as immutable. Subsequent Put/Delete will fail with ErrFrozen.
@@ -131,6 +368,10 @@ func (mt *Memtable) Freeze() error {
 		// Already frozen
 		return nil
 	}
+	if mt.wal == nil {
+		// Read-only memtable: nothing to sync
+		return nil
+	}
 	// Ensure WAL is synced before flush starts
 	mt.mu.Lock()
 	err := mt.wal.Sync()
@@ -138,6 +379,27 @@ func (mt *Memtable) Freeze() error {
 	return err
 }
 
+// SyncWAL makes every write accepted so far durable and returns the size of
+// the WAL prefix that holds them. Writes are held off while it runs, so the
+// prefix matches the memtable contents at that moment.
+func (mt *Memtable) SyncWAL() (int64, error) {
+	if mt.wal == nil {
+		return 0, nil
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return mt.wal.SyncedSize()
+}
+
+// DurableWALSize returns the size of the WAL prefix that the last fsync
+// made durable, without syncing.
+func (mt *Memtable) DurableWALSize() int64 {
+	if mt.wal == nil {
+		return 0
+	}
+	return mt.wal.DurableSize()
+}
+
 // IsFrozen indicates whether the memtable has been frozen (immutable).
 func (mt *Memtable) IsFrozen() bool {
 	return atomic.LoadInt32(&mt.frozen) == 1
@@ -146,17 +408,9 @@ func (mt *Memtable) IsFrozen() bool {
 // recoverFromWAL restores memtable from WAL file
 // This is called automatically during initialization
 func (mt *Memtable) recoverFromWAL() error {
-	result, err := mt.wal.Load(func(k, v []byte) {
-		// For each record in WAL, restore to SkipList
-		mt.sl.Put(k, v)
-
-		// Update size estimate atomically
-		if v == nil {
-			// Tombstone (delete), only count key
-			atomic.AddInt64(&mt.size, int64(len(k)))
-		} else {
-			atomic.AddInt64(&mt.size, int64(len(k)+len(v)))
-		}
+	result, err := mt.wal.Replay(func(rec wal.Record) bool {
+		mt.applyRecord(rec)
+		return true
 	})
 
 	if err != nil {
@@ -171,6 +425,34 @@ func (mt *Memtable) recoverFromWAL() error {
 	return nil
 }
 
+// applyRecord restores one replayed WAL record during recovery.
+func (mt *Memtable) applyRecord(rec wal.Record) {
+	if rec.RangeDelete {
+		mt.applyRangeDelete(rec.Key, rec.Value)
+		return
+	}
+
+	// For each record in WAL, restore to SkipList
+	k, v := rec.Key, rec.Value
+	mt.sl.Put(k, v)
+
+	// Update size estimate atomically
+	if v == nil {
+		// Tombstone (delete), only count key
+		atomic.AddInt64(&mt.size, int64(len(k)))
+	} else {
+		atomic.AddInt64(&mt.size, int64(len(k)+len(v)))
+	}
+}
+
+// WALBytesWritten returns the bytes this memtable has appended to its WAL.
+func (mt *Memtable) WALBytesWritten() uint64 {
+	if mt.wal == nil {
+		return 0
+	}
+	return mt.wal.BytesWritten()
+}
+
 // Close closes the WAL file
 // Should be called when memtable is being flushed or destroyed
 func (mt *Memtable) Close() error {
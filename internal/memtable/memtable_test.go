@@ -192,3 +192,88 @@ func TestIsFull(t *testing.T) {
 		t.Error("Size should be non-zero after put")
 	}
 }
+
+func TestIsFullByEntryCount(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+
+	mt, err := NewMemtableWithOptions(walPath, Options{MaxEntries: 3})
+	if err != nil {
+		t.Fatalf("Failed to create memtable: %v", err)
+	}
+	defer mt.Close()
+
+	// Tombstones and range tombstones count; overwrites do not.
+	if err := mt.Delete([]byte("key1")); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if err := mt.Put([]byte("key1"), []byte("value1")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := mt.DeleteRange([]byte("a"), []byte("b")); err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+	if n := mt.Entries(); n != 2 {
+		t.Errorf("Expected 2 entries, got %d", n)
+	}
+	if mt.IsFull() {
+		t.Error("Memtable below its entry limit should not be full")
+	}
+
+	if err := mt.Delete([]byte("key2")); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if !mt.IsFull() {
+		t.Errorf("Memtable with %d entries should be full", mt.Entries())
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+
+	mt, err := NewMemtable(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create memtable: %v", err)
+	}
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := mt.Put([]byte(k), []byte("v")); err != nil {
+			t.Fatalf("Failed to put %s: %v", k, err)
+		}
+	}
+	if err := mt.DeleteRange([]byte("b"), []byte("d")); err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+	// Written after the range tombstone, so it must survive.
+	if err := mt.Put([]byte("c"), []byte("new")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	check := func(mt *Memtable) {
+		t.Helper()
+		if v, found := mt.Lookup([]byte("b")); !found || v != nil {
+			t.Errorf("b should be a point tombstone, got %q found=%v", v, found)
+		}
+		if v, found := mt.Get([]byte("c")); !found || string(v) != "new" {
+			t.Errorf("c = %q found=%v, want new", v, found)
+		}
+		if _, found := mt.Get([]byte("d")); !found {
+			t.Error("d is outside the range and should survive")
+		}
+		if !mt.IsRangeDeleted([]byte("bb")) || mt.IsRangeDeleted([]byte("d")) {
+			t.Error("range tombstone should cover [b, d) only")
+		}
+		if rts := mt.RangeTombstones(); len(rts) != 1 {
+			t.Errorf("expected 1 range tombstone, got %d", len(rts))
+		}
+	}
+	check(mt)
+	mt.Close()
+
+	// WAL replay must rebuild the same state.
+	mt2, err := NewMemtable(walPath)
+	if err != nil {
+		t.Fatalf("Failed to recover memtable: %v", err)
+	}
+	defer mt2.Close()
+	check(mt2)
+}
@@ -0,0 +1,29 @@
+package memtable
+
+import "bytes"
+
+// RangeTombstone deletes every key in [Start, End).
+//
+// A range tombstone only hides entries that are older than itself. Inside a
+// single memtable or SSTable this means older tables: point entries that share
+// a table with a range tombstone are always newer than it, because DeleteRange
+// converts any existing entries in the range to point tombstones.
+type RangeTombstone struct {
+	Start []byte // inclusive
+	End   []byte // exclusive
+}
+
+// Covers reports whether key falls inside the tombstone's range.
+func (rt RangeTombstone) Covers(key []byte) bool {
+	return bytes.Compare(key, rt.Start) >= 0 && bytes.Compare(key, rt.End) < 0
+}
+
+// CoveredBy reports whether any tombstone in rts covers key.
+func CoveredBy(rts []RangeTombstone, key []byte) bool {
+	for _, rt := range rts {
+		if rt.Covers(key) {
+			return true
+		}
+	}
+	return false
+}
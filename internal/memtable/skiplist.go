@@ -15,33 +15,115 @@ const MaxLevel = 32
 basic structure
 */
 type Node struct {
-	key   []byte
-	value []byte
-	next  []*Node // denotes next node of IDXth level
+	// prefix is an interned slice shared by every node with the same key
+	// prefix; key holds the remaining suffix. prefix is nil unless the
+	// skiplist was created with a PrefixDelimiter.
+	prefix []byte
+	key    []byte
+	value  []byte
+	next   []*Node // denotes next node of IDXth level
+}
+
+// SkipListOptions configures optional memory savings.
+type SkipListOptions struct {
+	// PrefixDelimiter enables key prefix interning when non-zero. The part of
+	// a key up to and including its last delimiter (e.g. "tenant:42:order:")
+	// is stored once and shared by all nodes, so keyspaces with long common
+	// prefixes pay for each prefix only once.
+	PrefixDelimiter byte
+
+	// Rand, if set, draws node levels instead of the global source, so a
+	// seeded list builds the same shape every run. It is only used with
+	// the list's lock held.
+	Rand *rand.Rand
 }
 
 type SkipList struct {
 	head  *Node
 	level int
 	size  int
+	nodes int // entries including tombstones
 	mu    sync.RWMutex
 	// reuse update array for inserts to avoid per-Put allocations
 	update [MaxLevel]*Node
+
+	delim    byte
+	prefixes map[string][]byte // interned prefixes, guarded by mu
+	rnd      *rand.Rand        // nil uses the global source
 }
 
 func NewSkipList() *SkipList {
-	return &SkipList{
+	return NewSkipListWithOptions(SkipListOptions{})
+}
+
+func NewSkipListWithOptions(opts SkipListOptions) *SkipList {
+	sl := &SkipList{
 		head:  &Node{next: make([]*Node, MaxLevel)},
 		level: 1,
+		delim: opts.PrefixDelimiter,
+		rnd:   opts.Rand,
 	}
+	if sl.delim != 0 {
+		sl.prefixes = make(map[string][]byte)
+	}
+	return sl
+}
+
+// compare orders n's key against key without materializing n's full key.
+func (n *Node) compare(key []byte) int {
+	if len(n.prefix) == 0 {
+		return bytes.Compare(n.key, key)
+	}
+	p := n.prefix
+	if len(key) < len(p) {
+		if c := bytes.Compare(p[:len(key)], key); c != 0 {
+			return c
+		}
+		return 1 // key is a proper prefix of n's key
+	}
+	if c := bytes.Compare(p, key[:len(p)]); c != 0 {
+		return c
+	}
+	return bytes.Compare(n.key, key[len(p):])
+}
+
+// fullKey returns n's key. With interning it allocates a new slice.
+func (n *Node) fullKey() []byte {
+	if len(n.prefix) == 0 {
+		return n.key
+	}
+	k := make([]byte, 0, len(n.prefix)+len(n.key))
+	return append(append(k, n.prefix...), n.key...)
+}
+
+// splitKey returns the interned prefix and a private copy of the suffix.
+// Callers must hold sl.mu for writing.
+func (sl *SkipList) splitKey(key []byte) (prefix, suffix []byte) {
+	if sl.delim == 0 {
+		return nil, utils.CopyBytes(key)
+	}
+	i := bytes.LastIndexByte(key, sl.delim)
+	if i < 0 {
+		return nil, utils.CopyBytes(key)
+	}
+	prefix, ok := sl.prefixes[string(key[:i+1])]
+	if !ok {
+		prefix = utils.CopyBytes(key[:i+1])
+		sl.prefixes[string(prefix)] = prefix
+	}
+	return prefix, utils.CopyBytes(key[i+1:])
 }
 
 /*
 random level
 */
 func (sl *SkipList) randomlevel() int {
+	coin := rand.Float64
+	if sl.rnd != nil {
+		coin = sl.rnd.Float64
+	}
 	level := 1
-	for rand.Float64() < 0.5 && level < MaxLevel {
+	for coin() < 0.5 && level < MaxLevel {
 		level++
 	}
 	return level
@@ -57,7 +139,7 @@ func (sl *SkipList) Put(key, val []byte) {
 
 	for i := sl.level - 1; i >= 0; i-- {
 		// key of next node smaller than key to insert, go on
-		for curr.next[i] != nil && bytes.Compare(curr.next[i].key, key) < 0 {
+		for curr.next[i] != nil && curr.next[i].compare(key) < 0 {
 			curr = curr.next[i]
 		}
 		update[i] = curr
@@ -65,7 +147,7 @@ func (sl *SkipList) Put(key, val []byte) {
 
 	// if already exist, update
 	curr = curr.next[0]
-	if curr != nil && bytes.Equal(curr.key, key) {
+	if curr != nil && curr.compare(key) == 0 {
 		if curr.value != nil && val == nil {
 			sl.size--
 		} else if curr.value == nil && val != nil {
@@ -84,16 +166,19 @@ func (sl *SkipList) Put(key, val []byte) {
 		sl.level = lvl
 	}
 
+	prefix, suffix := sl.splitKey(key)
 	newNode := &Node{
-		key:   utils.CopyBytes(key),
-		value: utils.CopyBytes(val),
-		next:  make([]*Node, lvl),
+		prefix: prefix,
+		key:    suffix,
+		value:  utils.CopyBytes(val),
+		next:   make([]*Node, lvl),
 	}
 
 	for i := 0; i < lvl; i++ {
 		newNode.next[i] = update[i].next[i]
 		update[i].next[i] = newNode
 	}
+	sl.nodes++
 
 	// if tomebstone, not increase size
 	if val != nil {
@@ -107,13 +192,13 @@ func (sl *SkipList) Get(key []byte) ([]byte, bool) {
 
 	curr := sl.head
 	for i := sl.level - 1; i >= 0; i-- {
-		for curr.next[i] != nil && bytes.Compare(curr.next[i].key, key) < 0 {
+		for curr.next[i] != nil && curr.next[i].compare(key) < 0 {
 			curr = curr.next[i]
 		}
 	}
 
 	curr = curr.next[0]
-	if curr != nil && bytes.Equal(curr.key, key) {
+	if curr != nil && curr.compare(key) == 0 {
 		if curr.value == nil {
 			return nil, false
 		}
@@ -123,33 +208,188 @@ func (sl *SkipList) Get(key []byte) ([]byte, bool) {
 	return nil, false
 }
 
+// Entries returns the number of keys in the list, tombstones included.
+func (sl *SkipList) Entries() int {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.nodes
+}
+
+// CountRange returns the number of entries in [start, end), tombstones
+// included. A nil start or end leaves that side of the range open.
+func (sl *SkipList) CountRange(start, end []byte) int {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	curr := sl.head
+	if start != nil {
+		for i := sl.level - 1; i >= 0; i-- {
+			for curr.next[i] != nil && curr.next[i].compare(start) < 0 {
+				curr = curr.next[i]
+			}
+		}
+	}
+
+	n := 0
+	for curr = curr.next[0]; curr != nil && (end == nil || curr.compare(end) < 0); curr = curr.next[0] {
+		n++
+	}
+	return n
+}
+
+// Lookup is like Get but also reports tombstones: found is true whenever the
+// key has an entry, and value is nil if that entry is a delete.
+// Callers layering several tables need this to stop at a newer delete.
+func (sl *SkipList) Lookup(key []byte) (value []byte, found bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	curr := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for curr.next[i] != nil && curr.next[i].compare(key) < 0 {
+			curr = curr.next[i]
+		}
+	}
+
+	curr = curr.next[0]
+	if curr != nil && curr.compare(key) == 0 {
+		return curr.value, true
+	}
+	return nil, false
+}
+
+// DeleteRange replaces every live entry in [start, end) with a tombstone.
+// It returns the number of entries that were converted.
+func (sl *SkipList) DeleteRange(start, end []byte) int {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
 
+	curr := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for curr.next[i] != nil && curr.next[i].compare(start) < 0 {
+			curr = curr.next[i]
+		}
+	}
+
+	n := 0
+	for curr = curr.next[0]; curr != nil && curr.compare(end) < 0; curr = curr.next[0] {
+		if curr.value != nil {
+			curr.value = nil
+			sl.size--
+			n++
+		}
+	}
+	return n
+}
 
 /*
 Iterator
 */
 type SLIterator struct {
+	sl   *SkipList
 	curr *Node
 }
 
 func (sl *SkipList) NewIterator() *SLIterator {
 	sl.mu.RLock()
 	defer sl.mu.RUnlock()
-	return &SLIterator{curr: sl.head.next[0]}
+	return &SLIterator{sl: sl, curr: sl.head.next[0]}
+}
+
+// SeekToFirst positions the iterator at the first entry.
+func (it *SLIterator) SeekToFirst() {
+	it.sl.mu.RLock()
+	defer it.sl.mu.RUnlock()
+	it.curr = it.sl.head.next[0]
+}
+
+// Seek positions the iterator at the first entry with a key >= target.
+func (it *SLIterator) Seek(target []byte) {
+	it.sl.mu.RLock()
+	defer it.sl.mu.RUnlock()
+
+	curr := it.sl.head
+	for i := it.sl.level - 1; i >= 0; i-- {
+		for curr.next[i] != nil && curr.next[i].compare(target) < 0 {
+			curr = curr.next[i]
+		}
+	}
+	it.curr = curr.next[0]
+}
+
+// SeekToLast positions the iterator at the last entry.
+func (it *SLIterator) SeekToLast() {
+	it.sl.mu.RLock()
+	defer it.sl.mu.RUnlock()
+
+	curr := it.sl.head
+	for i := it.sl.level - 1; i >= 0; i-- {
+		for curr.next[i] != nil {
+			curr = curr.next[i]
+		}
+	}
+	it.curr = it.sl.nodeOrNil(curr)
+}
+
+// Prev moves to the previous entry. Nodes have no back pointers, so this
+// searches for the last node before the current key, in O(log n). Stepping
+// back from the first entry leaves the iterator invalid; Prev on an invalid
+// iterator does nothing.
+func (it *SLIterator) Prev() {
+	if it.curr == nil {
+		return
+	}
+	it.sl.mu.RLock()
+	defer it.sl.mu.RUnlock()
+
+	key := it.curr.fullKey()
+	curr := it.sl.head
+	for i := it.sl.level - 1; i >= 0; i-- {
+		for curr.next[i] != nil && curr.next[i].compare(key) < 0 {
+			curr = curr.next[i]
+		}
+	}
+	it.curr = it.sl.nodeOrNil(curr)
+}
+
+// nodeOrNil maps the head sentinel to nil.
+func (sl *SkipList) nodeOrNil(n *Node) *Node {
+	if n == sl.head {
+		return nil
+	}
+	return n
 }
 
 func (it *SLIterator) Valid() bool {
 	return it.curr != nil
 }
 
+// Next, Key and Value take the list's read lock, so an iterator can walk a
+// memtable that is still being written to. On an iterator that is not
+// Valid, Next does nothing and Key and Value return nil.
 func (it *SLIterator) Next() {
+	if it.curr == nil {
+		return
+	}
+	it.sl.mu.RLock()
+	defer it.sl.mu.RUnlock()
 	it.curr = it.curr.next[0]
 }
 
 func (it *SLIterator) Key() []byte {
-	return it.curr.key
+	if it.curr == nil {
+		return nil
+	}
+	it.sl.mu.RLock()
+	defer it.sl.mu.RUnlock()
+	return it.curr.fullKey()
 }
 
 func (it *SLIterator) Value() []byte {
+	if it.curr == nil {
+		return nil
+	}
+	it.sl.mu.RLock()
+	defer it.sl.mu.RUnlock()
 	return it.curr.value
 }
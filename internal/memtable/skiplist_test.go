@@ -1,6 +1,9 @@
 package memtable
 
 import (
+	"bytes"
+	"fmt"
+	"math/rand"
 	"testing"
 )
 
@@ -127,6 +130,50 @@ func TestSkipListIterator(t *testing.T) {
 	}
 }
 
+func TestSkipListReverseIterator(t *testing.T) {
+	sl := NewSkipList()
+	for _, k := range []string{"key3", "key1", "key5", "key2", "key4"} {
+		sl.Put([]byte(k), []byte("v"))
+	}
+
+	it := sl.NewIterator()
+	var got []string
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		got = append(got, string(it.Key()))
+	}
+	if want := "[key5 key4 key3 key2 key1]"; fmt.Sprint(got) != want {
+		t.Errorf("reverse order = %v, want %s", got, want)
+	}
+
+	it.SeekToFirst()
+	it.Next()
+	it.Next()
+	it.Prev()
+	if string(it.Key()) != "key2" {
+		t.Errorf("Prev after Next x2: got %s, want key2", it.Key())
+	}
+
+	it.Seek([]byte("key25"))
+	if string(it.Key()) != "key3" {
+		t.Errorf("Seek(key25): got %s, want key3", it.Key())
+	}
+	it.Seek([]byte("key9"))
+	if it.Valid() {
+		t.Errorf("Seek past the end is valid at %s", it.Key())
+	}
+	// An exhausted iterator tolerates further use
+	it.Next()
+	if it.Key() != nil || it.Value() != nil {
+		t.Errorf("invalid iterator returned %q = %q", it.Key(), it.Value())
+	}
+
+	empty := NewSkipList().NewIterator()
+	empty.SeekToLast()
+	if empty.Valid() {
+		t.Error("SeekToLast on an empty list is valid")
+	}
+}
+
 func TestSkipListSize(t *testing.T) {
 	sl := NewSkipList()
 
@@ -151,3 +198,83 @@ func TestSkipListSize(t *testing.T) {
 		t.Errorf("Update should not increase size, expected 2, got %d", sl.size)
 	}
 }
+
+func TestSkipListPrefixInterning(t *testing.T) {
+	plain := NewSkipList()
+	interned := NewSkipListWithOptions(SkipListOptions{PrefixDelimiter: ':'})
+
+	keys := []string{
+		"tenant:2:order:10", "tenant:1:order:2", "tenant:1:order:10",
+		"tenant:1:", "tenant:1", "tenant", "tenant:10:order:1",
+		"tenant:1:order:", "a", ":", "::", "tenant:1:order:2:x",
+	}
+	for i, k := range keys {
+		v := []byte(fmt.Sprintf("v%d", i))
+		plain.Put([]byte(k), v)
+		interned.Put([]byte(k), v)
+	}
+
+	// Same keys come out in the same order.
+	pit, iit := plain.NewIterator(), interned.NewIterator()
+	for ; pit.Valid(); pit.Next() {
+		if !iit.Valid() {
+			t.Fatalf("interned iterator ended early before %q", pit.Key())
+		}
+		if !bytes.Equal(pit.Key(), iit.Key()) || !bytes.Equal(pit.Value(), iit.Value()) {
+			t.Errorf("got %q=%q, want %q=%q", iit.Key(), iit.Value(), pit.Key(), pit.Value())
+		}
+		iit.Next()
+	}
+	if iit.Valid() {
+		t.Errorf("interned iterator has extra key %q", iit.Key())
+	}
+
+	for _, k := range keys {
+		want, _ := plain.Get([]byte(k))
+		got, ok := interned.Get([]byte(k))
+		if !ok || !bytes.Equal(got, want) {
+			t.Errorf("Get(%q) = %q, %v; want %q", k, got, ok, want)
+		}
+	}
+	if _, ok := interned.Get([]byte("tenant:1:order:1")); ok {
+		t.Error("Get of missing key sharing an interned prefix should miss")
+	}
+
+	// Nodes with the same prefix share one backing array.
+	var shared []byte
+	for n := interned.head.next[0]; n != nil; n = n.next[0] {
+		if string(n.prefix) != "tenant:1:order:" {
+			continue
+		}
+		if shared == nil {
+			shared = n.prefix
+		} else if &shared[0] != &n.prefix[0] {
+			t.Error("prefix was not interned")
+		}
+	}
+	if shared == nil {
+		t.Fatal("expected interned prefix tenant:1:order:")
+	}
+}
+
+func TestSkipListSeededLevels(t *testing.T) {
+	levels := func(seed int64) []int {
+		sl := NewSkipListWithOptions(SkipListOptions{Rand: rand.New(rand.NewSource(seed))})
+		for i := 0; i < 200; i++ {
+			sl.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("v"))
+		}
+		var out []int
+		for n := sl.head.next[0]; n != nil; n = n.next[0] {
+			out = append(out, len(n.next))
+		}
+		return out
+	}
+
+	a, b := levels(42), levels(42)
+	if fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Error("Same seed produced different skiplist shapes")
+	}
+	if fmt.Sprint(a) == fmt.Sprint(levels(7)) {
+		t.Error("Different seeds produced identical skiplist shapes")
+	}
+}
@@ -3,23 +3,127 @@ package sstable
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
+	"sort"
 
+	"github.com/return2faye/SiltKV/internal/memtable"
 	"github.com/return2faye/SiltKV/internal/utils"
 )
 
 const (
 	// BlockSize is the target size for each data block (4KB)
 	BlockSize = 4 * 1024
-	// MagicNumber is used to identify valid SSTable files
+	// MagicNumber identifies SSTable files with the original 32-byte footer
 	MagicNumber = 0x53494C544B56 // "SILTKV" in ASCII
+	// MagicNumberV2 identifies files with a 48-byte footer that also locates
+	// the range tombstone block
+	MagicNumberV2 = 0x53494C544B5632 // "SILTKV2" in ASCII
+	// MagicNumberV3 uses the V2 footer and appends a CRC32C trailer to every
+	// data block
+	MagicNumberV3 = 0x53494C544B5633 // "SILTKV3" in ASCII
+	// MagicNumberV4 is V3 with a record count in every block index entry
+	MagicNumberV4 = 0x53494C544B5634 // "SILTKV4" in ASCII
+	// MagicNumberV5 is V4 with prefix-compressed block index keys
+	MagicNumberV5 = 0x53494C544B5635 // "SILTKV5" in ASCII
+	// MagicNumberV6 is V5 with a properties section between the range
+	// tombstones and the footer
+	MagicNumberV6 = 0x53494C544B5636 // "SILTKV6" in ASCII
+	// MagicNumberV7 is V6 with a 56-byte footer that also holds a CRC32C of
+	// everything in front of it
+	MagicNumberV7 = 0x53494C544B5637 // "SILTKV7" in ASCII
+	// MagicNumberV8 is V7 with a compression type byte in every block
+	// trailer, in front of the checksum, which covers it
+	MagicNumberV8 = 0x53494C544B5638 // "SILTKV8" in ASCII
+	// MagicNumberV9 is V8 with prefix-compressed keys and restart points
+	// in every data block; see blockIter
+	MagicNumberV9 = 0x53494C544B5639 // "SILTKV9" in ASCII
+	// MagicNumberV10 is V9 with bloom filters probed by double hashing
+	// instead of by one FNV hash per probe
+	MagicNumberV10 = 0x53494C544B563130 // "SILTKV10" in ASCII
+	// MagicNumberV11 is V10 whose bloom filter section may hold one filter
+	// per data block; see partitionedFilterMarker
+	MagicNumberV11 = 0x53494C544B563131 // "SILTKV11" in ASCII
+	// MagicNumberV12 is V11 whose block index section may be partitioned;
+	// see partitionedIndexMarker
+	MagicNumberV12 = 0x53494C544B563132 // "SILTKV12" in ASCII
+	// MagicNumberVersioned ends the footers of V13 and later, which hold
+	// the format version in front of it; later formats need no magic
+	// number of their own
+	MagicNumberVersioned = 0x53494C544B564656 // "SILTKVFV" in ASCII
+
+	// FormatVersion is the table format the Writer produces: V13, which
+	// is V12 with the versioned footer. Versions 1 to 12 are those of
+	// MagicNumber to MagicNumberV12.
+	FormatVersion = 13
+	// firstVersionedFormat is the first format with a versioned footer
+	firstVersionedFormat = 13
+
+	// blockTrailerSize is the size of the per-block checksum in V3 files
+	blockTrailerSize = 4
+	// compressedTrailerSize is the size of the V8 block trailer: the
+	// Compression of the block and its checksum
+	compressedTrailerSize = 1 + blockTrailerSize
+
+	legacyFooterSize = 32
+	v2FooterSize     = 48
+	// FooterSize is the size of the footer written by the current Writer
+	FooterSize = 56
 )
 
+// Comparator orders the keys of a table. Writers derive block index keys
+// and readers search the index with the same Comparator, which keeps
+// FindBlock correct for separator keys that are not in the table.
+type Comparator interface {
+	Compare(a, b []byte) int
+	// Separator returns a key s with a <= s < b, as short as possible.
+	// It is only called with a < b.
+	Separator(a, b []byte) []byte
+}
+
+// BytewiseComparator orders keys by bytes.Compare. Every table uses it.
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+// Separator cuts a just past its common prefix with b and bumps the last
+// byte kept by one. The first byte that differs is bumped if that still
+// sorts below b; otherwise the first later byte below 0xff is, since a
+// already sorts below b at the differing byte. If a is a prefix of b, or
+// nothing shorter exists, a itself is returned.
+func (bytewiseComparator) Separator(a, b []byte) []byte {
+	n := sharedPrefixLen(a, b)
+	if n >= len(a) || n >= len(b) {
+		return utils.CopyBytes(a)
+	}
+	i := n
+	if a[n]+1 >= b[n] {
+		for i = n + 1; i < len(a)-1 && a[i] == 0xff; i++ {
+		}
+	}
+	if i >= len(a)-1 {
+		return utils.CopyBytes(a)
+	}
+	sep := utils.CopyBytes(a[:i+1])
+	sep[i]++
+	return sep
+}
+
 // BlockIndexEntry represents an entry in the block index.
-// It stores the last key of a block and the offset where the block starts.
+// It stores an upper bound for the keys of a block and the offset where the
+// block starts.
 type BlockIndexEntry struct {
-	LastKey []byte // Last key in the block
+	// LastKey is at least the last key in the block. Since V5 it may be a
+	// shorter separator that still sorts below the first key of the next
+	// block; for the final block it is always the exact last key.
+	LastKey []byte
 	Offset  int64  // Offset of the block in the file
+	Count   uint32 // Records in the block, tombstones included; 0 before V4
 }
 
 // BlockIndex is a sparse index that maps block last keys to block offsets.
@@ -27,14 +131,34 @@ type BlockIndex struct {
 	Entries []BlockIndexEntry
 }
 
-// Add adds a new entry to the block index (lastKey of the block, offset).
-func (bi *BlockIndex) Add(lastKey []byte, offset int64) {
+// Add adds a new entry to the block index (lastKey of the block, offset,
+// and the number of records in it).
+func (bi *BlockIndex) Add(lastKey []byte, offset int64, count uint32) {
 	bi.Entries = append(bi.Entries, BlockIndexEntry{
 		LastKey: utils.CopyBytes(lastKey),
 		Offset:  offset,
+		Count:   count,
 	})
 }
 
+// FindBlockIndex is like FindBlock but returns the entry index, or -1.
+func (bi *BlockIndex) FindBlockIndex(key []byte) int {
+	// sort.Search semantics: first entry where LastKey >= key
+	left, right := 0, len(bi.Entries)
+	for left < right {
+		mid := (left + right) / 2
+		if BytewiseComparator.Compare(bi.Entries[mid].LastKey, key) >= 0 {
+			right = mid
+		} else {
+			left = mid + 1
+		}
+	}
+	if left == len(bi.Entries) {
+		return -1
+	}
+	return left
+}
+
 // FindBlock finds the block that might contain the given key.
 // Returns the offset of the block, or -1 if no block could contain the key.
 // Uses last key: we want the first block whose lastKey >= key.
@@ -48,7 +172,7 @@ func (bi *BlockIndex) FindBlock(key []byte) int64 {
 
 	for left <= right {
 		mid := (left + right) / 2
-		cmp := bytes.Compare(bi.Entries[mid].LastKey, key)
+		cmp := BytewiseComparator.Compare(bi.Entries[mid].LastKey, key)
 		if cmp >= 0 {
 			// This block's range extends up to lastKey >= key, so it might contain key
 			result = bi.Entries[mid].Offset
@@ -62,27 +186,106 @@ func (bi *BlockIndex) FindBlock(key []byte) int64 {
 }
 
 // Serialize serializes the block index to bytes.
-// Format: [entryCount(4)][entry1: keyLen(4) + key + offset(8)][entry2: ...]
+//
+// Keys are sorted, so neighbouring keys tend to share a long prefix; each
+// key is stored as the length of the prefix it shares with the previous key
+// followed by the rest. Format:
+// [entryCount(4)][entry1: shared(uvarint) + unshared(uvarint) + key suffix +
+// offset(uvarint) + count(uvarint)][entry2: ...]
 func (bi *BlockIndex) Serialize() []byte {
 	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+	}
 
 	// Write entry count
 	count := uint32(len(bi.Entries))
 	binary.Write(&buf, binary.LittleEndian, count)
 
 	// Write each entry
+	var prev []byte
 	for _, entry := range bi.Entries {
-		keyLen := uint32(len(entry.LastKey))
-		binary.Write(&buf, binary.LittleEndian, keyLen)
-		buf.Write(entry.LastKey)
-		binary.Write(&buf, binary.LittleEndian, entry.Offset)
+		shared := sharedPrefixLen(prev, entry.LastKey)
+		putUvarint(uint64(shared))
+		putUvarint(uint64(len(entry.LastKey) - shared))
+		buf.Write(entry.LastKey[shared:])
+		putUvarint(uint64(entry.Offset))
+		putUvarint(uint64(entry.Count))
+		prev = entry.LastKey
 	}
 
 	return buf.Bytes()
 }
 
-// DeserializeBlockIndex deserializes a block index from bytes.
+// partitionedIndexMarker takes the place of the entry count at the start
+// of a block index section that is split into partitions (V12):
+//
+//	[marker(4)][top size(4)][top index][partition 0][partition 1]...
+//
+// Partitions are block indexes in the Serialize format, each of about
+// BlockSize bytes, covering consecutive data blocks. The top index has an
+// entry per partition: the last key of its last block, its offset counted
+// from the end of the top index, and the number of blocks it covers.
+// Readers keep only the top index in memory and read a partition, through
+// the block cache, when a lookup gets to it, so opening a large table does
+// not decode its whole index.
+const partitionedIndexMarker = 0xFFFFFFFF
+
+// serializePartitioned serializes bi as a partitioned index section, or
+// with Serialize if it fits in a single partition.
+func (bi *BlockIndex) serializePartitioned() []byte {
+	whole := bi.Serialize()
+	if len(whole) <= BlockSize {
+		return whole
+	}
+	var top BlockIndex
+	var parts []byte
+	for start := 0; start < len(bi.Entries); {
+		end, size := start, 0
+		for end < len(bi.Entries) && size < BlockSize {
+			// At most: both key lengths, the key and both varints
+			size += len(bi.Entries[end].LastKey) + 2*binary.MaxVarintLen32 + binary.MaxVarintLen64
+			end++
+		}
+		part := &BlockIndex{Entries: bi.Entries[start:end]}
+		top.Add(bi.Entries[end-1].LastKey, int64(len(parts)), uint32(end-start))
+		parts = append(parts, part.Serialize()...)
+		start = end
+	}
+	topData := top.Serialize()
+	out := make([]byte, 8, 8+len(topData)+len(parts))
+	binary.LittleEndian.PutUint32(out[0:4], partitionedIndexMarker)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(topData)))
+	out = append(out, topData...)
+	return append(out, parts...)
+}
+
+// sharedPrefixLen returns the length of the longest common prefix of a and b.
+func sharedPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// DeserializeBlockIndex deserializes a block index written by Serialize.
 func DeserializeBlockIndex(data []byte) (*BlockIndex, error) {
+	return deserializeBlockIndex(data, FormatVersion)
+}
+
+// deserializeBlockIndex decodes a block index in the format of the given
+// file version: prefix-compressed since V5, with per-entry record counts
+// since V4.
+func deserializeBlockIndex(data []byte, version int) (*BlockIndex, error) {
+	if version >= 5 {
+		return deserializePrefixBlockIndex(data)
+	}
+	withCounts := version == 4
+
 	if len(data) < 4 {
 		return nil, io.ErrUnexpectedEOF
 	}
@@ -117,50 +320,371 @@ func DeserializeBlockIndex(data []byte) (*BlockIndex, error) {
 			return nil, err
 		}
 
+		var n uint32
+		if withCounts {
+			if err := binary.Read(reader, binary.LittleEndian, &n); err != nil {
+				return nil, err
+			}
+		}
+
 		index.Entries = append(index.Entries, BlockIndexEntry{
 			LastKey: key,
 			Offset:  offset,
+			Count:   n,
 		})
 	}
 
 	return index, nil
 }
 
+// deserializePrefixBlockIndex decodes the V5 block index. The keys are
+// expanded into one shared buffer instead of an allocation per entry,
+// which keeps an open Reader's index compact.
+func deserializePrefixBlockIndex(data []byte) (*BlockIndex, error) {
+	if len(data) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	count := binary.LittleEndian.Uint32(data[0:4])
+	data = data[4:]
+	if uint64(count) > uint64(len(data)) {
+		// Every entry takes at least one byte per field
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// uvarint decodes the next varint, leaving err set once data runs out.
+	var err error
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			err = io.ErrUnexpectedEOF
+			return 0
+		}
+		data = data[n:]
+		return v
+	}
+
+	// Two passes: size the key buffer first so that entries can alias it
+	// without it ever being reallocated.
+	type rawEntry struct {
+		shared int
+		suffix []byte
+		offset int64
+		count  uint32
+	}
+	raw := make([]rawEntry, count)
+	total, prevLen := 0, 0
+	for i := range raw {
+		shared, unshared := uvarint(), uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if shared > uint64(prevLen) || shared+unshared > maxSSTableKeySize || unshared > uint64(len(data)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		suffix := data[:unshared]
+		data = data[unshared:]
+		offset, n := uvarint(), uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if offset > math.MaxInt64 || n > math.MaxUint32 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		raw[i] = rawEntry{shared: int(shared), suffix: suffix, offset: int64(offset), count: uint32(n)}
+		prevLen = int(shared + unshared)
+		total += prevLen
+	}
+
+	keys := make([]byte, 0, total)
+	index := &BlockIndex{Entries: make([]BlockIndexEntry, count)}
+	var prev []byte
+	for i, e := range raw {
+		start := len(keys)
+		keys = append(keys, prev[:e.shared]...)
+		keys = append(keys, e.suffix...)
+		key := keys[start:len(keys):len(keys)]
+		index.Entries[i] = BlockIndexEntry{LastKey: key, Offset: e.offset, Count: e.count}
+		prev = key
+	}
+	return index, nil
+}
+
 // Footer contains metadata at the end of an SSTable file.
+//
+// Files written with MagicNumber have a 32-byte footer without the range
+// tombstone fields; they are read with RangeDelOffset/RangeDelSize set to zero.
+// Files before V7 have a 48-byte footer without the file checksum.
+// V8 and later use the V7 footer; since V13 it holds the format version
+// and MagicNumberVersioned instead of a magic number per version.
 type Footer struct {
-	BloomFilterOffset int64 // Offset of bloom filter section
-	BlockIndexOffset  int64 // Offset of block index section
-	BlockIndexSize    int64 // Size of block index section
-	MagicNumber       int64 // Magic number to verify file format
+	BloomFilterOffset int64  // Offset of bloom filter section
+	BlockIndexOffset  int64  // Offset of block index section
+	BlockIndexSize    int64  // Size of block index section
+	RangeDelOffset    int64  // Offset of range tombstone section
+	RangeDelSize      int64  // Size of range tombstone section
+	FileChecksum      uint32 // CRC32C of the file up to the footer (V7)
+	MagicNumber       int64  // Magic number to verify file format
+	Version           int    // Format version, 1 for MagicNumber; see FormatVersion
+}
+
+// magicVersions maps the magic numbers of the formats before the
+// versioned footer to their version.
+var magicVersions = map[int64]int{
+	MagicNumber:    1,
+	MagicNumberV2:  2,
+	MagicNumberV3:  3,
+	MagicNumberV4:  4,
+	MagicNumberV5:  5,
+	MagicNumberV6:  6,
+	MagicNumberV7:  7,
+	MagicNumberV8:  8,
+	MagicNumberV9:  9,
+	MagicNumberV10: 10,
+	MagicNumberV11: 11,
+	MagicNumberV12: 12,
+}
+
+// Size returns the on-disk size of the footer.
+func (f *Footer) Size() int64 {
+	switch {
+	case f.Version <= 1:
+		return legacyFooterSize
+	case f.Version < 7:
+		return v2FooterSize
+	}
+	return FooterSize
+}
+
+// blockTrailerSize returns the size of the trailer after every data block.
+func (f *Footer) blockTrailerSize() int64 {
+	switch {
+	case f.HasBlockCompression():
+		return compressedTrailerSize
+	case f.HasBlockChecksums():
+		return blockTrailerSize
+	}
+	return 0
 }
 
-// Serialize serializes the footer to bytes (32 bytes total).
+// HasBlockChecksums reports whether data blocks carry a CRC32C trailer.
+func (f *Footer) HasBlockChecksums() bool {
+	return f.Version >= 3
+}
+
+// HasBlockCounts reports whether block index entries carry record counts.
+func (f *Footer) HasBlockCounts() bool {
+	return f.Version >= 4
+}
+
+// HasProperties reports whether a properties section follows the range
+// tombstones.
+func (f *Footer) HasProperties() bool {
+	return f.Version >= 6
+}
+
+// HasFileChecksum reports whether FileChecksum is set.
+func (f *Footer) HasFileChecksum() bool {
+	return f.Version >= 7
+}
+
+// HasBlockCompression reports whether block trailers carry a Compression.
+func (f *Footer) HasBlockCompression() bool {
+	return f.Version >= 8
+}
+
+// HasPrefixRecords reports whether data blocks hold prefix-compressed keys
+// and restart points.
+func (f *Footer) HasPrefixRecords() bool {
+	return f.Version >= 9
+}
+
+// HasDoubleHashBloom reports whether the bloom filter is probed by double
+// hashing; older filters set one bit per key.
+func (f *Footer) HasDoubleHashBloom() bool {
+	return f.Version >= 10
+}
+
+// HasPartitionedFilters reports whether the bloom filter section may hold
+// one filter per data block.
+func (f *Footer) HasPartitionedFilters() bool {
+	return f.Version >= 11
+}
+
+// HasPartitionedIndex reports whether the block index section may be
+// partitioned.
+func (f *Footer) HasPartitionedIndex() bool {
+	return f.Version >= 12
+}
+
+// Serialize serializes the footer to bytes (56 bytes total).
+// It always writes the versioned footer of FormatVersion, the format the
+// Writer produces.
 func (f *Footer) Serialize() []byte {
-	buf := make([]byte, 32)
+	buf := make([]byte, FooterSize)
 	binary.LittleEndian.PutUint64(buf[0:8], uint64(f.BloomFilterOffset))
 	binary.LittleEndian.PutUint64(buf[8:16], uint64(f.BlockIndexOffset))
 	binary.LittleEndian.PutUint64(buf[16:24], uint64(f.BlockIndexSize))
-	binary.LittleEndian.PutUint64(buf[24:32], uint64(f.MagicNumber))
+	binary.LittleEndian.PutUint64(buf[24:32], uint64(f.RangeDelOffset))
+	binary.LittleEndian.PutUint64(buf[32:40], uint64(f.RangeDelSize))
+	binary.LittleEndian.PutUint32(buf[40:44], f.FileChecksum)
+	binary.LittleEndian.PutUint32(buf[44:48], FormatVersion)
+	binary.LittleEndian.PutUint64(buf[48:56], uint64(MagicNumberVersioned))
 	return buf
 }
 
-// DeserializeFooter deserializes a footer from bytes.
+// DeserializeFooter deserializes a footer from the trailing bytes of a file.
+// data may be longer than the footer; only its tail is used. A versioned
+// footer of a format newer than FormatVersion is reported with
+// ErrUnsupportedFormat rather than as a malformed footer.
 func DeserializeFooter(data []byte) (*Footer, error) {
-	if len(data) < 32 {
+	if len(data) < legacyFooterSize {
 		return nil, io.ErrUnexpectedEOF
 	}
 
-	footer := &Footer{
-		BloomFilterOffset: int64(binary.LittleEndian.Uint64(data[0:8])),
-		BlockIndexOffset:  int64(binary.LittleEndian.Uint64(data[8:16])),
-		BlockIndexSize:    int64(binary.LittleEndian.Uint64(data[16:24])),
-		MagicNumber:       int64(binary.LittleEndian.Uint64(data[24:32])),
+	f := &Footer{MagicNumber: int64(binary.LittleEndian.Uint64(data[len(data)-8:]))}
+	if f.MagicNumber == MagicNumberVersioned {
+		if len(data) < FooterSize {
+			return nil, io.ErrUnexpectedEOF
+		}
+		f.Version = int(binary.LittleEndian.Uint32(data[len(data)-12:]))
+		if f.Version < firstVersionedFormat {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if f.Version > FormatVersion {
+			return nil, fmt.Errorf("%w %d", ErrUnsupportedFormat, f.Version)
+		}
+	} else {
+		var ok bool
+		if f.Version, ok = magicVersions[f.MagicNumber]; !ok {
+			// Unknown magic number
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	if int64(len(data)) < f.Size() {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	data = data[int64(len(data))-f.Size():]
+	f.BloomFilterOffset = int64(binary.LittleEndian.Uint64(data[0:8]))
+	f.BlockIndexOffset = int64(binary.LittleEndian.Uint64(data[8:16]))
+	f.BlockIndexSize = int64(binary.LittleEndian.Uint64(data[16:24]))
+	if f.Version >= 2 {
+		f.RangeDelOffset = int64(binary.LittleEndian.Uint64(data[24:32]))
+		f.RangeDelSize = int64(binary.LittleEndian.Uint64(data[32:40]))
+	}
+	if f.HasFileChecksum() {
+		f.FileChecksum = binary.LittleEndian.Uint32(data[40:44])
 	}
+	return f, nil
+}
 
-	// Verify magic number
-	if footer.MagicNumber != MagicNumber {
+// serializeRangeTombstones encodes range tombstones.
+// Format: [count(4)][entry1: startLen(4) + start + endLen(4) + end][entry2: ...]
+func serializeRangeTombstones(rts []memtable.RangeTombstone) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(rts)))
+	for _, rt := range rts {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(rt.Start)))
+		buf.Write(rt.Start)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(rt.End)))
+		buf.Write(rt.End)
+	}
+	return buf.Bytes()
+}
+
+// deserializeRangeTombstones decodes the output of serializeRangeTombstones.
+func deserializeRangeTombstones(data []byte) ([]memtable.RangeTombstone, error) {
+	if len(data) < 4 {
 		return nil, io.ErrUnexpectedEOF
 	}
+	count := binary.LittleEndian.Uint32(data[0:4])
+	pos := 4
 
-	return footer, nil
+	readKey := func() ([]byte, error) {
+		if pos+4 > len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n := int(binary.LittleEndian.Uint32(data[pos : pos+4]))
+		pos += 4
+		if n > maxSSTableKeySize || pos+n > len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		key := utils.CopyBytes(data[pos : pos+n])
+		pos += n
+		return key, nil
+	}
+
+	rts := make([]memtable.RangeTombstone, 0, count)
+	for i := uint32(0); i < count; i++ {
+		start, err := readKey()
+		if err != nil {
+			return nil, err
+		}
+		end, err := readKey()
+		if err != nil {
+			return nil, err
+		}
+		rts = append(rts, memtable.RangeTombstone{Start: start, End: end})
+	}
+	return rts, nil
+}
+
+// maxPropertySize bounds the names and values in a properties section.
+const maxPropertySize = 64 << 10
+
+// serializeProperties encodes table properties, sorted by name.
+// Format: [count(4)][entry1: nameLen(4) + name + valueLen(4) + value][entry2: ...]
+func serializeProperties(props map[string]string) []byte {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(names)))
+	for _, name := range names {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(name)))
+		buf.WriteString(name)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(props[name])))
+		buf.WriteString(props[name])
+	}
+	return buf.Bytes()
+}
+
+// deserializeProperties decodes properties written by serializeProperties.
+func deserializeProperties(data []byte) (map[string]string, error) {
+	if len(data) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	count := binary.LittleEndian.Uint32(data[0:4])
+	pos := 4
+
+	readString := func() (string, error) {
+		if pos+4 > len(data) {
+			return "", io.ErrUnexpectedEOF
+		}
+		n := int(binary.LittleEndian.Uint32(data[pos : pos+4]))
+		pos += 4
+		if n > maxPropertySize || pos+n > len(data) {
+			return "", io.ErrUnexpectedEOF
+		}
+		s := string(data[pos : pos+n])
+		pos += n
+		return s, nil
+	}
+
+	props := make(map[string]string)
+	for i := uint32(0); i < count; i++ {
+		name, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		props[name] = value
+	}
+	return props, nil
 }
@@ -1,19 +1,29 @@
 package sstable
 
 import (
+	"bytes"
 	"encoding/binary"
-	"hash"
-	"hash/fnv"
 	"io"
 )
 
+// maxBloomHashCount caps the probes per key, in filters built and loaded.
+const maxBloomHashCount = 10
+
 // BloomFilter is a probabilistic data structure used to test whether an element is a member of a set.
 // False positives are possible, but false negatives are not.
 // This allows us to quickly skip SSTables that definitely don't contain a key.
+//
+// The k probes of a key are derived from one 64-bit hash by double hashing:
+// probe i sets bit (h1 + i*h2) mod m, where h1 and h2 are the two halves of
+// the hash. A filter holds no hashing state, so MayContain allocates
+// nothing and is safe for concurrent use.
 type BloomFilter struct {
-	bits     []byte // bit array
-	bitCount uint32 // number of bits in the filter
-	hashFunc []hash.Hash32
+	bits      []byte // bit array
+	bitCount  uint32 // number of bits in the filter
+	hashCount uint32 // probes per key
+	// legacy is set for filters of tables before V10, which probed with k
+	// FNV-1a hashers that all computed the same hash: one bit per key.
+	legacy bool
 }
 
 // NewBloomFilter creates a new Bloom filter with the given capacity and false positive rate.
@@ -26,55 +36,111 @@ func NewBloomFilter(capacity uint32, falsePositiveRate float64) *BloomFilter {
 
 	// Round up to nearest byte
 	byteCount := (bitCount + 7) / 8
+	if byteCount == 0 {
+		byteCount = 1
+	}
 	bitCount = byteCount * 8
 
 	// Calculate optimal number of hash functions: k = (m/n) * ln(2)
 	hashCount := int((float64(bitCount) / float64(capacity)) * log(2.0))
-	if hashCount < 1 {
-		hashCount = 1
+
+	return &BloomFilter{
+		bits:      make([]byte, byteCount),
+		bitCount:  bitCount,
+		hashCount: clampHashCount(hashCount),
 	}
-	if hashCount > 10 {
-		hashCount = 10 // Cap at 10 hash functions
+}
+
+// newBloomFilterFromHashes builds a filter with bitsPerKey bits for each key,
+// given the bloomHash of every key.
+func newBloomFilterFromHashes(hashes []uint64, bitsPerKey int) *BloomFilter {
+	bitCount := uint32(len(hashes) * bitsPerKey)
+	if bitCount < 64 {
+		// Tiny filters would have a very high false positive rate
+		bitCount = 64
 	}
+	byteCount := (bitCount + 7) / 8
+	bitCount = byteCount * 8
 
-	// Create hash functions
-	hashFuncs := make([]hash.Hash32, hashCount)
-	for i := 0; i < hashCount; i++ {
-		hashFuncs[i] = fnv.New32a()
+	// k = bits per key * ln(2), as in NewBloomFilter
+	bf := &BloomFilter{
+		bits:      make([]byte, byteCount),
+		bitCount:  bitCount,
+		hashCount: clampHashCount(int(float64(bitsPerKey) * log(2.0))),
+	}
+	for _, h := range hashes {
+		bf.addHash(h)
 	}
+	return bf
+}
 
-	return &BloomFilter{
-		bits:     make([]byte, byteCount),
-		bitCount: bitCount,
-		hashFunc: hashFuncs,
+func clampHashCount(k int) uint32 {
+	return uint32(max(1, min(k, maxBloomHashCount)))
+}
+
+// bloomHash returns the hash that the probes of key are derived from, so
+// filters can be built from hashes collected ahead of time: 64-bit FNV-1a,
+// finished with the MurmurHash3 fmix64 mixer so that both halves are well
+// distributed.
+func bloomHash(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
 	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// legacyBloomHash is the 32-bit FNV-1a hash that legacy filters probe with.
+func legacyBloomHash(key []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
 }
 
 // Add adds a key to the Bloom filter.
 func (bf *BloomFilter) Add(key []byte) {
-	for _, h := range bf.hashFunc {
-		h.Reset()
-		h.Write(key)
-		hashValue := h.Sum32()
-		bitIndex := hashValue % bf.bitCount
-		byteIndex := bitIndex / 8
-		bitOffset := bitIndex % 8
-		bf.bits[byteIndex] |= 1 << bitOffset
+	if bf.legacy {
+		bf.set(legacyBloomHash(key) % bf.bitCount)
+		return
+	}
+	bf.addHash(bloomHash(key))
+}
+
+func (bf *BloomFilter) addHash(h uint64) {
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := uint32(0); i < bf.hashCount; i++ {
+		bf.set((h1 + i*h2) % bf.bitCount)
 	}
 }
 
+func (bf *BloomFilter) set(bitIndex uint32) {
+	bf.bits[bitIndex/8] |= 1 << (bitIndex % 8)
+}
+
+func (bf *BloomFilter) isSet(bitIndex uint32) bool {
+	return bf.bits[bitIndex/8]&(1<<(bitIndex%8)) != 0
+}
+
 // MayContain checks if the key might be in the filter.
 // Returns true if the key might be present (could be false positive).
 // Returns false if the key is definitely not present.
 func (bf *BloomFilter) MayContain(key []byte) bool {
-	for _, h := range bf.hashFunc {
-		h.Reset()
-		h.Write(key)
-		hashValue := h.Sum32()
-		bitIndex := hashValue % bf.bitCount
-		byteIndex := bitIndex / 8
-		bitOffset := bitIndex % 8
-		if (bf.bits[byteIndex] & (1 << bitOffset)) == 0 {
+	if bf.legacy {
+		return bf.isSet(legacyBloomHash(key) % bf.bitCount)
+	}
+	h := bloomHash(key)
+	h1, h2 := uint32(h), uint32(h>>32)
+	for i := uint32(0); i < bf.hashCount; i++ {
+		if !bf.isSet((h1 + i*h2) % bf.bitCount) {
 			return false
 		}
 	}
@@ -86,41 +152,74 @@ func (bf *BloomFilter) Bytes() []byte {
 	// Format: [bitCount(4)][hashCount(4)][bits...]
 	result := make([]byte, 8+len(bf.bits))
 	binary.LittleEndian.PutUint32(result[0:4], bf.bitCount)
-	binary.LittleEndian.PutUint32(result[4:8], uint32(len(bf.hashFunc)))
+	binary.LittleEndian.PutUint32(result[4:8], bf.hashCount)
 	copy(result[8:], bf.bits)
 	return result
 }
 
-// LoadBloomFilter loads a Bloom filter from serialized bytes.
-func LoadBloomFilter(data []byte) (*BloomFilter, error) {
+// LoadBloomFilter loads a Bloom filter from serialized bytes. legacy is set
+// for the filters of tables before V10 (see Footer.HasDoubleHashBloom).
+func LoadBloomFilter(data []byte, legacy bool) (*BloomFilter, error) {
+	bf, err := parseBloomFilter(data, legacy)
+	if err != nil {
+		return nil, err
+	}
+	bf.bits = bytes.Clone(bf.bits)
+	return &bf, nil
+}
+
+// parseBloomFilter is LoadBloomFilter without the copy: the filter's bits
+// are part of data.
+func parseBloomFilter(data []byte, legacy bool) (BloomFilter, error) {
 	if len(data) < 8 {
-		return nil, io.ErrUnexpectedEOF
+		return BloomFilter{}, io.ErrUnexpectedEOF
 	}
 
 	bitCount := binary.LittleEndian.Uint32(data[0:4])
 	hashCount := binary.LittleEndian.Uint32(data[4:8])
-
-	expectedSize := 8 + int(bitCount+7)/8
-	if len(data) < expectedSize {
-		return nil, io.ErrUnexpectedEOF
+	if bitCount == 0 || hashCount == 0 || hashCount > maxBloomHashCount {
+		return BloomFilter{}, ErrCorruptSSTable
 	}
 
-	bits := make([]byte, (bitCount+7)/8)
-	copy(bits, data[8:8+(bitCount+7)/8])
-
-	// Recreate hash functions
-	hashFuncs := make([]hash.Hash32, hashCount)
-	for i := uint32(0); i < hashCount; i++ {
-		hashFuncs[i] = fnv.New32a()
+	byteCount := int(bitCount+7) / 8
+	if len(data) < 8+byteCount {
+		return BloomFilter{}, io.ErrUnexpectedEOF
 	}
-
-	return &BloomFilter{
-		bits:     bits,
-		bitCount: bitCount,
-		hashFunc: hashFuncs,
+	return BloomFilter{
+		bits:      data[8 : 8+byteCount],
+		bitCount:  bitCount,
+		hashCount: hashCount,
+		legacy:    legacy,
 	}, nil
 }
 
+// partitionedFilterMarker takes the place of the bit count at the start of
+// a filter section that holds one filter per data block (V11):
+//
+//	[marker(4)][count(4)][count x end offset(4)][filter 0][filter 1]...
+//
+// Filter i holds the keys of data block i and ends at end offset i,
+// counted from the start of the section. Readers keep only the offsets and
+// read the filter of a block when a lookup gets to it, so opening a large
+// table does not load a large filter.
+const partitionedFilterMarker = 0xFFFFFFFF
+
+// buildPartitionedFilter serializes one filter per data block with
+// bitsPerKey bits for each key, given the bloomHash of every key and, per
+// block, the number of keys up to its end.
+func buildPartitionedFilter(hashes []uint64, blockEnds []int, bitsPerKey int) []byte {
+	out := make([]byte, 8+4*len(blockEnds))
+	binary.LittleEndian.PutUint32(out[0:4], partitionedFilterMarker)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(blockEnds)))
+	start := 0
+	for i, end := range blockEnds {
+		out = append(out, newBloomFilterFromHashes(hashes[start:end], bitsPerKey).Bytes()...)
+		binary.LittleEndian.PutUint32(out[8+4*i:], uint32(len(out)))
+		start = end
+	}
+	return out
+}
+
 // log calculates natural logarithm (approximation using Taylor series)
 func log(x float64) float64 {
 	if x <= 0 {
@@ -0,0 +1,286 @@
+package sstable
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CachePolicy selects how a BlockCache decides what to keep.
+type CachePolicy int
+
+const (
+	// CachePolicyLRU admits every block and evicts the least recently used.
+	// A single large scan can flush the whole hot set out of the cache.
+	CachePolicyLRU CachePolicy = iota
+
+	// CachePolicyTinyLFU is W-TinyLFU: new blocks enter a small LRU window
+	// (1% of capacity) and only move into the main LRU if a frequency
+	// sketch says they are used more often than the block they would
+	// evict. Blocks read once by a scan fall out of the window instead.
+	CachePolicyTinyLFU
+)
+
+func (p CachePolicy) String() string {
+	switch p {
+	case CachePolicyLRU:
+		return "lru"
+	case CachePolicyTinyLFU:
+		return "tinylfu"
+	default:
+		return "unknown"
+	}
+}
+
+// CacheStats is a snapshot of BlockCache counters.
+type CacheStats struct {
+	Policy     CachePolicy
+	Capacity   int64 // bytes
+	Size       int64 // bytes currently cached
+	Entries    int
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	Rejections uint64 // blocks the admission policy refused (TinyLFU only)
+}
+
+// HitRate returns Hits / (Hits + Misses), or 0 before any lookup.
+func (s CacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// blockKey identifies a data block: the owning Reader's id and block number.
+type blockKey struct {
+	file  uint64
+	block int
+}
+
+func (k blockKey) hash() uint64 {
+	// splitmix64 finalizer over both fields
+	h := k.file*0x9e3779b97f4a7c15 ^ uint64(k.block)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+type cacheEntry struct {
+	key    blockKey
+	data   []byte
+	window bool // in the admission window rather than the main LRU
+}
+
+// BlockCache caches decoded data blocks across Readers, bounded by bytes.
+// Cached blocks are shared and must not be modified. It is safe for
+// concurrent use.
+type BlockCache struct {
+	mu       sync.Mutex
+	policy   CachePolicy
+	capacity int64
+	entries  map[blockKey]*list.Element
+
+	// main holds admitted blocks, most recently used at the front. Under
+	// LRU it is the whole cache.
+	main     *list.List
+	mainSize int64
+
+	// window and sketch are only used by CachePolicyTinyLFU.
+	window     *list.List
+	windowSize int64
+	windowCap  int64
+	sketch     *countMinSketch
+
+	hits, misses, evictions, rejections uint64
+}
+
+// NewBlockCache creates a cache holding up to capacity bytes of blocks.
+func NewBlockCache(capacity int64, policy CachePolicy) *BlockCache {
+	c := &BlockCache{
+		policy:   policy,
+		capacity: capacity,
+		entries:  make(map[blockKey]*list.Element),
+		main:     list.New(),
+	}
+	if policy == CachePolicyTinyLFU {
+		c.window = list.New()
+		c.windowCap = capacity / 100
+		if c.windowCap < BlockSize {
+			c.windowCap = BlockSize
+		}
+		// Size the sketch for roughly the number of blocks that fit.
+		c.sketch = newCountMinSketch(int(capacity / BlockSize))
+	}
+	return c
+}
+
+// get returns the cached block for k.
+func (c *BlockCache) get(k blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sketch != nil {
+		c.sketch.increment(k.hash())
+	}
+	el, ok := c.entries[k]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	e := el.Value.(*cacheEntry)
+	if e.window {
+		c.window.MoveToFront(el)
+	} else {
+		c.main.MoveToFront(el)
+	}
+	return e.data, true
+}
+
+// add offers a block to the cache. The policy may decline to keep it.
+func (c *BlockCache) add(k blockKey, data []byte) {
+	size := int64(len(data))
+	if size == 0 || size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[k]; ok {
+		return
+	}
+
+	if c.policy != CachePolicyTinyLFU {
+		c.entries[k] = c.main.PushFront(&cacheEntry{key: k, data: data})
+		c.mainSize += size
+		for c.mainSize > c.capacity {
+			c.evict(c.main.Back())
+		}
+		return
+	}
+
+	c.entries[k] = c.window.PushFront(&cacheEntry{key: k, data: data, window: true})
+	c.windowSize += size
+	for c.windowSize > c.windowCap {
+		c.promote(c.window.Back())
+	}
+}
+
+// promote moves the window's LRU block into the main region if the sketch
+// rates it above the main-region blocks it would displace, and drops it
+// otherwise.
+func (c *BlockCache) promote(el *list.Element) {
+	cand := el.Value.(*cacheEntry)
+	size := int64(len(cand.data))
+	mainCap := c.capacity - c.windowCap
+
+	candFreq := c.sketch.estimate(cand.key.hash())
+	for c.mainSize+size > mainCap {
+		victim := c.main.Back()
+		if victim == nil {
+			break
+		}
+		if candFreq <= c.sketch.estimate(victim.Value.(*cacheEntry).key.hash()) {
+			c.rejections++
+			c.evict(el)
+			return
+		}
+		c.evict(victim)
+	}
+
+	c.window.Remove(el)
+	c.windowSize -= size
+	cand.window = false
+	c.entries[cand.key] = c.main.PushFront(cand)
+	c.mainSize += size
+}
+
+func (c *BlockCache) evict(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	if e.window {
+		c.window.Remove(el)
+		c.windowSize -= int64(len(e.data))
+	} else {
+		c.main.Remove(el)
+		c.mainSize -= int64(len(e.data))
+	}
+	delete(c.entries, e.key)
+	c.evictions++
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *BlockCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Policy:     c.policy,
+		Capacity:   c.capacity,
+		Size:       c.mainSize + c.windowSize,
+		Entries:    len(c.entries),
+		Hits:       c.hits,
+		Misses:     c.misses,
+		Evictions:  c.evictions,
+		Rejections: c.rejections,
+	}
+}
+
+// countMinSketch estimates access frequencies with 4 rows of saturating
+// counters. Every counter is halved after a fixed number of increments so
+// the estimates follow recent popularity.
+type countMinSketch struct {
+	rows       [4][]uint8
+	mask       uint64
+	additions  int
+	resetAfter int
+}
+
+const sketchMaxCount = 15
+
+func newCountMinSketch(expected int) *countMinSketch {
+	width := 1024
+	for width < expected {
+		width <<= 1
+	}
+	s := &countMinSketch{mask: uint64(width - 1), resetAfter: 10 * width}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) index(h uint64, row int) uint64 {
+	// Derive the row hashes from one 64-bit hash (double hashing).
+	return (h + uint64(row)*(h>>32|1)) & s.mask
+}
+
+func (s *countMinSketch) increment(h uint64) {
+	for i := range s.rows {
+		if c := &s.rows[i][s.index(h, i)]; *c < sketchMaxCount {
+			*c++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAfter {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *countMinSketch) estimate(h uint64) uint8 {
+	min := uint8(sketchMaxCount)
+	for i := range s.rows {
+		if c := s.rows[i][s.index(h, i)]; c < min {
+			min = c
+		}
+	}
+	return min
+}
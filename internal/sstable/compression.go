@@ -0,0 +1,100 @@
+package sstable
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how a Writer compresses data blocks. Readers handle
+// every kind, whatever their own options say.
+type Compression uint8
+
+const (
+	// NoCompression stores blocks as they are.
+	NoCompression Compression = iota
+	// SnappyCompression is fast and cheap to decompress; repetitive values
+	// such as JSON usually shrink to a third or less.
+	SnappyCompression
+	// ZstdCompression compresses better than Snappy at a higher CPU cost.
+	ZstdCompression
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	case ZstdCompression:
+		return "zstd"
+	default:
+		return "unknown"
+	}
+}
+
+// maxDecodedBlockSize bounds what a block may decompress to. A block holds
+// BlockSize bytes of records, or a single larger record; anything beyond
+// this is corruption, not data.
+const maxDecodedBlockSize = 1 << 20
+
+// errBadCompression is wrapped into ErrCorruptSSTable for blocks that do not
+// decompress.
+var errBadCompression = errors.New("sstable: bad block compression")
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedBlockSize))
+		return dec
+	})
+)
+
+// compressBlock returns block compressed with c, appended to dst[:0], and
+// the kind actually used: blocks that would not shrink by at least an
+// eighth are stored uncompressed, which saves the decompression on read.
+func compressBlock(c Compression, block, dst []byte) ([]byte, Compression) {
+	var out []byte
+	switch c {
+	case SnappyCompression:
+		out = s2.EncodeSnappy(dst[:cap(dst)], block)
+	case ZstdCompression:
+		out = zstdEncoder().EncodeAll(block, dst[:0])
+	default:
+		return block, NoCompression
+	}
+	if len(out) >= len(block)-len(block)/8 {
+		return block, NoCompression
+	}
+	return out, c
+}
+
+// decompressBlock returns data, stored with compression c, decompressed.
+func decompressBlock(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return data, nil
+	case SnappyCompression:
+		n, err := s2.DecodedLen(data)
+		if err != nil || n > maxDecodedBlockSize {
+			return nil, errBadCompression
+		}
+		out, err := s2.Decode(make([]byte, n), data)
+		if err != nil {
+			return nil, errBadCompression
+		}
+		return out, nil
+	case ZstdCompression:
+		out, err := zstdDecoder().DecodeAll(data, nil)
+		if err != nil {
+			return nil, errBadCompression
+		}
+		return out, nil
+	}
+	return nil, errBadCompression
+}
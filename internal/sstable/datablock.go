@@ -0,0 +1,199 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// restartInterval is the number of records between restart points in V9
+// data blocks. Longer runs share more key prefixes; shorter ones make
+// seeks and Prev decode fewer records.
+const restartInterval = 16
+
+// uvarintLen returns the encoded size of v as a uvarint.
+func uvarintLen(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// blockIter decodes the records of one data block.
+//
+// Since V9 a record stores only the part of its key that differs from the
+// previous key: [shared(uvarint)][unshared(uvarint)][valueLen(uvarint)]
+// [key suffix][value]. Every restartInterval-th record is a restart point
+// that stores its full key; the block ends with the offsets of the restart
+// points (4 bytes each) and their count (4), so that a seek binary-searches
+// them and decodes at most one run. Older blocks hold [keyLen(4)]
+// [valueLen(4)][key][value] records; they are decoded as a single run
+// starting at offset 0.
+type blockIter struct {
+	data     []byte // the records
+	restarts []byte // restart point offsets; unused for older blocks
+	prefix   bool   // records in the V9 format
+
+	off  int    // offset of the current record; len(data) when there is none
+	next int    // offset of the record after it
+	key  []byte // key of the current record, rebuilt in place
+	val  []byte // value of the current record, aliasing data
+	err  error  // the first malformed record found
+}
+
+// init makes bi decode block, whose records are in the V9 format if prefix
+// is set. It is positioned on nothing.
+func (bi *blockIter) init(block []byte, prefix bool) error {
+	*bi = blockIter{data: block, prefix: prefix, key: bi.key[:0]}
+	if prefix {
+		if len(block) < 4 {
+			return bi.corrupt(0)
+		}
+		n := uint64(binary.LittleEndian.Uint32(block[len(block)-4:]))
+		if n*4+4 > uint64(len(block)) {
+			return bi.corrupt(0)
+		}
+		start := len(block) - 4 - int(n)*4
+		bi.data, bi.restarts = block[:start], block[start:len(block)-4]
+	}
+	bi.off, bi.next = len(bi.data), len(bi.data)
+	return nil
+}
+
+// corrupt records a malformed record at off and ends the iteration.
+func (bi *blockIter) corrupt(off int) error {
+	if bi.err == nil {
+		bi.err = fmt.Errorf("%w: malformed record at block offset %d", ErrCorruptBlock, off)
+	}
+	bi.off, bi.next = len(bi.data), len(bi.data)
+	bi.key, bi.val = bi.key[:0], nil
+	return bi.err
+}
+
+// valid reports whether bi is on a record.
+func (bi *blockIter) valid() bool {
+	return bi.off < len(bi.data)
+}
+
+func (bi *blockIter) numRestarts() int {
+	if !bi.prefix {
+		return 1
+	}
+	return len(bi.restarts) / 4
+}
+
+func (bi *blockIter) restart(i int) int {
+	if !bi.prefix {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(bi.restarts[i*4:]))
+}
+
+// decodeAt moves to the record at off, which must be a restart point or
+// follow the current record, and reports whether there is one.
+func (bi *blockIter) decodeAt(off int) bool {
+	if off >= len(bi.data) {
+		bi.off, bi.next = len(bi.data), len(bi.data)
+		bi.key, bi.val = bi.key[:0], nil
+		return false
+	}
+	var shared, unshared, vlen uint64
+	p := off
+	if bi.prefix {
+		for _, v := range []*uint64{&shared, &unshared, &vlen} {
+			n := 0
+			*v, n = binary.Uvarint(bi.data[p:])
+			if n <= 0 {
+				bi.corrupt(off)
+				return false
+			}
+			p += n
+		}
+	} else {
+		if p+8 > len(bi.data) {
+			bi.corrupt(off)
+			return false
+		}
+		unshared = uint64(binary.LittleEndian.Uint32(bi.data[p:]))
+		vlen = uint64(binary.LittleEndian.Uint32(bi.data[p+4:]))
+		p += 8
+	}
+	if shared > uint64(len(bi.key)) || shared+unshared > maxSSTableKeySize || vlen > maxSSTableValueSize ||
+		uint64(p)+unshared+vlen > uint64(len(bi.data)) {
+		bi.corrupt(off)
+		return false
+	}
+	end := p + int(unshared)
+	bi.key = append(bi.key[:shared], bi.data[p:end]...)
+	bi.val = bi.data[end : end+int(vlen)]
+	bi.off, bi.next = off, end+int(vlen)
+	return true
+}
+
+// seekToRestart moves to restart point i.
+func (bi *blockIter) seekToRestart(i int) bool {
+	bi.key = bi.key[:0]
+	if i >= bi.numRestarts() {
+		return bi.decodeAt(len(bi.data))
+	}
+	return bi.decodeAt(bi.restart(i))
+}
+
+// first moves to the first record.
+func (bi *blockIter) first() bool {
+	return bi.seekToRestart(0)
+}
+
+// nextRecord moves to the record after the current one.
+func (bi *blockIter) nextRecord() bool {
+	return bi.decodeAt(bi.next)
+}
+
+// last moves to the last record.
+func (bi *blockIter) last() bool {
+	if !bi.seekToRestart(bi.numRestarts() - 1) {
+		return false
+	}
+	for bi.next < len(bi.data) {
+		if !bi.nextRecord() {
+			return false
+		}
+	}
+	return true
+}
+
+// prev moves to the record before the current one by decoding forward from
+// the restart point in front of it.
+func (bi *blockIter) prev() bool {
+	target := bi.off
+	i := sort.Search(bi.numRestarts(), func(i int) bool { return bi.restart(i) >= target }) - 1
+	if i < 0 || !bi.seekToRestart(i) {
+		return bi.decodeAt(len(bi.data))
+	}
+	for bi.next < target {
+		if !bi.nextRecord() {
+			return false
+		}
+	}
+	return true
+}
+
+// seek moves to the first record with a key >= target.
+func (bi *blockIter) seek(target []byte) bool {
+	// The last restart point with a key < target starts the run that may
+	// hold target; the point after it already sorts at or after target.
+	i := sort.Search(bi.numRestarts(), func(i int) bool {
+		return !bi.seekToRestart(i) || bytes.Compare(bi.key, target) >= 0
+	})
+	if bi.err != nil || !bi.seekToRestart(max(i-1, 0)) {
+		return false
+	}
+	for bytes.Compare(bi.key, target) < 0 {
+		if !bi.nextRecord() {
+			return false
+		}
+	}
+	return true
+}
@@ -8,30 +8,46 @@ import (
 // It handles duplicate keys by keeping the value from the newest SSTable.
 type MergeIterator struct {
 	iterators []*Iterator
+	sources   []int       // sources[i] is the readers index of iterators[i]
 	current   []*Iterator // iterators that have valid current key
 	key       []byte
 	value     []byte
+	source    int // readers index that supplied the current value
+
+	// reverse is set while moving backwards (after SeekToLast or Prev).
+	// Going forward, every child sits past the current key; going backward,
+	// every child sits before it.
+	reverse bool
 }
 
 // NewMergeIterator creates a new merge iterator from multiple SSTable readers.
 // Readers should be ordered from newest to oldest.
 func NewMergeIterator(readers []*Reader) (*MergeIterator, error) {
+	return NewMergeIteratorWithOptions(readers, IteratorOptions{})
+}
+
+// NewMergeIteratorWithOptions is NewMergeIterator with options applied to
+// every underlying SSTable iterator.
+func NewMergeIteratorWithOptions(readers []*Reader, opts IteratorOptions) (*MergeIterator, error) {
 	iterators := make([]*Iterator, 0, len(readers))
-	for _, r := range readers {
+	sources := make([]int, 0, len(readers))
+	for i, r := range readers {
 		if r != nil {
-			it := r.NewIterator()
+			it := r.NewIteratorWithOptions(opts)
 			if err := it.Next(); err != nil {
 				// Skip corrupted iterators
 				continue
 			}
 			if it.Valid() {
 				iterators = append(iterators, it)
+				sources = append(sources, i)
 			}
 		}
 	}
 
 	mi := &MergeIterator{
 		iterators: iterators,
+		sources:   sources,
 		current:   make([]*Iterator, 0, len(iterators)),
 	}
 
@@ -58,11 +74,119 @@ func (mi *MergeIterator) Value() []byte {
 	return mi.value
 }
 
+// Source returns the index, within the readers passed to NewMergeIterator,
+// of the SSTable that supplied the current value.
+func (mi *MergeIterator) Source() int {
+	return mi.source
+}
+
 // Next advances the iterator to the next key.
 func (mi *MergeIterator) Next() error {
+	if mi.reverse {
+		if !mi.Valid() {
+			return nil
+		}
+		// Move every child to the first key after the current one.
+		for _, it := range mi.iterators {
+			if !it.Valid() {
+				if err := it.SeekToFirst(); err != nil {
+					return err
+				}
+			}
+			for it.Valid() && bytes.Compare(it.Key(), mi.key) <= 0 {
+				if err := it.Next(); err != nil {
+					return err
+				}
+			}
+		}
+		mi.reverse = false
+	}
+	return mi.advance()
+}
+
+// Seek positions the iterator at the first key >= target.
+func (mi *MergeIterator) Seek(target []byte) error {
+	for _, it := range mi.iterators {
+		if err := it.Seek(target); err != nil {
+			return err
+		}
+	}
+	mi.reverse = false
 	return mi.advance()
 }
 
+// SeekToLast positions the iterator at the last key.
+func (mi *MergeIterator) SeekToLast() error {
+	for _, it := range mi.iterators {
+		if err := it.SeekToLast(); err != nil {
+			return err
+		}
+	}
+	mi.reverse = true
+	return mi.retreat()
+}
+
+// Prev moves the iterator to the previous key. Prev on an invalid iterator
+// does nothing.
+func (mi *MergeIterator) Prev() error {
+	if !mi.Valid() {
+		return nil
+	}
+	if !mi.reverse {
+		// Move every child to the last key before the current one.
+		for _, it := range mi.iterators {
+			if !it.Valid() {
+				if err := it.SeekToLast(); err != nil {
+					return err
+				}
+			}
+			for it.Valid() && bytes.Compare(it.Key(), mi.key) >= 0 {
+				if err := it.Prev(); err != nil {
+					return err
+				}
+			}
+		}
+		mi.reverse = true
+	}
+	return mi.retreat()
+}
+
+// retreat is advance for the reverse direction: it takes the largest key
+// among the children, newest first, and steps those children back.
+func (mi *MergeIterator) retreat() error {
+	mi.current = mi.current[:0]
+	mi.key = nil
+	mi.value = nil
+
+	var maxKey []byte
+	for _, it := range mi.iterators {
+		if it.Valid() && (maxKey == nil || bytes.Compare(it.Key(), maxKey) > 0) {
+			maxKey = it.Key()
+		}
+	}
+	if maxKey == nil {
+		return nil
+	}
+
+	for i, it := range mi.iterators {
+		if it.Valid() && bytes.Equal(it.Key(), maxKey) {
+			if len(mi.current) == 0 {
+				mi.source = mi.sources[i]
+			}
+			mi.current = append(mi.current, it)
+		}
+	}
+	mi.key = mi.current[0].Key()
+	mi.value = mi.current[0].Value()
+
+	for _, it := range mi.current {
+		if err := it.Prev(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // advance finds the next key to return.
 // It handles duplicates by keeping the value from the first (newest) iterator.
 func (mi *MergeIterator) advance() error {
@@ -90,11 +214,14 @@ func (mi *MergeIterator) advance() error {
 	}
 
 	// Collect all iterators with the same key (newest first)
-	for _, it := range mi.iterators {
+	for i, it := range mi.iterators {
 		if !it.Valid() {
 			continue
 		}
 		if bytes.Equal(it.Key(), minKey) {
+			if len(mi.current) == 0 {
+				mi.source = mi.sources[i]
+			}
 			mi.current = append(mi.current, it)
 		}
 	}
@@ -0,0 +1,77 @@
+package sstable
+
+import "sync"
+
+// readaheadAfter is how many blocks an iterator must load in a row, each
+// the one after the last, before it starts reading ahead. Seeks and short
+// scans then read no more than they use.
+const readaheadAfter = 2
+
+// readahead reads the blocks after the one a forward scan is on in
+// background goroutines, so that the scan finds them read when it gets
+// there instead of waiting for the disk block by block.
+type readahead struct {
+	max     int            // blocks to keep read ahead; see IteratorOptions.Readahead
+	seq     int            // blocks loaded in a row, each after the previous
+	pending []*prefetch    // the blocks after the current one, in order
+	reads   sync.WaitGroup // every read started, dropped ones included
+}
+
+// prefetch is a block read in the background.
+type prefetch struct {
+	block int
+	done  chan struct{} // closed once data and err are set
+	data  []byte
+	err   error
+}
+
+// load returns block i of r for an iterator on block cur. A block read
+// ahead is taken as it is; any other load drops what was read ahead, since
+// the scan moved elsewhere.
+func (ra *readahead) load(r *Reader, i, cur int) ([]byte, error) {
+	if i == cur+1 {
+		ra.seq++
+	} else if i != cur {
+		ra.seq = 0
+	}
+	var p *prefetch
+	if len(ra.pending) > 0 && ra.pending[0].block == i {
+		p, ra.pending = ra.pending[0], ra.pending[1:]
+	} else {
+		ra.pending = nil
+	}
+	if ra.seq >= readaheadAfter {
+		ra.fill(r, i)
+	}
+	if p == nil {
+		return r.cachedBlock(i)
+	}
+	<-p.done
+	return p.data, p.err
+}
+
+// wait waits for every read started, including those a seek dropped, and
+// drops the blocks read ahead.
+func (ra *readahead) wait() {
+	ra.reads.Wait()
+	ra.pending = nil
+}
+
+// fill starts reading the blocks after i that are not yet pending, up to
+// ra.max of them. Reads go through the block cache like the iterator's own.
+func (ra *readahead) fill(r *Reader, i int) {
+	next := i + 1
+	if n := len(ra.pending); n > 0 {
+		next = ra.pending[n-1].block + 1
+	}
+	for ; len(ra.pending) < ra.max && next < r.numBlocks(); next++ {
+		p := &prefetch{block: next, done: make(chan struct{})}
+		ra.pending = append(ra.pending, p)
+		ra.reads.Add(1)
+		go func() {
+			defer ra.reads.Done()
+			p.data, p.err = r.cachedBlock(p.block)
+			close(p.done)
+		}()
+	}
+}
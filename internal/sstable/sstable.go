@@ -4,25 +4,57 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/return2faye/SiltKV/internal/memtable"
 	"github.com/return2faye/SiltKV/internal/utils"
 )
 
 const (
-	maxSSTableKeySize   = 128        // 128B - maximum key size for SSTable
-	maxSSTableValueSize = 4 * 1024   // 4KB - maximum value size for SSTable
+	maxSSTableKeySize   = 1 << 20    // 1MB - maximum key size for SSTable, as wal.KeySizeLimit
+	maxSSTableValueSize = 4 << 20    // 4MB - maximum value size for SSTable, as wal.ValueSizeLimit
 	maxSSTableFileSize  = 64 << 20   // 64MB - maximum size for a single SSTable file
+	maxBloomFilterSize  = 16 << 20   // 16MB - larger filter sections are ignored
+
+	// defaultBloomBitsPerKey is the filter strength WriterOptions defaults
+	// to, whatever the number of keys.
+	defaultBloomBitsPerKey = 10
 )
 
 var (
 	// ErrCorruptSSTable is returned when an SSTable file has an invalid layout
 	// (e.g. missing or malformed footer, invalid offsets, etc.).
 	ErrCorruptSSTable = errors.New("sstable: corrupt file")
+	// ErrChecksumMismatch is returned when a block's contents don't match
+	// the CRC32C stored in its trailer.
+	ErrChecksumMismatch = errors.New("sstable: block checksum mismatch")
+	// ErrFileChecksumMismatch is returned by VerifyChecksums when the file
+	// does not match the CRC32C stored in its footer.
+	ErrFileChecksumMismatch = errors.New("sstable: file checksum mismatch")
+	// ErrUnsupportedFormat is returned for a table written in a format
+	// newer than FormatVersion, which this package cannot read.
+	ErrUnsupportedFormat = errors.New("sstable: unsupported format version")
+	// ErrCorruptFooter is returned, with the file path, when a table's
+	// footer cannot be read or points outside the file. It wraps
+	// ErrCorruptSSTable.
+	ErrCorruptFooter = fmt.Errorf("%w: bad footer", ErrCorruptSSTable)
+	// ErrCorruptBlock is returned, with the file path and offset, for a
+	// data block that is cut short, fails its checksum, does not decompress
+	// or holds a malformed record. It wraps ErrCorruptSSTable; checksum
+	// failures wrap ErrChecksumMismatch as well.
+	ErrCorruptBlock = fmt.Errorf("%w: bad block", ErrCorruptSSTable)
 )
 
+// crcTable is the CRC32C (Castagnoli) table used for block checksums.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // MaxSSTableFileSize returns the maximum size for a single SSTable file.
 func MaxSSTableFileSize() int64 {
 	return maxSSTableFileSize
@@ -39,24 +71,105 @@ type Table struct {
 type Writer struct {
 	file            *os.File
 	fileSize        int64
-	blockIndex      *BlockIndex  // Block index for sparse indexing
-	bloomFilter     *BloomFilter // Bloom filter for fast key existence check
-	currentBlock    []byte       // Current block buffer being written
-	blockOffset     int64        // Starting offset of the current block
-	firstKeyInBlock []byte       // First key in the current block (for block start)
-	lastKeyInBlock  []byte       // Last key in the current block (for sparse index)
+	blockIndex      *BlockIndex // Block index for sparse indexing
+	currentBlock    []byte      // Current block buffer being written
+	blockOffset     int64       // Starting offset of the current block
+	firstKeyInBlock []byte      // First key in the current block (for block start)
+	lastKeyInBlock  []byte      // Last key in the current block (for sparse index)
+	blockCount      uint32      // Records in the current block
+	restarts        []uint32    // Offsets of the restart points in the current block
+	cmp             Comparator  // Derives block index keys
+
+	// The index entry of the last flushed block waits for the first key of
+	// the next block, so that it can hold a short separator between the two.
+	pendingEntry *BlockIndexEntry
+
+	rangeDels []memtable.RangeTombstone // Range tombstones, written on Close
+	props     map[string]string         // Table properties, written on Close
+
+	numEntries   uint64 // records written, tombstones included
+	numDeletions uint64 // point tombstones written
+	smallestKey  []byte // first key written
+	rawDataSize  uint64 // data block bytes before compression
+	dataSize     uint64 // data block bytes as written, trailers included
+	creationTime time.Time
+	checksum     uint32 // CRC32C of everything written so far
+
+	bloomBitsPerKey int         // see WriterOptions
+	beforeWrite     func(int)   // see WriterOptions
+	compression     Compression // see WriterOptions
+	compressed      []byte      // reused output buffer of compressBlock
+	keyHashes       []uint64    // bloomHash of every key, when bloomBitsPerKey > 0
+	partitioned     bool        // see WriterOptions.PartitionedFilters
+	blockHashEnds   []int       // per flushed block, the keys up to its end
+	partitionIndex  bool        // see WriterOptions.PartitionedIndex
+}
+
+// WriterOptions configures a Writer. The zero value gives the defaults.
+type WriterOptions struct {
+	// BloomBitsPerKey sizes the bloom filter at this many bits per key:
+	// more bits mean fewer wasted block reads for absent keys, at the cost
+	// of memory in every open Reader. The filter is built on Close, sized
+	// for the keys actually written. Zero uses 10 bits per key; a negative
+	// value writes no filter at all.
+	BloomBitsPerKey int
+
+	// PartitionedFilters writes one bloom filter per data block instead of
+	// one for the whole table. A Reader then keeps only their offsets in
+	// memory and reads the filter of a block, through the block cache, when
+	// a lookup gets to it: large tables open fast and cost little memory,
+	// but a lookup that misses the cache reads the filter as well.
+	PartitionedFilters bool
+
+	// PartitionedIndex splits a block index larger than BlockSize into
+	// partitions of about that size under a small top-level index. A
+	// Reader then decodes only the top level at open and reads a
+	// partition, through the block cache, when a lookup or iterator gets
+	// to it: tables with many blocks open fast and cost little memory, but
+	// a lookup that misses the cache reads a partition as well.
+	PartitionedIndex bool
+
+	// BeforeWrite, if set, is called with the size of each data block
+	// before it is written. Rate limiters use it to pace background writes.
+	BeforeWrite func(n int)
+
+	// Compression compresses each data block on its own, so that a lookup
+	// only decompresses the block it reads. Blocks that barely shrink are
+	// stored uncompressed.
+	Compression Compression
+
+	// CreationTime is recorded as PropCreationTime. The zero value uses the
+	// time the Writer is created.
+	CreationTime time.Time
 }
 
 func NewWriter(path string) (*Writer, error) {
+	return NewWriterWithOptions(path, WriterOptions{})
+}
+
+// NewWriterWithOptions is NewWriter with explicit options.
+func NewWriterWithOptions(path string, opts WriterOptions) (*Writer, error) {
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 	if err != nil {
 		return nil, err
 	}
+	if opts.CreationTime.IsZero() {
+		opts.CreationTime = time.Now()
+	}
+	if opts.BloomBitsPerKey == 0 {
+		opts.BloomBitsPerKey = defaultBloomBitsPerKey
+	}
 	return &Writer{
+		creationTime:    opts.CreationTime,
+		bloomBitsPerKey: opts.BloomBitsPerKey,
+		partitioned:     opts.PartitionedFilters,
+		partitionIndex:  opts.PartitionedIndex,
+		beforeWrite:     opts.BeforeWrite,
+		compression:     opts.Compression,
+		cmp:             BytewiseComparator,
 		file:            f,
 		fileSize:        0,
 		blockIndex:      &BlockIndex{Entries: make([]BlockIndexEntry, 0)},
-		bloomFilter:     nil, // Will be initialized later
 		currentBlock:    make([]byte, 0, BlockSize),
 		blockOffset:     0,
 		firstKeyInBlock: nil,
@@ -73,60 +186,119 @@ func (w *Writer) flushCurrentBlock() error {
 	// Record the starting offset of the block
 	blockOffset := w.fileSize
 
-	// Write the block to the file
-	if _, err := w.file.Write(w.currentBlock); err != nil {
+	// End the records with the restart points
+	for _, off := range w.restarts {
+		w.currentBlock = binary.LittleEndian.AppendUint32(w.currentBlock, off)
+	}
+	w.currentBlock = binary.LittleEndian.AppendUint32(w.currentBlock, uint32(len(w.restarts)))
+
+	data, kind := compressBlock(w.compression, w.currentBlock, w.compressed)
+	if kind != NoCompression {
+		w.compressed = data
+	}
+	if w.beforeWrite != nil {
+		w.beforeWrite(len(data) + compressedTrailerSize)
+	}
+
+	// Write the block followed by its trailer: the compression used and a
+	// CRC32C of both
+	trailer := make([]byte, compressedTrailerSize)
+	trailer[0] = byte(kind)
+	crc := crc32.Update(crc32.Checksum(data, crcTable), crcTable, trailer[:1])
+	binary.LittleEndian.PutUint32(trailer[1:], crc)
+	if _, err := w.write(data); err != nil {
 		return err
 	}
+	if _, err := w.write(trailer); err != nil {
+		return err
+	}
+
+	// Every key of the block is in keyHashes by now; the next one's hash may
+	// be as well, so the count of records tells where the block ends.
+	if w.partitioned {
+		w.blockHashEnds = append(w.blockHashEnds, int(w.numEntries))
+	}
 
-	// Add this block's last key to the sparse index (last key is better for lookup)
+	// Hold this block's index entry back until the next block starts
 	if w.lastKeyInBlock != nil {
-		w.blockIndex.Add(w.lastKeyInBlock, blockOffset)
+		w.pendingEntry = &BlockIndexEntry{LastKey: w.lastKeyInBlock, Offset: blockOffset, Count: w.blockCount}
 	}
 
 	// Update file size
-	w.fileSize += int64(len(w.currentBlock))
+	w.fileSize += int64(len(data)) + compressedTrailerSize
+	w.rawDataSize += uint64(len(w.currentBlock))
+	w.dataSize += uint64(len(data)) + compressedTrailerSize
 
 	// Reset current block (preserve capacity)
 	w.currentBlock = w.currentBlock[:0]
 	w.firstKeyInBlock = nil
 	w.lastKeyInBlock = nil
+	w.blockCount = 0
+	w.restarts = w.restarts[:0]
 	w.blockOffset = w.fileSize
 
 	return nil
 }
 
+// write appends p to the file and to the running file checksum.
+func (w *Writer) write(p []byte) (int, error) {
+	w.checksum = crc32.Update(w.checksum, crcTable, p)
+	return w.file.Write(p)
+}
+
 // writeRecordToBlock writes a record to the current block
-// Returns true if the block is full and needs to be flushed
+// Returns true if the previous block was full and had to be flushed first
 func (w *Writer) writeRecordToBlock(key, value []byte) (bool, error) {
-	klen := uint32(len(key))
 	vlen := uint32(len(value))
-	recordSize := 8 + len(key) + len(value)
-
-	if w.firstKeyInBlock == nil {
-		w.firstKeyInBlock = utils.CopyBytes(key)
-	}
-	// Always update last key in block (used for sparse index)
-	w.lastKeyInBlock = utils.CopyBytes(key)
+	// At most: the full key, and one more restart point
+	recordSize := 2 + uvarintLen(uint64(len(key))) + uvarintLen(uint64(len(value))) + len(key) + len(value) + 4
+	restartsSize := 4*len(w.restarts) + 4
 
 	// Check if the record can fit in the current block
-	if len(w.currentBlock)+recordSize > BlockSize && len(w.currentBlock) > 0 {
-		// Block is full, need to flush
+	flushed := false
+	if len(w.currentBlock)+restartsSize+recordSize > BlockSize && len(w.currentBlock) > 0 {
+		// Block is full, flush it and start the record in a fresh block
 		if err := w.flushCurrentBlock(); err != nil {
 			return false, err
 		}
-		return true, nil
+		flushed = true
 	}
 
-	// Write the record to the block buffer
-	header := make([]byte, 8)
-	binary.LittleEndian.PutUint32(header[0:4], klen)
-	binary.LittleEndian.PutUint32(header[4:8], vlen)
-
-	w.currentBlock = append(w.currentBlock, header...)
-	w.currentBlock = append(w.currentBlock, key...)
+	if w.smallestKey == nil {
+		w.smallestKey = utils.CopyBytes(key)
+	}
+	if w.firstKeyInBlock == nil {
+		w.firstKeyInBlock = utils.CopyBytes(key)
+		if e := w.pendingEntry; e != nil {
+			// Any key from the previous block's last key up to, but not
+			// including, this one sends lookups to the previous block.
+			w.blockIndex.Add(w.cmp.Separator(e.LastKey, key), e.Offset, e.Count)
+			w.pendingEntry = nil
+		}
+	}
+	// Write the record to the block buffer, with the part of the key it
+	// shares with the previous one left out except at restart points
+	shared := 0
+	if w.blockCount%restartInterval == 0 {
+		w.restarts = append(w.restarts, uint32(len(w.currentBlock)))
+	} else {
+		shared = sharedPrefixLen(w.lastKeyInBlock, key)
+	}
+	w.currentBlock = binary.AppendUvarint(w.currentBlock, uint64(shared))
+	w.currentBlock = binary.AppendUvarint(w.currentBlock, uint64(len(key)-shared))
+	w.currentBlock = binary.AppendUvarint(w.currentBlock, uint64(vlen))
+	w.currentBlock = append(w.currentBlock, key[shared:]...)
 	w.currentBlock = append(w.currentBlock, value...)
 
-	return false, nil
+	// Always update last key in block (used for sparse index)
+	w.lastKeyInBlock = utils.CopyBytes(key)
+	w.blockCount++
+	w.numEntries++
+	if vlen == 0 {
+		w.numDeletions++
+	}
+
+	return flushed, nil
 }
 
 func (w *Writer) Close() error {
@@ -134,45 +306,90 @@ func (w *Writer) Close() error {
 		return nil
 	}
 
-	// 1. Flush remaining block
+	// 1. Flush remaining block; the final index entry keeps its exact last
+	// key, which Reader.Bounds reports as the largest key
 	if err := w.flushCurrentBlock(); err != nil {
 		return err
 	}
+	if e := w.pendingEntry; e != nil {
+		w.blockIndex.Add(e.LastKey, e.Offset, e.Count)
+		w.pendingEntry = nil
+	}
 
 	// 2. Write Block Index
-	blockIndexData := w.blockIndex.Serialize()
+	var blockIndexData []byte
+	if w.partitionIndex {
+		blockIndexData = w.blockIndex.serializePartitioned()
+	} else {
+		blockIndexData = w.blockIndex.Serialize()
+	}
 	blockIndexOffset := w.fileSize
-	if _, err := w.file.Write(blockIndexData); err != nil {
+	if _, err := w.write(blockIndexData); err != nil {
 		return err
 	}
 	blockIndexSize := int64(len(blockIndexData))
 	w.fileSize += blockIndexSize
 
-	// 3. Write Bloom Filter
-	if w.bloomFilter == nil {
-		// If there's no data, create an empty Bloom Filter
-		w.bloomFilter = NewBloomFilter(1, 0.01)
+	// 3. Write Bloom Filter (an empty section when disabled)
+	var bloomFilterData []byte
+	switch {
+	case w.bloomBitsPerKey > 0 && w.partitioned:
+		bloomFilterData = buildPartitionedFilter(w.keyHashes, w.blockHashEnds, w.bloomBitsPerKey)
+	case w.bloomBitsPerKey > 0:
+		bloomFilterData = newBloomFilterFromHashes(w.keyHashes, w.bloomBitsPerKey).Bytes()
 	}
-	bloomFilterData := w.bloomFilter.Bytes()
 	bloomFilterOffset := w.fileSize
-	if _, err := w.file.Write(bloomFilterData); err != nil {
+	if _, err := w.write(bloomFilterData); err != nil {
 		return err
 	}
 	w.fileSize += int64(len(bloomFilterData))
 
-	// 4. Write Footer
+	// 4. Write Range Tombstones
+	rangeDelData := serializeRangeTombstones(w.rangeDels)
+	rangeDelOffset := w.fileSize
+	if _, err := w.write(rangeDelData); err != nil {
+		return err
+	}
+	w.fileSize += int64(len(rangeDelData))
+
+	// 5. Write Properties, which run up to the footer
+	w.SetProperty(PropNumEntries, strconv.FormatUint(w.numEntries, 10))
+	w.SetProperty(PropNumDeletions, strconv.FormatUint(w.numDeletions, 10))
+	w.SetProperty(PropRawDataSize, strconv.FormatUint(w.rawDataSize, 10))
+	w.SetProperty(PropDataSize, strconv.FormatUint(w.dataSize, 10))
+	w.SetProperty(PropCreationTime, strconv.FormatInt(w.creationTime.UnixNano(), 10))
+	if entries := w.blockIndex.Entries; len(entries) > 0 {
+		w.SetProperty(PropSmallestKey, string(w.smallestKey))
+		w.SetProperty(PropLargestKey, string(entries[len(entries)-1].LastKey))
+	}
+	propsData := serializeProperties(w.props)
+	if _, err := w.write(propsData); err != nil {
+		return err
+	}
+	w.fileSize += int64(len(propsData))
+
+	// 6. Write Footer
 	footer := &Footer{
 		BloomFilterOffset: bloomFilterOffset,
 		BlockIndexOffset:  blockIndexOffset,
 		BlockIndexSize:    blockIndexSize,
-		MagicNumber:       MagicNumber,
+		RangeDelOffset:    rangeDelOffset,
+		RangeDelSize:      int64(len(rangeDelData)),
+		FileChecksum:      w.checksum,
+		MagicNumber:       MagicNumberVersioned,
+		Version:           FormatVersion,
 	}
 	footerData := footer.Serialize()
-	if _, err := w.file.Write(footerData); err != nil {
+	if _, err := w.write(footerData); err != nil {
 		return err
 	}
 	w.fileSize += int64(len(footerData))
 
+	// 7. Sync, so that a table that closed without error survives a power
+	// failure. Making its directory entry durable is up to the caller.
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
 	err := w.file.Close()
 	w.file = nil
 	return err
@@ -185,18 +402,12 @@ func (w *Writer) WriteFromIterator(it *memtable.SLIterator) error {
 		return os.ErrInvalid
 	}
 
-	// Initialize Bloom Filter (estimate capacity)
-	if w.bloomFilter == nil {
-		w.bloomFilter = NewBloomFilter(10000, 0.01)
-	}
-
 	// Iterate through the iterator and write data
 	for it.Valid() {
 		key := it.Key()
 		val := it.Value()
 
-		// Add to Bloom Filter
-		w.bloomFilter.Add(key)
+		w.addToFilter(key)
 
 		// Write to block
 		_, err := w.writeRecordToBlock(key, val)
@@ -210,6 +421,14 @@ func (w *Writer) WriteFromIterator(it *memtable.SLIterator) error {
 	return nil
 }
 
+// addToFilter records key for the bloom filter, which Close builds once
+// the number of keys is known.
+func (w *Writer) addToFilter(key []byte) {
+	if w.bloomBitsPerKey > 0 {
+		w.keyHashes = append(w.keyHashes, bloomHash(key))
+	}
+}
+
 // Write writes a single key-value pair to the SSTable.
 // Returns the current file size after write.
 func (w *Writer) Write(key, value []byte) (int64, error) {
@@ -217,13 +436,7 @@ func (w *Writer) Write(key, value []byte) (int64, error) {
 		return 0, os.ErrInvalid
 	}
 
-	// Initialize Bloom Filter (if not already initialized)
-	if w.bloomFilter == nil {
-		w.bloomFilter = NewBloomFilter(1000, 0.01)
-	}
-
-	// Add to Bloom Filter
-	w.bloomFilter.Add(key)
+	w.addToFilter(key)
 
 	// Write to block
 	_, err := w.writeRecordToBlock(key, value)
@@ -234,6 +447,45 @@ func (w *Writer) Write(key, value []byte) (int64, error) {
 	return w.fileSize, nil
 }
 
+// AddRangeTombstone records a range tombstone covering [start, end).
+// It hides entries in older tables only; point entries written to this
+// table must be newer than the tombstone.
+func (w *Writer) AddRangeTombstone(start, end []byte) {
+	w.rangeDels = append(w.rangeDels, memtable.RangeTombstone{
+		Start: utils.CopyBytes(start),
+		End:   utils.CopyBytes(end),
+	})
+}
+
+// Properties every Writer records, so that compaction can tell how much of a
+// table is tombstones, and readers which keys it holds, without reading it.
+const (
+	// PropNumEntries is the number of records, point tombstones included.
+	PropNumEntries = "siltkv.num_entries"
+	// PropNumDeletions is the number of point tombstones.
+	PropNumDeletions = "siltkv.num_deletions"
+	// PropSmallestKey and PropLargestKey are the first and last keys of the
+	// records, tombstones included; range tombstones are not taken into
+	// account. Tables without records have neither.
+	PropSmallestKey = "siltkv.smallest_key"
+	PropLargestKey  = "siltkv.largest_key"
+	// PropRawDataSize is the size of the data blocks before compression,
+	// and PropDataSize their size in the file.
+	PropRawDataSize = "siltkv.raw_data_size"
+	PropDataSize    = "siltkv.data_size"
+	// PropCreationTime is when the table was written, in unix nanoseconds.
+	PropCreationTime = "siltkv.creation_time"
+)
+
+// SetProperty records a table property, replacing any earlier value for
+// name. Properties are free-form metadata that the table itself ignores.
+func (w *Writer) SetProperty(name, value string) {
+	if w.props == nil {
+		w.props = make(map[string]string)
+	}
+	w.props[name] = value
+}
+
 // Size returns the current file size.
 func (w *Writer) Size() int64 {
 	return w.fileSize
@@ -247,10 +499,50 @@ type Reader struct {
 	footer      *Footer
 	blockIndex  *BlockIndex
 	bloomFilter *BloomFilter
+	// With partitioned filters, the filter of block i ends filterEnds[i]
+	// bytes into the section at filterOffset, and bloomFilter is nil.
+	filterOffset int64
+	filterEnds   []uint32
+	rangeDels    []memtable.RangeTombstone
 	initialized bool
+
+	// With a partitioned block index, blockIndex is nil and indexTop is
+	// its top level: partition p covers blocks partFirst[p] up to
+	// partFirst[p+1] and starts indexTop.Entries[p].Offset bytes into the
+	// partsSize bytes of partitions at partsOffset.
+	indexTop    *BlockIndex
+	partFirst   []int
+	partsOffset int64
+	partsSize   int64
+	lastPart    atomic.Pointer[indexPartition] // the partition decoded last
+
+	// smallest and largest are PropSmallestKey and PropLargestKey, or nil
+	// for tables that do not record them.
+	smallest, largest []byte
+
+	bloomChecks    uint64 // atomic; lookups that consulted the bloom filter
+	bloomNegatives uint64 // atomic; lookups the bloom filter ruled out
+
+	id    uint64 // distinguishes this file's blocks in a shared cache
+	cache *BlockCache
+}
+
+// ReaderOptions configures a Reader. The zero value gives the defaults.
+type ReaderOptions struct {
+	// Cache, if set, holds data blocks read by Get and by iterators.
+	// One cache is normally shared by every Reader of a DB.
+	Cache *BlockCache
 }
 
+// nextReaderID hands out Reader ids for block cache keys.
+var nextReaderID uint64
+
 func NewReader(path string) (*Reader, error) {
+	return NewReaderWithOptions(path, ReaderOptions{})
+}
+
+// NewReaderWithOptions is NewReader with explicit options.
+func NewReaderWithOptions(path string, opts ReaderOptions) (*Reader, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -267,6 +559,8 @@ func NewReader(path string) (*Reader, error) {
 		fileSize:    stat.Size(),
 		path:        path,
 		initialized: false,
+		id:          atomic.AddUint64(&nextReaderID, 1),
+		cache:       opts.Cache,
 	}
 
 	// Initialize metadata (footer, block index, bloom filter)
@@ -285,20 +579,27 @@ func (r *Reader) initialize() error {
 	}
 
 	// All SSTables are required to use the new format with footer/index/bloom.
-	// A valid file must be at least 32 bytes to hold the footer.
-	if r.fileSize < 32 {
-		return ErrCorruptSSTable
+	// A valid file must be at least 32 bytes to hold the (legacy) footer.
+	if r.fileSize < legacyFooterSize {
+		return fmt.Errorf("%w: %s", ErrCorruptFooter, r.path)
 	}
 
-	// Read footer (last 32 bytes).
-	footerData := make([]byte, 32)
-	if _, err := r.file.ReadAt(footerData, r.fileSize-32); err != nil {
-		return ErrCorruptSSTable
+	// Read footer (up to the last 56 bytes; the magic number tells the size).
+	footerLen := int64(FooterSize)
+	if r.fileSize < footerLen {
+		footerLen = r.fileSize
+	}
+	footerData := make([]byte, footerLen)
+	if _, err := r.file.ReadAt(footerData, r.fileSize-footerLen); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrCorruptFooter, r.path, err)
 	}
 
 	footer, err := DeserializeFooter(footerData)
+	if errors.Is(err, ErrUnsupportedFormat) {
+		return fmt.Errorf("%w: %s", err, r.path)
+	}
 	if err != nil {
-		return ErrCorruptSSTable
+		return fmt.Errorf("%w: %s", ErrCorruptFooter, r.path)
 	}
 	r.footer = footer
 
@@ -306,49 +607,403 @@ func (r *Reader) initialize() error {
 	if footer.BlockIndexOffset < 0 || footer.BlockIndexSize < 0 ||
 		footer.BloomFilterOffset < 0 || footer.BlockIndexOffset > r.fileSize ||
 		footer.BloomFilterOffset > r.fileSize {
+		return fmt.Errorf("%w: %s", ErrCorruptFooter, r.path)
+	}
+
+	// Read block index. Only V1 tables may lack one and be read record by
+	// record; every later Writer wrote an index, so for them a missing one
+	// is corruption rather than a reason to scan.
+	switch {
+	case footer.BlockIndexSize > 0 && footer.BlockIndexOffset+footer.BlockIndexSize <= r.fileSize-footer.Size():
+		if err := r.loadIndex(footer.BlockIndexOffset, footer.BlockIndexSize); err != nil {
+			return err
+		}
+	case footer.Version > 1:
 		return ErrCorruptSSTable
 	}
 
-	// Read block index
-	if footer.BlockIndexSize > 0 && footer.BlockIndexOffset+footer.BlockIndexSize <= r.fileSize {
-		blockIndexData := make([]byte, footer.BlockIndexSize)
-		if _, err := r.file.ReadAt(blockIndexData, footer.BlockIndexOffset); err != nil {
-			return ErrCorruptSSTable
+	// Read bloom filter. The Writer puts it right after the block index,
+	// ending at the range tombstones or the footer; older layouts had it in
+	// front of the index. An empty section means the table has no filter.
+	bloomEnd := footer.BlockIndexOffset
+	if footer.BloomFilterOffset >= footer.BlockIndexOffset {
+		bloomEnd = r.fileSize - footer.Size()
+		if footer.RangeDelOffset >= footer.BloomFilterOffset {
+			bloomEnd = footer.RangeDelOffset
 		}
+	}
+	bloomFilterSize := bloomEnd - footer.BloomFilterOffset
+	if err := r.loadFilter(footer.BloomFilterOffset, bloomFilterSize); err != nil {
+		return err
+	}
 
-		blockIndex, err := DeserializeBlockIndex(blockIndexData)
+	// Read range tombstones
+	if footer.RangeDelSize > 0 {
+		if footer.RangeDelOffset < 0 || footer.RangeDelOffset+footer.RangeDelSize > r.fileSize-footer.Size() {
+			return ErrCorruptSSTable
+		}
+		rangeDelData := make([]byte, footer.RangeDelSize)
+		if _, err := r.file.ReadAt(rangeDelData, footer.RangeDelOffset); err != nil {
+			return ErrCorruptSSTable
+		}
+		rangeDels, err := deserializeRangeTombstones(rangeDelData)
 		if err != nil {
 			return ErrCorruptSSTable
 		}
-		r.blockIndex = blockIndex
+		r.rangeDels = rangeDels
 	}
 
-	// Read bloom filter
-	if footer.BloomFilterOffset < footer.BlockIndexOffset {
-		bloomFilterSize := footer.BlockIndexOffset - footer.BloomFilterOffset
-		if bloomFilterSize > 0 && bloomFilterSize < 1024*1024 { // Sanity check: max 1MB
-			bloomFilterData := make([]byte, bloomFilterSize)
-			if _, err := r.file.ReadAt(bloomFilterData, footer.BloomFilterOffset); err != nil {
+	// Read the key bounds. Properties are only metadata: a table whose
+	// properties cannot be read is served without them.
+	if props, err := r.Properties(); err == nil {
+		smallest, ok1 := props[PropSmallestKey]
+		largest, ok2 := props[PropLargestKey]
+		if ok1 && ok2 {
+			r.smallest, r.largest = []byte(smallest), []byte(largest)
+		}
+	}
+
+	r.initialized = true
+	return nil
+}
+
+// loadIndex reads the block index section of size bytes at offset: the
+// whole index, or only the top level of a partitioned one.
+func (r *Reader) loadIndex(offset, size int64) error {
+	if r.footer.HasPartitionedIndex() && size >= 8 {
+		header := make([]byte, 8)
+		if _, err := r.file.ReadAt(header, offset); err != nil {
+			return ErrCorruptSSTable
+		}
+		if binary.LittleEndian.Uint32(header[0:4]) == partitionedIndexMarker {
+			topSize := int64(binary.LittleEndian.Uint32(header[4:8]))
+			if 8+topSize > size {
 				return ErrCorruptSSTable
 			}
-
-			bloomFilter, err := LoadBloomFilter(bloomFilterData)
+			data := make([]byte, topSize)
+			if _, err := r.file.ReadAt(data, offset+8); err != nil {
+				return ErrCorruptSSTable
+			}
+			top, err := deserializePrefixBlockIndex(data)
 			if err != nil {
 				return ErrCorruptSSTable
 			}
-			r.bloomFilter = bloomFilter
+			partsSize := size - 8 - topSize
+			first := make([]int, len(top.Entries)+1)
+			for p, e := range top.Entries {
+				end := partsSize
+				if p+1 < len(top.Entries) {
+					end = top.Entries[p+1].Offset
+				}
+				if e.Count == 0 || e.Offset >= end {
+					return ErrCorruptSSTable
+				}
+				first[p+1] = first[p] + int(e.Count)
+			}
+			r.indexTop, r.partFirst = top, first
+			r.partsOffset, r.partsSize = offset+8+topSize, partsSize
+			return nil
 		}
 	}
 
-	r.initialized = true
+	data := make([]byte, size)
+	if _, err := r.file.ReadAt(data, offset); err != nil {
+		return ErrCorruptSSTable
+	}
+	blockIndex, err := deserializeBlockIndex(data, r.footer.Version)
+	if err != nil {
+		return ErrCorruptSSTable
+	}
+	r.blockIndex = blockIndex
 	return nil
 }
 
+// hasBlockIndex reports whether the table has a block index, whole or
+// partitioned.
+func (r *Reader) hasBlockIndex() bool {
+	return r.blockIndex != nil || r.indexTop != nil
+}
+
+// numBlocks returns the number of data blocks in the block index.
+func (r *Reader) numBlocks() int {
+	switch {
+	case r.indexTop != nil:
+		return r.partFirst[len(r.partFirst)-1]
+	case r.blockIndex != nil:
+		return len(r.blockIndex.Entries)
+	}
+	return 0
+}
+
+// findBlock is BlockIndex.FindBlockIndex over the whole index, whose
+// partition, if any, it reads.
+func (r *Reader) findBlock(key []byte) (int, error) {
+	if r.indexTop == nil {
+		return r.blockIndex.FindBlockIndex(key), nil
+	}
+	p := r.indexTop.FindBlockIndex(key)
+	if p < 0 {
+		return -1, nil
+	}
+	part, err := r.indexPartition(p)
+	if err != nil {
+		return -1, err
+	}
+	i := part.FindBlockIndex(key)
+	if i < 0 {
+		// The top level promised a block for the key
+		return -1, fmt.Errorf("%w: %s index partition %d", ErrCorruptSSTable, r.path, p)
+	}
+	return r.partFirst[p] + i, nil
+}
+
+// blockEntry returns the index entry of block i.
+func (r *Reader) blockEntry(i int) (BlockIndexEntry, error) {
+	if r.indexTop == nil {
+		return r.blockIndex.Entries[i], nil
+	}
+	p := sort.SearchInts(r.partFirst, i+1) - 1
+	part, err := r.indexPartition(p)
+	if err != nil {
+		return BlockIndexEntry{}, err
+	}
+	return part.Entries[i-r.partFirst[p]], nil
+}
+
+// indexPartition is a decoded partition of the block index.
+type indexPartition struct {
+	p     int
+	index *BlockIndex
+}
+
+// indexPartition returns partition p of the block index, read through the
+// block cache, if any, under the block number -1-numBlocks-p, below those
+// of the filter partitions. The partition decoded last is kept, so that
+// walking the blocks of a partition decodes it once.
+func (r *Reader) indexPartition(p int) (*BlockIndex, error) {
+	if last := r.lastPart.Load(); last != nil && last.p == p {
+		return last.index, nil
+	}
+	var data []byte
+	k := blockKey{file: r.id, block: -1 - r.numBlocks() - p}
+	if r.cache != nil {
+		data, _ = r.cache.get(k)
+	}
+	if data == nil {
+		start, end := r.indexTop.Entries[p].Offset, r.partsSize
+		if p+1 < len(r.indexTop.Entries) {
+			end = r.indexTop.Entries[p+1].Offset
+		}
+		data = make([]byte, end-start)
+		if _, err := r.file.ReadAt(data, r.partsOffset+start); err != nil {
+			return nil, fmt.Errorf("%w: %s index partition %d: %v", ErrCorruptSSTable, r.path, p, err)
+		}
+		if r.cache != nil {
+			r.cache.add(k, data)
+		}
+	}
+	index, err := deserializePrefixBlockIndex(data)
+	if err == nil && len(index.Entries) != int(r.indexTop.Entries[p].Count) {
+		err = errors.New("wrong number of blocks")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s index partition %d: %v", ErrCorruptSSTable, r.path, p, err)
+	}
+	r.lastPart.Store(&indexPartition{p: p, index: index})
+	return index, nil
+}
+
+// loadFilter reads the bloom filter section of size bytes at offset: the
+// whole filter, or only the partition offsets of a partitioned one. An
+// empty section, or a full filter beyond maxBloomFilterSize, leaves the
+// table without a filter.
+func (r *Reader) loadFilter(offset, size int64) error {
+	if size < 8 {
+		return nil
+	}
+	header := make([]byte, 8)
+	if _, err := r.file.ReadAt(header, offset); err != nil {
+		return ErrCorruptSSTable
+	}
+	if r.footer.HasPartitionedFilters() && binary.LittleEndian.Uint32(header[0:4]) == partitionedFilterMarker {
+		count := int64(binary.LittleEndian.Uint32(header[4:8]))
+		if !r.hasBlockIndex() || count != int64(r.numBlocks()) || 8+4*count > size {
+			return ErrCorruptSSTable
+		}
+		index := make([]byte, 4*count)
+		if _, err := r.file.ReadAt(index, offset+8); err != nil {
+			return ErrCorruptSSTable
+		}
+		ends := make([]uint32, count)
+		prev := uint32(8 + 4*count)
+		for i := range ends {
+			ends[i] = binary.LittleEndian.Uint32(index[4*i:])
+			if ends[i] < prev || int64(ends[i]) > size {
+				return ErrCorruptSSTable
+			}
+			prev = ends[i]
+		}
+		r.filterOffset, r.filterEnds = offset, ends
+		return nil
+	}
+
+	if size >= maxBloomFilterSize { // Sanity check
+		return nil
+	}
+	data := make([]byte, size)
+	if _, err := r.file.ReadAt(data, offset); err != nil {
+		return ErrCorruptSSTable
+	}
+	bloomFilter, err := LoadBloomFilter(data, !r.footer.HasDoubleHashBloom())
+	if err != nil {
+		return ErrCorruptSSTable
+	}
+	r.bloomFilter = bloomFilter
+	return nil
+}
+
+// blockMayContain checks key against the partitioned filter of block i,
+// read through the block cache, if any, under the negative block number
+// -1-i.
+func (r *Reader) blockMayContain(i int, key []byte) (bool, error) {
+	var data []byte
+	k := blockKey{file: r.id, block: -1 - i}
+	if r.cache != nil {
+		data, _ = r.cache.get(k)
+	}
+	if data == nil {
+		start := uint32(8 + 4*len(r.filterEnds))
+		if i > 0 {
+			start = r.filterEnds[i-1]
+		}
+		data = make([]byte, r.filterEnds[i]-start)
+		if _, err := r.file.ReadAt(data, r.filterOffset+int64(start)); err != nil {
+			return false, fmt.Errorf("%w: %s filter of block %d: %v", ErrCorruptSSTable, r.path, i, err)
+		}
+		if r.cache != nil {
+			r.cache.add(k, data)
+		}
+	}
+	bf, err := parseBloomFilter(data, false)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s filter of block %d: %v", ErrCorruptSSTable, r.path, i, err)
+	}
+	return bf.MayContain(key), nil
+}
+
 // Path returns the file path of this SSTable.
 func (r *Reader) Path() string {
 	return r.path
 }
 
+// RangeTombstones returns the range tombstones stored in this SSTable.
+func (r *Reader) RangeTombstones() []memtable.RangeTombstone {
+	return r.rangeDels
+}
+
+// Footer returns a copy of the table's footer.
+func (r *Reader) Footer() Footer {
+	return *r.footer
+}
+
+// Properties reads the table properties: the Prop* values every Writer
+// records, such as the key bounds and record counts, and those set with
+// SetProperty, such as the compaction provenance of an LSM output file.
+// Tables written before V6 have none, and older tables only some. The
+// section is read from disk on every call; it is meant for tools and
+// debugging.
+func (r *Reader) Properties() (map[string]string, error) {
+	if !r.footer.HasProperties() {
+		return map[string]string{}, nil
+	}
+	start := r.footer.RangeDelOffset + r.footer.RangeDelSize
+	end := r.fileSize - r.footer.Size()
+	if start < 0 || start > end {
+		return nil, ErrCorruptSSTable
+	}
+	data := make([]byte, end-start)
+	if _, err := r.file.ReadAt(data, start); err != nil {
+		return nil, ErrCorruptSSTable
+	}
+	props, err := deserializeProperties(data)
+	if err != nil {
+		return nil, ErrCorruptSSTable
+	}
+	return props, nil
+}
+
+// Bounds returns copies of the smallest and largest keys in the table,
+// tombstones included, or nils if it holds no records. Range tombstones
+// are not taken into account. They come from the table properties; for
+// tables that do not record them, the block index gives the largest key
+// and the first record header the smallest, so this reads a few bytes of
+// the file, or the first block if it may be compressed, and bypasses the
+// block cache.
+func (r *Reader) Bounds() (smallest, largest []byte, err error) {
+	if r.largest != nil {
+		return utils.CopyBytes(r.smallest), utils.CopyBytes(r.largest), nil
+	}
+	n := r.numBlocks()
+	if n == 0 {
+		// No index to consult; walk the records.
+		it := r.NewIterator()
+		for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+			if smallest == nil {
+				smallest = utils.CopyBytes(it.Key())
+			}
+			largest = it.Key()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return smallest, utils.CopyBytes(largest), nil
+	}
+
+	first, err := r.blockEntry(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	last, err := r.blockEntry(n - 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	largest = utils.CopyBytes(last.LastKey)
+	if r.footer.HasBlockCompression() {
+		// The first record may be compressed; read its whole block.
+		block, err := r.readBlock(0, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		var bi blockIter
+		if err := bi.init(block, r.footer.HasPrefixRecords()); err != nil {
+			return nil, nil, err
+		}
+		if !bi.first() {
+			return nil, nil, ErrCorruptSSTable
+		}
+		return utils.CopyBytes(bi.key), largest, nil
+	}
+	header := make([]byte, 8)
+	if _, err := r.file.ReadAt(header, first.Offset); err != nil {
+		return nil, nil, ErrCorruptSSTable
+	}
+	klen := binary.LittleEndian.Uint32(header[0:4])
+	if klen > maxSSTableKeySize {
+		return nil, nil, ErrCorruptSSTable
+	}
+	smallest = make([]byte, klen)
+	if _, err := r.file.ReadAt(smallest, first.Offset+8); err != nil {
+		return nil, nil, ErrCorruptSSTable
+	}
+	return smallest, largest, nil
+}
+
+// IsRangeDeleted reports whether a range tombstone in this SSTable covers key.
+// Like in memtables, point entries of the same table take precedence.
+func (r *Reader) IsRangeDeleted(key []byte) bool {
+	return memtable.CoveredBy(r.rangeDels, key)
+}
+
 func (r *Reader) Close() error {
 	if r.file == nil {
 		return nil
@@ -358,7 +1013,51 @@ func (r *Reader) Close() error {
 	return err
 }
 
+// Get looks up key in the table. A tombstone is reported as found with a nil
+// value, so callers can stop searching older tables.
 func (r *Reader) Get(key []byte) ([]byte, bool, error) {
+	return r.GetTo(key, nil)
+}
+
+// GetTo is Get, but appends the value to dst and returns the extended
+// buffer. For a tombstone it returns nil, like Get; if key is absent it
+// returns dst unchanged.
+func (r *Reader) GetTo(key, dst []byte) ([]byte, bool, error) {
+	val, found, err := r.find(key)
+	if err != nil || !found {
+		return dst, found, err
+	}
+	if len(val) == 0 {
+		// Zero-length value is a tombstone
+		return nil, true, nil
+	}
+	return append(dst, val...), true, nil
+}
+
+// BloomStats returns how many lookups consulted the bloom filter and how many
+// of them it ruled out without reading a block.
+func (r *Reader) BloomStats() (checks, negatives uint64) {
+	return atomic.LoadUint64(&r.bloomChecks), atomic.LoadUint64(&r.bloomNegatives)
+}
+
+// Size returns the size of the SSTable file in bytes.
+func (r *Reader) Size() int64 {
+	return r.fileSize
+}
+
+// Exists reports whether the table holds an entry for key without copying
+// its value out of the block. deleted is true if that entry is a tombstone.
+func (r *Reader) Exists(key []byte) (found, deleted bool, err error) {
+	val, found, err := r.find(key)
+	if err != nil || !found {
+		return false, false, err
+	}
+	return true, len(val) == 0, nil
+}
+
+// find locates key via the bloom filter and block index.
+// The returned value aliases the block buffer read for this call.
+func (r *Reader) find(key []byte) ([]byte, bool, error) {
 	if r == nil || r.file == nil {
 		return nil, false, os.ErrInvalid
 	}
@@ -370,100 +1069,367 @@ func (r *Reader) Get(key []byte) ([]byte, bool, error) {
 		}
 	}
 
-	// New format: use Bloom Filter and Block Index
-	// 1. Quick check with Bloom Filter
-	if r.bloomFilter != nil && !r.bloomFilter.MayContain(key) {
-		// Key definitely not in this SSTable
+	// New format: use the key bounds, Bloom Filter and Block Index
+	// 0. Keys outside the table's bounds are not in it
+	if r.largest != nil && (bytes.Compare(key, r.smallest) < 0 || bytes.Compare(key, r.largest) > 0) {
 		return nil, false, nil
 	}
 
+	// 1. Quick check with Bloom Filter
+	if r.bloomFilter != nil {
+		atomic.AddUint64(&r.bloomChecks, 1)
+		if !r.bloomFilter.MayContain(key) {
+			// Key definitely not in this SSTable
+			atomic.AddUint64(&r.bloomNegatives, 1)
+			return nil, false, nil
+		}
+	}
+
 	// 2. Find the block that might contain the key
-	blockOffset := r.blockIndex.FindBlock(key)
-	if blockOffset < 0 {
+	if !r.hasBlockIndex() {
 		return nil, false, nil
 	}
+	blockIdx, err := r.findBlock(key)
+	if err != nil || blockIdx < 0 {
+		return nil, false, err
+	}
+	// A partitioned filter is only checked once the block is known
+	if r.filterEnds != nil {
+		atomic.AddUint64(&r.bloomChecks, 1)
+		ok, err := r.blockMayContain(blockIdx, key)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			atomic.AddUint64(&r.bloomNegatives, 1)
+			return nil, false, nil
+		}
+	}
 
 	// 3. Search within the block
-	return r.searchInBlock(key, blockOffset)
+	return r.searchInBlock(key, blockIdx)
 }
 
-// searchInBlock searches for a key within the specified block
-func (r *Reader) searchInBlock(key []byte, blockOffset int64) ([]byte, bool, error) {
-	// Determine the end position of the block (start of next block or end of data section)
+// blockBounds returns the file range [start, end) holding the records of
+// block i, compressed or not, excluding its trailer.
+func (r *Reader) blockBounds(i int) (start, end int64, err error) {
+	e, err := r.blockEntry(i)
+	if err != nil {
+		return 0, 0, err
+	}
+	start = e.Offset
 	// Data section ends at the start of the Block Index (not the Bloom Filter).
-	// Layout: [data blocks][block index][bloom filter][footer]
-	blockEnd := r.footer.BlockIndexOffset
-	if len(r.blockIndex.Entries) > 0 {
-		// Find the offset of the next block
-		for _, entry := range r.blockIndex.Entries {
-			if entry.Offset > blockOffset {
-				blockEnd = entry.Offset
-				break
-			}
+	// Layout: [data blocks][block index][bloom filter][range tombstones][properties][footer]
+	end = r.footer.BlockIndexOffset
+	if i+1 < r.numBlocks() {
+		next, err := r.blockEntry(i + 1)
+		if err != nil {
+			return 0, 0, err
 		}
+		end = next.Offset
 	}
+	return start, end - r.footer.blockTrailerSize(), nil
+}
 
-	blockSize := blockEnd - blockOffset
-	if blockSize <= 0 {
-		return nil, false, nil
+// readBlock reads the records of block i, decompressing them if needed. If
+// verify is set and the file carries block checksums, the trailer is read
+// and checked as well.
+func (r *Reader) readBlock(i int, verify bool) ([]byte, error) {
+	start, end, err := r.blockBounds(i)
+	if err != nil {
+		return nil, err
+	}
+	if end <= start {
+		return nil, nil
 	}
 
-	// Read the entire block
-	blockData := make([]byte, blockSize)
-	if _, err := r.file.ReadAt(blockData, blockOffset); err != nil {
-		return nil, false, err
+	size := end - start
+	if (verify && r.footer.HasBlockChecksums()) || r.footer.HasBlockCompression() {
+		size += r.footer.blockTrailerSize()
+	}
+	buf := make([]byte, size)
+	if _, err := r.file.ReadAt(buf, start); err != nil {
+		if errors.Is(err, io.EOF) {
+			// The index points past the end of the file
+			return nil, fmt.Errorf("%w: %s block at offset %d: truncated", ErrCorruptBlock, r.path, start)
+		}
+		return nil, err
+	}
+	data := buf[:end-start]
+	if len(buf) == len(data) {
+		return data, nil
 	}
 
-	// Parse the block and search for the key
-	pos := int64(0)
-	for pos < blockSize {
-		if pos+8 > blockSize {
-			break
+	// The checksum ends the trailer and covers everything in front of it.
+	if verify {
+		want := binary.LittleEndian.Uint32(buf[len(buf)-blockTrailerSize:])
+		if crc32.Checksum(buf[:len(buf)-blockTrailerSize], crcTable) != want {
+			return nil, fmt.Errorf("%w: %w: %s block at offset %d", ErrCorruptBlock, ErrChecksumMismatch, r.path, start)
 		}
+	}
+	if !r.footer.HasBlockCompression() {
+		return data, nil
+	}
+	block, err := decompressBlock(Compression(buf[len(data)]), data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s block at offset %d: %v", ErrCorruptBlock, r.path, start, err)
+	}
+	return block, nil
+}
 
-		// Read header
-		klen := binary.LittleEndian.Uint32(blockData[pos : pos+4])
-		vlen := binary.LittleEndian.Uint32(blockData[pos+4 : pos+8])
+// cachedBlock is readBlock(i, true) through the block cache, if any: every
+// block read from disk is verified, so corruption surfaces as an error
+// instead of a wrong value. Cached blocks were verified when they were read.
+func (r *Reader) cachedBlock(i int) ([]byte, error) {
+	if r.cache == nil {
+		return r.readBlock(i, true)
+	}
+	k := blockKey{file: r.id, block: i}
+	if data, ok := r.cache.get(k); ok {
+		return data, nil
+	}
+	data, err := r.readBlock(i, true)
+	if err != nil {
+		return nil, err
+	}
+	r.cache.add(k, data)
+	return data, nil
+}
 
-		if klen > maxSSTableKeySize || vlen > maxSSTableValueSize {
-			return nil, false, io.ErrUnexpectedEOF
+// VerifyChecksumsInRange reads every block that may hold keys in [start, end)
+// and checks it against its stored checksum. A nil start or end leaves that
+// side of the range open. Files written before block checksums existed
+// have nothing to verify and always succeed.
+//
+// It returns the number of blocks verified and the first mismatch found.
+func (r *Reader) VerifyChecksumsInRange(start, end []byte) (int, error) {
+	if r == nil || r.file == nil {
+		return 0, os.ErrInvalid
+	}
+	if !r.hasBlockIndex() || !r.footer.HasBlockChecksums() {
+		return 0, nil
+	}
+
+	first := 0
+	if start != nil {
+		var err error
+		if first, err = r.findBlock(start); err != nil {
+			return 0, err
+		}
+		if first < 0 {
+			// Every key in the file sorts before start
+			return 0, nil
 		}
+	}
 
-		totalLen := int64(klen) + int64(vlen)
-		if pos+8+totalLen > blockSize {
-			break
+	verified := 0
+	for i := first; i < r.numBlocks(); i++ {
+		// Block i starts after the previous block's last key, so once that
+		// key reaches end no later block can overlap the range.
+		if end != nil && i > 0 {
+			prev, err := r.blockEntry(i - 1)
+			if err != nil {
+				return verified, err
+			}
+			if bytes.Compare(prev.LastKey, end) >= 0 {
+				break
+			}
+		}
+		if _, err := r.readBlock(i, true); err != nil {
+			return verified, err
 		}
+		verified++
+	}
+	return verified, nil
+}
 
-		recordKey := blockData[pos+8 : pos+8+int64(klen)]
-		cmp := bytes.Compare(recordKey, key)
+// VerifyChecksums checks every block against its stored checksum and, since
+// V7, the whole file against the checksum in the footer, which also
+// covers the index, filter and properties. It returns the first mismatch,
+// wrapping ErrChecksumMismatch or ErrFileChecksumMismatch. Files written
+// before either checksum existed have nothing to verify and succeed.
+func (r *Reader) VerifyChecksums() error {
+	if _, err := r.VerifyChecksumsInRange(nil, nil); err != nil {
+		return err
+	}
+	if !r.footer.HasFileChecksum() {
+		return nil
+	}
+	h := crc32.New(crcTable)
+	if _, err := io.Copy(h, io.NewSectionReader(r.file, 0, r.fileSize-r.footer.Size())); err != nil {
+		return err
+	}
+	if h.Sum32() != r.footer.FileChecksum {
+		return fmt.Errorf("%w: %s", ErrFileChecksumMismatch, r.path)
+	}
+	return nil
+}
 
-		if cmp == 0 {
-			// Found it!
-			recordValue := blockData[pos+8+int64(klen) : pos+8+totalLen]
-			return utils.CopyBytes(recordValue), true, nil
+// CountRange returns the number of records in the blocks that may hold
+// keys in [start, end). A nil start or end leaves that side of the range
+// open. The count is exact at block granularity: whole boundary blocks are
+// counted, and tombstones count like values.
+//
+// V4 and later files answer from the block index alone; older files, whose
+// index entries count 0 records, have their overlapping blocks read and
+// walked.
+func (r *Reader) CountRange(start, end []byte) (uint64, error) {
+	if r == nil || r.file == nil {
+		return 0, os.ErrInvalid
+	}
+	if !r.hasBlockIndex() {
+		return 0, nil
+	}
+
+	first := 0
+	if start != nil {
+		var err error
+		if first, err = r.findBlock(start); err != nil {
+			return 0, err
 		}
+		if first < 0 {
+			return 0, nil
+		}
+	}
 
-		if cmp > 0 {
-			// Key is not in this block (keys are sorted)
-			return nil, false, nil
+	var total uint64
+	for i := first; i < r.numBlocks(); i++ {
+		if end != nil && i > 0 {
+			prev, err := r.blockEntry(i - 1)
+			if err != nil {
+				return total, err
+			}
+			if bytes.Compare(prev.LastKey, end) >= 0 {
+				break
+			}
+		}
+		e, err := r.blockEntry(i)
+		if err != nil {
+			return total, err
+		}
+		if n := e.Count; n > 0 {
+			total += uint64(n)
+			continue
 		}
+		n, err := r.countBlock(i)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
 
-		pos += 8 + totalLen
+// countBlock counts the records of block i by walking them.
+func (r *Reader) countBlock(i int) (uint64, error) {
+	bi, err := r.blockIter(i)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for ok := bi.first(); ok; ok = bi.nextRecord() {
+		n++
 	}
+	return n, bi.err
+}
 
-	return nil, false, nil
+// blockIter returns an iterator over the records of block i.
+func (r *Reader) blockIter(i int) (*blockIter, error) {
+	data, err := r.cachedBlock(i)
+	if err != nil {
+		return nil, err
+	}
+	bi := &blockIter{}
+	if err := bi.init(data, r.footer.HasPrefixRecords()); err != nil {
+		return nil, err
+	}
+	return bi, nil
 }
 
+// searchInBlock searches for a key within the specified block.
+// The returned value is a slice of the block buffer, not a copy.
+// GetInBlock is GetTo for a key whose record is known to be in data block
+// i, as Iterator.Block reported when the key was read: it skips the key
+// bounds, bloom filter and block index. A key that is not in the block is
+// not found.
+func (r *Reader) GetInBlock(key, dst []byte, i int) ([]byte, bool, error) {
+	if r == nil || r.file == nil {
+		return dst, false, os.ErrInvalid
+	}
+	if !r.initialized {
+		if err := r.initialize(); err != nil {
+			return dst, false, err
+		}
+	}
+	if i < 0 || i >= r.numBlocks() {
+		return dst, false, nil
+	}
+	val, found, err := r.searchInBlock(key, i)
+	if err != nil || !found {
+		return dst, found, err
+	}
+	if len(val) == 0 {
+		// Zero-length value is a tombstone
+		return nil, true, nil
+	}
+	return append(dst, val...), true, nil
+}
+
+func (r *Reader) searchInBlock(key []byte, blockIdx int) ([]byte, bool, error) {
+	bi, err := r.blockIter(blockIdx)
+	if err != nil {
+		return nil, false, err
+	}
+	if !bi.seek(key) || !bytes.Equal(bi.key, key) {
+		return nil, false, bi.err
+	}
+	return bi.val, true, nil
+}
+
+// Iterator walks the records of a table, a block at a time. A V1 table
+// without a block index is read record by record from the file instead.
 type Iterator struct {
-	r       *Reader
-	pos     int64 // offset in file
-	dataEnd int64 // End position of data section (before Bloom Filter)
-	key     []byte
-	val     []byte
-	eof     bool
+	r        *Reader
+	opts     IteratorOptions
+	blockIdx int       // block of the current record (-1 before the first read)
+	blk      blockIter // records of blockIdx
+	key      []byte
+	val      []byte
+	buf      []byte // backs key and val with ReuseBuffers
+	eof      bool
+	ra       *readahead // nil without IteratorOptions.Readahead
+
+	// Without a block index: the file offset of the next record and the
+	// end of the data section.
+	pos     int64
+	dataEnd int64
+}
+
+// IteratorOptions tunes how an Iterator reads its file.
+type IteratorOptions struct {
+	// BeforeBlock, if set, is called before the iterator starts reading a
+	// data block. Low-priority scans use it to pause while foreground
+	// reads are slow.
+	BeforeBlock func()
+
+	// ReuseBuffers lets Key and Value return memory that the next move of
+	// the iterator overwrites, saving a copy per record for callers that
+	// are done with a record before moving on.
+	ReuseBuffers bool
+
+	// Readahead is how many data blocks to read ahead of a forward scan,
+	// in background goroutines, once it has moved through two blocks in a
+	// row, so that it does not wait for the disk at each block. BeforeBlock
+	// runs when a block is used, not when it is read ahead. Zero disables.
+	Readahead int
 }
 
 func (r *Reader) NewIterator() *Iterator {
+	return r.NewIteratorWithOptions(IteratorOptions{})
+}
+
+// NewIteratorWithOptions creates an iterator with the given options.
+func (r *Reader) NewIteratorWithOptions(opts IteratorOptions) *Iterator {
 	// Initialize (if not already initialized)
 	if !r.initialized {
 		r.initialize()
@@ -473,18 +1439,34 @@ func (r *Reader) NewIterator() *Iterator {
 	dataEnd := r.fileSize
 	if r.footer != nil {
 		// New format: data ends before Block Index.
-		// Layout: [data blocks][block index][bloom filter][footer]
-		if r.footer.BlockIndexOffset >= 0 && r.footer.BlockIndexOffset <= r.fileSize-32 {
+		// Layout: [data blocks][block index][bloom filter][range tombstones][properties][footer]
+		footerSize := r.footer.Size()
+		if r.footer.BlockIndexOffset >= 0 && r.footer.BlockIndexOffset <= r.fileSize-footerSize {
 			dataEnd = r.footer.BlockIndexOffset
-		} else if r.fileSize > 32 {
-			dataEnd = r.fileSize - 32
+		} else if r.fileSize > footerSize {
+			dataEnd = r.fileSize - footerSize
 		}
 	}
 
-	return &Iterator{
-		r:       r,
-		pos:     0,
-		dataEnd: dataEnd,
+	it := &Iterator{
+		r:        r,
+		opts:     opts,
+		pos:      0,
+		dataEnd:  dataEnd,
+		blockIdx: -1,
+	}
+	if opts.Readahead > 0 {
+		it.ra = &readahead{max: opts.Readahead}
+	}
+	return it
+}
+
+// Close waits for the blocks the iterator is reading ahead, which use the
+// Reader. With IteratorOptions.Readahead, call it before closing the
+// Reader; otherwise it does nothing. The iterator can still be used.
+func (it *Iterator) Close() {
+	if it.ra != nil {
+		it.ra.wait()
 	}
 }
 
@@ -500,6 +1482,15 @@ func (it *Iterator) Value() []byte {
 	return it.val
 }
 
+// Block returns the index of the data block holding the current record,
+// for Reader.GetInBlock, or -1 for a table without a block index.
+func (it *Iterator) Block() int {
+	if !it.r.hasBlockIndex() {
+		return -1
+	}
+	return it.blockIdx
+}
+
 func (it *Iterator) Next() error {
 	if it.eof {
 		return nil
@@ -507,24 +1498,189 @@ func (it *Iterator) Next() error {
 	if it.r == nil || it.r.file == nil {
 		return os.ErrInvalid
 	}
+	if !it.r.hasBlockIndex() {
+		// Check if we've reached the end of the data section
+		// Note: use >= instead of >, because pos is the next position to read
+		if it.pos >= it.dataEnd {
+			return it.setEOF()
+		}
+		return it.readRecord()
+	}
+
+	// Move on to the next block once the records of this one are used up
+	ok := it.blockIdx >= 0 && it.blk.nextRecord()
+	for !ok {
+		if it.blk.err != nil {
+			return it.blk.err
+		}
+		if it.blockIdx+1 >= it.r.numBlocks() {
+			return it.setEOF()
+		}
+		if err := it.loadBlock(it.blockIdx + 1); err != nil {
+			return err
+		}
+		ok = it.blk.first()
+	}
+	return it.setRecord()
+}
+
+// SeekToFirst positions the iterator at the first record.
+func (it *Iterator) SeekToFirst() error {
+	it.pos = 0
+	it.blockIdx = -1
+	it.eof = false
+	it.key, it.val = nil, nil
+	return it.Next()
+}
+
+// Seek positions the iterator at the first record with a key >= target,
+// reading only the block the block index points to.
+func (it *Iterator) Seek(target []byte) error {
+	if it.r == nil || it.r.file == nil {
+		return os.ErrInvalid
+	}
+	if !it.r.hasBlockIndex() {
+		// No index to search; scan from the start.
+		err := it.SeekToFirst()
+		for err == nil && it.Valid() && bytes.Compare(it.key, target) < 0 {
+			err = it.Next()
+		}
+		return err
+	}
+
+	it.eof = false
+	it.key, it.val = nil, nil
+	i, err := it.r.findBlock(target)
+	if err != nil {
+		return err
+	}
+	if i < 0 {
+		// Every key sorts before target
+		return it.setEOF()
+	}
+	if err := it.loadBlock(i); err != nil {
+		return err
+	}
+	if it.blk.seek(target) {
+		return it.setRecord()
+	}
+	if it.blk.err != nil {
+		return it.blk.err
+	}
+	// The index promised a key >= target here; fall through to the next
+	// block if the block was cut short.
+	return it.Next()
+}
+
+// SeekToLast positions the iterator at the last record.
+func (it *Iterator) SeekToLast() error {
+	if it.r == nil || it.r.file == nil {
+		return os.ErrInvalid
+	}
+	it.eof = false
+	it.key, it.val = nil, nil
+	if !it.r.hasBlockIndex() {
+		// No block index to walk backwards with
+		return it.setEOF()
+	}
+	return it.lastInBlock(it.r.numBlocks() - 1)
+}
 
-	// Check if we've reached the end of the data section
-	// Note: use >= instead of >, because pos is the next position to read
-	if it.pos >= it.dataEnd {
-		it.eof = true
-		it.key, it.val = nil, nil
+// Prev moves to the previous record. Stepping back from the first record
+// leaves the iterator invalid. Prev on an invalid iterator does nothing.
+func (it *Iterator) Prev() error {
+	if !it.Valid() {
 		return nil
 	}
+	if !it.r.hasBlockIndex() {
+		return it.setEOF()
+	}
+	if it.blk.prev() {
+		return it.setRecord()
+	}
+	if it.blk.err != nil {
+		return it.blk.err
+	}
+	return it.lastInBlock(it.blockIdx - 1)
+}
 
+// lastInBlock positions the iterator at the last record of block i, or of
+// the closest earlier block holding records.
+func (it *Iterator) lastInBlock(i int) error {
+	for ; i >= 0; i-- {
+		if err := it.loadBlock(i); err != nil {
+			return err
+		}
+		if it.blk.last() {
+			return it.setRecord()
+		}
+		if it.blk.err != nil {
+			return it.blk.err
+		}
+	}
+	return it.setEOF()
+}
+
+// loadBlock makes block i current.
+func (it *Iterator) loadBlock(i int) error {
+	if it.opts.BeforeBlock != nil && i != it.blockIdx {
+		it.opts.BeforeBlock()
+	}
+	var data []byte
+	var err error
+	if it.ra != nil {
+		data, err = it.ra.load(it.r, i, it.blockIdx)
+	} else {
+		data, err = it.r.cachedBlock(i)
+	}
+	if err != nil {
+		return err
+	}
+	it.blockIdx = i
+	return it.blk.init(data, it.r.footer.HasPrefixRecords())
+}
+
+// setRecord copies the record blk is on, so that it stays valid after the
+// iterator moves, unless ReuseBuffers allows otherwise.
+func (it *Iterator) setRecord() error {
+	n := len(it.blk.key) + len(it.blk.val)
+	var buf []byte
+	if it.opts.ReuseBuffers && cap(it.buf) >= n {
+		buf = it.buf[:n]
+	} else {
+		buf = make([]byte, n)
+		if it.opts.ReuseBuffers {
+			it.buf = buf
+		}
+	}
+	copy(buf, it.blk.key)
+	copy(buf[len(it.blk.key):], it.blk.val)
+	it.key = buf[:len(it.blk.key)]
+	it.val = buf[len(it.blk.key):]
+	if len(it.val) == 0 {
+		// Zero-length value is a tombstone
+		it.val = nil
+	}
+	return nil
+}
+
+// setEOF leaves the iterator past the last record.
+func (it *Iterator) setEOF() error {
+	it.eof = true
+	it.key, it.val = nil, nil
+	return nil
+}
+
+// readRecord reads the record at it.pos from a table without a block index
+// and advances pos past it.
+func (it *Iterator) readRecord() error {
 	// read header
 	header := make([]byte, 8)
 
 	// no header corruption
 	n, err := it.r.file.ReadAt(header, it.pos)
 	if err == io.EOF && n == 0 {
-		it.eof = true
-		it.key, it.val = nil, nil
-		return nil
+		return it.setEOF()
 	}
 
 	// other problems
@@ -534,40 +1690,22 @@ func (it *Iterator) Next() error {
 
 	// header incomplete
 	if n < 8 {
-		it.eof = true
-		it.key, it.val = nil, nil
-		return nil
+		return it.setEOF()
 	}
 
 	klen := binary.LittleEndian.Uint32(header[0:4])
 	vlen := binary.LittleEndian.Uint32(header[4:8])
 
 	// security check
-	if klen > maxSSTableKeySize {
-		it.eof = true
-		it.key, it.val = nil, nil
-		return nil
-	}
-
-	if vlen > maxSSTableValueSize {
-		it.eof = true
-		it.key, it.val = nil, nil
-		return nil
+	if klen > maxSSTableKeySize || vlen > maxSSTableValueSize {
+		return it.setEOF()
 	}
 
 	totalLen := int64(klen) + int64(vlen)
-	if totalLen < 0 {
-		it.eof = true
-		it.key, it.val = nil, nil
-		return nil
-	}
-
 	expectedEnd := it.pos + 8 + totalLen
 	if expectedEnd > it.dataEnd {
 		// Exceeded data section, reached end of file
-		it.eof = true
-		it.key, it.val = nil, nil
-		return nil
+		return it.setEOF()
 	}
 
 	buf := make([]byte, totalLen)
@@ -577,13 +1715,15 @@ func (it *Iterator) Next() error {
 	}
 
 	if int64(n) < totalLen {
-		it.eof = true
-		it.key, it.val = nil, nil
-		return nil
+		return it.setEOF()
 	}
 
 	it.key = buf[:klen]
 	it.val = buf[klen:]
+	if vlen == 0 {
+		// Zero-length value is a tombstone
+		it.val = nil
+	}
 
 	// update position
 	it.pos += 8 + totalLen
@@ -1,8 +1,15 @@
 package sstable
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/return2faye/SiltKV/internal/memtable"
@@ -101,8 +108,8 @@ func TestIteratorCorruption(t *testing.T) {
 	if err == nil {
 		t.Fatal("NewReader should fail on corrupt file")
 	}
-	if err != ErrCorruptSSTable {
-		t.Errorf("Expected ErrCorruptSSTable, got: %v", err)
+	if !errors.Is(err, ErrCorruptFooter) || !errors.Is(err, ErrCorruptSSTable) {
+		t.Errorf("Expected ErrCorruptFooter, got: %v", err)
 	}
 }
 
@@ -212,3 +219,1415 @@ func TestIteratorOrder(t *testing.T) {
 		t.Errorf("Expected %d items, got %d", len(expectedOrder), idx)
 	}
 }
+
+func TestIteratorReverse(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "reverse.sst")
+	writer, err := NewWriter(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	value := make([]byte, 100)
+	for i := 0; i < 300; i++ {
+		if _, err := writer.Write([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	for _, cache := range []*BlockCache{nil, NewBlockCache(1<<20, CachePolicyLRU)} {
+		reader, err := NewReaderWithOptions(sstPath, ReaderOptions{Cache: cache})
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		if len(reader.blockIndex.Entries) < 3 {
+			t.Fatalf("expected several blocks, got %d", len(reader.blockIndex.Entries))
+		}
+
+		it := reader.NewIterator()
+		want := 299
+		for err := it.SeekToLast(); it.Valid(); err = it.Prev() {
+			if err != nil {
+				t.Fatalf("Prev: %v", err)
+			}
+			if got := string(it.Key()); got != fmt.Sprintf("key%03d", want) {
+				t.Fatalf("reverse position %d: got %s", want, got)
+			}
+			want--
+		}
+		if want != -1 {
+			t.Errorf("reverse scan stopped before key%03d", want)
+		}
+
+		// Change direction in the middle of a block and across a boundary.
+		it.SeekToFirst()
+		for i := 0; i < 40; i++ {
+			it.Next()
+		}
+		it.Prev()
+		it.Prev()
+		if got := string(it.Key()); got != "key038" {
+			t.Errorf("after Next x40, Prev x2: got %s, want key038", got)
+		}
+		it.Next()
+		if got := string(it.Key()); got != "key039" {
+			t.Errorf("Next after Prev: got %s, want key039", got)
+		}
+		reader.Close()
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "seek.sst")
+	writer, err := NewWriter(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	value := make([]byte, 100)
+	for i := 0; i < 600; i += 2 {
+		if _, err := writer.Write([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	reader, err := NewReader(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	blocks := 0
+	it := reader.NewIteratorWithOptions(IteratorOptions{BeforeBlock: func() { blocks++ }})
+	for _, tc := range []struct{ target, want string }{
+		{"key401", "key402"},
+		{"key402", "key402"},
+		{"a", "key000"},
+		{"key598", "key598"},
+		{"key599", ""},
+	} {
+		blocks = 0
+		if err := it.Seek([]byte(tc.target)); err != nil {
+			t.Fatalf("Seek(%s): %v", tc.target, err)
+		}
+		got := ""
+		if it.Valid() {
+			got = string(it.Key())
+		}
+		if got != tc.want {
+			t.Errorf("Seek(%s) = %q, want %q", tc.target, got, tc.want)
+		}
+		if blocks > 1 {
+			t.Errorf("Seek(%s) read %d blocks", tc.target, blocks)
+		}
+	}
+
+	it.Seek([]byte("key401"))
+	it.Next()
+	if string(it.Key()) != "key404" {
+		t.Errorf("Next after Seek = %s, want key404", it.Key())
+	}
+}
+
+func TestMergeIteratorReverse(t *testing.T) {
+	tmpDir := t.TempDir()
+	write := func(name string, kvs [][2]string) *Reader {
+		path := filepath.Join(tmpDir, name)
+		w, err := NewWriter(path)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		for _, kv := range kvs {
+			if _, err := w.Write([]byte(kv[0]), []byte(kv[1])); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+		r, err := NewReader(path)
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		t.Cleanup(func() { r.Close() })
+		return r
+	}
+	newer := write("newer.sst", [][2]string{{"b", "new"}, {"d", "new"}})
+	older := write("older.sst", [][2]string{{"a", "old"}, {"b", "old"}, {"c", "old"}, {"e", "old"}})
+
+	mi, err := NewMergeIterator([]*Reader{newer, older})
+	if err != nil {
+		t.Fatalf("NewMergeIterator: %v", err)
+	}
+	var got []string
+	for err := mi.SeekToLast(); mi.Valid(); err = mi.Prev() {
+		if err != nil {
+			t.Fatalf("Prev: %v", err)
+		}
+		got = append(got, string(mi.Key())+"="+string(mi.Value()))
+	}
+	want := "[e=old d=new c=old b=new a=old]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("reverse merge = %v, want %s", got, want)
+	}
+
+	if err := mi.Seek([]byte("bb")); err != nil || string(mi.Key()) != "c" {
+		t.Errorf("Seek(bb) = %s, %v; want c", mi.Key(), err)
+	}
+	mi.Seek([]byte("b"))
+	if string(mi.Key()) != "b" || string(mi.Value()) != "new" {
+		t.Errorf("Seek(b) = %s=%s, want b=new", mi.Key(), mi.Value())
+	}
+
+	// Switch directions: forward to c, back to b, forward again to c.
+	mi, _ = NewMergeIterator([]*Reader{newer, older})
+	mi.Next()
+	mi.Next()
+	if string(mi.Key()) != "c" {
+		t.Fatalf("forward position: got %s, want c", mi.Key())
+	}
+	mi.Prev()
+	if string(mi.Key()) != "b" || string(mi.Value()) != "new" {
+		t.Errorf("Prev: got %s=%s, want b=new", mi.Key(), mi.Value())
+	}
+	mi.Next()
+	if string(mi.Key()) != "c" {
+		t.Errorf("Next after Prev: got %s, want c", mi.Key())
+	}
+}
+
+func TestExistsAcrossBlocks(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "exists.sst")
+
+	writer, err := NewWriter(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	// ~1KB values force several records per block and many block boundaries.
+	value := make([]byte, 1000)
+	numKeys := 100
+	for i := 0; i < numKeys; i++ {
+		val := value
+		if i%10 == 0 {
+			val = nil // tombstone
+		}
+		if _, err := writer.Write([]byte(fmt.Sprintf("key%03d", i)), val); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	reader, err := NewReader(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		found, deleted, err := reader.Exists(key)
+		if err != nil {
+			t.Fatalf("Exists(%s) error: %v", key, err)
+		}
+		if !found {
+			t.Errorf("Exists(%s): entry not found", key)
+			continue
+		}
+		if deleted != (i%10 == 0) {
+			t.Errorf("Exists(%s): deleted=%v", key, deleted)
+		}
+
+		val, found, err := reader.Get(key)
+		if err != nil || !found {
+			t.Fatalf("Get(%s) = found %v, err %v", key, found, err)
+		}
+		if (val == nil) != (i%10 == 0) {
+			t.Errorf("Get(%s): tombstone should read back as nil value", key)
+		}
+	}
+
+	found, _, err := reader.Exists([]byte("missing"))
+	if err != nil || found {
+		t.Errorf("Exists(missing) = %v, %v", found, err)
+	}
+}
+
+func TestRangeTombstonesRoundTrip(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "rangedel.sst")
+
+	writer, err := NewWriter(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if _, err := writer.Write([]byte("c"), []byte("v")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	writer.AddRangeTombstone([]byte("a"), []byte("f"))
+	writer.AddRangeTombstone([]byte("x"), []byte("z"))
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	reader, err := NewReader(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	if n := len(reader.RangeTombstones()); n != 2 {
+		t.Fatalf("expected 2 range tombstones, got %d", n)
+	}
+	for key, want := range map[string]bool{"a": true, "e": true, "f": false, "y": true, "z": false} {
+		if got := reader.IsRangeDeleted([]byte(key)); got != want {
+			t.Errorf("IsRangeDeleted(%q) = %v, want %v", key, got, want)
+		}
+	}
+	// The point entry is still readable; precedence is decided by the caller.
+	if val, found, err := reader.Get([]byte("c")); err != nil || !found || string(val) != "v" {
+		t.Errorf("Get(c) = %q, %v, %v", val, found, err)
+	}
+}
+
+func TestCountRange(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "count.sst")
+
+	writer, err := NewWriter(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	value := make([]byte, 100)
+	for i := 0; i < 500; i++ {
+		if _, err := writer.Write([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	reader, err := NewReader(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+	if !reader.footer.HasBlockCounts() {
+		t.Fatal("new file has no block counts")
+	}
+	perBlock := uint64(reader.blockIndex.Entries[0].Count)
+	if perBlock == 0 {
+		t.Fatal("first block has no count")
+	}
+
+	if n, err := reader.CountRange(nil, nil); err != nil || n != 500 {
+		t.Errorf("CountRange(nil, nil) = %d, %v; want 500", n, err)
+	}
+	n, err := reader.CountRange([]byte("key100"), []byte("key200"))
+	if err != nil || n < 100 || n > 100+2*perBlock {
+		t.Errorf("CountRange(key100, key200) = %d, %v; want 100..%d", n, err, 100+2*perBlock)
+	}
+	if n, err := reader.CountRange([]byte("zzz"), nil); err != nil || n != 0 {
+		t.Errorf("CountRange past the last key = %d, %v", n, err)
+	}
+
+	// Files without block counts walk the blocks and get the same answer.
+	for i := range reader.blockIndex.Entries {
+		reader.blockIndex.Entries[i].Count = 0
+	}
+	if legacy, err := reader.CountRange([]byte("key100"), []byte("key200")); err != nil || legacy != n {
+		t.Errorf("CountRange without block counts = %d, %v; want %d", legacy, err, n)
+	}
+}
+
+func TestVerifyChecksumsInRange(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "verify.sst")
+
+	writer, err := NewWriter(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	value := make([]byte, 1000)
+	for i := 0; i < 40; i++ {
+		if _, err := writer.Write([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	reader, err := NewReader(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	numBlocks := len(reader.blockIndex.Entries)
+	if numBlocks < 4 {
+		t.Fatalf("expected several blocks, got %d", numBlocks)
+	}
+
+	n, err := reader.VerifyChecksumsInRange(nil, nil)
+	if err != nil || n != numBlocks {
+		t.Fatalf("full verify = %d blocks, %v; want %d", n, err, numBlocks)
+	}
+	n, err = reader.VerifyChecksumsInRange([]byte("key009"), []byte("key011"))
+	if err != nil || n != 1 {
+		t.Errorf("narrow verify = %d blocks, %v; want 1", n, err)
+	}
+	if n, err := reader.VerifyChecksumsInRange([]byte("zzz"), nil); err != nil || n != 0 {
+		t.Errorf("verify past last key = %d blocks, %v; want 0", n, err)
+	}
+
+	// Iteration must step over the block trailers.
+	it := reader.NewIterator()
+	count := 0
+	for it.Next(); it.Valid(); it.Next() {
+		count++
+	}
+	if count != 40 {
+		t.Errorf("iterated %d records, want 40", count)
+	}
+
+	// Flip a byte inside the last block.
+	lastStart, _, _ := reader.blockBounds(numBlocks - 1)
+	reader.Close()
+	f, err := os.OpenFile(sstPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte{0xFF}, lastStart+20); err != nil {
+		t.Fatalf("Failed to corrupt file: %v", err)
+	}
+	f.Close()
+
+	reader, err = NewReader(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen reader: %v", err)
+	}
+	defer reader.Close()
+
+	if _, err := reader.VerifyChecksumsInRange([]byte("key000"), []byte("key005")); err != nil {
+		t.Errorf("range away from the damage should verify, got %v", err)
+	}
+	if _, err := reader.VerifyChecksumsInRange([]byte("key039"), nil); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "verify.sst")
+
+	writer, err := NewWriter(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	value := make([]byte, 1000)
+	for i := 0; i < 40; i++ {
+		if _, err := writer.Write([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	// Sorts last, so its value ends right before the footer.
+	writer.SetProperty("zz.note", "abc")
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	corrupt := func(off int64) {
+		t.Helper()
+		f, err := os.OpenFile(sstPath, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("Failed to open file: %v", err)
+		}
+		defer f.Close()
+		b := make([]byte, 1)
+		f.ReadAt(b, off)
+		if _, err := f.WriteAt([]byte{b[0] + 1}, off); err != nil {
+			t.Fatalf("Failed to corrupt file: %v", err)
+		}
+	}
+
+	reader, err := NewReader(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	if err := reader.VerifyChecksums(); err != nil {
+		t.Fatalf("VerifyChecksums on an intact file: %v", err)
+	}
+	footerStart := reader.Size() - reader.footer.Size()
+	firstStart, _, _ := reader.blockBounds(0)
+	reader.Close()
+
+	// Damage outside the data blocks is only caught by the file checksum.
+	corrupt(footerStart - 1)
+	reader, err = NewReader(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen reader: %v", err)
+	}
+	if props, err := reader.Properties(); err != nil || props["zz.note"] != "abd" {
+		t.Fatalf("Properties = %v, %v", props, err)
+	}
+	if err := reader.VerifyChecksums(); !errors.Is(err, ErrFileChecksumMismatch) {
+		t.Errorf("expected ErrFileChecksumMismatch, got %v", err)
+	}
+	reader.Close()
+
+	// Damage in a data block fails reads of that block, not wrong values.
+	corrupt(firstStart + 20)
+	reader, err = NewReader(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen reader: %v", err)
+	}
+	defer reader.Close()
+	if _, _, err := reader.Get([]byte("key000")); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Get from a corrupt block: expected ErrChecksumMismatch, got %v", err)
+	}
+	if err := reader.NewIterator().SeekToFirst(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("iterating a corrupt block: expected ErrChecksumMismatch, got %v", err)
+	}
+	if _, _, err := reader.Get([]byte("key039")); err != nil {
+		t.Errorf("Get from an intact block: %v", err)
+	}
+	if err := reader.VerifyChecksums(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestIteratorBeforeBlockHook(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "hook.sst")
+
+	writer, err := NewWriter(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	value := make([]byte, 1000)
+	for i := 0; i < 40; i++ {
+		if _, err := writer.Write([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	reader, err := NewReader(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	calls := 0
+	it := reader.NewIteratorWithOptions(IteratorOptions{BeforeBlock: func() { calls++ }})
+	count := 0
+	for {
+		if err := it.Next(); err != nil {
+			t.Fatalf("Failed to advance iterator: %v", err)
+		}
+		if !it.Valid() {
+			break
+		}
+		count++
+	}
+	if count != 40 {
+		t.Errorf("Expected 40 entries, got %d", count)
+	}
+	if blocks := len(reader.blockIndex.Entries); calls != blocks {
+		t.Errorf("BeforeBlock called %d times, want once per block (%d)", calls, blocks)
+	}
+}
+
+func TestBlockCacheScanResistance(t *testing.T) {
+	block := make([]byte, BlockSize)
+	hot := 50
+
+	// Read a hot set repeatedly, then scan many blocks once each, then
+	// read the hot set again and see how much of it survived.
+	survivors := func(policy CachePolicy) int {
+		c := NewBlockCache(int64(100*BlockSize), policy)
+		for round := 0; round < 5; round++ {
+			for i := 0; i < hot; i++ {
+				k := blockKey{file: 1, block: i}
+				if _, ok := c.get(k); !ok {
+					c.add(k, block)
+				}
+			}
+		}
+		for i := 0; i < 1000; i++ {
+			k := blockKey{file: 2, block: i}
+			if _, ok := c.get(k); !ok {
+				c.add(k, block)
+			}
+		}
+		n := 0
+		for i := 0; i < hot; i++ {
+			if _, ok := c.get(blockKey{file: 1, block: i}); ok {
+				n++
+			}
+		}
+		if st := c.Stats(); st.Size > st.Capacity {
+			t.Errorf("%v: cache holds %d bytes, capacity %d", policy, st.Size, st.Capacity)
+		}
+		return n
+	}
+
+	if n := survivors(CachePolicyLRU); n != 0 {
+		t.Errorf("LRU kept %d hot blocks through a scan, expected the scan to evict them", n)
+	}
+	if n := survivors(CachePolicyTinyLFU); n < hot*9/10 {
+		t.Errorf("TinyLFU kept only %d of %d hot blocks through a scan", n, hot)
+	}
+}
+
+func TestReaderUsesBlockCache(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "cache.sst")
+
+	writer, err := NewWriter(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	value := make([]byte, 1000)
+	for i := 0; i < 40; i++ {
+		if _, err := writer.Write([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	cache := NewBlockCache(1<<20, CachePolicyLRU)
+	reader, err := NewReaderWithOptions(sstPath, ReaderOptions{Cache: cache})
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	for pass := 0; pass < 2; pass++ {
+		it := reader.NewIterator()
+		count := 0
+		for {
+			if err := it.Next(); err != nil {
+				t.Fatalf("Failed to advance iterator: %v", err)
+			}
+			if !it.Valid() {
+				break
+			}
+			if want := fmt.Sprintf("key%03d", count); string(it.Key()) != want {
+				t.Fatalf("Expected %s, got %s", want, it.Key())
+			}
+			count++
+		}
+		if count != 40 {
+			t.Fatalf("Expected 40 entries, got %d", count)
+		}
+	}
+
+	blocks := uint64(len(reader.blockIndex.Entries))
+	st := cache.Stats()
+	if st.Misses != blocks || st.Hits != blocks {
+		t.Errorf("Expected %d misses then %d hits, got %+v", blocks, blocks, st)
+	}
+
+	if val, found, err := reader.Get([]byte("key007")); err != nil || !found || len(val) != 1000 {
+		t.Errorf("Get through cache: found=%v err=%v len=%d", found, err, len(val))
+	}
+	if st := cache.Stats(); st.Hits != blocks+1 {
+		t.Errorf("Expected Get to hit the cache, got %+v", st)
+	}
+}
+
+func TestBloomBitsPerKey(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	write := func(name string, bitsPerKey int) *Reader {
+		t.Helper()
+		path := filepath.Join(tmpDir, name)
+		w, err := NewWriterWithOptions(path, WriterOptions{BloomBitsPerKey: bitsPerKey})
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		for i := 0; i < 1000; i++ {
+			if _, err := w.Write([]byte(fmt.Sprintf("key%04d", i)), []byte("v")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+		r, err := NewReader(path)
+		if err != nil {
+			t.Fatalf("Failed to open reader: %v", err)
+		}
+		t.Cleanup(func() { r.Close() })
+		return r
+	}
+
+	sized := write("sized.sst", 10)
+	none := write("none.sst", -1)
+
+	for _, r := range []*Reader{sized, none} {
+		for i := 0; i < 1000; i += 7 {
+			if _, found, err := r.Get([]byte(fmt.Sprintf("key%04d", i))); err != nil || !found {
+				t.Fatalf("%s: Get(key%04d) found=%v err=%v", r.Path(), i, found, err)
+			}
+		}
+		// Absent keys within the table's bounds, which rule out the rest
+		for i := 0; i < 1000; i++ {
+			if _, found, _ := r.Get([]byte(fmt.Sprintf("key%04d-absent", i))); found {
+				t.Fatalf("%s: found absent key", r.Path())
+			}
+		}
+	}
+
+	if checks, negatives := sized.BloomStats(); checks == 0 || negatives < 800 {
+		t.Errorf("sized filter ruled out %d of %d absent lookups", negatives, checks)
+	}
+	if checks, _ := none.BloomStats(); checks != 0 {
+		t.Errorf("table without a filter consulted one %d times", checks)
+	}
+}
+
+func TestBloomFilterDoubleHashing(t *testing.T) {
+	hashes := make([]uint64, 10000)
+	for i := range hashes {
+		hashes[i] = bloomHash([]byte(fmt.Sprintf("key%05d", i)))
+	}
+	bf, err := LoadBloomFilter(newBloomFilterFromHashes(hashes, 10).Bytes(), false)
+	if err != nil {
+		t.Fatalf("LoadBloomFilter: %v", err)
+	}
+
+	// Probes are concurrency-safe and allocation-free.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				if !bf.MayContain([]byte(fmt.Sprintf("key%05d", i))) {
+					t.Errorf("false negative for key%05d", i)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	key := []byte("absent")
+	if allocs := testing.AllocsPerRun(100, func() { bf.MayContain(key) }); allocs != 0 {
+		t.Errorf("MayContain allocated %.0f times", allocs)
+	}
+
+	// 10 bits per key with 6 probes: about 1% false positives
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		if bf.MayContain([]byte(fmt.Sprintf("absent%05d", i))) {
+			positives++
+		}
+	}
+	if positives > 200 {
+		t.Errorf("%d of 10000 absent keys passed the filter", positives)
+	}
+
+	// Filters of tables before V10 set the bit of one FNV-1a hash per key.
+	legacy := make([]byte, 8+128)
+	binary.LittleEndian.PutUint32(legacy[0:4], 1024)
+	binary.LittleEndian.PutUint32(legacy[4:8], 6)
+	h := fnv.New32a()
+	h.Write([]byte("old-key"))
+	bit := h.Sum32() % 1024
+	legacy[8+bit/8] |= 1 << (bit % 8)
+	old, err := LoadBloomFilter(legacy, true)
+	if err != nil {
+		t.Fatalf("LoadBloomFilter(legacy): %v", err)
+	}
+	if !old.MayContain([]byte("old-key")) {
+		t.Errorf("legacy filter lost its key")
+	}
+
+	if _, err := LoadBloomFilter(make([]byte, 16), false); err == nil {
+		t.Errorf("LoadBloomFilter accepted a filter of zero bits")
+	}
+}
+
+func TestPartitionedFilters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "partitioned.sst")
+	w, err := NewWriterWithOptions(path, WriterOptions{PartitionedFilters: true})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 5000; i++ {
+		if _, err := w.Write([]byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	for _, cache := range []*BlockCache{nil, NewBlockCache(1<<20, CachePolicyLRU)} {
+		r, err := NewReaderWithOptions(path, ReaderOptions{Cache: cache})
+		if err != nil {
+			t.Fatalf("Failed to open reader: %v", err)
+		}
+		// Only the offsets of the filters are loaded at open.
+		if r.bloomFilter != nil || len(r.filterEnds) != len(r.blockIndex.Entries) || len(r.filterEnds) < 10 {
+			t.Fatalf("reader holds %d filter partitions for %d blocks", len(r.filterEnds), len(r.blockIndex.Entries))
+		}
+		for i := 0; i < 5000; i += 7 {
+			if _, found, err := r.Get([]byte(fmt.Sprintf("key%05d", i))); err != nil || !found {
+				t.Fatalf("Get(key%05d) found=%v err=%v", i, found, err)
+			}
+		}
+		for i := 0; i < 5000; i++ {
+			if _, found, err := r.Get([]byte(fmt.Sprintf("key%05d-absent", i))); err != nil || found {
+				t.Fatalf("Get of absent key found=%v err=%v", found, err)
+			}
+		}
+		checks, negatives := r.BloomStats()
+		if negatives < 4800 {
+			t.Errorf("partitioned filters ruled out %d of %d lookups", negatives, checks)
+		}
+		if cache != nil && cache.Stats().Hits == 0 {
+			t.Errorf("filter partitions were not served from the cache")
+		}
+		r.Close()
+	}
+}
+
+func TestVersionedFooter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "versioned.sst")
+	w, err := NewWriter(path)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := w.Write([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	footer, err := DeserializeFooter(data)
+	if err != nil {
+		t.Fatalf("DeserializeFooter: %v", err)
+	}
+	if footer.MagicNumber != MagicNumberVersioned || footer.Version != FormatVersion {
+		t.Errorf("footer magic %x version %d, want %x version %d",
+			footer.MagicNumber, footer.Version, MagicNumberVersioned, FormatVersion)
+	}
+	if !footer.HasPartitionedIndex() || !footer.HasFileChecksum() {
+		t.Errorf("V%d footer lacks the features of the formats before it", footer.Version)
+	}
+
+	// Older footers get the version of their magic number.
+	old := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint64(old[len(old)-8:], uint64(MagicNumberV9))
+	if f, err := DeserializeFooter(old); err != nil || f.Version != 9 || f.HasDoubleHashBloom() {
+		t.Errorf("V9 footer = %+v, %v", f, err)
+	}
+
+	// A newer format is reported as such, not as corruption.
+	rewrite := func(patch func(b []byte)) error {
+		t.Helper()
+		b := append([]byte(nil), data...)
+		patch(b)
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		r, err := NewReader(path)
+		if err == nil {
+			r.Close()
+		}
+		return err
+	}
+	err = rewrite(func(b []byte) { binary.LittleEndian.PutUint32(b[len(b)-12:], FormatVersion+1) })
+	if !errors.Is(err, ErrUnsupportedFormat) || errors.Is(err, ErrCorruptSSTable) {
+		t.Errorf("reading a V%d table: %v", FormatVersion+1, err)
+	}
+
+	// A block index that runs past the footer is corruption, not a table
+	// to scan record by record.
+	err = rewrite(func(b []byte) {
+		off := len(b) - FooterSize
+		binary.LittleEndian.PutUint64(b[off+16:], uint64(len(b)))
+	})
+	if !errors.Is(err, ErrCorruptSSTable) {
+		t.Errorf("reading a table with a bad index size: %v", err)
+	}
+}
+
+func TestPartitionedIndex(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, n int) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		w, err := NewWriterWithOptions(path, WriterOptions{PartitionedIndex: true})
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		for i := 0; i < n; i++ {
+			if _, err := w.Write([]byte(fmt.Sprintf("key%06d", i)), bytes.Repeat([]byte{'v'}, 200)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+		return path
+	}
+
+	// An index that fits in one partition is written whole.
+	small, err := NewReader(write("small.sst", 100))
+	if err != nil {
+		t.Fatalf("Failed to open reader: %v", err)
+	}
+	if small.blockIndex == nil || small.indexTop != nil {
+		t.Errorf("small table got a partitioned index")
+	}
+	small.Close()
+
+	const n = 20000
+	path := write("large.sst", n)
+	for _, cache := range []*BlockCache{nil, NewBlockCache(1<<20, CachePolicyLRU)} {
+		r, err := NewReaderWithOptions(path, ReaderOptions{Cache: cache})
+		if err != nil {
+			t.Fatalf("Failed to open reader: %v", err)
+		}
+		// Only the top level is loaded at open.
+		if r.blockIndex != nil || r.indexTop == nil || len(r.indexTop.Entries) < 2 {
+			t.Fatalf("reader did not load a partitioned index")
+		}
+		for i := 0; i < n; i += 7 {
+			if _, found, err := r.Get([]byte(fmt.Sprintf("key%06d", i))); err != nil || !found {
+				t.Fatalf("Get(key%06d) found=%v err=%v", i, found, err)
+			}
+		}
+		for _, key := range []string{"a", "key000000-", "key010000-", "z"} {
+			if _, found, err := r.Get([]byte(key)); err != nil || found {
+				t.Fatalf("Get(%s) found=%v err=%v", key, found, err)
+			}
+		}
+
+		// Iterators cross partitions both ways.
+		it := r.NewIterator()
+		count := 0
+		for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+			if want := fmt.Sprintf("key%06d", count); string(it.Key()) != want {
+				t.Fatalf("forward key %d = %q, want %q", count, it.Key(), want)
+			}
+			count++
+		}
+		if err != nil || count != n {
+			t.Fatalf("forward iteration read %d records, err=%v", count, err)
+		}
+		count = 0
+		for err = it.SeekToLast(); err == nil && it.Valid(); err = it.Prev() {
+			count++
+		}
+		if err != nil || count != n {
+			t.Fatalf("backward iteration read %d records, err=%v", count, err)
+		}
+		if err := it.Seek([]byte("key012345")); err != nil || !it.Valid() || string(it.Key()) != "key012345" {
+			t.Fatalf("Seek landed on %q, err=%v", it.Key(), err)
+		}
+
+		if total, err := r.CountRange(nil, nil); err != nil || total != n {
+			t.Errorf("CountRange = %d, %v; want %d", total, err, n)
+		}
+		smallest, largest, err := r.Bounds()
+		if err != nil || string(smallest) != "key000000" || string(largest) != fmt.Sprintf("key%06d", n-1) {
+			t.Errorf("Bounds = %q, %q, %v", smallest, largest, err)
+		}
+		if err := r.VerifyChecksums(); err != nil {
+			t.Errorf("VerifyChecksums: %v", err)
+		}
+		if cache != nil {
+			if _, ok := cache.get(blockKey{file: r.id, block: -1 - r.numBlocks()}); !ok {
+				t.Errorf("index partition 0 is not in the cache")
+			}
+		}
+		r.Close()
+	}
+}
+
+func TestDefaultBloomFilterSizedByKeyCount(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// flush writes n keys from a memtable and returns the size of the
+	// table's filter section.
+	flush := func(name string, n int) int64 {
+		t.Helper()
+		mt, err := memtable.NewMemtable(filepath.Join(tmpDir, name+".wal"))
+		if err != nil {
+			t.Fatalf("Failed to create memtable: %v", err)
+		}
+		defer mt.Close()
+		for i := 0; i < n; i++ {
+			if err := mt.Put([]byte(fmt.Sprintf("key%06d", i)), []byte("v")); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+		mt.Freeze()
+
+		path := filepath.Join(tmpDir, name+".sst")
+		w, err := NewWriter(path)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		if err := w.WriteFromIterator(mt.NewIterator()); err != nil {
+			t.Fatalf("WriteFromIterator failed: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+		r, err := NewReader(path)
+		if err != nil {
+			t.Fatalf("Failed to open reader: %v", err)
+		}
+		defer r.Close()
+		if _, found, err := r.Get([]byte("key000000")); err != nil || !found {
+			t.Fatalf("Get(key000000) found=%v err=%v", found, err)
+		}
+		f := r.Footer()
+		return f.RangeDelOffset - f.BloomFilterOffset
+	}
+
+	// 8-byte header plus 10 bits per key
+	if got := flush("small", 100); got != 8+125 {
+		t.Errorf("filter of 100 keys is %d bytes, want %d", got, 8+125)
+	}
+	if got := flush("large", 20000); got != 8+25000 {
+		t.Errorf("filter of 20000 keys is %d bytes, want %d", got, 8+25000)
+	}
+}
+
+func TestBlockIndexPrefixCompression(t *testing.T) {
+	bi := &BlockIndex{}
+	var fullKeyBytes int
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("tenant:0042:orders:2026-10-17:%06d", i*37))
+		bi.Add(key, int64(i)*4096, uint32(i))
+		fullKeyBytes += len(key)
+	}
+
+	data := bi.Serialize()
+	if len(data) >= fullKeyBytes/2 {
+		t.Errorf("serialized index is %d bytes for %d bytes of keys; prefixes not shared", len(data), fullKeyBytes)
+	}
+
+	got, err := DeserializeBlockIndex(data)
+	if err != nil {
+		t.Fatalf("DeserializeBlockIndex: %v", err)
+	}
+	if len(got.Entries) != len(bi.Entries) {
+		t.Fatalf("got %d entries, want %d", len(got.Entries), len(bi.Entries))
+	}
+	for i, e := range got.Entries {
+		want := bi.Entries[i]
+		if !bytes.Equal(e.LastKey, want.LastKey) || e.Offset != want.Offset || e.Count != want.Count {
+			t.Fatalf("entry %d = {%q %d %d}, want {%q %d %d}", i, e.LastKey, e.Offset, e.Count, want.LastKey, want.Offset, want.Count)
+		}
+	}
+	// Keys share a buffer; appending to one must not clobber the next.
+	_ = append(got.Entries[0].LastKey, 'x')
+	if !bytes.Equal(got.Entries[1].LastKey, bi.Entries[1].LastKey) {
+		t.Error("appending to a decoded key overwrote its neighbour")
+	}
+
+	for _, cut := range []int{3, 5, len(data) / 2, len(data) - 1} {
+		if _, err := DeserializeBlockIndex(data[:cut]); err == nil {
+			t.Errorf("truncated index (%d of %d bytes) decoded without error", cut, len(data))
+		}
+	}
+}
+
+func TestShortestSeparator(t *testing.T) {
+	for _, tc := range []struct{ a, b, want string }{
+		{"abc1xyz", "abc5", "abc2"},
+		{"abc1xyz", "abc2", "abc1y"}, // bumping the differing byte gives b
+		{"abc", "abcd", "abc"},       // a is a prefix of b
+		{"ab\xff\xffz", "ac", "ab\xff\xffz"},
+		{"a5", "a6", "a5"},
+	} {
+		got := BytewiseComparator.Separator([]byte(tc.a), []byte(tc.b))
+		if string(got) != tc.want {
+			t.Errorf("Separator(%q, %q) = %q, want %q", tc.a, tc.b, got, tc.want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "sep.sst")
+	w, err := NewWriter(path)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	tail := string(bytes.Repeat([]byte("x"), 100))
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%06d:%s", i*3, tail)) }
+	const n = 500
+	for i := 0; i < n; i++ {
+		if _, err := w.Write(key(i), []byte("value")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, err := NewReader(path)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	defer r.Close()
+	entries := r.blockIndex.Entries
+	if len(entries) < 3 {
+		t.Fatalf("expected several blocks, got %d", len(entries))
+	}
+	for i, e := range entries[:len(entries)-1] {
+		if len(e.LastKey) >= len(key(0)) {
+			t.Errorf("entry %d keeps the full key %q", i, e.LastKey)
+		}
+	}
+	if _, largest, err := r.Bounds(); err != nil || !bytes.Equal(largest, key(n-1)) {
+		t.Errorf("Bounds largest = %q, %v; want %q", largest, err, key(n-1))
+	}
+
+	for i := 0; i < n; i++ {
+		if _, found, err := r.Get(key(i)); err != nil || !found {
+			t.Fatalf("Get(%q) = %v, %v", key(i), found, err)
+		}
+		// Keys between neighbours, separators included, are absent, and a
+		// seek to them lands on the next key.
+		gap := []byte(fmt.Sprintf("%06d", i*3+1))
+		if _, found, err := r.Get(gap); err != nil || found {
+			t.Fatalf("Get(%q) = %v, %v; want absent", gap, found, err)
+		}
+		it := r.NewIterator()
+		if err := it.Seek(gap); err != nil {
+			t.Fatalf("Seek(%q): %v", gap, err)
+		}
+		if i < n-1 && (!it.Valid() || !bytes.Equal(it.Key(), key(i+1))) {
+			t.Fatalf("Seek(%q) landed on %q, want %q", gap, it.Key(), key(i+1))
+		}
+		if i == n-1 && it.Valid() {
+			t.Fatalf("Seek(%q) past the end landed on %q", gap, it.Key())
+		}
+	}
+}
+
+func TestProperties(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, props map[string]string) *Reader {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		w, err := NewWriter(path)
+		if err != nil {
+			t.Fatalf("NewWriter: %v", err)
+		}
+		w.Write([]byte("k"), []byte("v"))
+		w.AddRangeTombstone([]byte("x"), []byte("y"))
+		for name, value := range props {
+			w.SetProperty(name, value)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		r, err := NewReader(path)
+		if err != nil {
+			t.Fatalf("NewReader: %v", err)
+		}
+		t.Cleanup(func() { r.Close() })
+		return r
+	}
+
+	want := map[string]string{"origin": "L0:a.sst L1:b.sst", "empty": ""}
+	r := write("props.sst", want)
+	got, err := r.Properties()
+	if err != nil {
+		t.Fatalf("Properties: %v", err)
+	}
+	if len(got) != len(want)+7 || got["origin"] != want["origin"] || got["empty"] != "" {
+		t.Errorf("Properties() = %v, want %v", got, want)
+	}
+	if got[PropNumEntries] != "1" || got[PropNumDeletions] != "0" {
+		t.Errorf("record counts = %q entries, %q deletions", got[PropNumEntries], got[PropNumDeletions])
+	}
+	if got[PropSmallestKey] != "k" || got[PropLargestKey] != "k" {
+		t.Errorf("key bounds = %q, %q", got[PropSmallestKey], got[PropLargestKey])
+	}
+	if got[PropRawDataSize] == "" || got[PropDataSize] == "" || got[PropCreationTime] == "" {
+		t.Errorf("sizes and creation time missing: %v", got)
+	}
+	// Properties sit between the range tombstones and the footer.
+	if len(r.RangeTombstones()) != 1 {
+		t.Errorf("range tombstones lost: %v", r.RangeTombstones())
+	}
+	if _, found, err := r.Get([]byte("k")); err != nil || !found {
+		t.Errorf("Get(k) = %v, %v", found, err)
+	}
+	// Keys outside the bounds are ruled out before the bloom filter.
+	checks, _ := r.BloomStats()
+	if _, found, err := r.Get([]byte("a")); err != nil || found {
+		t.Errorf("Get(a) = %v, %v", found, err)
+	}
+	if c, _ := r.BloomStats(); c != checks {
+		t.Errorf("Get outside the key bounds consulted the bloom filter")
+	}
+
+	r = write("none.sst", nil)
+	if got, err := r.Properties(); err != nil || len(got) != 7 {
+		t.Errorf("Properties() with only the built-in ones = %v, %v", got, err)
+	}
+
+	// Files older than V6 have no properties section at all.
+	r.footer.MagicNumber, r.footer.Version = MagicNumberV5, 5
+	if got, err := r.Properties(); err != nil || len(got) != 0 {
+		t.Errorf("Properties() of a V5 file = %v, %v", got, err)
+	}
+}
+
+func TestBlockCompression(t *testing.T) {
+	dir := t.TempDir()
+	write := func(c Compression, value func(i int) []byte) string {
+		t.Helper()
+		path := filepath.Join(dir, fmt.Sprintf("%s-%d.sst", c, len(value(0))))
+		w, err := NewWriterWithOptions(path, WriterOptions{Compression: c})
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		for i := 0; i < 200; i++ {
+			if _, err := w.Write([]byte(fmt.Sprintf("key%03d", i)), value(i)); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+		return path
+	}
+	jsonValue := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"name":"user-%d","tags":["alpha","beta","gamma"],"active":true,`+
+			`"address":{"street":"Main Street","city":"Springfield","country":"US"}}`, i, i))
+	}
+
+	sizes := make(map[Compression]int64)
+	for _, c := range []Compression{NoCompression, SnappyCompression, ZstdCompression} {
+		r, err := NewReader(write(c, jsonValue))
+		if err != nil {
+			t.Fatalf("%s: Failed to create reader: %v", c, err)
+		}
+		sizes[c] = r.Size()
+
+		for _, i := range []int{0, 57, 199} {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if val, found, err := r.Get(key); err != nil || !found || !bytes.Equal(val, jsonValue(i)) {
+				t.Errorf("%s: Get(%s) = %q, %v, %v", c, key, val, found, err)
+			}
+		}
+		n := 0
+		it := r.NewIterator()
+		for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+			if want := fmt.Sprintf("key%03d", n); string(it.Key()) != want || !bytes.Equal(it.Value(), jsonValue(n)) {
+				t.Fatalf("%s: record %d = %q, want %s", c, n, it.Key(), want)
+			}
+			n++
+		}
+		if err != nil || n != 200 {
+			t.Errorf("%s: iterated %d records, %v; want 200", c, n, err)
+		}
+		n = 0
+		for err = it.SeekToLast(); err == nil && it.Valid(); err = it.Prev() {
+			n++
+		}
+		if err != nil || n != 200 {
+			t.Errorf("%s: iterated %d records backwards, %v; want 200", c, n, err)
+		}
+		if err := it.Seek([]byte("key100")); err != nil || string(it.Key()) != "key100" {
+			t.Errorf("%s: Seek(key100) at %q, %v", c, it.Key(), err)
+		}
+		if smallest, largest, err := r.Bounds(); err != nil || string(smallest) != "key000" || string(largest) != "key199" {
+			t.Errorf("%s: Bounds() = %q, %q, %v", c, smallest, largest, err)
+		}
+		if err := r.VerifyChecksums(); err != nil {
+			t.Errorf("%s: VerifyChecksums: %v", c, err)
+		}
+		r.Close()
+	}
+	for _, c := range []Compression{SnappyCompression, ZstdCompression} {
+		if sizes[c]*2 > sizes[NoCompression] {
+			t.Errorf("%s table is %d bytes, uncompressed %d", c, sizes[c], sizes[NoCompression])
+		}
+	}
+
+	// Blocks that do not shrink are stored as they are.
+	noise := func(i int) []byte {
+		v := make([]byte, 300)
+		rand.New(rand.NewSource(int64(i))).Read(v)
+		return v
+	}
+	r, err := NewReader(write(ZstdCompression, noise))
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer r.Close()
+	_, end, _ := r.blockBounds(0)
+	kind := make([]byte, 1)
+	if _, err := r.file.ReadAt(kind, end); err != nil || Compression(kind[0]) != NoCompression {
+		t.Errorf("incompressible block stored as %v, %v", Compression(kind[0]), err)
+	}
+	if val, found, err := r.Get([]byte("key042")); err != nil || !found || !bytes.Equal(val, noise(42)) {
+		t.Errorf("Get from an uncompressed block = %v, %v", found, err)
+	}
+}
+
+func TestDataBlockPrefixCompression(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "prefix.sst")
+	w, err := NewWriter(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	key := func(i int) []byte { return []byte(fmt.Sprintf("user:%07d", 1000000+i*3)) }
+	var keyBytes int64
+	for i := 0; i < 2000; i++ {
+		if _, err := w.Write(key(i), []byte("v")); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		keyBytes += int64(len(key(i)))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	r, err := NewReader(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer r.Close()
+	if dataBytes := r.footer.BlockIndexOffset; dataBytes > keyBytes*2/3 {
+		t.Errorf("%d bytes of data blocks for %d bytes of keys; prefixes not shared", dataBytes, keyBytes)
+	}
+	bi, err := r.blockIter(0)
+	if err != nil {
+		t.Fatalf("blockIter: %v", err)
+	}
+	if want := (int(r.blockIndex.Entries[0].Count) + restartInterval - 1) / restartInterval; bi.numRestarts() != want {
+		t.Errorf("first block has %d restart points, want %d", bi.numRestarts(), want)
+	}
+
+	for i := 0; i < 2000; i += 7 {
+		if val, found, err := r.Get(key(i)); err != nil || !found || string(val) != "v" {
+			t.Fatalf("Get(%s) = %q, %v, %v", key(i), val, found, err)
+		}
+		// Between two keys: absent, and Seek lands on the next one.
+		between := append(key(i), '!')
+		if _, found, err := r.Get(between); err != nil || found {
+			t.Errorf("Get(%s) = %v, %v; want absent", between, found, err)
+		}
+		it := r.NewIterator()
+		if err := it.Seek(between); err != nil || (i < 1999 && !bytes.Equal(it.Key(), key(i+1))) {
+			t.Errorf("Seek(%s) at %q, %v; want %s", between, it.Key(), err, key(i+1))
+		}
+	}
+
+	it := r.NewIterator()
+	n := 2000
+	for err = it.SeekToLast(); err == nil && it.Valid(); err = it.Prev() {
+		n--
+		if !bytes.Equal(it.Key(), key(n)) {
+			t.Fatalf("Prev at %q, want %s", it.Key(), key(n))
+		}
+	}
+	if err != nil || n != 0 {
+		t.Errorf("walked back to record %d, %v; want 0", n, err)
+	}
+
+	// Blocks of older files hold full keys behind fixed-size headers.
+	var legacy []byte
+	for _, k := range []string{"a", "b", "c"} {
+		legacy = binary.LittleEndian.AppendUint32(legacy, uint32(len(k)))
+		legacy = binary.LittleEndian.AppendUint32(legacy, 1)
+		legacy = append(legacy, k+"1"...)
+	}
+	var old blockIter
+	if err := old.init(legacy, false); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if !old.seek([]byte("bb")) || string(old.key) != "c" || string(old.val) != "1" {
+		t.Errorf("seek(bb) in an older block at %q = %q", old.key, old.val)
+	}
+	for _, want := range []string{"b", "a"} {
+		if !old.prev() || string(old.key) != want {
+			t.Errorf("prev in an older block at %q, want %s", old.key, want)
+		}
+	}
+	if old.prev() {
+		t.Errorf("prev before the first record at %q", old.key)
+	}
+}
+
+func TestIteratorReadahead(t *testing.T) {
+	sstPath := filepath.Join(t.TempDir(), "readahead.sst")
+	writer, err := NewWriter(sstPath)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	value := make([]byte, 100)
+	for i := 0; i < 1000; i++ {
+		if _, err := writer.Write([]byte(fmt.Sprintf("key%04d", i)), value); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	for _, cache := range []*BlockCache{nil, NewBlockCache(1<<20, CachePolicyLRU)} {
+		reader, err := NewReaderWithOptions(sstPath, ReaderOptions{Cache: cache})
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		if reader.numBlocks() < 10 {
+			t.Fatalf("expected many blocks, got %d", reader.numBlocks())
+		}
+
+		it := reader.NewIteratorWithOptions(IteratorOptions{Readahead: 4})
+		n := 0
+		for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+			if got, want := string(it.Key()), fmt.Sprintf("key%04d", n); got != want {
+				t.Fatalf("scan at %s, want %s", got, want)
+			}
+			if it.Block() >= readaheadAfter && len(it.ra.pending) == 0 && it.Block()+1 < reader.numBlocks() {
+				t.Fatalf("nothing read ahead of block %d", it.Block())
+			}
+			n++
+		}
+		if err != nil || n != 1000 {
+			t.Fatalf("scan read %d records, %v", n, err)
+		}
+
+		// A seek drops the blocks read ahead for the scan it leaves.
+		it.SeekToFirst()
+		for i := 0; i < 300; i++ {
+			it.Next()
+		}
+		if err := it.Seek([]byte("key0900")); err != nil || string(it.Key()) != "key0900" {
+			t.Fatalf("Seek(key0900) at %q, %v", it.Key(), err)
+		}
+		if len(it.ra.pending) != 0 {
+			t.Errorf("%d blocks still read ahead after a seek", len(it.ra.pending))
+		}
+		for i := 901; i < 1000; i++ {
+			if err := it.Next(); err != nil || string(it.Key()) != fmt.Sprintf("key%04d", i) {
+				t.Fatalf("Next after Seek at %q, %v; want key%04d", it.Key(), err, i)
+			}
+		}
+		it.Close()
+		reader.Close()
+	}
+}
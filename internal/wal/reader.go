@@ -0,0 +1,374 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// Reader reads the records of a WAL in write order, one at a time. Where
+// Replay pushes every record to a callback, a Reader is pulled by its
+// consumer, which suits shipping the log elsewhere, as change data capture
+// does.
+//
+// A Reader can follow a log that is still being written: Next returns
+// io.EOF at the end of the data, and a later call picks up the records
+// written since. A record cut short by the end of the file is taken for
+// one still being written and read again by that later call, so damage at
+// the end of the log is only skipped once a record is written after it.
+type Reader struct {
+	r      io.ReadSeeker
+	br     *bufio.Reader
+	closer io.Closer
+	header []byte
+	ext    []byte
+	buf    *[]byte
+	opts   ReplayOptions
+
+	// follow is set for a Reader, which may read a log still being
+	// written. Replay clears it: a record cut short at the end of a log it
+	// recovers is damage.
+	follow bool
+	// chunkAt is the file offset of the compressed chunk whose records
+	// the Reader reads, or -1 for one reading a file.
+	chunkAt int64
+
+	off     int64       // offset of the next record
+	result  *LoadResult // shared with the Reader of a chunk
+	info    RecordInfo  // the record being decoded
+	pending []Record    // ops of a batch not returned yet
+	chunk   *Reader     // records of a chunk not returned yet
+	done    bool        // damage ended the log
+}
+
+func newReader(r io.ReadSeeker, header []byte, dataBuf *[]byte, opts ReplayOptions, follow bool) *Reader {
+	return &Reader{
+		r:       r,
+		br:      bufio.NewReaderSize(r, resyncBufSize),
+		header:  header,
+		ext:     make([]byte, seqExtSize),
+		buf:     dataBuf,
+		opts:    opts,
+		follow:  follow,
+		chunkAt: -1,
+		result:  &LoadResult{FirstCorrupt: -1},
+	}
+}
+
+// NewReader returns a Reader of the WAL in r, which is positioned at its
+// start.
+func NewReader(r io.ReadSeeker) *Reader {
+	var buf []byte
+	return newReader(r, make([]byte, headerSize), &buf, ReplayOptions{}, true)
+}
+
+// OpenReader opens the WAL at path for reading. The file stays open until
+// Close, so on most platforms the Reader can finish a WAL that is deleted
+// meanwhile.
+func OpenReader(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	rd := NewReader(f)
+	rd.closer = f
+	return rd, nil
+}
+
+// Close closes the file of a Reader from OpenReader.
+func (rd *Reader) Close() error {
+	if rd.closer == nil {
+		return nil
+	}
+	return rd.closer.Close()
+}
+
+// Next returns the next intact record, or io.EOF at the end of the log.
+// Damaged records are skipped. Key and Value alias an internal buffer and
+// are only valid until the next call.
+func (rd *Reader) Next() (Record, error) {
+	for {
+		if len(rd.pending) > 0 {
+			rec := rd.pending[0]
+			rd.pending = rd.pending[1:]
+			return rec, nil
+		}
+		if rd.chunk != nil {
+			if rec, err := rd.chunk.Next(); err != io.EOF {
+				return rec, err
+			}
+			rd.chunk = nil
+		}
+		if rd.done {
+			return Record{}, io.EOF
+		}
+		rec, ok, err := rd.decode()
+		if ok || err != nil {
+			return rec, err
+		}
+	}
+}
+
+// replayRecords passes the records decoded from r to fn until the end of
+// the log or fn returning false. Damage in a record with a sync marker is
+// skipped up to the next marker; an older record with a bad header or cut
+// short ends the replay, as nothing after it can be located unless a later
+// record has a marker.
+func replayRecords(r io.ReadSeeker, header []byte, dataBuf *[]byte, opts ReplayOptions, fn func(rec Record) bool) (*LoadResult, error) {
+	rd := newReader(r, header, dataBuf, opts, false)
+	for {
+		rec, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rd.result, err
+		}
+		if !fn(rec) {
+			break
+		}
+		// A batch counts as one record, once all of its ops are in.
+		if rec.BatchEnd == 0 || rec.Seq == rec.BatchEnd {
+			rd.result.Recovered++
+		}
+	}
+	return rd.result, nil
+}
+
+// report ends the record being decoded, which took size bytes, as status.
+func (rd *Reader) report(size int64, status RecordStatus) {
+	rd.info.Size = size
+	rd.info.Status = status
+	rd.off = rd.info.Offset + size
+	info := rd.info
+	if rd.chunkAt >= 0 {
+		// The records of a chunk have no offsets of their own in the file.
+		info.Offset, info.Compressed = rd.chunkAt, true
+	} else {
+		rd.result.End = rd.off
+	}
+	if status != RecordOK {
+		rd.result.Skipped++
+		if rd.result.FirstCorrupt < 0 {
+			rd.result.FirstCorrupt = info.Offset
+		}
+	}
+	if rd.opts.OnRecord != nil {
+		rd.opts.OnRecord(info)
+	}
+}
+
+// damaged reports the record being decoded as status and returns nil if a
+// sync marker follows: the damage spans up to it, and reading goes on
+// there. Otherwise the record took size bytes and ends the log, with
+// io.EOF, unless rd follows a live log: then the record may still be
+// being written, and is read again by the next call.
+// Marker bytes that happen to occur in the damaged data make it count as
+// more than one damaged record.
+func (rd *Reader) damaged(size int64, status RecordStatus) error {
+	next, err := resync(rd.r, rd.br, rd.info.Offset+1)
+	if err != nil {
+		return err
+	}
+	if next >= 0 {
+		rd.report(next-rd.info.Offset, status)
+		return nil
+	}
+	if rd.follow {
+		if _, err := rd.r.Seek(rd.info.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		rd.br.Reset(rd.r)
+		return io.EOF
+	}
+	rd.report(size, status)
+	rd.done = true
+	return io.EOF
+}
+
+// decode reads the record at rd.off. It returns the record if it stands
+// on its own, or ok false once it has queued the ops of a batch or the
+// records of a chunk, or skipped damage. err is io.EOF at the end of the
+// log.
+func (rd *Reader) decode() (rec Record, ok bool, err error) {
+	rd.info = RecordInfo{Offset: rd.off, Version: 1}
+	header := rd.header
+
+	// Reuse header buffer (fixed size)
+	n, err := io.ReadFull(rd.br, header)
+	if err == io.EOF {
+		return Record{}, false, io.EOF
+	}
+	if err != nil {
+		// A header cut short by the end of the file
+		return Record{}, false, rd.damaged(int64(n), RecordTruncated)
+	}
+	size := int64(headerSize)
+	framed := string(header[:syncMarkerSize]) == syncMarker
+	if framed {
+		// The header proper follows the marker.
+		copy(header, header[syncMarkerSize:])
+		n, err := io.ReadFull(rd.br, header[headerSize-syncMarkerSize:])
+		if err != nil {
+			return Record{}, false, rd.damaged(size+int64(n), RecordTruncated)
+		}
+		size += syncMarkerSize
+	}
+
+	expectSum := binary.LittleEndian.Uint32(header[0:4])
+	kField := binary.LittleEndian.Uint32(header[4:8])
+	vsiz := binary.LittleEndian.Uint32(header[8:12])
+	isRange := kField&rangeDeleteFlag != 0
+	hasSeq := kField&seqFlag != 0
+	isBatch := kField&batchFlag != 0
+	isChunk := kField&chunkFlag != 0
+	ksiz := kField &^ (rangeDeleteFlag | seqFlag | batchFlag | chunkFlag)
+	rd.info.Checksum = expectSum
+	rd.info.Ops = 1
+	switch {
+	case framed:
+		rd.info.Version = 3
+	case hasSeq:
+		rd.info.Version = 2
+	}
+	var count uint32
+	if isBatch {
+		// The kSize field holds the op count; there is no key.
+		count, ksiz = ksiz, 0
+		rd.info.Ops = int(count)
+	}
+
+	// Security: Validate sizes to prevent memory exhaustion attacks
+	inChunk := rd.chunkAt >= 0
+	if ksiz > KeySizeLimit || (!isBatch && !isChunk && vsiz > ValueSizeLimit) || (isRange && vsiz > KeySizeLimit) ||
+		(isBatch && (isRange || !hasSeq || count == 0 || vsiz > BatchSizeLimit || count > vsiz/3)) ||
+		(isChunk && (inChunk || !framed || hasSeq || isRange || isBatch || ksiz != 0 || vsiz > chunkSizeLimit)) {
+		// Invalid size: the next record cannot be located from here
+		return Record{}, false, rd.damaged(size, RecordBadHeader)
+	}
+
+	neededSize := int(ksiz + vsiz)
+
+	actualSum := crc32.ChecksumIEEE(header[4:])
+	if hasSeq {
+		n, err := io.ReadFull(rd.br, rd.ext)
+		if err != nil {
+			return Record{}, false, rd.damaged(size+int64(n), RecordTruncated)
+		}
+		size += seqExtSize
+		actualSum = crc32.Update(actualSum, crc32.IEEETable, rd.ext)
+		rec.Seq = binary.LittleEndian.Uint64(rd.ext[0:8])
+		rec.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(rd.ext[8:16])))
+		rd.info.Seq, rd.info.Time = rec.Seq, rec.Time
+	}
+
+	// Reuse data buffer, grow if needed
+	if cap(*rd.buf) < neededSize {
+		*rd.buf = make([]byte, neededSize)
+	}
+	data := (*rd.buf)[:neededSize]
+
+	if n, err := io.ReadFull(rd.br, data); err != nil {
+		// Can't read data: the file ends inside the record, or its
+		// length is damaged
+		return Record{}, false, rd.damaged(size+int64(n), RecordTruncated)
+	}
+	size += int64(neededSize)
+
+	// Verify checksum
+	actualSum = crc32.Update(actualSum, crc32.IEEETable, data)
+	if expectSum != actualSum {
+		if framed {
+			// The sizes may be what is damaged, so the record's own
+			// length cannot be trusted to find the next one.
+			return Record{}, false, rd.damaged(size, RecordChecksumMismatch)
+		}
+		// Checksum mismatch: skip the record and go on with the next
+		rd.report(size, RecordChecksumMismatch)
+		return Record{}, false, nil
+	}
+	if isChunk {
+		chunk, err := rd.openChunk(data)
+		if err != nil {
+			rd.report(size, RecordBadChunk)
+			return Record{}, false, nil
+		}
+		rd.off = rd.info.Offset + size
+		rd.result.End = rd.off
+		rd.chunk = chunk
+		return Record{}, false, nil
+	}
+	if isBatch {
+		recs, ok := decodeBatch(data, count, rec.Seq, rec.Time)
+		if !ok {
+			rd.report(size, RecordBadBatch)
+			return Record{}, false, nil
+		}
+		rd.report(size, RecordOK)
+		rd.pending = recs
+		return Record{}, false, nil
+	}
+	rd.report(size, RecordOK)
+
+	// Checksum valid, restore data
+	rec.Key = data[:ksiz]
+	rec.Value = data[ksiz:]
+	rec.RangeDelete = isRange
+
+	// handle tombstone
+	if !isRange && vsiz == 0 {
+		rec.Value = nil
+	}
+	return rec, true, nil
+}
+
+// openChunk returns a Reader of the records compressed into the chunk
+// data, which starts at rd.info.Offset, or errBadChunk if it does not
+// decompress. The chunk Reader adds its counts to rd's.
+func (rd *Reader) openChunk(data []byte) (*Reader, error) {
+	n, err := s2.DecodedLen(data)
+	if err != nil || n > chunkSizeLimit {
+		return nil, errBadChunk
+	}
+	records, err := s2.Decode(make([]byte, n), data)
+	if err != nil {
+		return nil, errBadChunk
+	}
+	var buf []byte
+	chunk := newReader(bytes.NewReader(records), make([]byte, headerSize), &buf, rd.opts, false)
+	chunk.chunkAt = rd.info.Offset
+	chunk.result = rd.result
+	return chunk, nil
+}
+
+// resync returns the offset of the first sync marker at or after off in
+// r, or -1 if there is none, and leaves br reading from it.
+func resync(r io.ReadSeeker, br *bufio.Reader, off int64) (int64, error) {
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return -1, err
+	}
+	br.Reset(r)
+	for {
+		buf, err := br.Peek(br.Size())
+		if i := bytes.Index(buf, []byte(syncMarker)); i >= 0 {
+			br.Discard(i)
+			return off + int64(i), nil
+		}
+		if err == io.EOF {
+			return -1, nil
+		}
+		if err != nil {
+			return -1, err
+		}
+		// Keep the tail that may hold the start of a marker.
+		n := len(buf) - (syncMarkerSize - 1)
+		br.Discard(n)
+		off += int64(n)
+	}
+}
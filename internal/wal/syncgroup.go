@@ -0,0 +1,151 @@
+package wal
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/clock"
+)
+
+// SyncGroup runs the periodic fsyncs of many WAL writers that share one
+// device. Instead of each writer ticking on its own, which keeps the disk
+// under constant fsync pressure once enough DBs are open, the group syncs
+// all of its writers back to back in one window per interval.
+//
+// Windows are aligned to multiples of the interval and shifted by a random
+// phase below Jitter, so groups for different devices do not all fire at
+// the same instant.
+type SyncGroup struct {
+	clock    clock.Clock
+	interval time.Duration
+	phase    time.Duration
+
+	mu      sync.Mutex
+	writers []*WalWriter
+
+	rounds uint64 // atomic; completed sync windows
+
+	stopCh chan struct{}
+	done   chan struct{}
+}
+
+// SyncGroupOptions configures a SyncGroup. The zero value gives the defaults.
+type SyncGroupOptions struct {
+	// Interval between sync windows. Zero means one second, the same as a
+	// writer's private sync loop.
+	Interval time.Duration
+
+	// Jitter bounds the random phase added to the aligned windows.
+	// Zero means no jitter.
+	Jitter time.Duration
+
+	// Clock drives the windows. Nil uses the wall clock.
+	Clock clock.Clock
+}
+
+// NewSyncGroup creates a SyncGroup and starts its sync loop.
+func NewSyncGroup(opts SyncGroupOptions) *SyncGroup {
+	g := &SyncGroup{
+		clock:    opts.Clock,
+		interval: opts.Interval,
+		stopCh:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if g.clock == nil {
+		g.clock = clock.Real()
+	}
+	if g.interval <= 0 {
+		g.interval = time.Second
+	}
+	if opts.Jitter > 0 {
+		g.phase = time.Duration(rand.Int63n(int64(opts.Jitter)))
+	}
+	go g.loop()
+	return g
+}
+
+// Rounds returns the number of sync windows run so far.
+func (g *SyncGroup) Rounds() uint64 {
+	return atomic.LoadUint64(&g.rounds)
+}
+
+// Writers returns the number of writers in the group.
+func (g *SyncGroup) Writers() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.writers)
+}
+
+// Close stops the sync loop. Writers still in the group are no longer synced
+// periodically; their data is synced when they are closed.
+func (g *SyncGroup) Close() {
+	select {
+	case <-g.stopCh:
+	default:
+		close(g.stopCh)
+	}
+	<-g.done
+}
+
+func (g *SyncGroup) add(w *WalWriter) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writers = append(g.writers, w)
+}
+
+// remove takes w out of the group and waits for a window that is syncing it
+// to finish with it.
+func (g *SyncGroup) remove(w *WalWriter) {
+	g.mu.Lock()
+	for i, other := range g.writers {
+		if other == w {
+			g.writers = append(g.writers[:i], g.writers[i+1:]...)
+			break
+		}
+	}
+	g.mu.Unlock()
+	w.wg.Wait()
+}
+
+func (g *SyncGroup) loop() {
+	defer close(g.done)
+
+	// Wait for the first aligned window.
+	now := g.clock.Now()
+	first := now.Truncate(g.interval).Add(g.interval).Add(g.phase)
+	select {
+	case <-g.clock.After(first.Sub(now)):
+	case <-g.stopCh:
+		return
+	}
+
+	ticker := g.clock.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		g.round()
+		select {
+		case <-ticker.C():
+		case <-g.stopCh:
+			return
+		}
+	}
+}
+
+// round syncs every writer in the group, one after another.
+func (g *SyncGroup) round() {
+	g.mu.Lock()
+	writers := make([]*WalWriter, len(g.writers))
+	copy(writers, g.writers)
+	for _, w := range writers {
+		w.wg.Add(1) // lets remove wait for us
+	}
+	g.mu.Unlock()
+
+	for _, w := range writers {
+		w.periodicSync()
+		w.wg.Done()
+	}
+	atomic.AddUint64(&g.rounds, 1)
+}
@@ -1,19 +1,29 @@
 package wal
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"hash/crc32"
-	"io"
 	"os"
+	"path/filepath"
+	"runtime/pprof"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/klauspost/compress/s2"
+
+	"github.com/return2faye/SiltKV/internal/clock"
 )
 
 var (
 	ErrChecksum    = errors.New("wal: invalid checksum")
 	ErrClosed      = errors.New("wal: writer is closed")
 	ErrInvalidSize = errors.New("wal: invalid key or value size")
+
+	// errBadChunk is a compressed chunk that does not decompress.
+	errBadChunk = errors.New("wal: bad chunk compression")
 )
 
 const (
@@ -24,16 +34,65 @@ const (
 	headerSize = 12
 	// initialDataBufferSize is the initial capacity for the reusable data buffer in Load
 	initialDataBufferSize = 1024
-	// maxKeySize is the maximum allowed key size (128B, tuned for web workloads)
+	// maxKeySize is the default maximum key size (128B, tuned for web workloads)
 	maxKeySize = 128
-	// maxValueSize is the maximum allowed value size (4KB, compressed JSON payload)
+	// maxValueSize is the default maximum value size (4KB, compressed JSON payload)
 	maxValueSize = 4 * 1024
-	// maxRecordSize is the maximum allowed total record size (header + key + value)
-	maxRecordSize = headerSize + maxKeySize + maxValueSize
 	// maxWriteBufSize is the maximum buffer size before forcing a flush (64KB)
 	maxWriteBufSize = 64 << 10
+	// rangeDeleteFlag marks a range tombstone record in the kSize header field.
+	// The key holds the inclusive start and the value the exclusive end key.
+	// Key sizes never come close to using this bit.
+	rangeDeleteFlag = 1 << 31
+	// seqFlag marks a record whose header is followed by a seqExtSize-byte
+	// extension: sequence number (8) | unix nano timestamp (8). The
+	// checksum covers the extension. Older records lack it.
+	seqFlag    = 1 << 30
+	seqExtSize = 16
+	// batchFlag marks a batch record: the rest of the kSize field holds the
+	// op count and vSize the length of the encoded ops. The ops take
+	// consecutive sequence numbers starting at the one in the extension,
+	// which a batch record always has.
+	batchFlag = 1 << 29
+	// batchOpRange and batchOpDelete tag an encoded batch op; a put is 0.
+	batchOpRange  = 1
+	batchOpDelete = 2
+	// syncMarker starts every record, ahead of the header, so that a
+	// replay that meets a damaged record can scan forward to the next one
+	// and go on from there. Logs written before it was added lack it;
+	// their records start with the checksum.
+	syncMarker     = "\xf7SKV"
+	syncMarkerSize = 4
+	// resyncBufSize is the read buffer of a replay, which is also how far
+	// a resync looks ahead at a time.
+	resyncBufSize = 64 << 10
+	// chunkFlag marks a compressed chunk: vSize bytes of Snappy-compressed
+	// records, as the write buffer held them when it was flushed. The
+	// kSize field holds no size, and there is no sequence extension.
+	chunkFlag = 1 << 28
+	// chunkSizeLimit bounds what a chunk decompresses to: a full write
+	// buffer plus the largest record that can overflow it.
+	chunkSizeLimit = maxWriteBufSize + syncMarkerSize + headerSize + seqExtSize + BatchSizeLimit
+)
+
+// DefaultMaxKeySize and DefaultMaxValueSize are the largest key and value
+// Write accepts when WriterOptions.MaxKeySize and MaxValueSize are zero.
+const (
+	DefaultMaxKeySize   = maxKeySize
+	DefaultMaxValueSize = maxValueSize
 )
 
+// KeySizeLimit and ValueSizeLimit bound WriterOptions.MaxKeySize and
+// MaxValueSize. Replay takes a record header with a larger size for damage,
+// whatever limits the log was written with.
+const (
+	KeySizeLimit   = 1 << 20
+	ValueSizeLimit = 4 << 20
+)
+
+// BatchSizeLimit bounds the encoded ops of one batch record.
+const BatchSizeLimit = 32 << 20
+
 // Write-Ahead Log implementation
 type WalWriter struct {
 	mu        sync.Mutex
@@ -48,17 +107,111 @@ type WalWriter struct {
 	maxBufSize int    // maximum buffer size before flush
 
 	closed   bool
-	asyncErr error // background fsync error (surfaced on Write/Sync)
+	asyncErr error // failed write or fsync, returned by every later Write and Sync
+	onError  func(error)
+
+	compress bool   // see WriterOptions.Compress
+	chunkBuf []byte // reusable buffer for a compressed chunk
+
+	maxKey   int // see WriterOptions.MaxKeySize
+	maxValue int
+
+	bytesWritten uint64 // encoded record bytes accepted by this writer (guarded by mu)
+	size         int64  // bytes in the file, buffered ones not included (guarded by mu)
+	durable      int64  // bytes in the file as of the last fsync (atomic)
+	onSync       func(time.Duration)
+	beforeSync   func() error
+	clock        clock.Clock // record timestamps and the sync loop ticker
+
+	// seq is the sequence counter (atomic); shared between writers when
+	// WriterOptions.Sequence is set. lastSeq and lastTime track the newest
+	// record written or replayed through this writer (guarded by mu).
+	seq      *uint64
+	lastSeq  uint64
+	lastTime int64
 
 	stopCh chan struct{}
-	wg     sync.WaitGroup
+	wg     sync.WaitGroup // background sync loop, or in-flight group syncs
+	group  *SyncGroup     // nil when the writer runs its own sync loop
+}
+
+// WriterOptions configures a WalWriter.
+type WriterOptions struct {
+	// OnSync, if set, is called with the duration of every successful fsync.
+	// It may run with the writer's lock held, so it must be quick and must
+	// not call back into the writer.
+	OnSync func(time.Duration)
+
+	// BeforeSync, if set, is called before every fsync of the log, which
+	// fails with its error. A DB whose records point into other files
+	// syncs those here, so the log is never durable ahead of them.
+	BeforeSync func() error
+
+	// Sequence is a counter shared by the writers of one DB. Each record
+	// takes the next value with an atomic increment, so sequence numbers
+	// are unique and increasing across WAL files. If nil, the writer uses
+	// a private counter.
+	Sequence *uint64
+
+	// Clock stamps records and drives the background sync loop. Nil uses
+	// the wall clock; tests pass a clock.Fake to control both.
+	Clock clock.Clock
+
+	// SyncGroup, if set, runs this writer's periodic fsync together with
+	// the other writers in the group instead of on a private ticker.
+	SyncGroup *SyncGroup
+
+	// ProfileLabels are pprof label key/value pairs set on the private
+	// sync loop goroutine, so that profiles attribute its fsyncs.
+	ProfileLabels []string
+
+	// MaxKeySize and MaxValueSize are the largest key and value Write
+	// accepts; larger ones fail with ErrInvalidSize before anything is
+	// logged. Zero uses the defaults (128B and 4KB). They are capped at
+	// KeySizeLimit and ValueSizeLimit.
+	MaxKeySize   int
+	MaxValueSize int
+
+	// OnError, if set, is called once when writing or syncing the log
+	// fails, in the background or not. The writer keeps the error and
+	// fails every later Write and Sync with it. It is called on a
+	// goroutine of its own, as the failure may happen with the caller's
+	// locks held.
+	OnError func(error)
+
+	// Compress makes the writer compress its write buffer with Snappy
+	// each time it flushes it to the file, and log the result as one
+	// chunk record when that saves at least an eighth. Records are still
+	// encoded one by one as they are written, so Write does no more work;
+	// the cost is paid once per flushed buffer. Damage to a chunk loses
+	// all of its records.
+	Compress bool
 }
 
 func NewWalWriter(path string) (*WalWriter, error) {
+	return NewWalWriterWithOptions(path, WriterOptions{})
+}
+
+// NewWalWriterWithOptions is NewWalWriter with explicit options.
+func NewWalWriterWithOptions(path string, opts WriterOptions) (*WalWriter, error) {
+	_, err := os.Stat(path)
+	created := os.IsNotExist(err)
 	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if created {
+		// Synced records are only durable once the file itself is.
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
 	w := &WalWriter{
 		file:       f,
 		buf:        make([]byte, 0, initialBufferSize),     // pre-allocate write buffer capacity
@@ -66,12 +219,47 @@ func NewWalWriter(path string) (*WalWriter, error) {
 		dataBuf:    make([]byte, 0, initialDataBufferSize), // pre-allocate data buffer capacity
 		writeBuf:   make([]byte, 0, maxWriteBufSize),       // pre-allocate write buffer
 		maxBufSize: maxWriteBufSize,
+		onSync:     opts.OnSync,
+		beforeSync: opts.BeforeSync,
+		onError:    opts.OnError,
+		seq:        opts.Sequence,
+		clock:      opts.Clock,
+		maxKey:     maxKeySize,
+		maxValue:   maxValueSize,
+		compress:   opts.Compress,
+		size:       st.Size(),
+		durable:    st.Size(),
 		stopCh:     make(chan struct{}),
 	}
+	if opts.MaxKeySize > 0 {
+		w.maxKey = min(opts.MaxKeySize, KeySizeLimit)
+	}
+	if opts.MaxValueSize > 0 {
+		w.maxValue = min(opts.MaxValueSize, ValueSizeLimit)
+	}
+	if w.seq == nil {
+		w.seq = new(uint64)
+	}
+	if w.clock == nil {
+		w.clock = clock.Real()
+	}
 
 	// Start background fsync loop (time-driven durability)
-	w.wg.Add(1)
-	go w.syncLoop(time.Second)
+	if opts.SyncGroup != nil {
+		w.group = opts.SyncGroup
+		w.group.add(w)
+	} else {
+		w.wg.Add(1)
+		if len(opts.ProfileLabels) > 0 {
+			// A goroutine inherits the labels of the one that starts it.
+			labels := pprof.Labels(opts.ProfileLabels...)
+			pprof.Do(context.Background(), labels, func(context.Context) {
+				go w.syncLoop(time.Second)
+			})
+		} else {
+			go w.syncLoop(time.Second)
+		}
+	}
 
 	return w, nil
 }
@@ -82,17 +270,114 @@ func (w *WalWriter) Write(key, value []byte) error {
 
 	// Fail Fast: Validate sizes before any allocation or I/O
 	// This prevents silent data loss (write succeeds but can't be recovered)
-	if ksiz > maxKeySize {
+	if ksiz > w.maxKey {
 		return ErrInvalidSize
 	}
-	if vsiz > maxValueSize {
+	if vsiz > w.maxValue {
 		return ErrInvalidSize
 	}
-	if ksiz+vsiz > maxRecordSize-headerSize {
+
+	return w.writeRecord(uint32(ksiz), key, value)
+}
+
+// WriteRangeDelete logs a range tombstone covering keys in [start, end).
+func (w *WalWriter) WriteRangeDelete(start, end []byte) error {
+	if len(start) > w.maxKey || len(end) > w.maxKey {
 		return ErrInvalidSize
 	}
+	return w.writeRecord(uint32(len(start))|rangeDeleteFlag, start, end)
+}
+
+// BatchOp is one mutation of a batch written with WriteBatch.
+type BatchOp struct {
+	Key   []byte
+	Value []byte // nil for a tombstone; the end key for a range delete
 
-	neededSize := headerSize + ksiz + vsiz
+	RangeDelete bool // Key and Value are the [start, end) of a range tombstone
+}
+
+// WriteBatch logs ops as a single record with one checksum, so a replay
+// returns either all of them or none. The ops take consecutive sequence
+// numbers in order. An empty batch writes nothing.
+func (w *WalWriter) WriteBatch(ops []BatchOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	var payload []byte
+	for _, op := range ops {
+		tag := byte(0)
+		switch {
+		case op.RangeDelete:
+			if len(op.Key) > w.maxKey || len(op.Value) > w.maxKey {
+				return ErrInvalidSize
+			}
+			tag = batchOpRange
+		case op.Value == nil:
+			tag = batchOpDelete
+		}
+		if len(op.Key) > w.maxKey || len(op.Value) > w.maxValue {
+			return ErrInvalidSize
+		}
+		payload = append(payload, tag)
+		payload = binary.AppendUvarint(payload, uint64(len(op.Key)))
+		payload = binary.AppendUvarint(payload, uint64(len(op.Value)))
+		payload = append(payload, op.Key...)
+		payload = append(payload, op.Value...)
+		if len(payload) > BatchSizeLimit {
+			return ErrInvalidSize
+		}
+	}
+	return w.writeEncoded(uint32(len(ops))|batchFlag, nil, payload, uint64(len(ops)))
+}
+
+// decodeBatch splits the encoded ops of a batch record of count ops into
+// records numbered from seq. The records alias data.
+func decodeBatch(data []byte, count uint32, seq uint64, t time.Time) ([]Record, bool) {
+	recs := make([]Record, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(data) == 0 {
+			return nil, false
+		}
+		tag := data[0]
+		data = data[1:]
+		ksiz, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, false
+		}
+		data = data[n:]
+		vsiz, n := binary.Uvarint(data)
+		if n <= 0 || tag > batchOpDelete || ksiz+vsiz > uint64(len(data)-n) {
+			return nil, false
+		}
+		data = data[n:]
+		rec := Record{
+			Seq:         seq + uint64(i),
+			Time:        t,
+			Key:         data[:ksiz:ksiz],
+			Value:       data[ksiz : ksiz+vsiz : ksiz+vsiz],
+			RangeDelete: tag == batchOpRange,
+			BatchEnd:    seq + uint64(count) - 1,
+		}
+		if tag == batchOpDelete {
+			rec.Value = nil
+		}
+		recs = append(recs, rec)
+		data = data[ksiz+vsiz:]
+	}
+	return recs, len(data) == 0
+}
+
+// writeRecord encodes one record into the write buffer.
+// kField is the raw kSize header field, including any record flags.
+func (w *WalWriter) writeRecord(kField uint32, key, value []byte) error {
+	return w.writeEncoded(kField, key, value, 1)
+}
+
+// writeEncoded is writeRecord for a record that takes n sequence numbers.
+func (w *WalWriter) writeEncoded(kField uint32, key, value []byte, n uint64) error {
+	ksiz := len(key)
+	vsiz := len(value)
+	neededSize := syncMarkerSize + headerSize + seqExtSize + ksiz + vsiz
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -109,21 +394,34 @@ func (w *WalWriter) Write(key, value []byte) error {
 	if cap(w.buf) < neededSize {
 		w.buf = make([]byte, neededSize)
 	}
-	buf := w.buf[:neededSize]
+	record := w.buf[:neededSize]
+	copy(record, syncMarker)
+	buf := record[syncMarkerSize:]
+
+	// Sequence numbers are taken under mu so they increase in file order.
+	last := atomic.AddUint64(w.seq, n)
+	seq := last - n + 1
+	now := w.clock.Now().UnixNano()
 
-	// header: checksum(4) | kSize(4) | vSize(4)
-	binary.LittleEndian.PutUint32(buf[4:8], uint32(ksiz))
+	// header: checksum(4) | kSize(4) | vSize(4) | seq(8) | time(8)
+	binary.LittleEndian.PutUint32(buf[4:8], kField|seqFlag)
 	binary.LittleEndian.PutUint32(buf[8:12], uint32(vsiz))
+	binary.LittleEndian.PutUint64(buf[12:20], seq)
+	binary.LittleEndian.PutUint64(buf[20:28], uint64(now))
 
-	copy(buf[12:], key)
-	copy(buf[12+ksiz:], value)
+	data := buf[headerSize+seqExtSize:]
+	copy(data, key)
+	copy(data[ksiz:], value)
 
 	sum := crc32.ChecksumIEEE(buf[4:])
 	binary.LittleEndian.PutUint32(buf[0:4], sum)
 
 	// Append encoded record to write buffer
-	w.writeBuf = append(w.writeBuf, buf...)
+	w.writeBuf = append(w.writeBuf, record...)
 	w.bufSize += neededSize
+	w.bytesWritten += uint64(neededSize)
+	w.lastSeq = last
+	w.lastTime = now
 
 	// Flush to OS page cache if buffer is large enough
 	if w.bufSize >= w.maxBufSize {
@@ -142,9 +440,16 @@ func (w *WalWriter) flushBufferLocked() error {
 		return nil
 	}
 
-	_, err := w.file.Write(w.writeBuf)
+	out := w.writeBuf
+	if w.compress {
+		if chunk, ok := w.compressChunk(); ok {
+			out = chunk
+		}
+	}
+	n, err := w.file.Write(out)
+	w.size += int64(n)
 	if err != nil {
-		return err
+		return w.failLocked(err)
 	}
 
 	// Reset buffer
@@ -153,6 +458,62 @@ func (w *WalWriter) flushBufferLocked() error {
 	return nil
 }
 
+// compressChunk encodes the write buffer as one compressed chunk record
+// and reports whether that saves at least an eighth of its size. Must be
+// called with mu held.
+func (w *WalWriter) compressChunk() ([]byte, bool) {
+	const prefix = syncMarkerSize + headerSize
+	src := w.writeBuf
+	need := prefix + s2.MaxEncodedLen(len(src))
+	if cap(w.chunkBuf) < need {
+		w.chunkBuf = make([]byte, need)
+	}
+	buf := w.chunkBuf[:need]
+	enc := s2.EncodeSnappy(buf[prefix:], src)
+	if prefix+len(enc) >= len(src)-len(src)/8 {
+		return nil, false
+	}
+	buf = buf[:prefix+len(enc)]
+
+	// marker(4) | checksum(4) | kSize(4) = chunkFlag | vSize(4) | data
+	copy(buf, syncMarker)
+	h := buf[syncMarkerSize:]
+	binary.LittleEndian.PutUint32(h[4:8], chunkFlag)
+	binary.LittleEndian.PutUint32(h[8:12], uint32(len(enc)))
+	binary.LittleEndian.PutUint32(h[0:4], crc32.ChecksumIEEE(h[4:]))
+	return buf, true
+}
+
+// LastSequence returns the sequence number and timestamp of the newest
+// record written or replayed through this writer (0 and the zero time if
+// there is none).
+func (w *WalWriter) LastSequence() (uint64, time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.lastTime == 0 {
+		return w.lastSeq, time.Time{}
+	}
+	return w.lastSeq, time.Unix(0, w.lastTime)
+}
+
+// advanceSequence raises the counter to at least seq.
+func advanceSequence(counter *uint64, seq uint64) {
+	for {
+		cur := atomic.LoadUint64(counter)
+		if cur >= seq || atomic.CompareAndSwapUint64(counter, cur, seq) {
+			return
+		}
+	}
+}
+
+// BytesWritten returns the number of record bytes logged by this writer.
+// Records replayed by Load are not counted.
+func (w *WalWriter) BytesWritten() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.bytesWritten
+}
+
 // file.Write only writes to Page Cache in Kernel
 // fsync forces swap data in cache into disk
 func (w *WalWriter) Sync() error {
@@ -172,19 +533,209 @@ func (w *WalWriter) Sync() error {
 	}
 
 	// Explicit Sync is allowed to block and provides strong durability.
-	return w.file.Sync()
+	if err := w.syncFile(w.file, w.size); err != nil {
+		return w.failLocked(err)
+	}
+	return nil
+}
+
+// SyncedSize syncs the log and returns its size. Every record in the first
+// size bytes of the file is durable, and no record is cut in half.
+func (w *WalWriter) SyncedSize() (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || w.file == nil {
+		return 0, ErrClosed
+	}
+	if w.asyncErr != nil {
+		return 0, w.asyncErr
+	}
+	if err := w.flushBufferLocked(); err != nil {
+		return 0, err
+	}
+	if err := w.syncFile(w.file, w.size); err != nil {
+		return 0, w.failLocked(err)
+	}
+	st, err := w.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+// DurableSize returns how many bytes of the log the last fsync made
+// durable, without syncing. No record is cut in half at that size.
+func (w *WalWriter) DurableSize() int64 {
+	return atomic.LoadInt64(&w.durable)
+}
+
+// syncFile fsyncs f, which holds size bytes, and reports the latency to
+// the OnSync observer.
+func (w *WalWriter) syncFile(f *os.File, size int64) error {
+	if w.beforeSync != nil {
+		if err := w.beforeSync(); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if w.onSync != nil {
+		w.onSync(time.Since(start))
+	}
+	// A periodic sync runs without the lock, so a later sync may finish
+	// first.
+	for {
+		old := atomic.LoadInt64(&w.durable)
+		if size <= old || atomic.CompareAndSwapInt64(&w.durable, old, size) {
+			return nil
+		}
+	}
 }
 
 // LoadResult contains statistics about the Load operation
 type LoadResult struct {
 	Recovered int // number of records successfully recovered
 	Skipped   int // number of corrupted records skipped
+
+	// End is the file offset just past the last record read, valid or not.
+	End int64
+	// FirstCorrupt is the file offset of the first record that was skipped
+	// or ended the replay, or -1 if every record read was intact.
+	FirstCorrupt int64
+}
+
+// RecordStatus tells whether a record found during replay could be used.
+type RecordStatus int
+
+const (
+	// RecordOK is an intact record; it is passed on to the replay callback.
+	RecordOK RecordStatus = iota
+	// RecordChecksumMismatch is a record whose checksum does not match. It
+	// is skipped and the replay goes on with the next sync marker, or for
+	// an older record without one, with the record after it.
+	RecordChecksumMismatch
+	// RecordBadHeader is a record header with impossible sizes. The replay
+	// goes on with the next sync marker, or stops if there is none.
+	RecordBadHeader
+	// RecordTruncated is a record cut off by the end of the file, as left
+	// by a crash in the middle of a write, or whose damaged length reaches
+	// past it. The replay goes on with the next sync marker, or stops if
+	// there is none.
+	RecordTruncated
+	// RecordBadBatch is a batch record with a valid checksum whose ops
+	// cannot be decoded. None of its ops are replayed; the replay goes on
+	// with the record after it.
+	RecordBadBatch
+	// RecordBadChunk is a compressed chunk with a valid checksum that does
+	// not decompress. None of its records are replayed; the replay goes on
+	// with the record after it.
+	RecordBadChunk
+)
+
+func (s RecordStatus) String() string {
+	switch s {
+	case RecordOK:
+		return "ok"
+	case RecordChecksumMismatch:
+		return "checksum mismatch"
+	case RecordBadHeader:
+		return "bad header"
+	case RecordTruncated:
+		return "truncated"
+	case RecordBadBatch:
+		return "bad batch"
+	case RecordBadChunk:
+		return "bad chunk"
+	default:
+		return "unknown"
+	}
+}
+
+// RecordInfo locates one record in a WAL file, intact or not.
+type RecordInfo struct {
+	Offset int64 // file offset of the record header
+	Size   int64 // bytes of the record in the file, header included
+	// Version is 3 for records that start with a sync marker, 2 for older
+	// records that carry a sequence number and timestamp and 1 for the
+	// ones without. Seq and Time are only set for version 2 and 3 records
+	// whose header could be read.
+	Version  int
+	Seq      uint64
+	Time     time.Time
+	Checksum uint32 // as stored in the header
+	Status   RecordStatus
+	// Ops is the number of mutations in the record: the op count of a
+	// batch record, otherwise 1. It is 0 if the header was unreadable.
+	Ops int
+	// Compressed is set for a record that was logged inside a compressed
+	// chunk. Offset is that of the chunk, and Size is the record's size
+	// before compression.
+	Compressed bool
+}
+
+// ReplayOptions configures ReplayWithOptions and ReplayFileWithOptions.
+type ReplayOptions struct {
+	// OnRecord, if set, is called for every record found, in file order,
+	// before an intact one is passed to the replay callback. Tools and
+	// repair workflows use it to pinpoint where corruption begins.
+	OnRecord func(RecordInfo)
+}
+
+// Record is one logged mutation as seen during replay. Key and Value alias
+// an internal buffer and are only valid until the callback returns, or for
+// a Reader, until the next call to Next.
+type Record struct {
+	// Seq and Time are assigned when the record is written. Records written
+	// before sequence numbers existed have Seq 0 and a zero Time.
+	Seq  uint64
+	Time time.Time
+
+	Key   []byte
+	Value []byte // nil for a tombstone; the end key for a range delete
+
+	RangeDelete bool // Key and Value are the [start, end) of a range tombstone
+
+	// BatchEnd is the sequence number of the last op of the batch the
+	// record was written in, or 0 if it was written on its own.
+	BatchEnd uint64
 }
 
 // Load restores data from WAL file with fault tolerance
 // It skips corrupted records and continues recovery instead of stopping
 // Returns LoadResult with recovery statistics
+// Range tombstones are skipped; use LoadWithRangeDeletes to receive them.
 func (w *WalWriter) Load(apply func(k, v []byte)) (*LoadResult, error) {
+	return w.LoadWithRangeDeletes(apply, nil)
+}
+
+// LoadWithRangeDeletes is like Load, but also replays range tombstones through
+// applyRange, interleaved with point records in the order they were written.
+// A nil applyRange ignores range tombstones.
+func (w *WalWriter) LoadWithRangeDeletes(apply func(k, v []byte), applyRange func(start, end []byte)) (*LoadResult, error) {
+	return w.Replay(func(rec Record) bool {
+		if rec.RangeDelete {
+			if applyRange != nil {
+				applyRange(rec.Key, rec.Value)
+			}
+		} else {
+			apply(rec.Key, rec.Value)
+		}
+		return true
+	})
+}
+
+// Replay passes every valid record to fn in write order and stops early when
+// fn returns false. The writer's sequence counter is advanced past every
+// record seen, so new writes never reuse a replayed sequence number.
+func (w *WalWriter) Replay(fn func(rec Record) bool) (*LoadResult, error) {
+	return w.ReplayWithOptions(fn, ReplayOptions{})
+}
+
+// ReplayWithOptions is Replay with explicit options.
+func (w *WalWriter) ReplayWithOptions(fn func(rec Record) bool, opts ReplayOptions) (*LoadResult, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -196,76 +747,33 @@ func (w *WalWriter) Load(apply func(k, v []byte)) (*LoadResult, error) {
 		return nil, err
 	}
 
-	result := &LoadResult{}
-
-	for {
-		// Reuse header buffer (fixed size)
-		_, err := io.ReadFull(w.file, w.headerBuf)
-		if err == io.EOF {
-			break
+	var buf []byte
+	return replayRecords(w.file, w.headerBuf, &buf, opts, func(rec Record) bool {
+		if rec.Seq > w.lastSeq {
+			w.lastSeq = rec.Seq
 		}
-		if err != nil {
-			// If we can't read header, we've reached end or file is corrupted
-			// Try to continue from next potential record boundary
-			// For now, we'll break and return partial recovery
-			break
-		}
-
-		expectSum := binary.LittleEndian.Uint32(w.headerBuf[0:4])
-		ksiz := binary.LittleEndian.Uint32(w.headerBuf[4:8])
-		vsiz := binary.LittleEndian.Uint32(w.headerBuf[8:12])
-
-		// Security: Validate sizes to prevent memory exhaustion attacks
-		if ksiz > maxKeySize || vsiz > maxValueSize {
-			// Invalid size, skip this record
-			result.Skipped++
-			// Try to find next record by seeking forward
-			// For simplicity, we'll break here (could implement more sophisticated recovery)
-			break
-		}
-
-		neededSize := int(ksiz + vsiz)
-		if neededSize > maxRecordSize-headerSize {
-			result.Skipped++
-			break
-		}
-
-		// Reuse data buffer, grow if needed
-		if cap(w.dataBuf) < neededSize {
-			w.dataBuf = make([]byte, neededSize)
-		}
-		data := w.dataBuf[:neededSize]
-
-		if _, err := io.ReadFull(w.file, data); err != nil {
-			// Can't read data, skip this record
-			result.Skipped++
-			break
-		}
-
-		// Verify checksum
-		actualSum := crc32.ChecksumIEEE(w.headerBuf[4:])
-		actualSum = crc32.Update(actualSum, crc32.IEEETable, data)
-		if expectSum != actualSum {
-			// Checksum mismatch, skip this corrupted record
-			result.Skipped++
-			// Continue to next record instead of stopping
-			continue
+		if t := rec.Time.UnixNano(); !rec.Time.IsZero() && t > w.lastTime {
+			w.lastTime = t
 		}
+		advanceSequence(w.seq, rec.Seq)
+		return fn(rec)
+	})
+}
 
-		// Checksum valid, restore data
-		key := data[:ksiz]
-		value := data[ksiz:]
+// ReplayFile replays the WAL at path without opening it for writing.
+func ReplayFile(path string, fn func(rec Record) bool) (*LoadResult, error) {
+	return ReplayFileWithOptions(path, fn, ReplayOptions{})
+}
 
-		// handle tombstone
-		if vsiz == 0 {
-			apply(key, nil)
-		} else {
-			apply(key, value)
-		}
-		result.Recovered++
+// ReplayFileWithOptions is ReplayFile with explicit options.
+func ReplayFileWithOptions(path string, fn func(rec Record) bool, opts ReplayOptions) (*LoadResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
-
-	return result, nil
+	defer f.Close()
+	var buf []byte
+	return replayRecords(f, make([]byte, headerSize), &buf, opts, fn)
 }
 
 // Close closes the WAL file
@@ -281,6 +789,9 @@ func (w *WalWriter) Close() error {
 	// Stop background sync loop
 	close(w.stopCh)
 	w.mu.Unlock()
+	if w.group != nil {
+		w.group.remove(w)
+	}
 
 	// Wait for background goroutine to exit
 	w.wg.Wait()
@@ -294,7 +805,7 @@ func (w *WalWriter) Close() error {
 
 	// Flush pending writes then fsync and close.
 	flushErr := w.flushBufferLocked()
-	syncErr := w.file.Sync()
+	syncErr := w.syncFile(w.file, w.size)
 	closeErr := w.file.Close()
 	w.file = nil
 
@@ -312,40 +823,70 @@ func (w *WalWriter) Close() error {
 func (w *WalWriter) syncLoop(interval time.Duration) {
 	defer w.wg.Done()
 
-	ticker := time.NewTicker(interval)
+	ticker := w.clock.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			w.mu.Lock()
-			if w.closed || w.file == nil {
-				w.mu.Unlock()
+		case <-ticker.C():
+			if !w.periodicSync() {
 				return
 			}
-			if w.asyncErr != nil {
-				w.mu.Unlock()
-				continue
-			}
-
-			// Ensure data reaches OS page cache before fsync.
-			if err := w.flushBufferLocked(); err != nil {
-				w.asyncErr = err
-				w.mu.Unlock()
-				continue
-			}
-			f := w.file
-			w.mu.Unlock()
-
-			if err := f.Sync(); err != nil {
-				w.mu.Lock()
-				if w.asyncErr == nil {
-					w.asyncErr = err
-				}
-				w.mu.Unlock()
-			}
 		case <-w.stopCh:
 			return
 		}
 	}
 }
+
+// periodicSync flushes buffered writes and fsyncs the WAL. It returns false
+// once the writer is closed.
+func (w *WalWriter) periodicSync() bool {
+	w.mu.Lock()
+	if w.closed || w.file == nil {
+		w.mu.Unlock()
+		return false
+	}
+	if w.asyncErr != nil {
+		w.mu.Unlock()
+		return true
+	}
+
+	// Ensure data reaches OS page cache before fsync.
+	if err := w.flushBufferLocked(); err != nil {
+		w.mu.Unlock()
+		return true
+	}
+	f, size := w.file, w.size
+	w.mu.Unlock()
+
+	if err := w.syncFile(f, size); err != nil {
+		w.mu.Lock()
+		w.failLocked(err)
+		w.mu.Unlock()
+	}
+	return true
+}
+
+// failLocked makes err, from writing or syncing the file, the writer's
+// sticky error and returns it. After a failed write or fsync it is unknown
+// what reached the disk, and a retried fsync can succeed for data that
+// was lost, so nothing more is logged. Must be called with mu held.
+func (w *WalWriter) failLocked(err error) error {
+	if w.asyncErr == nil {
+		w.asyncErr = err
+		if w.onError != nil {
+			go w.onError(err)
+		}
+	}
+	return err
+}
+
+// syncDir fsyncs a directory so the entries created in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
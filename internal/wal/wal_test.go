@@ -1,9 +1,19 @@
 package wal
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/return2faye/SiltKV/internal/clock"
 )
 
 func TestWriteAndLoad(t *testing.T) {
@@ -213,6 +223,70 @@ func TestLoadEmptyFile(t *testing.T) {
 	}
 }
 
+func TestReplayRecordInfo(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	w, err := NewWalWriter(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL writer: %v", err)
+	}
+	for _, k := range []string{"a", "bb", "ccc"} {
+		if err := w.Write([]byte(k), []byte("value")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Damage the value of "bb" and cut "ccc" short.
+	size := func(k string) int64 { return int64(syncMarkerSize + headerSize + seqExtSize + len(k) + len("value")) }
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	second := size("a")
+	data[second+size("bb")-1] ^= 0xFF
+	data = data[:len(data)-2]
+	if err := os.WriteFile(walPath, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	var infos []RecordInfo
+	var keys []string
+	result, err := ReplayFileWithOptions(walPath, func(rec Record) bool {
+		keys = append(keys, string(rec.Key))
+		return true
+	}, ReplayOptions{OnRecord: func(info RecordInfo) { infos = append(infos, info) }})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("replayed %q, want only a", keys)
+	}
+	if result.Recovered != 1 || result.Skipped != 2 || result.FirstCorrupt != second || result.End != int64(len(data)) {
+		t.Errorf("result = %+v", result)
+	}
+
+	want := []RecordInfo{
+		{Offset: 0, Size: size("a"), Seq: 1, Status: RecordOK},
+		{Offset: second, Size: size("bb"), Seq: 2, Status: RecordChecksumMismatch},
+		{Offset: second + size("bb"), Size: size("ccc") - 2, Seq: 3, Status: RecordTruncated},
+	}
+	if len(infos) != len(want) {
+		t.Fatalf("got %d record infos, want %d: %+v", len(infos), len(want), infos)
+	}
+	for i, info := range infos {
+		w := want[i]
+		if info.Offset != w.Offset || info.Size != w.Size || info.Seq != w.Seq || info.Status != w.Status ||
+			info.Version != 3 || info.Time.IsZero() {
+			t.Errorf("record %d = %+v, want %+v", i, info, w)
+		}
+	}
+	if sum := binary.LittleEndian.Uint32(data[syncMarkerSize:]); infos[0].Checksum != sum {
+		t.Errorf("Checksum = %#x, want %#x", infos[0].Checksum, sum)
+	}
+}
+
 func TestWriteInvalidSize(t *testing.T) {
 	tmpDir := t.TempDir()
 	walPath := filepath.Join(tmpDir, "test.wal")
@@ -236,13 +310,615 @@ func TestWriteInvalidSize(t *testing.T) {
 		t.Errorf("Expected ErrInvalidSize for oversized value, got %v", err)
 	}
 
-	// Note: The third check (ksiz+vsiz > maxRecordSize-headerSize) is defensive
-	// but won't trigger in practice because maxKeySize + maxValueSize = maxRecordSize - headerSize.
-	// If key or value exceeds their individual limits, the first two checks will catch it.
-
 	// Test: Valid sizes should work
 	err = wal.Write([]byte("key"), []byte("value"))
 	if err != nil {
 		t.Errorf("Valid write should succeed, got %v", err)
 	}
 }
+
+func TestConfiguredSizeLimits(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+
+	wal, err := NewWalWriterWithOptions(walPath, WriterOptions{
+		MaxKeySize:   1024,
+		MaxValueSize: ValueSizeLimit + 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create WAL writer: %v", err)
+	}
+	defer wal.Close()
+
+	key := make([]byte, 1024)
+	key[0] = 'k'
+	value := make([]byte, 64*1024)
+	value[0] = 'v'
+	if err := wal.Write(key, value); err != nil {
+		t.Fatalf("Write within configured limits: %v", err)
+	}
+	if err := wal.Write(make([]byte, 1025), []byte("value")); err != ErrInvalidSize {
+		t.Errorf("Expected ErrInvalidSize for key above MaxKeySize, got %v", err)
+	}
+	// MaxValueSize above the format limit is capped at it.
+	if err := wal.Write([]byte("key"), make([]byte, ValueSizeLimit+1)); err != ErrInvalidSize {
+		t.Errorf("Expected ErrInvalidSize for value above ValueSizeLimit, got %v", err)
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+
+	var got []Record
+	if _, err := ReplayFile(walPath, func(rec Record) bool {
+		got = append(got, rec)
+		return true
+	}); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if len(got) != 1 || len(got[0].Key) != len(key) || len(got[0].Value) != len(value) ||
+		got[0].Key[0] != 'k' || got[0].Value[0] != 'v' {
+		t.Fatalf("Replayed %d records, want the large one back", len(got))
+	}
+}
+
+func TestRangeDeleteRecords(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+
+	wal, err := NewWalWriter(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL writer: %v", err)
+	}
+	if err := wal.Write([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := wal.WriteRangeDelete([]byte("a"), []byte("m")); err != nil {
+		t.Fatalf("Failed to write range delete: %v", err)
+	}
+	if err := wal.Write([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := wal.WriteRangeDelete(make([]byte, maxKeySize+1), []byte("z")); err != ErrInvalidSize {
+		t.Errorf("Expected ErrInvalidSize for oversized start key, got %v", err)
+	}
+	wal.Close()
+
+	wal2, err := NewWalWriter(walPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer wal2.Close()
+
+	var ops []string
+	result, err := wal2.LoadWithRangeDeletes(func(k, v []byte) {
+		ops = append(ops, "put "+string(k)+"="+string(v))
+	}, func(start, end []byte) {
+		ops = append(ops, "delrange "+string(start)+"-"+string(end))
+	})
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	want := []string{"put a=1", "delrange a-m", "put b=2"}
+	if len(ops) != len(want) {
+		t.Fatalf("Loaded ops %v, want %v", ops, want)
+	}
+	for i := range want {
+		if ops[i] != want[i] {
+			t.Errorf("op %d = %q, want %q", i, ops[i], want[i])
+		}
+	}
+	if result.Recovered != 3 || result.Skipped != 0 {
+		t.Errorf("Unexpected load result: %+v", result)
+	}
+
+	// Plain Load ignores range tombstones but keeps going past them.
+	puts := 0
+	if _, err := wal2.Load(func(k, v []byte) { puts++ }); err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	if puts != 2 {
+		t.Errorf("Load applied %d point records, want 2", puts)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+
+	// A record in the format used before sequence numbers existed.
+	legacy := make([]byte, headerSize+2)
+	binary.LittleEndian.PutUint32(legacy[4:8], 2) // tombstone for "k0"
+	copy(legacy[12:], "k0")
+	binary.LittleEndian.PutUint32(legacy[0:4], crc32.ChecksumIEEE(legacy[4:]))
+	if err := os.WriteFile(walPath, legacy, 0644); err != nil {
+		t.Fatalf("Failed to write legacy record: %v", err)
+	}
+
+	var shared uint64 = 10
+	w, err := NewWalWriterWithOptions(walPath, WriterOptions{Sequence: &shared})
+	if err != nil {
+		t.Fatalf("Failed to create WAL writer: %v", err)
+	}
+	for _, k := range []string{"k1", "k2", "k3"} {
+		if err := w.Write([]byte(k), []byte("v")); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if seq, ts := w.LastSequence(); seq != 13 || ts.IsZero() {
+		t.Errorf("LastSequence = %d, %v; want 13 and a timestamp", seq, ts)
+	}
+	w.Close()
+
+	var seqs []uint64
+	var keys []string
+	result, err := ReplayFile(walPath, func(rec Record) bool {
+		seqs = append(seqs, rec.Seq)
+		keys = append(keys, string(rec.Key))
+		return rec.Seq < 12 // stop after k2
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(keys) != 3 || keys[0] != "k0" || keys[2] != "k2" {
+		t.Fatalf("Replayed keys %v", keys)
+	}
+	if seqs[0] != 0 || seqs[1] != 11 || seqs[2] != 12 {
+		t.Errorf("Replayed sequences %v, want [0 11 12]", seqs)
+	}
+	if result.Recovered != 2 {
+		t.Errorf("Recovered = %d, want 2 (the stopping record is not counted)", result.Recovered)
+	}
+
+	// Replaying through a fresh writer advances its counter past the log.
+	var fresh uint64
+	w2, err := NewWalWriterWithOptions(walPath, WriterOptions{Sequence: &fresh})
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer w2.Close()
+	if _, err := w2.Load(func(k, v []byte) {}); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if fresh != 13 {
+		t.Errorf("Counter after replay = %d, want 13", fresh)
+	}
+}
+
+func TestFakeClockDrivesSyncLoop(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	fake := clock.NewFake(start)
+	synced := make(chan struct{}, 1)
+
+	w, err := NewWalWriterWithOptions(filepath.Join(t.TempDir(), "test.wal"), WriterOptions{
+		Clock: fake,
+		OnSync: func(time.Duration) {
+			select {
+			case synced <- struct{}{}:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create WAL writer: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Write([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if _, ts := w.LastSequence(); !ts.Equal(start) {
+		t.Errorf("Record time = %v, want the fake clock's %v", ts, start)
+	}
+
+	// No sync until the fake clock reaches the one-second interval.
+	select {
+	case <-synced:
+		t.Fatal("Sync loop ran before the clock advanced")
+	case <-time.After(20 * time.Millisecond):
+	}
+	fake.Advance(time.Second)
+	select {
+	case <-synced:
+	case <-time.After(time.Second):
+		t.Fatal("Sync loop did not run after advancing the clock")
+	}
+}
+
+func TestSyncGroupBatchesWriters(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1700000000, 0))
+	g := NewSyncGroup(SyncGroupOptions{Interval: time.Second, Clock: fake})
+	defer g.Close()
+
+	var syncs int32
+	dir := t.TempDir()
+	var writers []*WalWriter
+	for _, name := range []string{"a.wal", "b.wal"} {
+		w, err := NewWalWriterWithOptions(filepath.Join(dir, name), WriterOptions{
+			SyncGroup: g,
+			OnSync:    func(time.Duration) { atomic.AddInt32(&syncs, 1) },
+		})
+		if err != nil {
+			t.Fatalf("Failed to create WAL writer: %v", err)
+		}
+		writers = append(writers, w)
+	}
+	if n := g.Writers(); n != 2 {
+		t.Fatalf("Expected 2 writers in the group, got %d", n)
+	}
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// One window syncs both writers.
+	waitFor("the group to wait for its first window", func() bool { return fake.Waiters() > 0 })
+	fake.Advance(time.Second)
+	waitFor("the first window", func() bool { return g.Rounds() == 1 })
+	if n := atomic.LoadInt32(&syncs); n != 2 {
+		t.Errorf("Expected one fsync per writer, got %d", n)
+	}
+
+	// A closed writer leaves the group and is not synced again.
+	writers[0].Close()
+	if n := g.Writers(); n != 1 {
+		t.Errorf("Expected 1 writer after Close, got %d", n)
+	}
+	atomic.StoreInt32(&syncs, 0)
+	waitFor("the ticker", func() bool { return fake.Waiters() > 0 })
+	fake.Advance(time.Second)
+	waitFor("the second window", func() bool { return g.Rounds() == 2 })
+	if n := atomic.LoadInt32(&syncs); n != 1 {
+		t.Errorf("Expected one fsync in the second window, got %d", n)
+	}
+	writers[1].Close()
+}
+
+func TestBatchRecords(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+
+	wal, err := NewWalWriter(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL writer: %v", err)
+	}
+	if err := wal.Write([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := wal.WriteBatch([]BatchOp{
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("a")},
+		{Key: []byte("c"), Value: []byte("e"), RangeDelete: true},
+		{Key: []byte("f"), Value: []byte{}},
+	}); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	if err := wal.WriteBatch([]BatchOp{{Key: make([]byte, 129)}}); err != ErrInvalidSize {
+		t.Errorf("Expected ErrInvalidSize for an oversized key, got %v", err)
+	}
+	if seq, _ := wal.LastSequence(); seq != 5 {
+		t.Errorf("Expected last sequence 5 after the batch, got %d", seq)
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	intact, _ := os.Stat(walPath)
+
+	// A second batch torn by a crash comes back not at all.
+	if err := wal.WriteBatch([]BatchOp{
+		{Key: []byte("x"), Value: []byte("1")},
+		{Key: []byte("y"), Value: []byte("2")},
+	}); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	wal.Close()
+	if err := os.Truncate(walPath, intact.Size()+headerSize+seqExtSize+4); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+
+	var got []Record
+	var infos []RecordInfo
+	res, err := ReplayFileWithOptions(walPath, func(rec Record) bool {
+		rec.Key = append([]byte(nil), rec.Key...)
+		if rec.Value != nil {
+			rec.Value = append([]byte{}, rec.Value...)
+		}
+		got = append(got, rec)
+		return true
+	}, ReplayOptions{OnRecord: func(info RecordInfo) { infos = append(infos, info) }})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if res.Recovered != 2 || res.FirstCorrupt != intact.Size() {
+		t.Errorf("Expected 2 records and corruption at %d, got %+v", intact.Size(), res)
+	}
+	if len(infos) != 3 || infos[1].Ops != 4 || infos[2].Status != RecordTruncated {
+		t.Errorf("Unexpected record infos: %+v", infos)
+	}
+	want := []Record{
+		{Seq: 1, Key: []byte("a"), Value: []byte("1")},
+		{Seq: 2, Key: []byte("b"), Value: []byte("2"), BatchEnd: 5},
+		{Seq: 3, Key: []byte("a"), BatchEnd: 5},
+		{Seq: 4, Key: []byte("c"), Value: []byte("e"), RangeDelete: true, BatchEnd: 5},
+		{Seq: 5, Key: []byte("f"), Value: []byte{}, BatchEnd: 5},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Replayed %d ops, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Seq != w.Seq || string(g.Key) != string(w.Key) || string(g.Value) != string(w.Value) ||
+			(g.Value == nil) != (w.Value == nil) || g.RangeDelete != w.RangeDelete || g.BatchEnd != w.BatchEnd {
+			t.Errorf("Op %d: got %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func TestReplayResyncsAfterDamage(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	w, err := NewWalWriter(walPath)
+	if err != nil {
+		t.Fatalf("Failed to create WAL writer: %v", err)
+	}
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, k := range keys {
+		if err := w.Write([]byte(k), []byte("value")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Give "b" an impossible value size and "d" a value size that runs
+	// into "e". Neither record can be used to find the one after it.
+	const size = syncMarkerSize + headerSize + seqExtSize + 1 + len("value")
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	vsizAt := func(i int) []byte { return data[i*size+syncMarkerSize+8:] }
+	binary.LittleEndian.PutUint32(vsizAt(1), ValueSizeLimit+1)
+	binary.LittleEndian.PutUint32(vsizAt(3), uint32(len("value")+size/2))
+	if err := os.WriteFile(walPath, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	var got []string
+	var infos []RecordInfo
+	result, err := ReplayFileWithOptions(walPath, func(rec Record) bool {
+		got = append(got, string(rec.Key))
+		return true
+	}, ReplayOptions{OnRecord: func(info RecordInfo) { infos = append(infos, info) }})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(got) != 3 || got[0] != "a" || got[1] != "c" || got[2] != "e" {
+		t.Errorf("replayed %q, want a, c and e", got)
+	}
+	if result.Recovered != 3 || result.Skipped != 2 || result.FirstCorrupt != int64(size) || result.End != int64(len(data)) {
+		t.Errorf("result = %+v", result)
+	}
+	want := []RecordStatus{RecordOK, RecordBadHeader, RecordOK, RecordChecksumMismatch, RecordOK}
+	if len(infos) != len(want) {
+		t.Fatalf("got %d record infos, want %d: %+v", len(infos), len(want), infos)
+	}
+	for i, info := range infos {
+		if info.Offset != int64(i*size) || info.Size != int64(size) || info.Status != want[i] {
+			t.Errorf("record %d = %+v, want %s at %d", i, info, want[i], i*size)
+		}
+	}
+}
+
+func TestCompressedChunks(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	w, err := NewWalWriterWithOptions(walPath, WriterOptions{Compress: true})
+	if err != nil {
+		t.Fatalf("Failed to create WAL writer: %v", err)
+	}
+	value := make([]byte, 1000)
+	for i := range value {
+		value[i] = byte('a' + i%4)
+	}
+	const n = 300
+	for i := 0; i < n; i++ {
+		if err := w.Write([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	written := w.BytesWritten()
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fi, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if fi.Size()*4 > int64(written) {
+		t.Errorf("WAL file is %d bytes for %d bytes of records", fi.Size(), written)
+	}
+
+	check := func(damaged bool) {
+		t.Helper()
+		var keys []string
+		compressed := 0
+		res, err := ReplayFileWithOptions(walPath, func(rec Record) bool {
+			if !bytes.Equal(rec.Value, value) {
+				t.Fatalf("Value of %q does not match", rec.Key)
+			}
+			keys = append(keys, string(rec.Key))
+			return true
+		}, ReplayOptions{OnRecord: func(info RecordInfo) {
+			if info.Compressed {
+				compressed++
+			}
+		}})
+		if err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+		if (res.Skipped > 0) != damaged || res.End != fi.Size() {
+			t.Errorf("result = %+v", res)
+		}
+		if damaged {
+			// Only the first chunk is lost.
+			if len(keys) == 0 || keys[len(keys)-1] != fmt.Sprintf("key%03d", n-1) || len(keys) > n-50 {
+				t.Errorf("Replayed %d keys after damage to the first chunk", len(keys))
+			}
+			return
+		}
+		if len(keys) != n || keys[0] != "key000" || keys[n-1] != fmt.Sprintf("key%03d", n-1) {
+			t.Fatalf("Replayed %d keys", len(keys))
+		}
+		if compressed != n {
+			t.Errorf("%d records came from compressed chunks, want %d", compressed, n)
+		}
+	}
+	check(false)
+
+	// Damage in the first chunk loses it whole; the replay goes on with
+	// the next one.
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	data[syncMarkerSize+headerSize+10] ^= 0xFF
+	if err := os.WriteFile(walPath, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	check(true)
+}
+
+func TestReaderFollowsLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.wal")
+	w, err := NewWalWriter(path)
+	if err != nil {
+		t.Fatalf("NewWalWriter: %v", err)
+	}
+	defer w.Close()
+	write := func(keys ...string) {
+		t.Helper()
+		for _, k := range keys {
+			if err := w.Write([]byte(k), []byte("v")); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+		if err := w.Sync(); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+	}
+	expect := func(rd *Reader, keys ...string) {
+		t.Helper()
+		for _, k := range keys {
+			rec, err := rd.Next()
+			if err != nil || string(rec.Key) != k {
+				t.Fatalf("Next = %q, %v; want %q", rec.Key, err, k)
+			}
+		}
+		if rec, err := rd.Next(); err != io.EOF {
+			t.Fatalf("Next = %q, %v; want EOF", rec.Key, err)
+		}
+	}
+
+	write("a", "b")
+	rd, err := OpenReader(path)
+	if err != nil {
+		t.Fatalf("OpenReader: %v", err)
+	}
+	defer rd.Close()
+	expect(rd, "a", "b")
+	// Records written after EOF are read by the next calls.
+	write("c")
+	if err := w.WriteBatch([]BatchOp{{Key: []byte("d")}, {Key: []byte("e"), Value: []byte("v")}}); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+	write()
+	expect(rd, "c", "d", "e")
+	if got := w.DurableSize(); got != fileSize(t, path) {
+		t.Errorf("DurableSize = %d; want %d", got, fileSize(t, path))
+	}
+
+	// A record cut short at the end is waited for, not skipped.
+	start := fileSize(t, path)
+	write("f")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	partial := filepath.Join(dir, "partial.wal")
+	cut := int(start) + 5
+	if err := os.WriteFile(partial, data[:cut], 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	rd2, err := OpenReader(partial)
+	if err != nil {
+		t.Fatalf("OpenReader: %v", err)
+	}
+	defer rd2.Close()
+	expect(rd2, "a", "b", "c", "d", "e")
+	expect(rd2)
+	f, err := os.OpenFile(partial, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	f.Write(data[cut:])
+	f.Close()
+	expect(rd2, "f")
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	return st.Size()
+}
+
+func TestSyncErrorIsSticky(t *testing.T) {
+	errDisk := errors.New("disk failed")
+	var failing atomic.Bool
+	failing.Store(true)
+	reported := make(chan error, 2)
+	w, err := NewWalWriterWithOptions(filepath.Join(t.TempDir(), "test.wal"), WriterOptions{
+		BeforeSync: func() error {
+			if failing.Load() {
+				return errDisk
+			}
+			return nil
+		},
+		OnError: func(err error) { reported <- err },
+	})
+	if err != nil {
+		t.Fatalf("NewWalWriter: %v", err)
+	}
+	defer w.Close()
+	if err := w.Write([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Sync(); err != errDisk {
+		t.Fatalf("Sync = %v; want %v", err, errDisk)
+	}
+	if err := <-reported; err != errDisk {
+		t.Fatalf("OnError got %v; want %v", err, errDisk)
+	}
+
+	// The error stays, even once fsync would succeed again.
+	failing.Store(false)
+	if err := w.Write([]byte("k"), []byte("v")); err != errDisk {
+		t.Errorf("Write after the failure = %v; want %v", err, errDisk)
+	}
+	if err := w.Sync(); err != errDisk {
+		t.Errorf("Sync after the failure = %v; want %v", err, errDisk)
+	}
+	select {
+	case err := <-reported:
+		t.Errorf("OnError called again with %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
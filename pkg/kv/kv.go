@@ -1,8 +1,10 @@
 package kv
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"iter"
 
 	"github.com/return2faye/SiltKV/internal/lsm"
 )
@@ -12,8 +14,35 @@ var (
 	ErrNotFound = errors.New("kv: key not found")
 	// ErrClosed is returned when the DB is closed
 	ErrClosed = errors.New("kv: db is closed")
+	// ErrLocked is returned by Open when another process has the database open
+	ErrLocked = lsm.ErrLocked
+	// ErrBackupCorrupt is returned by Restore when a backup fails validation
+	ErrBackupCorrupt = lsm.ErrBackupCorrupt
+	// ErrChangesGap is yielded by Changes when the writes it is to stream
+	// next are no longer logged
+	ErrChangesGap = lsm.ErrWALTailGap
 )
 
+// scanReadahead is how many blocks of each SSTable Scan reads ahead.
+const scanReadahead = 4
+
+// Stats is a point-in-time snapshot of the database internals: memtable and
+// per-level SSTable sizes, I/O and amplification counters, compaction and
+// write stall metrics. See the field comments for details.
+type Stats = lsm.Stats
+
+// ResultBuffer receives the pages of ScanInto and reuses its memory across
+// them. See the field comments for the page size limits.
+type ResultBuffer = lsm.ResultBuffer
+
+// AdminRecord is an admin operation recorded in the data directory: a
+// compaction, backup, checkpoint, integrity check, repair or open.
+type AdminRecord = lsm.AdminRecord
+
+// Identity tells data directories apart: a UUID with its creation time and
+// engine version, kept through moves, backups and checkpoints.
+type Identity = lsm.Identity
+
 // DB represents a key-value database.
 // It provides a simple interface for storing and retrieving key-value pairs.
 type DB struct {
@@ -35,12 +64,48 @@ func Open(path string) (*DB, error) {
 	return &DB{db: lsmDB}, nil
 }
 
+// OpenWithWALArchive is Open with every write-ahead log the database
+// retires kept in archiveDir, for ReplayTo.
+func OpenWithWALArchive(path, archiveDir string) (*DB, error) {
+	if path == "" {
+		return nil, fmt.Errorf("kv: path cannot be empty")
+	}
+
+	lsmDB, err := lsm.Open(lsm.Options{DataDir: path, WALArchiveDir: archiveDir})
+	if err != nil {
+		return nil, fmt.Errorf("kv: failed to open database: %w", err)
+	}
+
+	return &DB{db: lsmDB}, nil
+}
+
 // Close closes the database and releases all resources.
 func (db *DB) Close() error {
 	if db.db == nil {
 		return ErrClosed
 	}
-	return db.db.Close()
+	if err := db.db.Close(); err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return ErrClosed
+		}
+		return err
+	}
+	return nil
+}
+
+// CloseAndFlush flushes buffered writes to disk and closes the database,
+// so the next Open does not need to replay the write-ahead log.
+func (db *DB) CloseAndFlush() error {
+	if db.db == nil {
+		return ErrClosed
+	}
+	if err := db.db.CloseAndFlush(); err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return ErrClosed
+		}
+		return err
+	}
+	return nil
 }
 
 // Put stores a key-value pair in the database.
@@ -51,8 +116,7 @@ func (db *DB) Put(key, value string) error {
 	}
 	err := db.db.Put([]byte(key), []byte(value))
 	if err != nil {
-		// Check if it's a closed error
-		if err.Error() == "lsm: db is closed" {
+		if errors.Is(err, lsm.ErrClosed) {
 			return ErrClosed
 		}
 		return fmt.Errorf("kv: put failed: %w", err)
@@ -69,19 +133,12 @@ func (db *DB) Get(key string) (string, error) {
 
 	val, found, err := db.db.Get([]byte(key))
 	if err != nil {
-		// Check if it's a closed error
-		if err.Error() == "lsm: db is closed" {
+		if errors.Is(err, lsm.ErrClosed) {
 			return "", ErrClosed
 		}
 		return "", fmt.Errorf("kv: get failed: %w", err)
 	}
-	
-	// If DB is closed, active will be nil and Get returns (nil, false, nil)
-	// We need to check if db.db is actually closed by trying to access it
-	// Actually, if db.db is closed, Get might return (nil, false, nil)
-	// So we can't distinguish between "not found" and "closed"
-	// For now, we'll trust that if db.db is not nil, it's not closed
-	
+
 	if !found {
 		return "", ErrNotFound
 	}
@@ -89,6 +146,128 @@ func (db *DB) Get(key string) (string, error) {
 	return string(val), nil
 }
 
+// Backup writes a consistent copy of the open database to destDir, which
+// must be empty or not exist yet. The copy can be opened with Open.
+func (db *DB) Backup(destDir string) error {
+	if db.db == nil {
+		return ErrClosed
+	}
+	if err := db.db.Backup(destDir); err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return ErrClosed
+		}
+		return fmt.Errorf("kv: backup failed: %w", err)
+	}
+	return nil
+}
+
+// Checkpoint creates a cheap, openable copy of the database in dir using
+// hard links where possible, e.g. to seed a replica. dir must be empty or
+// not exist yet.
+func (db *DB) Checkpoint(dir string) error {
+	if db.db == nil {
+		return ErrClosed
+	}
+	if err := db.db.Checkpoint(dir); err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return ErrClosed
+		}
+		return fmt.Errorf("kv: checkpoint failed: %w", err)
+	}
+	return nil
+}
+
+// AdminHistory returns the admin operations recorded for the database,
+// oldest first.
+func (db *DB) AdminHistory() ([]AdminRecord, error) {
+	if db.db == nil {
+		return nil, ErrClosed
+	}
+	recs, err := db.db.AdminHistory()
+	if err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return nil, ErrClosed
+		}
+		return nil, fmt.Errorf("kv: admin history failed: %w", err)
+	}
+	return recs, nil
+}
+
+// BackupIncremental is like Backup but reuses the SSTables already held by
+// the earlier backup in prevDir, so only data written since then is copied.
+func (db *DB) BackupIncremental(destDir, prevDir string) error {
+	if db.db == nil {
+		return ErrClosed
+	}
+	if _, err := db.db.BackupWithOptions(destDir, lsm.BackupOptions{Previous: prevDir}); err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return ErrClosed
+		}
+		return fmt.Errorf("kv: backup failed: %w", err)
+	}
+	return nil
+}
+
+// Restore checks the backup in backupDir against its recorded checksums and
+// copies it to dataDir, which must be empty or not exist yet. The restored
+// database can then be opened with Open(dataDir).
+func Restore(backupDir, dataDir string) error {
+	if err := lsm.Restore(backupDir, dataDir); err != nil {
+		return fmt.Errorf("kv: restore failed: %w", err)
+	}
+	return nil
+}
+
+// PointInTime is the target of ReplayTo: a sequence number, a time, or both.
+type PointInTime = lsm.PointInTime
+
+// ReplayTo rolls the closed database in dataDir, usually a restored backup,
+// forward to target through the write-ahead logs archived in archiveDir by
+// OpenWithWALArchive. It returns the sequence number of the last write it
+// restored.
+func ReplayTo(dataDir, archiveDir string, target PointInTime) (uint64, error) {
+	last, err := lsm.ReplayTo(dataDir, archiveDir, target)
+	if err != nil {
+		return last, fmt.Errorf("kv: replay failed: %w", err)
+	}
+	return last, nil
+}
+
+// Move relocates the closed database at path to newPath, which must not
+// exist yet. Use it instead of moving the directory by hand.
+func Move(path, newPath string) error {
+	if err := lsm.Move(path, "", newPath); err != nil {
+		return fmt.Errorf("kv: move failed: %w", err)
+	}
+	return nil
+}
+
+// Repair rebuilds the manifest of the closed database at path from its
+// SSTables, for when Open fails because the manifest is missing or corrupt.
+// Tables it cannot use are moved to an "orphans" subdirectory.
+func Repair(path string) error {
+	if _, err := lsm.Repair(path, ""); err != nil {
+		return fmt.Errorf("kv: repair failed: %w", err)
+	}
+	return nil
+}
+
+// Exists reports whether a key is present in the database.
+// It is cheaper than Get because the value is never copied.
+func (db *DB) Exists(key string) (bool, error) {
+	if db.db == nil {
+		return false, ErrClosed
+	}
+	ok, err := db.db.Exists([]byte(key))
+	if err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return false, ErrClosed
+		}
+		return false, fmt.Errorf("kv: exists failed: %w", err)
+	}
+	return ok, nil
+}
+
 // Delete removes a key from the database.
 // If the key doesn't exist, it's a no-op (no error returned).
 func (db *DB) Delete(key string) error {
@@ -97,11 +276,229 @@ func (db *DB) Delete(key string) error {
 	}
 	err := db.db.Delete([]byte(key))
 	if err != nil {
-		// Check if it's a closed error
-		if err.Error() == "lsm: db is closed" {
+		if errors.Is(err, lsm.ErrClosed) {
 			return ErrClosed
 		}
 		return fmt.Errorf("kv: delete failed: %w", err)
 	}
 	return nil
 }
+
+// DeleteRange removes every key in [start, end).
+// It costs the same regardless of how many keys fall in the range.
+func (db *DB) DeleteRange(start, end string) error {
+	if db.db == nil {
+		return ErrClosed
+	}
+	err := db.db.DeleteRange([]byte(start), []byte(end))
+	if err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return ErrClosed
+		}
+		return fmt.Errorf("kv: delete range failed: %w", err)
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the database's size, I/O and compaction
+// counters.
+func (db *DB) Stats() Stats {
+	if db.db == nil {
+		return Stats{}
+	}
+	return db.db.Stats()
+}
+
+// ID returns the identity of the data directory, or a zero Identity once
+// the DB is closed.
+func (db *DB) ID() Identity {
+	if db.db == nil {
+		return Identity{}
+	}
+	return db.db.ID()
+}
+
+// Flush writes buffered writes to SSTables and waits until they are on
+// disk, so a later Open does not need to replay them from the write-ahead
+// log.
+func (db *DB) Flush() error {
+	if db.db == nil {
+		return ErrClosed
+	}
+	if err := db.db.Flush(); err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return ErrClosed
+		}
+		return fmt.Errorf("kv: flush failed: %w", err)
+	}
+	return nil
+}
+
+// VerifyIntegrity checks the stored checksums of every SSTable file, so that
+// bit rot is found before a read runs into it.
+func (db *DB) VerifyIntegrity() error {
+	if db.db == nil {
+		return ErrClosed
+	}
+	if err := db.db.VerifyIntegrity(); err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return ErrClosed
+		}
+		return fmt.Errorf("kv: verify failed: %w", err)
+	}
+	return nil
+}
+
+// Compact merges SSTables until every level is within its size limit,
+// e.g. after a bulk load or a large DeleteRange.
+func (db *DB) Compact() error {
+	if db.db == nil {
+		return ErrClosed
+	}
+	if err := db.db.Compact(); err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return ErrClosed
+		}
+		return fmt.Errorf("kv: compact failed: %w", err)
+	}
+	return nil
+}
+
+// Scan calls fn for every key in [start, end) in key order. An empty end
+// scans to the last key. Scan stops at the first error fn returns and
+// returns it. Long scans read SSTable blocks ahead in the background.
+func (db *DB) Scan(start, end string, fn func(key, value string) error) error {
+	if db.db == nil {
+		return ErrClosed
+	}
+	opts := lsm.IterOptions{LowerBound: []byte(start), Readahead: scanReadahead}
+	if end != "" {
+		opts.UpperBound = []byte(end)
+	}
+	it, err := db.db.NewIterator(opts)
+	if err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return ErrClosed
+		}
+		return fmt.Errorf("kv: scan failed: %w", err)
+	}
+	defer it.Close()
+
+	for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+		if err := fn(string(it.Key()), string(it.Value())); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("kv: scan failed: %w", err)
+	}
+	return nil
+}
+
+// KV is a key and its value, as yielded by All and Range.
+type KV struct {
+	Key, Value string
+}
+
+// All returns every key and value in key order, for use with
+// range-over-func. See Range.
+func (db *DB) All(ctx context.Context) iter.Seq2[KV, error] {
+	return db.Range(ctx, "", "")
+}
+
+// Range returns the keys in [start, end) and their values in key order, for
+// use with range-over-func; an empty end runs to the last key. The
+// underlying iterator is closed when the loop ends. A failed read, ctx
+// being done or a closed DB (ErrClosed) ends the sequence with the error.
+func (db *DB) Range(ctx context.Context, start, end string) iter.Seq2[KV, error] {
+	return func(yield func(KV, error) bool) {
+		if db.db == nil {
+			yield(KV{}, ErrClosed)
+			return
+		}
+		var upper []byte
+		if end != "" {
+			upper = []byte(end)
+		}
+		for kv, err := range db.db.Range(ctx, []byte(start), upper) {
+			switch {
+			case errors.Is(err, lsm.ErrClosed):
+				yield(KV{}, ErrClosed)
+				return
+			case err != nil && ctx.Err() == nil:
+				err = fmt.Errorf("kv: scan failed: %w", err)
+			}
+			if !yield(KV{string(kv.Key), string(kv.Value)}, err) {
+				return
+			}
+		}
+	}
+}
+
+// Change is a write to the database, as streamed by Changes.
+type Change struct {
+	Seq   uint64 // sequence number of the write
+	Key   string
+	Value string
+	// Delete marks a deleted Key; RangeDelete a DeleteRange of [Key, Value).
+	Delete      bool
+	RangeDelete bool
+}
+
+// Changes streams the writes made to the database from sequence number
+// fromSeq on, in order, for use with range-over-func: a change data
+// capture feed. With fromSeq 0 it starts at the oldest write the database
+// still logs. A write shows up once it is durable, within about a second.
+// Once caught up the sequence waits for new writes, and it ends when ctx
+// is done. Writes flushed before they were streamed are read from the WAL
+// archive of OpenWithWALArchive; without one, the sequence ends with
+// ErrChangesGap instead.
+func (db *DB) Changes(ctx context.Context, fromSeq uint64) iter.Seq2[Change, error] {
+	return func(yield func(Change, error) bool) {
+		if db.db == nil {
+			yield(Change{}, ErrClosed)
+			return
+		}
+		tail, err := db.db.TailWAL(fromSeq)
+		if err != nil {
+			yield(Change{}, fmt.Errorf("kv: changes failed: %w", err))
+			return
+		}
+		defer tail.Close()
+		for {
+			rec, err := tail.Next(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				yield(Change{}, fmt.Errorf("kv: changes failed: %w", err))
+				return
+			}
+			c := Change{Seq: rec.Seq, Key: string(rec.Key), Value: string(rec.Value), RangeDelete: rec.RangeDelete}
+			c.Delete = rec.Value == nil && !rec.RangeDelete
+			if !yield(c, nil) {
+				return
+			}
+		}
+	}
+}
+
+// ScanInto fills buf with the next page of keys in [start, end) in key
+// order. An empty end scans to the last key. The keys and values in buf
+// are overwritten by the next call; pass buf.NextKey() as start to get the
+// following page, until it returns nil.
+func (db *DB) ScanInto(start, end []byte, buf *ResultBuffer) error {
+	if db.db == nil {
+		return ErrClosed
+	}
+	if len(end) == 0 {
+		end = nil
+	}
+	if err := db.db.ScanInto(start, end, buf); err != nil {
+		if errors.Is(err, lsm.ErrClosed) {
+			return ErrClosed
+		}
+		return fmt.Errorf("kv: scan failed: %w", err)
+	}
+	return nil
+}
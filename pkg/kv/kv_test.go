@@ -1,8 +1,12 @@
 package kv
 
 import (
+	"context"
+	"errors"
 	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestOpenClose(t *testing.T) {
@@ -141,6 +145,59 @@ func TestMultipleKeys(t *testing.T) {
 	}
 }
 
+func TestExists(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "test-db")
+	db, err := Open(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	ok, err := db.Exists("key1")
+	if err != nil || !ok {
+		t.Errorf("Exists(key1) = %v, %v; want true", ok, err)
+	}
+
+	if err := db.Delete("key1"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	ok, err = db.Exists("key1")
+	if err != nil || ok {
+		t.Errorf("Exists(key1) after delete = %v, %v; want false", ok, err)
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "test-db")
+	db, err := Open(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a1", "a2", "b1"} {
+		if err := db.Put(k, "v"); err != nil {
+			t.Fatalf("Failed to put %s: %v", k, err)
+		}
+	}
+	if err := db.DeleteRange("a", "b"); err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+
+	for _, k := range []string{"a1", "a2"} {
+		if _, err := db.Get(k); err != ErrNotFound {
+			t.Errorf("Get(%s) after DeleteRange: expected ErrNotFound, got %v", k, err)
+		}
+	}
+	if _, err := db.Get("b1"); err != nil {
+		t.Errorf("Get(b1) should survive DeleteRange, got %v", err)
+	}
+}
+
 func TestDeleteNonExistent(t *testing.T) {
 	tmpDir := filepath.Join(t.TempDir(), "test-db")
 	db, err := Open(tmpDir)
@@ -172,14 +229,268 @@ func TestClosedDB(t *testing.T) {
 		t.Errorf("Expected ErrClosed, got %v", err)
 	}
 
-	// Note: Get on closed DB might return ErrNotFound instead of ErrClosed
-	// because lsm.DB.Get returns (nil, false, nil) when active is nil
-	_, err = db.Get("key")
-	if err != ErrClosed && err != ErrNotFound {
-		t.Errorf("Expected ErrClosed or ErrNotFound, got %v", err)
+	if _, err := db.Get("key"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+
+	if _, err := db.Exists("key"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+
+	if err := db.DeleteRange("a", "b"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+
+	if _, err := db.AdminHistory(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from AdminHistory, got %v", err)
+	}
+
+	if err := db.Close(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from a second Close, got %v", err)
 	}
 
 	if err := db.Delete("key"); err != ErrClosed {
 		t.Errorf("Expected ErrClosed, got %v", err)
 	}
+
+	if err := db.Flush(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+
+	if err := db.Compact(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestStatsFlushCompact(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "test-db")
+	db, err := Open(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if s := db.Stats(); s.MemtableEntries != 1 || s.UserBytesWritten == 0 {
+		t.Errorf("Stats before Flush: %d memtable entries, %d user bytes", s.MemtableEntries, s.UserBytesWritten)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if s := db.Stats(); s.MemtableEntries != 0 || s.SSTableCount != 1 {
+		t.Errorf("Stats after Flush: %d memtable entries, %d SSTables", s.MemtableEntries, s.SSTableCount)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if val, err := db.Get("key1"); err != nil || val != "value1" {
+		t.Errorf("Get after Flush and Compact = %q, %v", val, err)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	tmpDir := t.TempDir()
+	db, err := Open(filepath.Join(tmpDir, "db"))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	full := filepath.Join(tmpDir, "full")
+	if err := db.Backup(full); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	incr := filepath.Join(tmpDir, "incr")
+	if err := db.BackupIncremental(incr, full); err != nil {
+		t.Fatalf("BackupIncremental failed: %v", err)
+	}
+
+	restoredDir := filepath.Join(tmpDir, "restored")
+	if err := Restore(incr, restoredDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restored, err := Open(restoredDir)
+	if err != nil {
+		t.Fatalf("Failed to open restored DB: %v", err)
+	}
+	defer restored.Close()
+	for k, want := range map[string]string{"key1": "value1", "key2": "value2"} {
+		if got, err := restored.Get(k); err != nil || got != want {
+			t.Errorf("Get(%s) = %q, %v; want %q", k, got, err, want)
+		}
+	}
+}
+
+func TestReplayTo(t *testing.T) {
+	tmpDir := t.TempDir()
+	archive := filepath.Join(tmpDir, "archive")
+	db, err := OpenWithWALArchive(filepath.Join(tmpDir, "db"), archive)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	for _, v := range []string{"v1", "v2", "v3"} {
+		if err := db.Put("key", v); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	restoredDir := filepath.Join(tmpDir, "restored")
+	if last, err := ReplayTo(restoredDir, archive, PointInTime{Sequence: 2}); err != nil || last != 2 {
+		t.Fatalf("ReplayTo = %d, %v; want 2", last, err)
+	}
+	restored, err := Open(restoredDir)
+	if err != nil {
+		t.Fatalf("Failed to open restored DB: %v", err)
+	}
+	defer restored.Close()
+	if got, err := restored.Get("key"); err != nil || got != "v2" {
+		t.Errorf("Get(key) = %q, %v; want v2", got, err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	tmpDir := filepath.Join(t.TempDir(), "test-db")
+	db, err := Open(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a1", "a2", "b1", "c1"} {
+		if err := db.Put(k, "v-"+k); err != nil {
+			t.Fatalf("Failed to put %s: %v", k, err)
+		}
+	}
+	db.Delete("a2")
+
+	var got []string
+	err = db.Scan("a", "c", func(key, value string) error {
+		got = append(got, key+"="+value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if len(got) != 2 || got[0] != "a1=v-a1" || got[1] != "b1=v-b1" {
+		t.Errorf("Scan(a, c) = %v", got)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = db.Scan("", "", func(key, value string) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("Scan with early stop = %v after %d keys", err, n)
+	}
+
+	got = got[:0]
+	buf := &ResultBuffer{MaxRows: 2}
+	for start := []byte(nil); ; {
+		if err := db.ScanInto(start, nil, buf); err != nil {
+			t.Fatalf("ScanInto: %v", err)
+		}
+		for i := 0; i < buf.Len(); i++ {
+			got = append(got, string(buf.Key(i)))
+		}
+		if start = buf.NextKey(); start == nil {
+			break
+		}
+	}
+	if len(got) != 3 || got[0] != "a1" || got[1] != "b1" || got[2] != "c1" {
+		t.Errorf("ScanInto pages = %v", got)
+	}
+}
+
+func TestRange(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test-db"))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a1", "a2", "b1", "c1"} {
+		if err := db.Put(k, "v-"+k); err != nil {
+			t.Fatalf("Failed to put %s: %v", k, err)
+		}
+	}
+	db.Delete("a2")
+
+	var got []string
+	for kv, err := range db.Range(context.Background(), "a", "c") {
+		if err != nil {
+			t.Fatalf("Range(a, c): %v", err)
+		}
+		got = append(got, kv.Key+"="+kv.Value)
+	}
+	if len(got) != 2 || got[0] != "a1=v-a1" || got[1] != "b1=v-b1" {
+		t.Errorf("Range(a, c) = %v", got)
+	}
+
+	n := 0
+	for range db.All(context.Background()) {
+		if n++; n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Errorf("All stopped after %d keys, want a break at 2", n)
+	}
+
+	db.Close()
+	for _, err := range db.All(context.Background()) {
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("All on a closed DB: %v, want ErrClosed", err)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	tmpDir := t.TempDir()
+	db, err := OpenWithWALArchive(filepath.Join(tmpDir, "db"), filepath.Join(tmpDir, "archive"))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	// Durable with the next periodic sync
+	if err := db.Delete("a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var got []Change
+	for c, err := range db.Changes(ctx, 1) {
+		if err != nil {
+			t.Fatalf("Changes: %v", err)
+		}
+		if got = append(got, c); len(got) == 2 {
+			break
+		}
+	}
+	want := []Change{{Seq: 1, Key: "a", Value: "1"}, {Seq: 2, Key: "a", Delete: true}}
+	if !slices.Equal(got, want) {
+		t.Errorf("Changes = %+v; want %+v", got, want)
+	}
 }
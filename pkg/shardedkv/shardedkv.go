@@ -0,0 +1,441 @@
+// Package shardedkv spreads one keyspace over several SiltKV databases, the
+// shards, by key hash. Every shard has its own directory, memtables and
+// compactions, so a store on N disks writes and compacts N times as fast
+// as a single database, while callers see one set of keys.
+//
+// A key always lives in the shard its hash picks, so the number and order
+// of the shard directories and the hash function must never change once a
+// store holds data. Each shard records its position in a SHARD file, and
+// Open refuses directories that were opened as a different shard.
+//
+// Operations on several keys run on all shards involved in parallel. They
+// are only atomic within a shard: a WriteBatch that fails on one shard may
+// have been applied on others.
+package shardedkv
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/return2faye/SiltKV/internal/lsm"
+	"github.com/return2faye/SiltKV/pkg/kv"
+)
+
+var (
+	// ErrNotFound is returned when a key is not found
+	ErrNotFound = kv.ErrNotFound
+	// ErrClosed is returned when the store is closed
+	ErrClosed = kv.ErrClosed
+	// ErrShardMismatch is returned by Open when a directory was created as
+	// a different shard, or as part of a store with a different number of
+	// shards
+	ErrShardMismatch = errors.New("shardedkv: directory belongs to another shard")
+)
+
+// shardFileName is the file in every shard directory recording which shard
+// of how many it is.
+const shardFileName = "SHARD"
+
+// Stats is a point-in-time snapshot of the internals of one shard.
+type Stats = kv.Stats
+
+// Options configures a Store.
+type Options struct {
+	// Dirs are the data directories of the shards, one per shard. They are
+	// created if needed.
+	Dirs []string
+
+	// Hash maps a key to its shard, Hash(key) % len(Dirs). Nil uses 64-bit
+	// FNV-1a. Keys are only spread evenly if the low bits of the hash are.
+	Hash func(key []byte) uint64
+}
+
+// Store is a keyspace spread over several databases. It is safe for
+// concurrent use.
+type Store struct {
+	shards []*lsm.DB
+	hash   func(key []byte) uint64
+}
+
+// Open opens or creates a store over the given shard directories. The
+// shards are opened in parallel, since each may have a log to recover.
+func Open(opts Options) (*Store, error) {
+	if len(opts.Dirs) == 0 {
+		return nil, fmt.Errorf("shardedkv: no shard directories")
+	}
+	s := &Store{shards: make([]*lsm.DB, len(opts.Dirs)), hash: opts.Hash}
+	if s.hash == nil {
+		s.hash = fnv64a
+	}
+	err := s.each(func(i int, _ *lsm.DB) error {
+		db, err := openShard(opts.Dirs[i], i, len(opts.Dirs))
+		s.shards[i] = db
+		return err
+	})
+	if err != nil {
+		for _, db := range s.shards {
+			if db != nil {
+				db.Close()
+			}
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// openShard opens the database in dir as shard i of n.
+func openShard(dir string, i, n int) (*lsm.DB, error) {
+	want := fmt.Sprintf("shard %d of %d\n", i, n)
+	path := filepath.Join(dir, shardFileName)
+	got, err := os.ReadFile(path)
+	switch {
+	case err == nil && string(got) != want:
+		return nil, fmt.Errorf("%w: %s is %s, not %s", ErrShardMismatch, dir,
+			strings.TrimSpace(string(got)), strings.TrimSpace(want))
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+
+	db, err := lsm.Open(lsm.Options{DataDir: dir})
+	if err != nil {
+		return nil, fmt.Errorf("shardedkv: failed to open shard %d: %w", i, err)
+	}
+	if got == nil {
+		if err := os.WriteFile(path, []byte(want), 0o644); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func fnv64a(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// Shards returns the number of shards.
+func (s *Store) Shards() int {
+	return len(s.shards)
+}
+
+// ShardOf returns the shard that holds key.
+func (s *Store) ShardOf(key string) int {
+	return int(s.hash([]byte(key)) % uint64(len(s.shards)))
+}
+
+// each runs fn for every shard in parallel and returns their errors.
+func (s *Store) each(fn func(i int, db *lsm.DB) error) error {
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, db := range s.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i, db)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// shardErr wraps the error of an operation on shard i.
+func shardErr(op string, i int, err error) error {
+	if errors.Is(err, lsm.ErrClosed) {
+		return ErrClosed
+	}
+	return fmt.Errorf("shardedkv: %s failed on shard %d: %w", op, i, err)
+}
+
+// Close closes every shard. It returns the errors of all shards that
+// failed to close.
+func (s *Store) Close() error {
+	return s.each(func(i int, db *lsm.DB) error {
+		if err := db.Close(); err != nil {
+			return shardErr("close", i, err)
+		}
+		return nil
+	})
+}
+
+// Put stores a key-value pair in the key's shard.
+func (s *Store) Put(key, value string) error {
+	i := s.ShardOf(key)
+	if err := s.shards[i].Put([]byte(key), []byte(value)); err != nil {
+		return shardErr("put", i, err)
+	}
+	return nil
+}
+
+// Get retrieves the value for a given key.
+// Returns ErrNotFound if the key doesn't exist.
+func (s *Store) Get(key string) (string, error) {
+	i := s.ShardOf(key)
+	val, found, err := s.shards[i].Get([]byte(key))
+	if err != nil {
+		return "", shardErr("get", i, err)
+	}
+	if !found {
+		return "", ErrNotFound
+	}
+	return string(val), nil
+}
+
+// Delete removes a key from its shard.
+// If the key doesn't exist, it's a no-op (no error returned).
+func (s *Store) Delete(key string) error {
+	i := s.ShardOf(key)
+	if err := s.shards[i].Delete([]byte(key)); err != nil {
+		return shardErr("delete", i, err)
+	}
+	return nil
+}
+
+// DeleteRange removes every key in [start, end). Keys of any range can be
+// in any shard, so every shard gets the range tombstone.
+func (s *Store) DeleteRange(start, end string) error {
+	return s.each(func(i int, db *lsm.DB) error {
+		if err := db.DeleteRange([]byte(start), []byte(end)); err != nil {
+			return shardErr("delete range", i, err)
+		}
+		return nil
+	})
+}
+
+// WriteBatch collects writes for Store.Write. The zero value is an empty
+// batch.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key, value string
+	delete     bool
+}
+
+// Put adds a write of key to the batch.
+func (b *WriteBatch) Put(key, value string) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// Delete adds a delete of key to the batch.
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch for reuse.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write applies the batch. Its writes are split by shard; every shard
+// applies its part atomically, in batch order and in parallel with the
+// others. A failed Write may have been applied on some shards only.
+func (s *Store) Write(b *WriteBatch) error {
+	parts := make([]lsm.WriteBatch, len(s.shards))
+	for _, op := range b.ops {
+		i := s.ShardOf(op.key)
+		if op.delete {
+			parts[i].Delete([]byte(op.key))
+		} else {
+			parts[i].Put([]byte(op.key), []byte(op.value))
+		}
+	}
+	return s.each(func(i int, db *lsm.DB) error {
+		if err := db.Write(&parts[i]); err != nil {
+			return shardErr("write", i, err)
+		}
+		return nil
+	})
+}
+
+// Result is the outcome of one key of a MultiGet.
+type Result struct {
+	Value string
+	Found bool
+}
+
+// MultiGet looks up keys, querying the shards in parallel. The results are
+// in the order of keys.
+func (s *Store) MultiGet(keys []string) ([]Result, error) {
+	parts := make([][]int, len(s.shards))
+	for k, key := range keys {
+		i := s.ShardOf(key)
+		parts[i] = append(parts[i], k)
+	}
+	results := make([]Result, len(keys))
+	err := s.each(func(i int, db *lsm.DB) error {
+		for _, k := range parts[i] {
+			val, found, err := db.Get([]byte(keys[k]))
+			if err != nil {
+				return shardErr("get", i, err)
+			}
+			results[k] = Result{Value: string(val), Found: found}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Flush writes the buffered writes of every shard to SSTables.
+func (s *Store) Flush() error {
+	return s.each(func(i int, db *lsm.DB) error {
+		if err := db.Flush(); err != nil {
+			return shardErr("flush", i, err)
+		}
+		return nil
+	})
+}
+
+// Stats returns a snapshot of every shard's internals, in shard order.
+func (s *Store) Stats() []Stats {
+	stats := make([]Stats, len(s.shards))
+	for i, db := range s.shards {
+		stats[i] = db.Stats()
+	}
+	return stats
+}
+
+// Iterator walks the keys of all shards in key order, merging one iterator
+// per shard. It is not safe for concurrent use and must be closed.
+//
+// A new Iterator is not positioned; call SeekToFirst or Seek.
+type Iterator struct {
+	its []*lsm.Iterator
+	h   iterHeap // the shards positioned at a key, smallest key first
+}
+
+// NewIterator returns an iterator over the keys in [start, end). An empty
+// end iterates to the last key.
+func (s *Store) NewIterator(start, end string) (*Iterator, error) {
+	opts := lsm.IterOptions{LowerBound: []byte(start)}
+	if end != "" {
+		opts.UpperBound = []byte(end)
+	}
+	it := &Iterator{its: make([]*lsm.Iterator, len(s.shards))}
+	for i, db := range s.shards {
+		sit, err := db.NewIterator(opts)
+		if err != nil {
+			it.Close()
+			return nil, shardErr("iterate", i, err)
+		}
+		it.its[i] = sit
+	}
+	return it, nil
+}
+
+// SeekToFirst moves to the first key.
+func (it *Iterator) SeekToFirst() error {
+	return it.reset(func(sit *lsm.Iterator) error { return sit.SeekToFirst() })
+}
+
+// Seek moves to the first key >= target.
+func (it *Iterator) Seek(target string) error {
+	return it.reset(func(sit *lsm.Iterator) error { return sit.Seek([]byte(target)) })
+}
+
+// reset positions every shard iterator with seek and rebuilds the heap.
+func (it *Iterator) reset(seek func(*lsm.Iterator) error) error {
+	it.h = it.h[:0]
+	for i, sit := range it.its {
+		if err := seek(sit); err != nil {
+			it.h = it.h[:0]
+			return shardErr("iterate", i, err)
+		}
+		if sit.Valid() {
+			it.h = append(it.h, sit)
+		}
+	}
+	heap.Init(&it.h)
+	return nil
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return len(it.h) > 0
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() string {
+	return string(it.h[0].Key())
+}
+
+// Value returns the current value.
+func (it *Iterator) Value() string {
+	return string(it.h[0].Value())
+}
+
+// Next moves to the next key. Every key lives in one shard only, so the
+// shards never disagree about a key.
+func (it *Iterator) Next() error {
+	top := it.h[0]
+	if err := top.Next(); err != nil {
+		it.h = it.h[:0]
+		return fmt.Errorf("shardedkv: iterate failed: %w", err)
+	}
+	if top.Valid() {
+		heap.Fix(&it.h, 0)
+	} else {
+		heap.Pop(&it.h)
+	}
+	return nil
+}
+
+// Close closes the shard iterators.
+func (it *Iterator) Close() error {
+	for _, sit := range it.its {
+		if sit != nil {
+			sit.Close()
+		}
+	}
+	it.its, it.h = nil, nil
+	return nil
+}
+
+// iterHeap orders shard iterators by their current key.
+type iterHeap []*lsm.Iterator
+
+func (h iterHeap) Len() int           { return len(h) }
+func (h iterHeap) Less(i, j int) bool { return bytes.Compare(h[i].Key(), h[j].Key()) < 0 }
+func (h iterHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *iterHeap) Push(x any)        { *h = append(*h, x.(*lsm.Iterator)) }
+func (h *iterHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Scan calls fn for every key in [start, end) in key order, across all
+// shards. An empty end scans to the last key. Scan stops at the first
+// error fn returns and returns it.
+func (s *Store) Scan(start, end string, fn func(key, value string) error) error {
+	it, err := s.NewIterator(start, end)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for err = it.SeekToFirst(); err == nil && it.Valid(); err = it.Next() {
+		if err := fn(it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package shardedkv
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func shardDirs(t *testing.T, n int) []string {
+	t.Helper()
+	root := t.TempDir()
+	dirs := make([]string, n)
+	for i := range dirs {
+		dirs[i] = filepath.Join(root, fmt.Sprintf("shard%d", i))
+	}
+	return dirs
+}
+
+func TestStore(t *testing.T) {
+	dirs := shardDirs(t, 4)
+	s, err := Open(Options{Dirs: dirs})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	var b WriteBatch
+	for i := 0; i < 200; i++ {
+		b.Put(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i))
+	}
+	b.Delete("key007")
+	if err := s.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := s.Put("key008", "changed"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.DeleteRange("key100", "key150"); err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+
+	// Every shard got part of the keys.
+	for i, st := range s.Stats() {
+		if st.MemtableEntries == 0 {
+			t.Errorf("shard %d holds no keys", i)
+		}
+	}
+
+	if _, err := s.Get("key007"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(key007) error = %v, want ErrNotFound", err)
+	}
+	res, err := s.MultiGet([]string{"key008", "key120", "key199", "nokey"})
+	if err != nil {
+		t.Fatalf("MultiGet: %v", err)
+	}
+	want := []Result{{"changed", true}, {"", false}, {"value199", true}, {"", false}}
+	for i := range want {
+		if res[i] != want[i] {
+			t.Errorf("MultiGet result %d = %+v, want %+v", i, res[i], want[i])
+		}
+	}
+
+	// Scans merge the shards back into key order.
+	var keys []string
+	err = s.Scan("key005", "key012", func(key, value string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if got := fmt.Sprint(keys); got != "[key005 key006 key008 key009 key010 key011]" {
+		t.Errorf("Scan = %s", got)
+	}
+	n := 0
+	if err := s.Scan("", "", func(string, string) error { n++; return nil }); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if n != 149 {
+		t.Errorf("Scan saw %d keys, want 149", n)
+	}
+
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := s.Put("k", "v"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Put after Close: %v, want ErrClosed", err)
+	}
+
+	// The data is where the hash says after reopening.
+	if s, err = Open(Options{Dirs: dirs}); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if val, err := s.Get("key199"); err != nil || val != "value199" {
+		t.Errorf("Get(key199) after reopen = %q, %v", val, err)
+	}
+	s.Close()
+
+	// Shard directories cannot be reordered or regrouped.
+	if _, err := Open(Options{Dirs: []string{dirs[1], dirs[0], dirs[2], dirs[3]}}); !errors.Is(err, ErrShardMismatch) {
+		t.Errorf("Open with swapped dirs: %v, want ErrShardMismatch", err)
+	}
+	if _, err := Open(Options{Dirs: dirs[:3]}); !errors.Is(err, ErrShardMismatch) {
+		t.Errorf("Open with fewer dirs: %v, want ErrShardMismatch", err)
+	}
+}
+
+func TestCustomHash(t *testing.T) {
+	s, err := Open(Options{Dirs: shardDirs(t, 2), Hash: func(key []byte) uint64 {
+		return uint64(key[0])
+	}})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+
+	if s.ShardOf("a") != 1 || s.ShardOf("b") != 0 {
+		t.Errorf("ShardOf(a), ShardOf(b) = %d, %d", s.ShardOf("a"), s.ShardOf("b"))
+	}
+	if err := s.Put("a", "1"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if st := s.Stats(); st[0].MemtableEntries != 0 || st[1].MemtableEntries != 1 {
+		t.Errorf("entries per shard = %d, %d", st[0].MemtableEntries, st[1].MemtableEntries)
+	}
+}
@@ -0,0 +1,236 @@
+// Package sst reads single SiltKV SSTable files without opening a database,
+// for tooling, tests and data pipelines that consume the files directly.
+//
+// Values are returned as stored: a database configured with value codecs
+// keeps them encoded on disk. Deletions are kept as tombstones, which Get
+// reports as absent and an Iterator reports through Deleted.
+package sst
+
+import (
+	"errors"
+
+	"github.com/return2faye/SiltKV/internal/sstable"
+)
+
+// ErrClosed is returned by a Reader, or an Iterator over it, after Close.
+var ErrClosed = errors.New("sst: reader is closed")
+
+// Names of the properties every table records.
+const (
+	PropNumEntries   = sstable.PropNumEntries   // records, point tombstones included
+	PropNumDeletions = sstable.PropNumDeletions // point tombstones
+	PropSmallestKey  = sstable.PropSmallestKey  // first key of the records
+	PropLargestKey   = sstable.PropLargestKey   // last key of the records
+	PropRawDataSize  = sstable.PropRawDataSize  // data block bytes before compression
+	PropDataSize     = sstable.PropDataSize     // data block bytes in the file
+	PropCreationTime = sstable.PropCreationTime // unix nanoseconds
+)
+
+// Span is a deleted key range [Start, End).
+type Span struct {
+	Start, End []byte
+}
+
+// Reader reads one SSTable file. It never modifies the file.
+type Reader struct {
+	r *sstable.Reader
+}
+
+// Open opens the SSTable at path and validates its footer and index.
+func Open(path string) (*Reader, error) {
+	r, err := sstable.NewReader(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r}, nil
+}
+
+// Close releases the file. Iterators created from r stop working.
+func (r *Reader) Close() error {
+	if r.r == nil {
+		return nil
+	}
+	err := r.r.Close()
+	r.r = nil
+	return err
+}
+
+// Path returns the path the table was opened from.
+func (r *Reader) Path() string {
+	if r.r == nil {
+		return ""
+	}
+	return r.r.Path()
+}
+
+// Size returns the size of the file in bytes.
+func (r *Reader) Size() int64 {
+	if r.r == nil {
+		return 0
+	}
+	return r.r.Size()
+}
+
+// Get returns the value of key. found is false if the table has no entry
+// for key or holds a tombstone for it; Deleted tells the two apart.
+// Range deletions are not applied; see DeletedRanges.
+func (r *Reader) Get(key []byte) (value []byte, found bool, err error) {
+	if r.r == nil {
+		return nil, false, ErrClosed
+	}
+	val, found, err := r.r.Get(key)
+	if err != nil || val == nil {
+		return nil, false, err
+	}
+	return val, found, nil
+}
+
+// Deleted reports whether the table holds a tombstone for key.
+func (r *Reader) Deleted(key []byte) (bool, error) {
+	if r.r == nil {
+		return false, ErrClosed
+	}
+	_, deleted, err := r.r.Exists(key)
+	return deleted, err
+}
+
+// Bounds returns the smallest and largest key in the table, tombstones
+// included. Both are nil for an empty table.
+func (r *Reader) Bounds() (smallest, largest []byte, err error) {
+	if r.r == nil {
+		return nil, nil, ErrClosed
+	}
+	return r.r.Bounds()
+}
+
+// Count returns the number of entries, tombstones included.
+func (r *Reader) Count() (uint64, error) {
+	if r.r == nil {
+		return 0, ErrClosed
+	}
+	return r.r.CountRange(nil, nil)
+}
+
+// DeletedRanges returns the range deletions stored in the table.
+func (r *Reader) DeletedRanges() []Span {
+	if r.r == nil {
+		return nil
+	}
+	rts := r.r.RangeTombstones()
+	spans := make([]Span, len(rts))
+	for i, rt := range rts {
+		spans[i] = Span{Start: rt.Start, End: rt.End}
+	}
+	return spans
+}
+
+// Properties returns the table properties: the key bounds, record counts,
+// data sizes and creation time every table records (see the Prop*
+// constants), and others such as the provenance recorded by compaction.
+// Tables written before properties existed have none.
+func (r *Reader) Properties() (map[string]string, error) {
+	if r.r == nil {
+		return nil, ErrClosed
+	}
+	return r.r.Properties()
+}
+
+// Verify checks the checksums of every data block and of the whole file.
+// Tables written before checksums existed have nothing to check.
+func (r *Reader) Verify() error {
+	if r.r == nil {
+		return ErrClosed
+	}
+	return r.r.VerifyChecksums()
+}
+
+// Iterator walks the entries of a table in key order, tombstones included.
+// It is positioned on nothing until First, Last or Seek is called. An
+// Iterator is not safe for concurrent use.
+type Iterator struct {
+	r   *Reader
+	it  *sstable.Iterator
+	err error
+}
+
+// NewIterator returns an iterator over r.
+func (r *Reader) NewIterator() *Iterator {
+	if r.r == nil {
+		return &Iterator{r: r, err: ErrClosed}
+	}
+	return &Iterator{r: r, it: r.r.NewIterator()}
+}
+
+// First moves to the first entry and reports whether there is one.
+func (it *Iterator) First() bool {
+	return it.step(func() error { return it.it.SeekToFirst() })
+}
+
+// Last moves to the last entry and reports whether there is one.
+func (it *Iterator) Last() bool {
+	return it.step(func() error { return it.it.SeekToLast() })
+}
+
+// Seek moves to the first entry with a key at or after target and reports
+// whether there is one.
+func (it *Iterator) Seek(target []byte) bool {
+	return it.step(func() error { return it.it.Seek(target) })
+}
+
+// Next moves to the following entry and reports whether there is one.
+func (it *Iterator) Next() bool {
+	return it.step(func() error { return it.it.Next() })
+}
+
+// Prev moves to the preceding entry and reports whether there is one.
+func (it *Iterator) Prev() bool {
+	return it.step(func() error { return it.it.Prev() })
+}
+
+func (it *Iterator) step(move func() error) bool {
+	if it.err != nil {
+		return false
+	}
+	if it.r.r == nil {
+		it.err = ErrClosed
+		return false
+	}
+	if err := move(); err != nil {
+		it.err = err
+		return false
+	}
+	return it.it.Valid()
+}
+
+// Valid reports whether the iterator is on an entry.
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.it != nil && it.it.Valid()
+}
+
+// Key returns the key of the current entry. It is only valid until the
+// iterator moves.
+func (it *Iterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.it.Key()
+}
+
+// Value returns the value of the current entry, or nil for a tombstone. It
+// is only valid until the iterator moves.
+func (it *Iterator) Value() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.it.Value()
+}
+
+// Deleted reports whether the current entry is a tombstone.
+func (it *Iterator) Deleted() bool {
+	return it.Valid() && it.it.Value() == nil
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
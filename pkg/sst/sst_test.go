@@ -0,0 +1,99 @@
+package sst
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/return2faye/SiltKV/pkg/kv"
+)
+
+// writeTable writes a database with a few values, a tombstone and a range
+// deletion, flushes it and returns the path of the resulting SSTable.
+func writeTable(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "db")
+	db, err := kv.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Put(k, "v"+k); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := db.Delete("d"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := db.DeleteRange("x", "z"); err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+	if err := db.CloseAndFlush(); err != nil {
+		t.Fatalf("CloseAndFlush: %v", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("expected one SSTable, got %v, %v", paths, err)
+	}
+	return paths[0]
+}
+
+func TestReader(t *testing.T) {
+	r, err := Open(writeTable(t))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if v, found, err := r.Get([]byte("b")); err != nil || !found || string(v) != "vb" {
+		t.Errorf("Get(b) = %q, %v, %v", v, found, err)
+	}
+	for _, k := range []string{"d", "e"} {
+		if _, found, err := r.Get([]byte(k)); err != nil || found {
+			t.Errorf("Get(%s) found = %v, %v", k, found, err)
+		}
+	}
+	if deleted, err := r.Deleted([]byte("d")); err != nil || !deleted {
+		t.Errorf("Deleted(d) = %v, %v", deleted, err)
+	}
+	if n, err := r.Count(); err != nil || n != 4 {
+		t.Errorf("Count = %d, %v; want 4", n, err)
+	}
+	if lo, hi, err := r.Bounds(); err != nil || string(lo) != "a" || string(hi) != "d" {
+		t.Errorf("Bounds = %q, %q, %v", lo, hi, err)
+	}
+	if spans := r.DeletedRanges(); len(spans) != 1 || string(spans[0].Start) != "x" || string(spans[0].End) != "z" {
+		t.Errorf("DeletedRanges = %q", spans)
+	}
+	if err := r.Verify(); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	var got []string
+	it := r.NewIterator()
+	for ok := it.First(); ok; ok = it.Next() {
+		if it.Deleted() {
+			got = append(got, string(it.Key())+"!")
+		} else {
+			got = append(got, string(it.Key())+"="+string(it.Value()))
+		}
+	}
+	if it.Err() != nil || len(got) != 4 || got[0] != "a=va" || got[3] != "d!" {
+		t.Errorf("iteration = %q, %v", got, it.Err())
+	}
+	if !it.Seek([]byte("bb")) || string(it.Key()) != "c" {
+		t.Errorf("Seek(bb) landed on %q", it.Key())
+	}
+	if !it.Last() || !it.Prev() || string(it.Key()) != "c" {
+		t.Errorf("Last, Prev landed on %q", it.Key())
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, _, err := r.Get([]byte("a")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get after Close = %v, want ErrClosed", err)
+	}
+	if it.Next() || !errors.Is(it.Err(), ErrClosed) {
+		t.Errorf("Next after Close = %v, want ErrClosed", it.Err())
+	}
+}
@@ -0,0 +1,184 @@
+// Package verify generates self-describing key-value data and checks it
+// back, so the integrity of a SiltKV instance can be validated end to end
+// without keeping a separate record of what was written.
+//
+// A value produced by Value embeds everything needed to check it:
+//
+//	magic "SVF1" | key hash (8) | generation (8) | body length (4) | body | CRC-32C (4)
+//
+// The key hash is the FNV-1a hash of the key the value was written under,
+// so a value that ends up under the wrong key is caught. The generation is
+// a caller-chosen counter, typically bumped on every overwrite. The body is
+// derived from the key hash and the generation, and the checksum covers all
+// preceding bytes. Integers are big-endian.
+package verify
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+)
+
+// ErrCorrupt is returned, wrapped with the reason, for a value that fails
+// Check.
+var ErrCorrupt = errors.New("verify: corrupt value")
+
+const (
+	magic      = "SVF1"
+	headerSize = len(magic) + 8 + 8 + 4
+	// Overhead is the number of bytes a value takes beyond its body.
+	Overhead = headerSize + 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Key returns the i-th key under prefix. Keys sort in the order of i.
+func Key(prefix string, i uint64) string {
+	return fmt.Sprintf("%s%016x", prefix, i)
+}
+
+// Value returns the payload for key at the given generation, with a body of
+// size bytes.
+func Value(key string, generation uint64, size int) []byte {
+	if size < 0 {
+		size = 0
+	}
+	h := keyHash(key)
+	v := make([]byte, headerSize, Overhead+size)
+	copy(v, magic)
+	binary.BigEndian.PutUint64(v[4:], h)
+	binary.BigEndian.PutUint64(v[12:], generation)
+	binary.BigEndian.PutUint32(v[20:], uint32(size))
+	v = appendBody(v, h, generation, size)
+	return binary.BigEndian.AppendUint32(v, crc32.Checksum(v, castagnoli))
+}
+
+// Check validates a value read back under key and returns its generation.
+func Check(key string, value []byte) (uint64, error) {
+	if len(value) < Overhead || string(value[:len(magic)]) != magic {
+		return 0, fmt.Errorf("%w: not a verify payload", ErrCorrupt)
+	}
+	n := len(value) - 4
+	if crc32.Checksum(value[:n], castagnoli) != binary.BigEndian.Uint32(value[n:]) {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+	h := binary.BigEndian.Uint64(value[4:])
+	generation := binary.BigEndian.Uint64(value[12:])
+	size := int(binary.BigEndian.Uint32(value[20:]))
+	if h != keyHash(key) {
+		return 0, fmt.Errorf("%w: value belongs to another key", ErrCorrupt)
+	}
+	if size != n-headerSize {
+		return 0, fmt.Errorf("%w: body length %d, header says %d", ErrCorrupt, n-headerSize, size)
+	}
+	body := appendBody(nil, h, generation, size)
+	if string(body) != string(value[headerSize:n]) {
+		return 0, fmt.Errorf("%w: body mismatch", ErrCorrupt)
+	}
+	return generation, nil
+}
+
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// appendBody appends size bytes of splitmix64 output seeded by the key hash
+// and generation.
+func appendBody(dst []byte, h, generation uint64, size int) []byte {
+	state := h ^ generation*0x9e3779b97f4a7c15
+	for size > 0 {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		z ^= z >> 31
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], z)
+		n := min(size, 8)
+		dst = append(dst, buf[:n]...)
+		size -= n
+	}
+	return dst
+}
+
+// Putter is the write side of a store, such as *kv.DB.
+type Putter interface {
+	Put(key, value string) error
+}
+
+// Scanner is the read side of a store, such as *kv.DB. An empty end scans
+// to the last key.
+type Scanner interface {
+	Scan(start, end string, fn func(key, value string) error) error
+}
+
+// Fill writes keys 0 to n-1 under prefix at the given generation with
+// bodies of size bytes.
+func Fill(p Putter, prefix string, n uint64, generation uint64, size int) error {
+	for i := uint64(0); i < n; i++ {
+		key := Key(prefix, i)
+		if err := p.Put(key, string(Value(key, generation, size))); err != nil {
+			return fmt.Errorf("verify: put %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Failure is a key whose value failed Check.
+type Failure struct {
+	Key string
+	Err error
+}
+
+// Report summarizes a Verify scan.
+type Report struct {
+	Keys          int       // keys scanned
+	Failures      []Failure // keys whose value failed Check
+	MinGeneration uint64    // over the values that passed
+	MaxGeneration uint64
+}
+
+// OK reports whether every scanned value passed Check.
+func (r Report) OK() bool {
+	return len(r.Failures) == 0
+}
+
+// Verify checks every value under prefix. Corrupt values are collected in
+// the report; the error is only for a failed scan.
+func Verify(s Scanner, prefix string) (Report, error) {
+	var r Report
+	err := s.Scan(prefix, prefixEnd(prefix), func(key, value string) error {
+		r.Keys++
+		g, err := Check(key, []byte(value))
+		if err != nil {
+			r.Failures = append(r.Failures, Failure{Key: key, Err: err})
+			return nil
+		}
+		if r.Keys-len(r.Failures) == 1 || g < r.MinGeneration {
+			r.MinGeneration = g
+		}
+		r.MaxGeneration = max(r.MaxGeneration, g)
+		return nil
+	})
+	if err != nil {
+		return r, fmt.Errorf("verify: scan failed: %w", err)
+	}
+	return r, nil
+}
+
+// prefixEnd returns the smallest string greater than every string starting
+// with prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+package verify
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/return2faye/SiltKV/pkg/kv"
+)
+
+func TestCheck(t *testing.T) {
+	key := Key("k", 7)
+	v := Value(key, 3, 100)
+	if len(v) != Overhead+100 {
+		t.Fatalf("len = %d, want %d", len(v), Overhead+100)
+	}
+	if g, err := Check(key, v); err != nil || g != 3 {
+		t.Fatalf("Check = %d, %v", g, err)
+	}
+
+	if _, err := Check(Key("k", 8), v); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("wrong key: expected ErrCorrupt, got %v", err)
+	}
+	for _, i := range []int{0, 5, 13, headerSize + 10, len(v) - 1} {
+		bad := append([]byte(nil), v...)
+		bad[i] ^= 0x40
+		if _, err := Check(key, bad); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("flipped byte %d: expected ErrCorrupt, got %v", i, err)
+		}
+	}
+	if _, err := Check(key, v[:len(v)-1]); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("truncated: expected ErrCorrupt, got %v", err)
+	}
+}
+
+func TestFillAndVerify(t *testing.T) {
+	db, err := kv.Open(filepath.Join(t.TempDir(), "test-db"))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := Fill(db, "a/", 50, 1, 64); err != nil {
+		t.Fatalf("Fill: %v", err)
+	}
+	if err := Fill(db, "a/", 10, 2, 64); err != nil {
+		t.Fatalf("Fill: %v", err)
+	}
+	db.Put("b/other", "not a payload")
+
+	r, err := Verify(db, "a/")
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !r.OK() || r.Keys != 50 || r.MinGeneration != 1 || r.MaxGeneration != 2 {
+		t.Errorf("report = %+v", r)
+	}
+
+	// Swap two values: both are well-formed, but under the wrong key.
+	v0, _ := db.Get(Key("a/", 0))
+	v1, _ := db.Get(Key("a/", 1))
+	db.Put(Key("a/", 0), v1)
+	db.Put(Key("a/", 1), v0)
+	r, err = Verify(db, "a/")
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if r.OK() || len(r.Failures) != 2 || r.Failures[0].Key != Key("a/", 0) {
+		t.Errorf("report after swap = %+v", r)
+	}
+}